@@ -0,0 +1,815 @@
+// Package api is nanofi's management REST API: devices, their commands and
+// config, firmware and events, as JSON under /api/v1/.
+//
+// Lists are paged with ?limit= and ?offset= and come back as
+//
+//	{"items": [...], "total": 42, "limit": 100, "offset": 0}
+//
+// and every error has the same body:
+//
+//	{"error": {"status": 404, "code": "not_found", "message": "unknown device"}}
+//
+// With a Server's Auth set, requests need a session from POST /login or an
+// API token, and a role that allows them; changes are recorded in Audit.
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+	"github.com/jda/nanofi/command"
+	"github.com/jda/nanofi/config"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/firmware"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/reconcile"
+)
+
+// Prefix is the path the API is served under
+const Prefix = "/api/v1/"
+
+// Page sizes
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Error codes
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeTooManyRequests  = "too_many_requests"
+	CodeNotEnabled       = "not_enabled"
+	CodeInternal         = "internal"
+)
+
+// commandKinds are the commands the API queues
+var commandKinds = map[command.Kind]bool{
+	command.KindReboot:     true,
+	command.KindLocate:     true,
+	command.KindUpgrade:    true,
+	command.KindSetDefault: true,
+}
+
+// Server serves the API
+type Server struct {
+	devices  *device.Registry
+	commands *command.Queue
+
+	// Config resolves and validates a device's config; nil serves no config
+	Config func(dev device.Device) (config.Layer, error)
+	// Place puts a device in its site and group; nil leaves devices as
+	// the registry has them
+	Place func(dev device.Device) device.Device
+	// ConfigStatus is where devices are up to with their config
+	ConfigStatus func() []reconcile.Status
+	// Firmware is the local firmware server, if there is one
+	Firmware *firmware.Server
+	// Events are JSON lines files of events, by the name of their source
+	Events map[string]string
+	// Auth authenticates requests; nil lets anyone do anything
+	Auth *auth.Store
+	// Audit records changes and who made them, if set
+	Audit *audit.Log
+}
+
+// NewServer creates an API for devices and their commands
+func NewServer(devices *device.Registry, commands *command.Queue) *Server {
+	return &Server{devices: devices, commands: commands, Events: make(map[string]string)}
+}
+
+// Error is the body of every error response
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func apiError(status int, code string, format string, a ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// List is a page of a list
+type List struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// ServeHTTP routes a request under Prefix
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(Prefix, "/")), "/")
+	parts := strings.Split(path, "/")
+
+	var out interface{}
+	status := http.StatusOK
+	r, err := s.authorize(r, path, parts)
+	if err == nil {
+		out, status, err = s.route(w, r, path, parts)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	if lines, ok := out.(jsonLines); ok {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(status)
+		if _, err := w.Write(lines); err != nil {
+			glog.Errorf("api: could not write %s: %s", r.URL.Path, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		glog.Errorf("api: could not write %s: %s", r.URL.Path, err)
+	}
+}
+
+// route serves a request for path, returning the body and status
+func (s *Server) route(w http.ResponseWriter, r *http.Request, path string, parts []string) (out interface{}, status int, err error) {
+	status = http.StatusOK
+	switch {
+	case path == "login":
+		out, err = s.login(w, r)
+	case path == "logout":
+		err, status = s.logout(w, r), http.StatusNoContent
+	case path == "users":
+		switch r.Method {
+		case http.MethodGet:
+			out, err = s.listUsers(r)
+		case http.MethodPost:
+			out, err = s.addUser(r)
+			status = http.StatusCreated
+		default:
+			err = methodNotAllowed(r)
+		}
+	case parts[0] == "users" && len(parts) == 2:
+		if r.Method != http.MethodDelete {
+			err = methodNotAllowed(r)
+			break
+		}
+		err, status = s.deleteUser(r, parts[1]), http.StatusNoContent
+	case path == "tokens":
+		switch r.Method {
+		case http.MethodGet:
+			out, err = s.listTokens(r)
+		case http.MethodPost:
+			out, err = s.addToken(r)
+			status = http.StatusCreated
+		default:
+			err = methodNotAllowed(r)
+		}
+	case parts[0] == "tokens" && len(parts) == 2:
+		if r.Method != http.MethodDelete {
+			err = methodNotAllowed(r)
+			break
+		}
+		err, status = s.deleteToken(r, parts[1]), http.StatusNoContent
+	case path == "devices":
+		out, err = s.listDevices(r)
+	case parts[0] == "devices" && len(parts) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			out, err = s.getDevice(parts[1])
+		case http.MethodDelete:
+			err, status = s.forget(r, parts[1]), http.StatusNoContent
+		default:
+			err = methodNotAllowed(r)
+		}
+	case parts[0] == "devices" && len(parts) == 3 && parts[2] == "approve":
+		if r.Method != http.MethodPost {
+			err = methodNotAllowed(r)
+			break
+		}
+		out, err = s.approve(r, parts[1])
+		status = http.StatusAccepted
+	case parts[0] == "devices" && len(parts) == 3 && parts[2] == "commands":
+		switch r.Method {
+		case http.MethodGet:
+			out, err = s.listCommands(r, parts[1])
+		case http.MethodPost:
+			out, err = s.queue(r, parts[1])
+			status = http.StatusAccepted
+		default:
+			err = methodNotAllowed(r)
+		}
+	case parts[0] == "devices" && len(parts) == 3 && parts[2] == "config":
+		out, err = s.deviceConfig(r, parts[1])
+	case path == "commands":
+		out, err = s.listCommands(r, "")
+	case parts[0] == "commands" && len(parts) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			out, err = s.getCommand(parts[1])
+		case http.MethodDelete:
+			out, err = s.cancel(r, parts[1])
+		default:
+			err = methodNotAllowed(r)
+		}
+	case path == "config":
+		out, err = s.listConfig(r)
+	case path == "firmware":
+		out, err = s.listFirmware(r)
+	case path == "firmware/downloads":
+		out, err = s.listDownloads(r)
+	case path == "events":
+		out, err = s.listEvents(r)
+	case path == "audit":
+		out, err = s.listAudit(r)
+	case path == "audit/export":
+		out, err = s.exportAudit(r)
+	case path == "audit/verify":
+		out, err = s.verifyAudit(r)
+	default:
+		err = apiError(http.StatusNotFound, CodeNotFound, "no such resource %s", r.URL.Path)
+	}
+	return out, status, err
+}
+
+// writeError writes err as an error body, as an internal error unless it's
+// an *Error
+func writeError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		glog.Errorf("api: %s", err)
+		e = apiError(http.StatusInternalServerError, CodeInternal, "%s", err)
+	}
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nanofi"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(struct {
+		Error *Error `json:"error"`
+	}{e}); err != nil {
+		glog.Errorf("api: could not write error: %s", err)
+	}
+}
+
+// methodNotAllowed rejects r's method
+func methodNotAllowed(r *http.Request) error {
+	return apiError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "%s not allowed on %s", r.Method, r.URL.Path)
+}
+
+// readOnly rejects methods other than GET
+func readOnly(r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+	return nil
+}
+
+// page returns the bounds of the page r asks for out of n items
+func page(r *http.Request, n int) (start int, end int, list List, err error) {
+	list = List{Total: n, Limit: DefaultLimit}
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		if list.Limit, err = strconv.Atoi(v); err != nil || list.Limit < 1 || list.Limit > MaxLimit {
+			return 0, 0, list, apiError(http.StatusBadRequest, CodeBadRequest, "limit must be from 1 to %d", MaxLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if list.Offset, err = strconv.Atoi(v); err != nil || list.Offset < 0 {
+			return 0, 0, list, apiError(http.StatusBadRequest, CodeBadRequest, "offset must be 0 or more")
+		}
+	}
+	// clamped before adding the limit, which could overflow
+	start = list.Offset
+	if start > n {
+		start = n
+	}
+	end = start + list.Limit
+	if list.Limit > n-start {
+		end = n
+	}
+	return start, end, list, nil
+}
+
+// boolParam parses the query parameter name, if given
+func boolParam(r *http.Request, name string) (value bool, given bool, err error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, false, apiError(http.StatusBadRequest, CodeBadRequest, "%s must be true or false", name)
+	}
+	return b, true, nil
+}
+
+// lookup returns the device mac names
+func (s *Server) lookup(mac string) (device.Device, error) {
+	norm, err := device.NormalizeMAC(mac)
+	if err != nil {
+		return device.Device{}, apiError(http.StatusBadRequest, CodeBadRequest, "%q: %s", mac, err)
+	}
+	d, ok := s.devices.Get(norm)
+	if !ok {
+		return device.Device{}, apiError(http.StatusNotFound, CodeNotFound, "%s: %s", norm, device.ErrUnknownDevice)
+	}
+	return d, nil
+}
+
+// public is a device as the API shows it, placed and without its authkey
+func (s *Server) public(d device.Device) device.Device {
+	if s.Place != nil {
+		d = s.Place(d)
+	}
+	d.AuthKey = ""
+	return d
+}
+
+// listDevices lists devices, filtered by ?kind=, ?model=, ?version=,
+// ?site=, ?group=, ?adopted= and ?q=, which matches the MAC, hostname or
+// IP
+func (s *Server) listDevices(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	adopted, byAdopted, err := boolParam(r, "adopted")
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	match := func(name string, value string) bool {
+		want := q.Get(name)
+		return want == "" || strings.EqualFold(want, value)
+	}
+	search := strings.ToLower(q.Get("q"))
+
+	out := []device.Device{}
+	for _, d := range s.devices.List() {
+		d = s.public(d)
+		if !match("kind", d.Kind()) || !match("model", d.Model) || !match("version", d.Version) ||
+			!match("site", d.Site) || !match("group", d.Group) || (byAdopted && d.Adopted != adopted) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(strings.Join([]string{d.MAC, d.Hostname, d.DHCPName, d.IP}, " ")), search) {
+			continue
+		}
+		out = append(out, d)
+	}
+
+	start, end, list, err := page(r, len(out))
+	list.Items = out[start:end]
+	return list, err
+}
+
+func (s *Server) getDevice(mac string) (interface{}, error) {
+	d, err := s.lookup(mac)
+	if err != nil {
+		return nil, err
+	}
+	return s.public(d), nil
+}
+
+// forget removes a device, cancelling the commands queued for it
+func (s *Server) forget(r *http.Request, mac string) error {
+	d, err := s.lookup(mac)
+	if err != nil {
+		return err
+	}
+	for _, c := range s.commands.List(d.MAC) {
+		if c.Status == command.StatusQueued {
+			if _, err := s.commands.Cancel(c.ID); err != nil && !errors.Is(err, command.ErrNotQueued) {
+				return err
+			}
+		}
+	}
+	if err := s.devices.Forget(d.MAC); err != nil {
+		return err
+	}
+	if err := s.devices.Save(); err != nil {
+		return err
+	}
+	e := audit.For(d, audit.ActionForget)
+	e.Before = audit.Value(audit.Key(d.Adopted, d.AuthKey))
+	s.record(r, e)
+	return nil
+}
+
+// approve adopts a device by giving it an authkey with setparam
+func (s *Server) approve(r *http.Request, mac string) (interface{}, error) {
+	d, err := s.lookup(mac)
+	if err != nil {
+		return nil, err
+	}
+	if d.Adopted {
+		return nil, apiError(http.StatusConflict, CodeConflict, "%s is already adopted", d.MAC)
+	}
+
+	// a device approved before but yet to adopt keeps the key it was sent
+	key := d.AuthKey
+	if key == "" {
+		if key, err = inform.NewAuthKey(); err != nil {
+			return nil, err
+		}
+		if _, err := s.devices.Update(d.MAC, func(d *device.Device) { d.AuthKey = key }); err != nil {
+			return nil, err
+		}
+		if err := s.devices.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := s.commands.Add(command.Command{
+		MAC:     d.MAC,
+		Kind:    command.KindSetParam,
+		MgmtCfg: inform.MgmtCfg(key, inform.InitialCfgVersion),
+		By:      actor(r),
+	})
+	if err != nil {
+		return nil, err
+	}
+	e := audit.For(d, audit.ActionApprove)
+	e.Detail = c.ID
+	e.Before = audit.Value(audit.Key(d.Adopted, d.AuthKey))
+	e.After = audit.Value(audit.Key(d.Adopted, key))
+	s.record(r, e)
+	return WithoutCfg(c), nil
+}
+
+// WithoutCfg hides the config, and the authkey in it, of a setparam
+func WithoutCfg(c command.Command) command.Command {
+	if c.MgmtCfg != "" {
+		c.MgmtCfg = config.Redacted
+	}
+	if c.SystemCfg != "" {
+		c.SystemCfg = config.Redacted
+	}
+	return c
+}
+
+// commandRequest is the body of a command to queue
+type commandRequest struct {
+	Kind command.Kind `json:"kind"`
+	// Version is the firmware to upgrade to; URL and MD5Sum default to the
+	// local firmware server's image of it
+	Version string `json:"version,omitempty"`
+	URL     string `json:"url,omitempty"`
+	MD5Sum  string `json:"md5sum,omitempty"`
+	// Off turns locate off
+	Off     bool      `json:"off,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// queue queues a command for a device
+func (s *Server) queue(r *http.Request, mac string) (interface{}, error) {
+	d, err := s.lookup(mac)
+	if err != nil {
+		return nil, err
+	}
+	var req commandRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, apiError(http.StatusBadRequest, CodeBadRequest, "invalid command: %s", err)
+	}
+	if !commandKinds[req.Kind] {
+		return nil, apiError(http.StatusBadRequest, CodeBadRequest, "kind must be reboot, locate, upgrade or setdefault")
+	}
+	if req.Kind == command.KindUpgrade || req.Kind == command.KindSetDefault {
+		// firmware and resets, which lose the device's key, are for admins
+		if err := s.allow(r, auth.RoleAdmin); err != nil {
+			return nil, err
+		}
+	}
+
+	c := command.Command{
+		MAC:     d.MAC,
+		Kind:    req.Kind,
+		Version: req.Version,
+		URL:     req.URL,
+		MD5Sum:  req.MD5Sum,
+		Off:     req.Off,
+		Expires: req.Expires,
+		By:      actor(r),
+	}
+	if c.Kind == command.KindUpgrade && c.URL == "" && c.Version != "" {
+		if s.Firmware == nil {
+			return nil, apiError(http.StatusBadRequest, CodeBadRequest, "upgrade needs a url without a firmware server")
+		}
+		img, err := s.Firmware.Repository().Lookup(d.Model, c.Version)
+		if err != nil {
+			return nil, apiError(http.StatusBadRequest, CodeBadRequest, "%s %s: %s", d.Model, c.Version, err)
+		}
+		c.URL, c.MD5Sum = s.Firmware.URL(img), img.MD5
+	}
+
+	queued, err := s.commands.Add(c)
+	if err != nil {
+		return nil, apiError(http.StatusBadRequest, CodeBadRequest, "%s", err)
+	}
+	e := audit.For(d, audit.ActionCommand)
+	e.Detail = string(queued.Kind) + " " + queued.ID
+	e.After = audit.Value(WithoutCfg(queued))
+	s.record(r, e)
+	return queued, nil
+}
+
+// listCommands lists the commands for mac, or every device's, newest first,
+// filtered by ?status= and ?kind=
+func (s *Server) listCommands(r *http.Request, mac string) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if mac != "" {
+		d, err := s.lookup(mac)
+		if err != nil {
+			return nil, err
+		}
+		mac = d.MAC
+	} else if v := r.URL.Query().Get("mac"); v != "" {
+		norm, err := device.NormalizeMAC(v)
+		if err != nil {
+			return nil, apiError(http.StatusBadRequest, CodeBadRequest, "%q: %s", v, err)
+		}
+		mac = norm
+	}
+
+	q := r.URL.Query()
+	all := s.commands.List(mac)
+	out := []command.Command{}
+	for i := len(all) - 1; i >= 0; i-- {
+		c := all[i]
+		if (q.Get("status") != "" && string(c.Status) != q.Get("status")) || (q.Get("kind") != "" && string(c.Kind) != q.Get("kind")) {
+			continue
+		}
+		out = append(out, WithoutCfg(c))
+	}
+
+	start, end, list, err := page(r, len(out))
+	list.Items = out[start:end]
+	return list, err
+}
+
+func (s *Server) getCommand(id string) (interface{}, error) {
+	c, ok := s.commands.Get(id)
+	if !ok {
+		return nil, apiError(http.StatusNotFound, CodeNotFound, "%s: %s", id, command.ErrNotFound)
+	}
+	return WithoutCfg(c), nil
+}
+
+// cancel withdraws a queued command
+func (s *Server) cancel(r *http.Request, id string) (interface{}, error) {
+	c, err := s.commands.Cancel(id)
+	switch {
+	case errors.Is(err, command.ErrNotFound):
+		return nil, apiError(http.StatusNotFound, CodeNotFound, "%s: %s", id, err)
+	case errors.Is(err, command.ErrNotQueued):
+		return nil, apiError(http.StatusConflict, CodeConflict, "%s: %s", id, err)
+	case err != nil:
+		return nil, err
+	}
+	d, _ := s.devices.Get(c.MAC)
+	d.MAC = c.MAC
+	e := audit.For(d, audit.ActionCancel)
+	e.Detail = string(c.Kind) + " " + c.ID
+	e.Before = audit.Value(map[string]command.Status{"status": command.StatusQueued})
+	e.After = audit.Value(map[string]command.Status{"status": c.Status})
+	s.record(r, e)
+	return WithoutCfg(c), nil
+}
+
+// DeviceConfig is the config resolved for a device and where the device is
+// up to with it
+type DeviceConfig struct {
+	MAC string `json:"mac"`
+	// Config is the resolved config with secrets hidden
+	Config interface{} `json:"config"`
+	// Error is why the config isn't valid, if it isn't
+	Error  string            `json:"error,omitempty"`
+	Status *reconcile.Status `json:"status,omitempty"`
+}
+
+func (s *Server) deviceConfig(r *http.Request, mac string) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.Config == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "nanofi isn't configuring devices")
+	}
+	d, err := s.lookup(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	out := DeviceConfig{MAC: d.MAC}
+	cfg, err := s.Config(d)
+	if err != nil {
+		out.Error = err.Error()
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	out.Config = config.Redact(v)
+
+	if s.ConfigStatus != nil {
+		for _, st := range s.ConfigStatus() {
+			if st.MAC == d.MAC {
+				st := st
+				out.Status = &st
+			}
+		}
+	}
+	return out, nil
+}
+
+// listConfig lists where devices are up to with their config, filtered by
+// ?converged=
+func (s *Server) listConfig(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.ConfigStatus == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "nanofi isn't configuring devices")
+	}
+	converged, byConverged, err := boolParam(r, "converged")
+	if err != nil {
+		return nil, err
+	}
+
+	out := []reconcile.Status{}
+	for _, st := range s.ConfigStatus() {
+		if !byConverged || st.Converged == converged {
+			out = append(out, st)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+
+	start, end, list, err := page(r, len(out))
+	list.Items = out[start:end]
+	return list, err
+}
+
+// listFirmware lists the firmware images served, filtered by ?model=
+func (s *Server) listFirmware(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.Firmware == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "nanofi isn't serving firmware")
+	}
+
+	out := []firmware.Image{}
+	for _, img := range s.Firmware.Repository().Images() {
+		if m := r.URL.Query().Get("model"); m == "" || strings.EqualFold(m, img.Model) {
+			out = append(out, img)
+		}
+	}
+
+	start, end, list, err := page(r, len(out))
+	list.Items = out[start:end]
+	return list, err
+}
+
+// listDownloads lists devices' firmware downloads
+func (s *Server) listDownloads(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.Firmware == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "nanofi isn't serving firmware")
+	}
+
+	out := s.Firmware.Downloads()
+	if out == nil {
+		out = []firmware.Download{}
+	}
+	start, end, list, err := page(r, len(out))
+	list.Items = out[start:end]
+	return list, err
+}
+
+// Event is an event from one of the event files
+type Event struct {
+	Source string          `json:"source"`
+	Time   time.Time       `json:"time"`
+	MAC    string          `json:"mac,omitempty"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// listEvents lists events newest first, filtered by ?source=, ?mac= and
+// ?since=, an RFC 3339 time
+func (s *Server) listEvents(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, apiError(http.StatusBadRequest, CodeBadRequest, "since must be an RFC 3339 time")
+		}
+	}
+	mac := q.Get("mac")
+	if mac != "" {
+		norm, err := device.NormalizeMAC(mac)
+		if err != nil {
+			return nil, apiError(http.StatusBadRequest, CodeBadRequest, "%q: %s", mac, err)
+		}
+		mac = norm
+	}
+	source := q.Get("source")
+	if _, ok := s.Events[source]; source != "" && !ok {
+		return nil, apiError(http.StatusBadRequest, CodeBadRequest, "unknown event source %q", source)
+	}
+
+	out := []Event{}
+	for name, path := range s.Events {
+		if source != "" && name != source {
+			continue
+		}
+		events, err := readEvents(name, path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if (mac == "" || e.MAC == mac) && !e.Time.Before(since) {
+				out = append(out, e)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if !out[i].Time.Equal(out[j].Time) {
+			return out[i].Time.After(out[j].Time)
+		}
+		return out[i].Source < out[j].Source
+	})
+
+	start, end, list, err := page(r, len(out))
+	list.Items = out[start:end]
+	return list, err
+}
+
+// readEvents reads the JSON lines file of events at path. Events are timed
+// by their time field, or finished for bench results.
+func readEvents(source string, path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s events: %w", source, err)
+	}
+	defer f.Close()
+
+	var out []Event
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		var v struct {
+			Time     time.Time `json:"time"`
+			Finished time.Time `json:"finished"`
+			MAC      string    `json:"mac"`
+		}
+		if err := json.Unmarshal(line, &v); err != nil {
+			// a line cut short by a crash shouldn't hide the rest
+			continue
+		}
+		if v.Time.IsZero() {
+			v.Time = v.Finished
+		}
+		e := Event{Source: source, Time: v.Time, MAC: v.MAC, Event: make(json.RawMessage, len(line))}
+		copy(e.Event, line)
+		out = append(out, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s events: %w", source, err)
+	}
+	return out, nil
+}
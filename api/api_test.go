@@ -0,0 +1,500 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+	"github.com/jda/nanofi/command"
+	"github.com/jda/nanofi/config"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/firmware"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/reconcile"
+	"github.com/jda/nanofi/wlan"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	ap     = "fc:ec:da:00:00:01"
+	sw     = "fc:ec:da:00:00:02"
+	newAP  = "fc:ec:da:00:00:03"
+	nobody = "fc:ec:da:00:00:09"
+)
+
+func testServer(t *testing.T) *Server {
+	devices, err := device.NewRegistry("")
+	assert.Nil(t, err)
+	for _, d := range []struct {
+		mac     string
+		info    inform.Info
+		adopted bool
+	}{
+		{ap, inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Hostname: "ap-dock", IP: "10.0.0.11"}, true},
+		{sw, inform.Info{Model: "USMINI", Version: "2.0.9.1234", Hostname: "sw-dock", IP: "10.0.0.12"}, true},
+		{newAP, inform.Info{Model: "U7PG2", Version: "4.3.20.11298", IP: "10.0.0.13", Default: true}, false},
+	} {
+		_, _, err := devices.Observe(d.mac, d.info, d.adopted)
+		assert.Nil(t, err)
+	}
+	_, err = devices.Update(ap, func(d *device.Device) { d.AuthKey = "00112233445566778899aabbccddeeff" })
+	assert.Nil(t, err)
+
+	commands, err := command.NewQueue("")
+	assert.Nil(t, err)
+	return NewServer(devices, commands)
+}
+
+// do makes a request, decoding the response into out
+func do(t *testing.T, s *Server, method string, path string, body string, out interface{}) int {
+	return doAs(t, s, "", method, path, body, out)
+}
+
+// doAs makes a request with a bearer token, decoding the response into out
+func doAs(t *testing.T, s *Server, token string, method string, path string, body string, out interface{}) int {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if out != nil && w.Body.Len() > 0 {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), out), w.Body.String())
+	}
+	return w.Code
+}
+
+type deviceList struct {
+	Items  []device.Device `json:"items"`
+	Total  int             `json:"total"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+}
+
+type errorBody struct {
+	Error Error `json:"error"`
+}
+
+func TestDevices(t *testing.T) {
+	s := testServer(t)
+
+	tests := []struct {
+		query string
+		macs  []string
+	}{
+		{"", []string{ap, sw, newAP}},
+		{"?kind=usw", []string{sw}},
+		{"?model=u7pg2", []string{ap, newAP}},
+		{"?adopted=false", []string{newAP}},
+		{"?q=dock", []string{ap, sw}},
+		{"?q=10.0.0.13", []string{newAP}},
+		{"?limit=2", []string{ap, sw}},
+		{"?limit=2&offset=2", []string{newAP}},
+		{"?offset=5", []string{}},
+		{"?offset=9223372036854775807", []string{}},
+		{"?limit=1000&offset=9223372036854775000", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var out deviceList
+			assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/devices"+tt.query, "", &out))
+			macs := []string{}
+			for _, d := range out.Items {
+				macs = append(macs, d.MAC)
+				assert.Empty(t, d.AuthKey)
+			}
+			assert.Equal(t, tt.macs, macs)
+		})
+	}
+
+	var out deviceList
+	do(t, s, http.MethodGet, "/api/v1/devices?limit=2&offset=1", "", &out)
+	assert.Equal(t, 3, out.Total)
+	assert.Equal(t, 2, out.Limit)
+	assert.Equal(t, 1, out.Offset)
+
+	var d device.Device
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/devices/FC-EC-DA-00-00-01", "", &d))
+	assert.Equal(t, "ap-dock", d.Hostname)
+	assert.Empty(t, d.AuthKey)
+}
+
+func TestErrors(t *testing.T) {
+	s := testServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/api/v1/devices/" + nobody, "", http.StatusNotFound, CodeNotFound},
+		{http.MethodGet, "/api/v1/devices/ap-1", "", http.StatusBadRequest, CodeBadRequest},
+		{http.MethodGet, "/api/v1/devices?limit=0", "", http.StatusBadRequest, CodeBadRequest},
+		{http.MethodGet, "/api/v1/devices?offset=-1", "", http.StatusBadRequest, CodeBadRequest},
+		{http.MethodGet, "/api/v1/devices?adopted=maybe", "", http.StatusBadRequest, CodeBadRequest},
+		{http.MethodPost, "/api/v1/devices", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodPut, "/api/v1/devices/" + ap, "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodGet, "/api/v1/gadgets", "", http.StatusNotFound, CodeNotFound},
+		{http.MethodPost, "/api/v1/devices/" + ap + "/approve", "", http.StatusConflict, CodeConflict},
+		{http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "raw"}`, http.StatusBadRequest, CodeBadRequest},
+		{http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "reboot", "when": "now"}`, http.StatusBadRequest, CodeBadRequest},
+		{http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "upgrade", "version": "4.3.28.11361"}`, http.StatusBadRequest, CodeBadRequest},
+		{http.MethodGet, "/api/v1/commands/nope", "", http.StatusNotFound, CodeNotFound},
+		{http.MethodGet, "/api/v1/config", "", http.StatusNotFound, CodeNotEnabled},
+		{http.MethodGet, "/api/v1/devices/" + ap + "/config", "", http.StatusNotFound, CodeNotEnabled},
+		{http.MethodGet, "/api/v1/firmware", "", http.StatusNotFound, CodeNotEnabled},
+		{http.MethodGet, "/api/v1/events?source=rollout", "", http.StatusBadRequest, CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			var out errorBody
+			assert.Equal(t, tt.status, do(t, s, tt.method, tt.path, tt.body, &out))
+			assert.Equal(t, tt.status, out.Error.Status)
+			assert.Equal(t, tt.code, out.Error.Code)
+			assert.NotEmpty(t, out.Error.Message)
+		})
+	}
+}
+
+func TestApproveAndForget(t *testing.T) {
+	s := testServer(t)
+
+	var c command.Command
+	assert.Equal(t, http.StatusAccepted, do(t, s, http.MethodPost, "/api/v1/devices/"+newAP+"/approve", "", &c))
+	assert.Equal(t, command.KindSetParam, c.Kind)
+	assert.Equal(t, config.Redacted, c.MgmtCfg, "the authkey isn't shown")
+	d, _ := s.devices.Get(newAP)
+	assert.Len(t, d.AuthKey, 32)
+	queued, _ := s.commands.Get(c.ID)
+	assert.Contains(t, queued.MgmtCfg, "authkey="+d.AuthKey)
+
+	// approving again sends the same key
+	do(t, s, http.MethodPost, "/api/v1/devices/"+newAP+"/approve", "", &c)
+	again, _ := s.devices.Get(newAP)
+	assert.Equal(t, d.AuthKey, again.AuthKey)
+
+	assert.Equal(t, http.StatusNoContent, do(t, s, http.MethodDelete, "/api/v1/devices/"+newAP, "", nil))
+	_, ok := s.devices.Get(newAP)
+	assert.False(t, ok)
+	for _, c := range s.commands.List(newAP) {
+		assert.Equal(t, command.StatusCancelled, c.Status)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	s := testServer(t)
+
+	var reboot, locate command.Command
+	assert.Equal(t, http.StatusAccepted, do(t, s, http.MethodPost, "/api/v1/devices/"+ap+"/commands", `{"kind": "reboot"}`, &reboot))
+	assert.Equal(t, command.StatusQueued, reboot.Status)
+	do(t, s, http.MethodPost, "/api/v1/devices/"+sw+"/commands", `{"kind": "locate"}`, &locate)
+
+	var list struct {
+		Items []command.Command `json:"items"`
+		Total int               `json:"total"`
+	}
+	do(t, s, http.MethodGet, "/api/v1/commands", "", &list)
+	assert.Equal(t, 2, list.Total)
+	assert.Equal(t, locate.ID, list.Items[0].ID, "newest first")
+	do(t, s, http.MethodGet, "/api/v1/devices/"+ap+"/commands", "", &list)
+	assert.Equal(t, 1, list.Total)
+	do(t, s, http.MethodGet, "/api/v1/commands?kind=locate", "", &list)
+	assert.Equal(t, []string{locate.ID}, []string{list.Items[0].ID})
+
+	var c command.Command
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodDelete, "/api/v1/commands/"+reboot.ID, "", &c))
+	assert.Equal(t, command.StatusCancelled, c.Status)
+	var e errorBody
+	assert.Equal(t, http.StatusConflict, do(t, s, http.MethodDelete, "/api/v1/commands/"+reboot.ID, "", &e))
+	do(t, s, http.MethodGet, "/api/v1/commands?status=queued", "", &list)
+	assert.Equal(t, 1, list.Total)
+}
+
+func TestUpgradeFromFirmwareServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-api")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "U7PG2", "4.3.28.11361", "BZ.qca956x.v4.3.28.bin")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("hello"), 0644))
+	repo, err := firmware.NewRepository(dir)
+	assert.Nil(t, err)
+
+	s := testServer(t)
+	s.Firmware = firmware.NewServer(repo, "http://10.0.0.1:8081")
+
+	var c command.Command
+	assert.Equal(t, http.StatusAccepted, do(t, s, http.MethodPost, "/api/v1/devices/"+ap+"/commands", `{"kind": "upgrade", "version": "4.3.28.11361"}`, &c))
+	assert.Equal(t, "http://10.0.0.1:8081/firmware/U7PG2/4.3.28.11361/BZ.qca956x.v4.3.28.bin", c.URL)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", c.MD5Sum)
+
+	var list struct {
+		Items []firmware.Image `json:"items"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/firmware?model=u7pg2", "", &list))
+	assert.Len(t, list.Items, 1)
+}
+
+func TestConfig(t *testing.T) {
+	s := testServer(t)
+	s.Config = func(dev device.Device) (config.Layer, error) {
+		cfg := config.Layer{WLAN: &wlan.Config{WLANs: []wlan.WLAN{{SSID: "corp", Security: "wpa2", Passphrase: "correct horse"}}}}
+		if dev.MAC == sw {
+			return cfg, errors.New("wlan: no")
+		}
+		return cfg, nil
+	}
+	s.ConfigStatus = func() []reconcile.Status {
+		return []reconcile.Status{{MAC: sw, Want: "b"}, {MAC: ap, Want: "a", Reported: "a", Converged: true}}
+	}
+
+	var dc struct {
+		DeviceConfig
+		Config struct {
+			WLAN struct {
+				WLANs []map[string]interface{} `json:"wlans"`
+			} `json:"wlan"`
+		} `json:"config"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/devices/"+ap+"/config", "", &dc))
+	assert.Equal(t, config.Redacted, dc.Config.WLAN.WLANs[0]["passphrase"])
+	assert.True(t, dc.Status.Converged)
+	assert.Empty(t, dc.Error)
+	do(t, s, http.MethodGet, "/api/v1/devices/"+sw+"/config", "", &dc)
+	assert.Equal(t, "wlan: no", dc.Error)
+
+	var list struct {
+		Items []reconcile.Status `json:"items"`
+	}
+	do(t, s, http.MethodGet, "/api/v1/config?converged=false", "", &list)
+	assert.Equal(t, []reconcile.Status{{MAC: sw, Want: "b"}}, list.Items)
+}
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-api")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configEvents := filepath.Join(dir, "config-events.jsonl")
+	assert.Nil(t, ioutil.WriteFile(configEvents, []byte(
+		`{"time":"2020-05-01T10:00:00Z","kind":"pushed","mac":"`+ap+`"}`+"\n"+
+			`{"time":"2020-05-01T10:02:00Z","kind":"converged","mac":"`+ap+`"}`+"\n"+
+			`{"time":"2020-05-01T10:03:00Z","kin`+"\n"), 0644))
+	benchResults := filepath.Join(dir, "bench-results.jsonl")
+	assert.Nil(t, ioutil.WriteFile(benchResults, []byte(
+		`{"mac":"`+sw+`","stage":"done","finished":"2020-05-01T10:01:00Z"}`+"\n"), 0644))
+
+	s := testServer(t)
+	s.Events["config"] = configEvents
+	s.Events["bench"] = benchResults
+	s.Events["rollout"] = filepath.Join(dir, "missing.jsonl")
+
+	var list struct {
+		Items []Event `json:"items"`
+		Total int     `json:"total"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/events", "", &list))
+	assert.Equal(t, 3, list.Total)
+	sources := []string{}
+	for _, e := range list.Items {
+		sources = append(sources, e.Source)
+	}
+	assert.Equal(t, []string{"config", "bench", "config"}, sources, "newest first")
+	assert.JSONEq(t, `{"time":"2020-05-01T10:02:00Z","kind":"converged","mac":"`+ap+`"}`, string(list.Items[0].Event))
+
+	do(t, s, http.MethodGet, "/api/v1/events?mac="+strings.ToUpper(sw), "", &list)
+	assert.Equal(t, 1, list.Total)
+	do(t, s, http.MethodGet, "/api/v1/events?source=config&since=2020-05-01T10:01:00Z", "", &list)
+	assert.Equal(t, 1, list.Total)
+}
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := testServer(t)
+	s.Auth, err = auth.NewStore(filepath.Join(dir, "auth.json"))
+	assert.Nil(t, err)
+	s.Audit, err = audit.Open(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	defer s.Audit.Close()
+
+	tokens := make(map[auth.Role]string)
+	for _, role := range []auth.Role{auth.RoleReadOnly, auth.RoleOperator, auth.RoleAdmin} {
+		_, tokens[role], err = s.Auth.AddToken(string(role), role)
+		assert.Nil(t, err)
+	}
+	ro, op, admin := tokens[auth.RoleReadOnly], tokens[auth.RoleOperator], tokens[auth.RoleAdmin]
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"no token", "", http.MethodGet, "/api/v1/devices", "", http.StatusUnauthorized},
+		{"bad token", "nanofi_0000_nope", http.MethodGet, "/api/v1/devices", "", http.StatusUnauthorized},
+		{"read", ro, http.MethodGet, "/api/v1/devices", "", http.StatusOK},
+		{"read-only approve", ro, http.MethodPost, "/api/v1/devices/" + newAP + "/approve", "", http.StatusForbidden},
+		{"operator approve", op, http.MethodPost, "/api/v1/devices/" + newAP + "/approve", "", http.StatusAccepted},
+		{"operator reboot", op, http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "reboot"}`, http.StatusAccepted},
+		{"operator upgrade", op, http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "upgrade", "url": "http://fw/a.bin", "version": "4.3.28.11361"}`, http.StatusForbidden},
+		{"operator reset", op, http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "setdefault"}`, http.StatusForbidden},
+		{"admin upgrade", admin, http.MethodPost, "/api/v1/devices/" + ap + "/commands", `{"kind": "upgrade", "url": "http://fw/a.bin", "version": "4.3.28.11361"}`, http.StatusAccepted},
+		{"operator forget", op, http.MethodDelete, "/api/v1/devices/" + sw, "", http.StatusForbidden},
+		{"operator users", op, http.MethodGet, "/api/v1/users", "", http.StatusForbidden},
+		{"admin users", admin, http.MethodGet, "/api/v1/users", "", http.StatusOK},
+		{"weak password", admin, http.MethodPost, "/api/v1/users", `{"name": "vic", "password": "vic", "role": "read-only"}`, http.StatusBadRequest},
+		{"add user", admin, http.MethodPost, "/api/v1/users", `{"name": "vic", "password": "viewer pass", "role": "read-only"}`, http.StatusCreated},
+		{"user exists", admin, http.MethodPost, "/api/v1/users", `{"name": "vic", "password": "viewer pass", "role": "admin"}`, http.StatusConflict},
+		{"admin forget", admin, http.MethodDelete, "/api/v1/devices/" + sw, "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		var e errorBody
+		assert.Equal(t, tt.status, doAs(t, s, tt.token, tt.method, tt.path, tt.body, &e), tt.name)
+		if tt.status == http.StatusForbidden {
+			assert.Equal(t, CodeForbidden, e.Error.Code, tt.name)
+		}
+	}
+
+	// logging in gives a session cookie
+	login := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(`{"user": "vic", "password": "`+password+`"}`))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	w := login("wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = login("viewer pass")
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/commands", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// pages outside the API need admin to change anything
+	pages := s.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		token  string
+		method string
+		status int
+	}{
+		{"", http.MethodGet, http.StatusUnauthorized},
+		{ro, http.MethodGet, http.StatusOK},
+		{op, http.MethodPost, http.StatusForbidden},
+		{admin, http.MethodPost, http.StatusOK},
+	} {
+		req := httptest.NewRequest(tt.method, "/commands", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		pages.ServeHTTP(w, req)
+		assert.Equal(t, tt.status, w.Code, "%s %s", tt.method, tt.token)
+	}
+
+	entries, err := s.Audit.Query(audit.Filter{})
+	assert.Nil(t, err)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Actor+" "+e.Action+" "+e.Device+e.Target)
+	}
+	opID := strings.Split(op, "_")[1]
+	assert.Contains(t, actions, "token:operator/"+opID+" device.approve "+newAP)
+	assert.Contains(t, actions, "token:operator/"+opID+" denied /api/v1/devices/"+sw)
+	assert.Contains(t, actions, "anonymous login_failed user:vic")
+	assert.Contains(t, actions, "user:vic login user:vic")
+	assert.Contains(t, actions, "token:admin/"+strings.Split(admin, "_")[1]+" request /commands")
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := testServer(t)
+	assert.Equal(t, http.StatusNotFound, do(t, s, http.MethodGet, "/api/v1/audit", "", nil), "no audit log")
+	s.Audit, err = audit.Open(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	defer s.Audit.Close()
+
+	assert.Equal(t, http.StatusAccepted, do(t, s, http.MethodPost, "/api/v1/devices/"+ap+"/commands", `{"kind": "reboot"}`, nil))
+	assert.Equal(t, http.StatusAccepted, do(t, s, http.MethodPost, "/api/v1/devices/"+ap+"/commands", `{"kind": "setdefault"}`, nil))
+	assert.Equal(t, http.StatusAccepted, do(t, s, http.MethodPost, "/api/v1/devices/"+newAP+"/approve", "", nil))
+
+	var list struct {
+		Total int           `json:"total"`
+		Items []audit.Entry `json:"items"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/audit?device=AP-DOCK", "", &list))
+	assert.Equal(t, 2, list.Total)
+	assert.Equal(t, int64(2), list.Items[0].Seq, "newest first")
+	assert.Equal(t, ap, list.Items[0].Device)
+	assert.Equal(t, "anonymous", list.Items[0].Actor)
+	assert.Contains(t, string(list.Items[0].After), `"kind":"setdefault"`)
+
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/audit?action=device", "", &list))
+	assert.Equal(t, 1, list.Total)
+	assert.Equal(t, audit.ActionApprove, list.Items[0].Action)
+	assert.NotContains(t, string(list.Items[0].After), "authkey=", "keys are fingerprinted")
+
+	assert.Equal(t, http.StatusBadRequest, do(t, s, http.MethodGet, "/api/v1/audit?since=yesterday", "", nil))
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/audit?until=2000-01-01T00:00:00Z", "", &list))
+	assert.Equal(t, 0, list.Total)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/audit/export", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	head, err := audit.Verify(bytes.NewReader(w.Body.Bytes()))
+	assert.Nil(t, err, "exports can be verified")
+	assert.Equal(t, int64(3), head.Entries)
+
+	var v Verification
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/audit/verify", "", &v))
+	assert.True(t, v.Valid)
+	assert.Equal(t, head, v.Head)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	data = bytes.Replace(data, []byte(`"actor":"anonymous"`), []byte(`"actor":"user:someone"`), 1)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "audit.jsonl"), data, 0600))
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/audit/verify", "", &v))
+	assert.False(t, v.Valid)
+	assert.Contains(t, v.Error, "entry 1 has been changed")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "audit.jsonl"), append(data, "nope\n"...), 0600))
+	var bad struct {
+		Total      int    `json:"total"`
+		Unreadable string `json:"unreadable"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, s, http.MethodGet, "/api/v1/audit", "", &bad), "unreadable lines are reported")
+	assert.Equal(t, 3, bad.Total)
+	assert.Contains(t, bad.Unreadable, "line 4")
+}
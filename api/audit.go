@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/device"
+)
+
+// jsonLines is a body written as is, as JSON lines
+type jsonLines []byte
+
+// Verification is whether the audit log's chain is intact
+type Verification struct {
+	audit.Head
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditList is a page of audit entries. Unreadable names lines of the log
+// that aren't entries, which are left out.
+type AuditList struct {
+	List
+	Unreadable string `json:"unreadable,omitempty"`
+}
+
+// auditFilter reads ?actor=, ?action=, ?device= (a MAC or name), ?since=
+// and ?until=
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{Actor: q.Get("actor"), Action: q.Get("action"), Device: q.Get("device")}
+	if f.Device == "" {
+		f.Device = q.Get("mac")
+	}
+	if mac, err := device.NormalizeMAC(f.Device); err == nil {
+		f.Device = mac
+	}
+	for _, t := range []struct {
+		name string
+		to   *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(t.name); v != "" {
+			var err error
+			if *t.to, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, apiError(http.StatusBadRequest, CodeBadRequest, "%s must be an RFC 3339 time", t.name)
+			}
+		}
+	}
+	return f, nil
+}
+
+// listAudit lists audit entries, newest first
+func (s *Server) listAudit(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.Audit == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "there is no audit log")
+	}
+	f, err := auditFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	var out AuditList
+	entries, err := s.Audit.Query(f)
+	if errors.Is(err, audit.ErrUnreadable) {
+		glog.Warningf("api: %s", err)
+		out.Unreadable = err.Error()
+	} else if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	start, end, list, err := page(r, len(entries))
+	list.Items = entries[start:end]
+	out.List = list
+	return out, err
+}
+
+// exportAudit returns audit entries as they are in the log, oldest first
+func (s *Server) exportAudit(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.Audit == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "there is no audit log")
+	}
+	f, err := auditFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := s.Audit.Export(&b, f); errors.Is(err, audit.ErrUnreadable) {
+		glog.Warningf("api: exporting what can be read: %s", err)
+	} else if err != nil {
+		return nil, err
+	}
+	return jsonLines(b.Bytes()), nil
+}
+
+// verifyAudit checks the audit log's chain
+func (s *Server) verifyAudit(r *http.Request) (interface{}, error) {
+	if err := readOnly(r); err != nil {
+		return nil, err
+	}
+	if s.Audit == nil {
+		return nil, apiError(http.StatusNotFound, CodeNotEnabled, "there is no audit log")
+	}
+	head, err := s.Audit.Verify()
+	if errors.Is(err, audit.ErrTampered) {
+		return Verification{Head: head, Error: err.Error()}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return Verification{Head: head, Valid: true}, nil
+}
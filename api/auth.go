@@ -0,0 +1,289 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+)
+
+// authorize authenticates r, unless it's a login, and checks its role
+// allows it, returning r carrying who made it
+func (s *Server) authorize(r *http.Request, path string, parts []string) (*http.Request, error) {
+	if s.Auth == nil || path == "login" {
+		return r, nil
+	}
+	id, err := s.Auth.Authenticate(r)
+	if err != nil {
+		return r, apiError(http.StatusUnauthorized, CodeUnauthorized, "%s", err)
+	}
+	r = r.WithContext(auth.NewContext(r.Context(), id))
+	return r, s.allow(r, needs(r, parts))
+}
+
+// needs returns the role r needs. Reading needs read-only, except users and
+// tokens, which are for admins. Approving devices and queueing or
+// cancelling commands needs operator; queue asks for admin for upgrades and
+// resets. Anything else needs admin.
+func needs(r *http.Request, parts []string) auth.Role {
+	switch {
+	case parts[0] == "users" || parts[0] == "tokens":
+		return auth.RoleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || parts[0] == "logout":
+		return auth.RoleReadOnly
+	case parts[0] == "devices" && len(parts) == 3 && (parts[2] == "approve" || parts[2] == "commands"):
+		return auth.RoleOperator
+	case parts[0] == "commands":
+		return auth.RoleOperator
+	}
+	return auth.RoleAdmin
+}
+
+// allow checks whoever made r has role, recording it if they don't.
+// Requests that weren't authenticated are allowed, as Auth is off.
+func (s *Server) allow(r *http.Request, role auth.Role) error {
+	id, ok := auth.FromContext(r.Context())
+	if !ok || id.Role.Allows(role) {
+		return nil
+	}
+	s.record(r, audit.Entry{Action: audit.ActionDenied, Target: r.URL.Path, Detail: fmt.Sprintf("%s needs %s", r.Method, role)})
+	return apiError(http.StatusForbidden, CodeForbidden, "%s %s needs the %s role", r.Method, r.URL.Path, role)
+}
+
+// actor names whoever made r
+func actor(r *http.Request) string {
+	if id, ok := auth.FromContext(r.Context()); ok {
+		return id.String()
+	}
+	return "anonymous"
+}
+
+// record logs e, done by whoever made r, and adds it to the audit log
+func (s *Server) record(r *http.Request, e audit.Entry) {
+	e.Actor, e.Remote = actor(r), r.RemoteAddr
+	glog.Infof("api: %s (%s): %s %s%s %s", e.Actor, e.Remote, e.Action, e.Device, e.Target, e.Detail)
+	if s.Audit == nil {
+		return
+	}
+	if _, err := s.Audit.Record(e); err != nil {
+		glog.Errorf("api: %s", err)
+	}
+}
+
+// Protect puts next, the management pages outside the API, behind the same
+// authentication. Reading needs read-only and anything else admin.
+func (s *Server) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := s.Auth.Authenticate(r)
+		if err != nil {
+			writeError(w, apiError(http.StatusUnauthorized, CodeUnauthorized, "%s", err))
+			return
+		}
+		r = r.WithContext(auth.NewContext(r.Context(), id))
+
+		role := auth.RoleAdmin
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = auth.RoleReadOnly
+		}
+		if err := s.allow(r, role); err != nil {
+			writeError(w, err)
+			return
+		}
+		if role == auth.RoleAdmin {
+			s.record(r, audit.Entry{Action: audit.ActionRequest, Target: r.URL.Path, Detail: strings.TrimSpace(r.Method + " " + r.URL.RawQuery)})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authError maps errors from package auth to API errors
+func authError(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrInvalidName), errors.Is(err, auth.ErrInvalidRole), errors.Is(err, auth.ErrWeakPassword):
+		return apiError(http.StatusBadRequest, CodeBadRequest, "%s", err)
+	case errors.Is(err, auth.ErrExists):
+		return apiError(http.StatusConflict, CodeConflict, "%s", err)
+	case errors.Is(err, auth.ErrNotFound):
+		return apiError(http.StatusNotFound, CodeNotFound, "%s", err)
+	}
+	return err
+}
+
+// decode reads r's JSON body into v, rejecting unknown fields
+func decode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiError(http.StatusBadRequest, CodeBadRequest, "invalid body: %s", err)
+	}
+	return nil
+}
+
+// notEnabled is returned for users, tokens and logins without Auth
+func notEnabled() error {
+	return apiError(http.StatusNotFound, CodeNotEnabled, "authentication isn't enabled")
+}
+
+// loginRequest is the body of a login
+type loginRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// login starts a session, kept in a cookie
+func (s *Server) login(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if s.Auth == nil {
+		return nil, notEnabled()
+	}
+	if r.Method != http.MethodPost {
+		return nil, methodNotAllowed(r)
+	}
+	var req loginRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+
+	sess, err := s.Auth.Login(req.User, req.Password, r.RemoteAddr)
+	switch {
+	case errors.Is(err, auth.ErrRateLimited):
+		s.record(r, audit.Entry{Action: audit.ActionLoginFailed, Target: "user:" + req.User, Detail: "rate limited"})
+		w.Header().Set("Retry-After", strconv.Itoa(int(auth.FailureWindow.Seconds())))
+		return nil, apiError(http.StatusTooManyRequests, CodeTooManyRequests, "%s", err)
+	case errors.Is(err, auth.ErrBadCredentials):
+		s.record(r, audit.Entry{Action: audit.ActionLoginFailed, Target: "user:" + req.User})
+		return nil, apiError(http.StatusUnauthorized, CodeUnauthorized, "%s", err)
+	case err != nil:
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.SessionCookie,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	r = r.WithContext(auth.NewContext(r.Context(), auth.Identity{Name: sess.User, Role: sess.Role}))
+	s.record(r, audit.Entry{Action: audit.ActionLogin, Target: "user:" + sess.User})
+	return sess, nil
+}
+
+// logout ends the session r was made with
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) error {
+	if s.Auth == nil {
+		return notEnabled()
+	}
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(r)
+	}
+	s.Auth.Logout(auth.SessionID(r))
+	http.SetCookie(w, &http.Cookie{Name: auth.SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	s.record(r, audit.Entry{Action: audit.ActionLogout})
+	return nil
+}
+
+func (s *Server) listUsers(r *http.Request) (interface{}, error) {
+	if s.Auth == nil {
+		return nil, notEnabled()
+	}
+	users := s.Auth.Users()
+	start, end, list, err := page(r, len(users))
+	list.Items = users[start:end]
+	return list, err
+}
+
+// userRequest is the body of a user to add
+type userRequest struct {
+	Name     string    `json:"name"`
+	Password string    `json:"password"`
+	Role     auth.Role `json:"role"`
+}
+
+func (s *Server) addUser(r *http.Request) (interface{}, error) {
+	if s.Auth == nil {
+		return nil, notEnabled()
+	}
+	var req userRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	u, err := s.Auth.AddUser(req.Name, req.Password, req.Role)
+	if err != nil {
+		return nil, authError(err)
+	}
+	s.record(r, audit.Entry{Action: audit.ActionUserAdd, Target: "user:" + u.Name, After: audit.Value(u)})
+	return u, nil
+}
+
+func (s *Server) deleteUser(r *http.Request, name string) error {
+	if s.Auth == nil {
+		return notEnabled()
+	}
+	if err := s.Auth.DeleteUser(name); err != nil {
+		return authError(err)
+	}
+	s.record(r, audit.Entry{Action: audit.ActionUserDelete, Target: "user:" + name})
+	return nil
+}
+
+func (s *Server) listTokens(r *http.Request) (interface{}, error) {
+	if s.Auth == nil {
+		return nil, notEnabled()
+	}
+	tokens := s.Auth.Tokens()
+	start, end, list, err := page(r, len(tokens))
+	list.Items = tokens[start:end]
+	return list, err
+}
+
+// tokenRequest is the body of a token to add
+type tokenRequest struct {
+	Name string    `json:"name"`
+	Role auth.Role `json:"role"`
+}
+
+// NewToken is a token just created, with the secret to use it, which isn't
+// shown again
+type NewToken struct {
+	auth.Token
+	Secret string `json:"token"`
+}
+
+func (s *Server) addToken(r *http.Request) (interface{}, error) {
+	if s.Auth == nil {
+		return nil, notEnabled()
+	}
+	var req tokenRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	t, secret, err := s.Auth.AddToken(req.Name, req.Role)
+	if err != nil {
+		return nil, authError(err)
+	}
+	s.record(r, audit.Entry{Action: audit.ActionTokenAdd, Target: "token:" + t.Name + "/" + t.ID, After: audit.Value(t)})
+	return NewToken{Token: t, Secret: secret}, nil
+}
+
+func (s *Server) deleteToken(r *http.Request, id string) error {
+	if s.Auth == nil {
+		return notEnabled()
+	}
+	if err := s.Auth.DeleteToken(id); err != nil {
+		return authError(err)
+	}
+	s.record(r, audit.Entry{Action: audit.ActionTokenDelete, Target: "token:" + id})
+	return nil
+}
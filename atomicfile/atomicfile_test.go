@@ -0,0 +1,33 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	assert.Nil(t, WriteFile(path, []byte("old"), 0644))
+	assert.Nil(t, WriteFile(path, []byte("new"), 0600))
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1, "no temporary files are left behind")
+
+	assert.NotNil(t, WriteFile(filepath.Join(dir, "missing", "state.json"), nil, 0600))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/command"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/props"
+	"github.com/jda/nanofi/rollout"
+)
+
+// Actors for changes nanofi makes by itself
+const (
+	actorBench     = "system:bench"
+	actorRollout   = "system:rollout"
+	actorProvision = "system:provision"
+	actorSSHAdopt  = "system:ssh-adopt"
+	actorReload    = "system:reload"
+	// actorDevice is for changes devices report, such as being reset by hand
+	actorDevice = "device"
+)
+
+// record adds e to the audit log, if there is one
+func (c *controller) record(e audit.Entry) {
+	if c.audit == nil {
+		return
+	}
+	if _, err := c.audit.Record(e); err != nil {
+		glog.Errorf("audit: %s", err)
+	}
+}
+
+// auditObserved records changes dev reports since prev that nanofi didn't
+// ask for then, such as a device taking its key or being reset by hand
+func (c *controller) auditObserved(dev device.Device, prev device.Device) {
+	if prev.MAC == "" {
+		return
+	}
+	switch {
+	case !prev.Adopted && dev.Adopted:
+		e := audit.For(dev, audit.ActionAdopted)
+		e.Actor, e.After = actorDevice, audit.Value(audit.Key(true, dev.AuthKey))
+		c.record(e)
+	case prev.Adopted && !dev.Adopted:
+		e := audit.For(dev, audit.ActionDefaulted)
+		e.Actor, e.Before = actorDevice, audit.Value(audit.Key(true, prev.AuthKey))
+		c.record(e)
+		// it's back on the factory config
+		c.pushed.swap(dev.MAC, "")
+	}
+}
+
+// auditReply records the change reply makes to dev, sent on behalf of
+// actor. detail is the command the reply is for, if any.
+func (c *controller) auditReply(dev device.Device, reply inform.Response, actor string, detail string) {
+	var e audit.Entry
+	switch r := reply.(type) {
+	case inform.SetParamResponse:
+		cfg := mgmtSettings(r.MgmtCfg)
+		key, hasKey := cfg["authkey"]
+		current := ""
+		if dev.Adopted {
+			current = dev.AuthKey
+		}
+		switch {
+		case hasKey && key != current && !dev.Adopted:
+			e = audit.For(dev, audit.ActionAdopt)
+			e.Before = audit.Value(audit.KeyState{})
+			e.After = audit.Value(audit.Key(true, key))
+		case hasKey && key != current:
+			e = audit.For(dev, audit.ActionKey)
+			e.Before = audit.Value(audit.Key(true, current))
+			e.After = audit.Value(audit.Key(true, key))
+		default:
+			e = audit.For(dev, audit.ActionConfigPush)
+			e.Before = audit.Value(map[string]string{"cfgversion": dev.CfgVersion})
+			after := map[string]interface{}{"cfgversion": cfg["cfgversion"]}
+			if r.SystemCfg != "" {
+				// each change holds the value before and after
+				after["system_cfg"] = cfgChanges(c.pushed.swap(dev.MAC, r.SystemCfg), r.SystemCfg)
+			}
+			e.After = audit.Value(after)
+		}
+	case inform.UpgradeResponse:
+		e = audit.For(dev, audit.ActionUpgrade)
+		e.Before = audit.Value(map[string]string{"version": dev.Version})
+		e.After = audit.Value(map[string]string{"version": r.Version, "url": r.URL})
+	case inform.SetDefaultResponse:
+		e = audit.For(dev, audit.ActionReset)
+		e.Before = audit.Value(audit.Key(dev.Adopted, dev.AuthKey))
+		e.After = audit.Value(audit.KeyState{})
+	case inform.RebootResponse:
+		e = audit.For(dev, audit.ActionReboot)
+	case inform.CmdResponse:
+		e = audit.For(dev, audit.ActionRaw)
+		if strings.HasSuffix(r.Cmd, "locate") {
+			e.Action = audit.ActionLocate
+		}
+		e.After = audit.Value(map[string]string{"cmd": r.Cmd})
+	case inform.NoOpResponse, nil:
+		return
+	default:
+		e = audit.For(dev, audit.ActionRaw)
+		if data, err := reply.JSON(); err == nil {
+			e.After = data
+		}
+	}
+	e.Actor, e.Detail = actor, detail
+	c.record(e)
+}
+
+// pushedCfgs remembers the system_cfg last sent to each device since
+// nanofi started, for the audit log to show what a push changes
+type pushedCfgs struct {
+	mu   sync.Mutex
+	cfgs map[string]string
+}
+
+// swap records cfg as the system_cfg sent to mac, returning the one sent
+// before. An empty cfg is the factory config.
+func (p *pushedCfgs) swap(mac string, cfg string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfgs == nil {
+		p.cfgs = make(map[string]string)
+	}
+	prev := p.cfgs[mac]
+	if cfg == "" {
+		delete(p.cfgs, mac)
+	} else {
+		p.cfgs[mac] = cfg
+	}
+	return prev
+}
+
+// secretProps are system_cfg keys, by their last part, whose values are
+// only logged as fingerprints
+var secretProps = map[string]bool{"psk": true, "password": true, "secret": true}
+
+// cfgChanges lists what pushing the system_cfg after changes from before,
+// with secrets fingerprinted. Unparseable config is taken as empty.
+func cfgChanges(before string, after string) []props.Change {
+	parse := func(s string) *props.Node {
+		n, err := props.ParseString(s)
+		if err != nil {
+			return props.New()
+		}
+		return n
+	}
+	changes := props.Diff(parse(before), parse(after))
+	if changes == nil {
+		// resent unchanged
+		changes = []props.Change{}
+	}
+	for i, ch := range changes {
+		if secretProps[ch.Key[strings.LastIndexByte(ch.Key, '.')+1:]] {
+			changes[i].Old, changes[i].New = audit.Fingerprint(ch.Old), audit.Fingerprint(ch.New)
+		}
+	}
+	return changes
+}
+
+// sentCommand returns who queued the command just sent to mac, and its ID
+func (c *controller) sentCommand(mac string) (actor string, id string) {
+	for _, cmd := range c.commands.List(mac) {
+		if cmd.Status != command.StatusSent {
+			continue
+		}
+		if cmd.By == "" {
+			return "unknown", cmd.ID
+		}
+		return cmd.By, cmd.ID
+	}
+	return "unknown", ""
+}
+
+// mgmtSettings parses the key=value lines of a mgmt_cfg
+func mgmtSettings(mgmtCfg string) map[string]string {
+	out := make(map[string]string)
+	for _, line := range strings.Split(mgmtCfg, "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			out[line[:i]] = line[i+1:]
+		}
+	}
+	return out
+}
+
+// auditRollout records rollout decisions: waves starting, devices failing,
+// halts and rollbacks
+func (c *controller) auditRollout(ev rollout.Event) {
+	d, ok := c.devices.Get(ev.MAC)
+	if !ok {
+		d = device.Device{MAC: ev.MAC}
+	}
+	e := audit.For(d, audit.ActionRollout)
+	e.Time, e.Actor = ev.Time, actorRollout
+	e.Detail = strings.TrimSpace(string(ev.Kind) + " " + ev.Message)
+	e.After = audit.Value(map[string]interface{}{"mode": ev.Mode, "wave": ev.Wave})
+	c.record(e)
+}
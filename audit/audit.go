@@ -0,0 +1,403 @@
+// Package audit records every change nanofi makes, and who made it, in an
+// append-only JSON lines file. Each entry holds the hash of the one before
+// it, so editing, removing or reordering entries breaks the chain, which
+// Verify finds. Removing entries from the end can only be told by comparing
+// the last hash with one kept elsewhere.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+)
+
+// Actions
+const (
+	ActionLogin       = "login"
+	ActionLoginFailed = "login_failed"
+	ActionLogout      = "logout"
+	ActionDenied      = "denied"
+	ActionApprove     = "device.approve"
+	ActionAdopt       = "device.adopt"
+	ActionForget      = "device.forget"
+	ActionAdopted     = "device.adopted"
+	ActionDefaulted   = "device.defaulted"
+	ActionSetInform   = "device.set_inform"
+	ActionKey         = "device.key"
+	ActionReset       = "device.reset"
+	ActionReboot      = "device.reboot"
+	ActionLocate      = "device.locate"
+	ActionConfigPush  = "config.push"
+	ActionReload      = "config.reload"
+	ActionUpgrade     = "firmware.upgrade"
+	ActionRollout     = "firmware.rollout"
+	ActionCommand     = "command.queue"
+	ActionCancel      = "command.cancel"
+	ActionRaw         = "command.raw"
+	ActionUserAdd     = "user.add"
+	ActionUserDelete  = "user.delete"
+	ActionTokenAdd    = "token.add"
+	ActionTokenDelete = "token.delete"
+	ActionRequest     = "request"
+)
+
+// ErrTampered is returned by Verify for logs whose chain is broken
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// ErrUnreadable is returned for lines of a log that aren't entries
+var ErrUnreadable = errors.New("unreadable audit entries")
+
+// Entry is one change and who made it
+type Entry struct {
+	// Seq numbers entries from 1
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	// Actor is who made the change, e.g. user:alice, token:ci/3f2a9c1d or
+	// system:rollout for changes nanofi decided on itself
+	Actor string `json:"actor"`
+	// Remote is the address it was made from
+	Remote string `json:"remote,omitempty"`
+	Action string `json:"action"`
+	// Device is the MAC of the device changed, and DeviceName what it was
+	// called at the time
+	Device     string `json:"device,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	// Target is what else was changed, e.g. a user
+	Target string `json:"target,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Before and After are what changed, as JSON
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	// Prev is the previous entry's hash, empty for the first, and Hash the
+	// SHA-256 of this entry without Hash
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// sum returns the hash e should have
+func (e Entry) sum() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not encode audit entry: %w", err)
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// For starts an entry for action on d
+func For(d device.Device, action string) Entry {
+	name := d.Hostname
+	if name == "" {
+		name = d.DHCPName
+	}
+	return Entry{Action: action, Device: d.MAC, DeviceName: name}
+}
+
+// Fingerprint identifies a secret, such as an authkey, without giving it
+// away
+func Fingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:8])
+}
+
+// KeyState is what the log shows of a device's adoption and authkey
+type KeyState struct {
+	Adopted bool   `json:"adopted"`
+	AuthKey string `json:"authkey,omitempty"`
+}
+
+// Key returns the KeyState of a device with authkey
+func Key(adopted bool, authkey string) KeyState {
+	return KeyState{Adopted: adopted, AuthKey: Fingerprint(authkey)}
+}
+
+// Value encodes v for Before and After
+func Value(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Log is an audit log file
+type Log struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	last string
+	now  func() time.Time
+}
+
+// Open opens the audit log in path for appending, creating it if needed.
+// Entries carry on the chain from the last one in the file. An entry left
+// partly written at the end, by a crash or full disk, is cut off.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	l := &Log{path: path, f: f, now: time.Now}
+	if err := l.cutTorn(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	sc := newScanner(f)
+	for sc.Scan() {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		l.seq, l.last = e.Seq, e.Hash
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read audit log: %w", err)
+	}
+	return l, nil
+}
+
+// cutTorn truncates the file after its last complete line
+func (l *Log) cutTorn() error {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not read audit log: %w", err)
+	}
+	size := fi.Size()
+	keep := size
+	buf := make([]byte, 4096)
+	for keep > 0 {
+		n := int64(len(buf))
+		if n > keep {
+			n = keep
+		}
+		if _, err := l.f.ReadAt(buf[:n], keep-n); err != nil {
+			return fmt.Errorf("could not read audit log: %w", err)
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			keep = keep - n + int64(i) + 1
+			break
+		}
+		keep -= n
+	}
+	if keep == size {
+		return nil
+	}
+
+	glog.Warningf("audit: cutting off %d bytes of a partly written entry at the end of %s", size-keep, l.path)
+	if err := l.f.Truncate(keep); err != nil {
+		return fmt.Errorf("could not repair audit log: %w", err)
+	}
+	return nil
+}
+
+// Record appends e, timestamped now unless it has a time, and returns it
+// as written
+func (l *Log) Record(e Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq, e.Prev = l.seq+1, l.last
+	var err error
+	if e.Hash, err = e.sum(); err != nil {
+		return Entry{}, err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, fmt.Errorf("could not encode audit entry: %w", err)
+	}
+	fi, err := l.f.Stat()
+	if err != nil {
+		return Entry{}, fmt.Errorf("could not write audit entry: %w", err)
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		// don't leave part of e for the next entry to be appended to
+		l.f.Truncate(fi.Size())
+		return Entry{}, fmt.Errorf("could not write audit entry: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return Entry{}, fmt.Errorf("could not write audit entry: %w", err)
+	}
+	l.seq, l.last = e.Seq, e.Hash
+	return e, nil
+}
+
+// Close closes the file
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// Filter selects entries; empty fields match everything
+type Filter struct {
+	Actor string
+	// Action matches the action, or with no '.' every action under it, so
+	// device matches device.reset
+	Action string
+	// Device matches the device's MAC or name, ignoring case
+	Device string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Match reports whether e passes f
+func (f Filter) Match(e Entry) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action && !(!strings.Contains(f.Action, ".") && strings.HasPrefix(e.Action, f.Action+".")) {
+		return false
+	}
+	if f.Device != "" && !strings.EqualFold(e.Device, f.Device) && !strings.EqualFold(e.DeviceName, f.Device) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// each calls fn with every entry in the file and the line it was read from.
+// Lines that aren't entries are skipped, then returned as an error wrapping
+// ErrUnreadable.
+func (l *Log) each(fn func(e Entry, line []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("could not read audit log: %w", err)
+	}
+	defer f.Close()
+
+	sc := newScanner(f)
+	var bad []string
+	for n := 1; sc.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			bad = append(bad, strconv.Itoa(n))
+			continue
+		}
+		if err := fn(e, sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read audit log: %w", err)
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%w: line %s", ErrUnreadable, strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// Query returns the entries f matches, oldest first. If lines of the log
+// aren't entries, it returns the entries it could read along with an error
+// wrapping ErrUnreadable.
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	out := []Entry{}
+	err := l.each(func(e Entry, line []byte) error {
+		if f.Match(e) {
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Export writes the entries f matches to w as JSON lines, as they are in
+// the file. Exporting everything gives a log Verify can check. Lines that
+// aren't entries are left out, as with Query.
+func (l *Log) Export(w io.Writer, f Filter) error {
+	return l.each(func(e Entry, line []byte) error {
+		if !f.Match(e) {
+			return nil
+		}
+		// line is the scanner's, so isn't appended to
+		_, err := fmt.Fprintf(w, "%s\n", line)
+		return err
+	})
+}
+
+// Head is how far a log goes
+type Head struct {
+	Entries int64  `json:"entries"`
+	Hash    string `json:"hash"`
+}
+
+// Verify checks the chain of the log in r, returning its last entry. The
+// error says where the chain first breaks.
+func Verify(r io.Reader) (Head, error) {
+	var head Head
+	sc := newScanner(r)
+	for sc.Scan() {
+		var e Entry
+		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return head, fmt.Errorf("%w: entry after %d: %s", ErrTampered, head.Entries, err)
+		}
+		if e.Seq != head.Entries+1 {
+			return head, fmt.Errorf("%w: entry %d follows %d", ErrTampered, e.Seq, head.Entries)
+		}
+		if e.Prev != head.Hash {
+			return head, fmt.Errorf("%w: entry %d doesn't follow the one before", ErrTampered, e.Seq)
+		}
+		sum, err := e.sum()
+		if err != nil {
+			return head, err
+		}
+		if e.Hash != sum {
+			return head, fmt.Errorf("%w: entry %d has been changed", ErrTampered, e.Seq)
+		}
+		head = Head{Entries: e.Seq, Hash: e.Hash}
+	}
+	if err := sc.Err(); err != nil {
+		return head, fmt.Errorf("could not read audit log: %w", err)
+	}
+	return head, nil
+}
+
+// Verify checks the chain of the log's file
+func (l *Log) Verify() (Head, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.path)
+	if err != nil {
+		return Head{}, fmt.Errorf("could not read audit log: %w", err)
+	}
+	defer f.Close()
+	return Verify(f)
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	return sc
+}
@@ -0,0 +1,223 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/device"
+	"github.com/stretchr/testify/assert"
+)
+
+var lobby = device.Device{MAC: "fc:ec:da:00:00:01", Hostname: "lobby-ap", Adopted: true, AuthKey: "00112233445566778899aabbccddeeff"}
+
+// testLog opens a log in a new directory with three entries
+func testLog(t *testing.T) (*Log, string) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	_, err = l.Record(Entry{Actor: "cli:root", Action: ActionUserAdd, Target: "user:alice"})
+	assert.Nil(t, err)
+	now = time.Date(2021, 3, 2, 3, 0, 0, 0, time.UTC)
+	reset := For(lobby, ActionReset)
+	reset.Actor, reset.Remote = "user:alice", "192.0.2.1:1234"
+	reset.Before, reset.After = Value(Key(true, lobby.AuthKey)), Value(KeyState{})
+	_, err = l.Record(reset)
+	assert.Nil(t, err)
+	now = time.Date(2021, 3, 2, 9, 0, 0, 0, time.UTC)
+	upgrade := For(device.Device{MAC: "fc:ec:da:00:00:02", DHCPName: "office-sw"}, ActionUpgrade)
+	upgrade.Actor = "system:rollout"
+	_, err = l.Record(upgrade)
+	assert.Nil(t, err)
+	return l, dir
+}
+
+func TestRecord(t *testing.T) {
+	l, dir := testLog(t)
+	defer os.RemoveAll(dir)
+
+	entries, err := l.Query(Filter{})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, int64(2), entries[1].Seq)
+	assert.Equal(t, entries[0].Hash, entries[1].Prev)
+	assert.Equal(t, "lobby-ap", entries[1].DeviceName)
+	assert.Equal(t, "office-sw", entries[2].DeviceName)
+	assert.Equal(t, `{"adopted":true,"authkey":"`+Fingerprint(lobby.AuthKey)+`"}`, string(entries[1].Before))
+	assert.Empty(t, entries[0].Before)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), lobby.AuthKey)
+
+	// reopening carries on the chain
+	assert.Nil(t, l.Close())
+	l, err = Open(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	defer l.Close()
+	e, err := l.Record(Entry{Actor: "cli:root", Action: ActionTokenAdd, Target: "token:ci/3f2a9c1d"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), e.Seq)
+	assert.Equal(t, entries[2].Hash, e.Prev)
+
+	head, err := l.Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, Head{Entries: 4, Hash: e.Hash}, head)
+}
+
+func TestQuery(t *testing.T) {
+	l, dir := testLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	tests := []struct {
+		name   string
+		filter Filter
+		seqs   []int64
+	}{
+		{"everything", Filter{}, []int64{1, 2, 3}},
+		{"actor", Filter{Actor: "user:alice"}, []int64{2}},
+		{"action", Filter{Action: ActionReset}, []int64{2}},
+		{"action prefix", Filter{Action: "device"}, []int64{2}},
+		{"partial action", Filter{Action: "device.re"}, nil},
+		{"device name", Filter{Device: "Lobby-AP"}, []int64{2}},
+		{"device MAC", Filter{Device: "fc:ec:da:00:00:02"}, []int64{3}},
+		{"since", Filter{Since: time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC)}, []int64{2, 3}},
+		{"3am", Filter{Device: "lobby-ap", Since: time.Date(2021, 3, 2, 2, 0, 0, 0, time.UTC), Until: time.Date(2021, 3, 2, 4, 0, 0, 0, time.UTC)}, []int64{2}},
+		{"until is exclusive", Filter{Until: time.Date(2021, 3, 2, 3, 0, 0, 0, time.UTC)}, []int64{1}},
+	}
+	for _, tt := range tests {
+		entries, err := l.Query(tt.filter)
+		assert.Nil(t, err, tt.name)
+		var seqs []int64
+		for _, e := range entries {
+			seqs = append(seqs, e.Seq)
+		}
+		assert.Equal(t, tt.seqs, seqs, tt.name)
+	}
+}
+
+func TestExport(t *testing.T) {
+	l, dir := testLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	assert.Nil(t, l.Export(&buf, Filter{}))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), buf.String(), "exports are the file as is")
+
+	buf.Reset()
+	assert.Nil(t, l.Export(&buf, Filter{Actor: "system:rollout"}))
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), `"action":"firmware.upgrade"`)
+}
+
+func TestVerify(t *testing.T) {
+	l, dir := testLog(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	assert.Nil(t, l.Export(&buf, Filter{}))
+	lines := strings.SplitAfter(buf.String(), "\n")[:3]
+
+	tests := []struct {
+		name string
+		log  string
+		err  string
+	}{
+		{"intact", strings.Join(lines, ""), ""},
+		{"empty", "", ""},
+		{"edited", strings.Replace(strings.Join(lines, ""), "user:alice", "user:bob", 1), "entry 1 has been changed"},
+		{"edited and rehashed", lines[0] + strings.Replace(lines[1], `"actor":"user:alice"`, `"actor":"user:bob"`, 1) + lines[2], "entry 2 has been changed"},
+		{"removed", lines[0] + lines[2], "entry 3 follows 1"},
+		{"reordered", lines[1] + lines[0] + lines[2], "entry 2 follows 0"},
+		{"not JSON", lines[0] + "nope\n", "entry after 1"},
+		{"extra field", lines[0] + strings.Replace(lines[1], `{"seq"`, `{"note":"x","seq"`, 1), "entry after 1"},
+	}
+	for _, tt := range tests {
+		head, err := Verify(strings.NewReader(tt.log))
+		if tt.err == "" {
+			assert.Nil(t, err, tt.name)
+			continue
+		}
+		assert.True(t, errors.Is(err, ErrTampered), tt.name)
+		assert.Contains(t, err.Error(), tt.err, tt.name)
+		assert.True(t, head.Entries < 3, tt.name)
+	}
+
+	// a rehashed entry breaks the link to the next one
+	e, err := l.Query(Filter{})
+	assert.Nil(t, err)
+	e[1].Actor = "user:bob"
+	e[1].Hash, err = e[1].sum()
+	assert.Nil(t, err)
+	forged := lines[0] + string(Value(e[1])) + "\n" + lines[2]
+	_, err = Verify(strings.NewReader(forged))
+	assert.Contains(t, err.Error(), "entry 3 doesn't follow the one before")
+}
+
+func TestTorn(t *testing.T) {
+	l, dir := testLog(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	assert.Nil(t, l.Close())
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`{"seq":4,"time":"2021-03`)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	l, err = Open(path)
+	assert.Nil(t, err)
+	defer l.Close()
+	e, err := l.Record(Entry{Actor: "cli:root", Action: ActionTokenAdd})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), e.Seq)
+	entries, err := l.Query(Filter{})
+	assert.Nil(t, err, "the partly written entry is cut off")
+	assert.Len(t, entries, 4)
+	head, err := l.Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), head.Entries)
+
+	// lines that aren't entries are skipped and reported
+	f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	_, err = f.WriteString("nope\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, err = l.Record(Entry{Actor: "cli:root", Action: ActionTokenAdd})
+	assert.Nil(t, err)
+	entries, err = l.Query(Filter{})
+	assert.True(t, errors.Is(err, ErrUnreadable))
+	assert.Contains(t, err.Error(), "line 5")
+	assert.Len(t, entries, 5)
+	var buf bytes.Buffer
+	err = l.Export(&buf, Filter{})
+	assert.True(t, errors.Is(err, ErrUnreadable))
+	assert.Equal(t, 5, strings.Count(buf.String(), "\n"))
+}
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t, "", Fingerprint(""))
+	assert.Len(t, Fingerprint(lobby.AuthKey), 16)
+	assert.NotEqual(t, Fingerprint("a"), Fingerprint("b"))
+	assert.Nil(t, Value(nil))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+)
+
+const authUsage = `usage: nanofi [flags] user add <name> <role>  (password read from stdin)
+       nanofi [flags] user delete <name>
+       nanofi [flags] user list
+       nanofi [flags] token add <name> <role>
+       nanofi [flags] token delete <id>
+       nanofi [flags] token list
+roles are read-only, operator and admin`
+
+// manageAuth runs nanofi user and nanofi token, which add, delete and list
+// the users and API tokens allowed to manage nanofi
+func manageAuth(w io.Writer, in io.Reader, store *auth.Store, log *audit.Log, args []string) error {
+	if len(args) < 2 {
+		return errors.New(authUsage)
+	}
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	record := func(action string, target string, after interface{}) error {
+		_, err := log.Record(audit.Entry{Actor: actor, Action: action, Target: target, After: audit.Value(after)})
+		return err
+	}
+
+	switch {
+	case args[0] == "user" && args[1] == "add" && len(args) == 4:
+		password, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("could not read password: %w", err)
+		}
+		u, err := store.AddUser(args[2], strings.TrimRight(password, "\r\n"), auth.Role(args[3]))
+		if err != nil {
+			return err
+		}
+		return record(audit.ActionUserAdd, "user:"+u.Name, u)
+	case args[0] == "user" && args[1] == "delete" && len(args) == 3:
+		if err := store.DeleteUser(args[2]); err != nil {
+			return err
+		}
+		return record(audit.ActionUserDelete, "user:"+args[2], nil)
+	case args[0] == "user" && args[1] == "list" && len(args) == 2:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\tCREATED")
+		for _, u := range store.Users() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Name, u.Role, u.Created.Format("2006-01-02"))
+		}
+		return tw.Flush()
+	case args[0] == "token" && args[1] == "add" && len(args) == 4:
+		t, secret, err := store.AddToken(args[2], auth.Role(args[3]))
+		if err != nil {
+			return err
+		}
+		if err := record(audit.ActionTokenAdd, "token:"+t.Name+"/"+t.ID, t); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, secret)
+		return err
+	case args[0] == "token" && args[1] == "delete" && len(args) == 3:
+		if err := store.DeleteToken(args[2]); err != nil {
+			return err
+		}
+		return record(audit.ActionTokenDelete, "token:"+args[2], nil)
+	case args[0] == "token" && args[1] == "list" && len(args) == 2:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tROLE\tCREATED")
+		for _, t := range store.Tokens() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Role, t.Created.Format("2006-01-02"))
+		}
+		return tw.Flush()
+	}
+	return errors.New(authUsage)
+}
@@ -0,0 +1,357 @@
+// Package auth is who may use the management API: local users with bcrypt
+// hashed passwords, who log in for a session, and long-lived API tokens for
+// scripts. Each has a role, and roles are ranked: read-only can look,
+// operator can also reboot, locate and approve devices, and admin can do
+// anything, including config, keys and firmware.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jda/nanofi/atomicfile"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is what a user or token may do
+type Role string
+
+// Roles, from least to most allowed
+const (
+	RoleReadOnly Role = "read-only"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRank = map[Role]int{RoleReadOnly: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return roleRank[r] > 0
+}
+
+// Allows reports whether r may do what needs role
+func (r Role) Allows(role Role) bool {
+	return r.Valid() && roleRank[r] >= roleRank[role]
+}
+
+// MinPasswordLength is the shortest password users may have
+const MinPasswordLength = 8
+
+// tokenPrefix starts every API token, so they're easy to spot in leaks
+const tokenPrefix = "nanofi_"
+
+// Errors
+var (
+	ErrInvalidName     = errors.New("names are letters, digits, '.', '_', '@' and '-'")
+	ErrInvalidRole     = errors.New("role must be read-only, operator or admin")
+	ErrWeakPassword    = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrExists          = errors.New("already exists")
+	ErrNotFound        = errors.New("not found")
+	ErrBadCredentials  = errors.New("wrong user or password")
+	ErrRateLimited     = errors.New("too many failed logins, try again later")
+	ErrUnauthenticated = errors.New("authentication required")
+)
+
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// cost is the bcrypt cost passwords are hashed with
+var cost = bcrypt.DefaultCost
+
+// User is a local user
+type User struct {
+	Name string `json:"name"`
+	// PasswordHash is the bcrypt hash of the user's password
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Role         Role      `json:"role"`
+	Created      time.Time `json:"created"`
+}
+
+// Token is a long-lived API token. Only a hash of the token is kept; the
+// token itself is shown once, when it's created.
+type Token struct {
+	// ID is the public part of the token, by which it's listed and revoked
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Role    Role      `json:"role"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Identity is who made a request
+type Identity struct {
+	// Name is the user, or the token's name
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+	// TokenID is set for requests made with an API token
+	TokenID string `json:"token_id,omitempty"`
+}
+
+// String names the identity for logs, e.g. user:alice or token:ci/3f2a9c1d
+func (i Identity) String() string {
+	if i.TokenID != "" {
+		return "token:" + i.Name + "/" + i.TokenID
+	}
+	return "user:" + i.Name
+}
+
+// Store is the users and tokens, kept in a JSON file, and the sessions of
+// users who have logged in, kept in memory
+type Store struct {
+	path   string
+	mu     sync.Mutex
+	users  map[string]*User
+	tokens map[string]*Token
+
+	// SessionTTL is how long sessions last from login
+	SessionTTL time.Duration
+	sessions   map[string]*Session
+	failures   map[string][]time.Time
+
+	now func() time.Time
+}
+
+type storeFile struct {
+	Users  []*User  `json:"users"`
+	Tokens []*Token `json:"tokens"`
+}
+
+// NewStore loads the users and tokens in path, if it exists
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:       path,
+		users:      make(map[string]*User),
+		tokens:     make(map[string]*Token),
+		SessionTTL: DefaultSessionTTL,
+		sessions:   make(map[string]*Session),
+		failures:   make(map[string][]time.Time),
+		now:        time.Now,
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read users: %w", err)
+	}
+	var f storeFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("could not parse users %s: %w", path, err)
+	}
+	for _, u := range f.Users {
+		s.users[u.Name] = u
+	}
+	for _, t := range f.Tokens {
+		s.tokens[t.ID] = t
+	}
+	return s, nil
+}
+
+// Empty reports whether there are no users or tokens, so nobody can get in
+func (s *Store) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users) == 0 && len(s.tokens) == 0
+}
+
+// save writes the users and tokens out; callers hold s.mu
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	var f storeFile
+	for _, u := range s.users {
+		f.Users = append(f.Users, u)
+	}
+	for _, t := range s.tokens {
+		f.Tokens = append(f.Tokens, t)
+	}
+	sort.Slice(f.Users, func(i, j int) bool { return f.Users[i].Name < f.Users[j].Name })
+	sort.Slice(f.Tokens, func(i, j int) bool { return f.Tokens[i].ID < f.Tokens[j].ID })
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode users: %w", err)
+	}
+	if err := atomicfile.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("could not save users: %w", err)
+	}
+	return nil
+}
+
+// Users returns the users, without their password hashes, by name
+func (s *Store) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		c := *u
+		c.PasswordHash = ""
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// AddUser creates a user
+func (s *Store) AddUser(name string, password string, role Role) (User, error) {
+	if !nameRE.MatchString(name) {
+		return User{}, ErrInvalidName
+	}
+	if !role.Valid() {
+		return User{}, ErrInvalidRole
+	}
+	if len(password) < MinPasswordLength {
+		return User{}, ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return User{}, fmt.Errorf("could not hash password: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; ok {
+		return User{}, fmt.Errorf("user %s %w", name, ErrExists)
+	}
+	u := &User{Name: name, PasswordHash: string(hash), Role: role, Created: s.now().UTC()}
+	s.users[name] = u
+	if err := s.save(); err != nil {
+		delete(s.users, name)
+		return User{}, err
+	}
+	c := *u
+	c.PasswordHash = ""
+	return c, nil
+}
+
+// DeleteUser removes a user and ends their sessions
+func (s *Store) DeleteUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return fmt.Errorf("user %s %w", name, ErrNotFound)
+	}
+	delete(s.users, name)
+	if err := s.save(); err != nil {
+		s.users[name] = u
+		return err
+	}
+	for id, sess := range s.sessions {
+		if sess.User == name {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Tokens returns the tokens, without their hashes, by ID
+func (s *Store) Tokens() []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		c := *t
+		c.Hash = ""
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// AddToken creates a token, returning it and the secret to authenticate
+// with, which isn't kept
+func (s *Store) AddToken(name string, role Role) (Token, string, error) {
+	if !nameRE.MatchString(name) {
+		return Token{}, "", ErrInvalidName
+	}
+	if !role.Valid() {
+		return Token{}, "", ErrInvalidRole
+	}
+	id, err := randomString(4, hex.EncodeToString)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = tokenPrefix + id + "_" + secret
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[id]; ok {
+		return Token{}, "", fmt.Errorf("token %s %w", id, ErrExists)
+	}
+	t := &Token{ID: id, Name: name, Role: role, Hash: hashToken(secret), Created: s.now().UTC()}
+	s.tokens[id] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return Token{}, "", err
+	}
+	c := *t
+	c.Hash = ""
+	return c, secret, nil
+}
+
+// DeleteToken revokes a token
+func (s *Store) DeleteToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return fmt.Errorf("token %s %w", id, ErrNotFound)
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+	return nil
+}
+
+// token returns who secret, an API token, belongs to
+func (s *Store) token(secret string) (Identity, error) {
+	parts := strings.SplitN(strings.TrimPrefix(secret, tokenPrefix), "_", 2)
+	if !strings.HasPrefix(secret, tokenPrefix) || len(parts) != 2 {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(secret))) != 1 {
+		return Identity{}, ErrUnauthenticated
+	}
+	return Identity{Name: t.Name, Role: t.Role, TokenID: t.ID}, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate token: %w", err)
+	}
+	return encode(b), nil
+}
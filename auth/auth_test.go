@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	cost = bcrypt.MinCost
+}
+
+func testStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(filepath.Join(dir, "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestRoles(t *testing.T) {
+	tests := []struct {
+		role   Role
+		needs  Role
+		allows bool
+	}{
+		{RoleReadOnly, RoleReadOnly, true},
+		{RoleReadOnly, RoleOperator, false},
+		{RoleOperator, RoleReadOnly, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleOperator, true},
+		{Role("root"), RoleReadOnly, false},
+		{Role(""), RoleReadOnly, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allows, tt.role.Allows(tt.needs), "%s needs %s", tt.role, tt.needs)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	s, dir := testStore(t)
+	defer os.RemoveAll(dir)
+	assert.True(t, s.Empty())
+
+	u, err := s.AddUser("alice", "correct horse", RoleAdmin)
+	assert.Nil(t, err)
+	assert.Empty(t, u.PasswordHash)
+	_, err = s.AddUser("alice", "correct horse", RoleAdmin)
+	assert.True(t, errors.Is(err, ErrExists))
+	_, err = s.AddUser("bob", "short", RoleAdmin)
+	assert.True(t, errors.Is(err, ErrWeakPassword))
+	_, err = s.AddUser("bob", "long enough", "root")
+	assert.True(t, errors.Is(err, ErrInvalidRole))
+	_, err = s.AddUser("bob smith", "long enough", RoleOperator)
+	assert.True(t, errors.Is(err, ErrInvalidName))
+	assert.False(t, s.Empty())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "auth.json"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"password_hash": "$2a$`)
+	assert.NotContains(t, string(data), "correct horse")
+
+	s2, err := NewStore(filepath.Join(dir, "auth.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, []User{{Name: "alice", Role: RoleAdmin, Created: u.Created}}, s2.Users())
+
+	assert.Nil(t, s2.DeleteUser("alice"))
+	assert.True(t, errors.Is(s2.DeleteUser("alice"), ErrNotFound))
+}
+
+func TestLogin(t *testing.T) {
+	s, dir := testStore(t)
+	defer os.RemoveAll(dir)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	_, err := s.AddUser("alice", "correct horse", RoleOperator)
+	assert.Nil(t, err)
+
+	_, err = s.Login("alice", "wrong", "192.0.2.1:1234")
+	assert.Equal(t, ErrBadCredentials, err)
+	_, err = s.Login("mallory", "correct horse", "192.0.2.1:1234")
+	assert.Equal(t, ErrBadCredentials, err, "unknown users look like wrong passwords")
+
+	sess, err := s.Login("alice", "correct horse", "192.0.2.1:1234")
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(DefaultSessionTTL), sess.Expires)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: SessionCookie, Value: sess.ID})
+	id, err := s.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "alice", Role: RoleOperator}, id)
+	assert.Equal(t, "user:alice", id.String())
+	assert.Equal(t, sess.ID, SessionID(r))
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+sess.ID)
+	_, err = s.Authenticate(r)
+	assert.Nil(t, err, "sessions work as bearer tokens too")
+
+	now = now.Add(DefaultSessionTTL)
+	_, err = s.Authenticate(r)
+	assert.Equal(t, ErrUnauthenticated, err, "expired")
+
+	now = now.Add(time.Hour)
+	sess, err = s.Login("alice", "correct horse", "192.0.2.1:1234")
+	assert.Nil(t, err)
+	s.Logout(sess.ID)
+	r.Header.Set("Authorization", "Bearer "+sess.ID)
+	_, err = s.Authenticate(r)
+	assert.Equal(t, ErrUnauthenticated, err, "logged out")
+
+	sess, err = s.Login("alice", "correct horse", "192.0.2.1:1234")
+	assert.Nil(t, err)
+	assert.Nil(t, s.DeleteUser("alice"))
+	r.Header.Set("Authorization", "Bearer "+sess.ID)
+	_, err = s.Authenticate(r)
+	assert.Equal(t, ErrUnauthenticated, err, "deleted users' sessions end")
+}
+
+func TestRateLimit(t *testing.T) {
+	s, dir := testStore(t)
+	defer os.RemoveAll(dir)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	_, err := s.AddUser("alice", "correct horse", RoleAdmin)
+	assert.Nil(t, err)
+
+	for i := 0; i < MaxFailures; i++ {
+		_, err = s.Login("alice", "wrong", "192.0.2.1:1234")
+		assert.Equal(t, ErrBadCredentials, err)
+	}
+	_, err = s.Login("bob", "whatever", "192.0.2.1:5678")
+	assert.Equal(t, ErrRateLimited, err, "limited by address")
+	_, err = s.Login("alice", "correct horse", "198.51.100.1:1234")
+	assert.Nil(t, err, "guessing alice's password doesn't lock alice out")
+	assert.Equal(t, 0, s.failed("198.51.100.1", now), "logins that succeed aren't failures")
+
+	// logins checked at once can't get more than MaxFailures guesses
+	now = now.Add(FailureWindow)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	guesses := 0
+	for i := 0; i < 4*MaxFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Login("alice", "wrong", "192.0.2.1:1234"); err == ErrBadCredentials {
+				mu.Lock()
+				guesses++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, MaxFailures, guesses)
+}
+
+func TestTokens(t *testing.T) {
+	s, dir := testStore(t)
+	defer os.RemoveAll(dir)
+
+	tok, secret, err := s.AddToken("ci", RoleReadOnly)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(secret, "nanofi_"+tok.ID+"_"))
+	assert.Empty(t, tok.Hash)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "auth.json"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), secret, "only the hash is kept")
+
+	s2, err := NewStore(filepath.Join(dir, "auth.json"))
+	assert.Nil(t, err)
+	tests := []struct {
+		header string
+		err    error
+	}{
+		{"Bearer " + secret, nil},
+		{"Bearer " + secret + "x", ErrUnauthenticated},
+		{"Bearer nanofi_" + tok.ID, ErrUnauthenticated},
+		{"Basic " + secret, ErrUnauthenticated},
+		{"", ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		id, err := s2.Authenticate(r)
+		assert.Equal(t, tt.err, err, tt.header)
+		if err == nil {
+			assert.Equal(t, Identity{Name: "ci", Role: RoleReadOnly, TokenID: tok.ID}, id)
+			assert.Equal(t, "token:ci/"+tok.ID, id.String())
+		}
+	}
+
+	assert.Nil(t, s2.DeleteToken(tok.ID))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	_, err = s2.Authenticate(r)
+	assert.Equal(t, ErrUnauthenticated, err, "revoked")
+	assert.True(t, errors.Is(s2.DeleteToken(tok.ID), ErrNotFound))
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultSessionTTL is how long sessions last unless SessionTTL says
+// otherwise
+const DefaultSessionTTL = 12 * time.Hour
+
+// Failed logins from one address are limited to MaxFailures in
+// FailureWindow. Failures aren't counted by user, so guessing a user's
+// password can't lock them out.
+const (
+	MaxFailures   = 5
+	FailureWindow = 15 * time.Minute
+)
+
+// SessionCookie is the cookie sessions are kept in
+const SessionCookie = "nanofi_session"
+
+// Session is a logged in user
+type Session struct {
+	ID      string    `json:"-"`
+	User    string    `json:"user"`
+	Role    Role      `json:"role"`
+	Expires time.Time `json:"expires"`
+}
+
+// dummyHash is compared against for unknown users, so they take as long as
+// known ones
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// Login checks a user's password and starts a session. Logins from remote,
+// a host:port, are refused for a while after too many failures.
+func (s *Store) Login(user string, password string, remote string) (Session, error) {
+	addr := host(remote)
+	s.mu.Lock()
+	now := s.now()
+	if s.failed(addr, now) >= MaxFailures {
+		s.mu.Unlock()
+		return Session{}, ErrRateLimited
+	}
+	// count the attempt as a failure until it succeeds, so logins checked
+	// at the same time can't get past MaxFailures
+	s.failures[addr] = append(s.failures[addr], now)
+	hash := dummy()
+	u, ok := s.users[user]
+	if ok {
+		hash = []byte(u.PasswordHash)
+	}
+	s.mu.Unlock()
+
+	// bcrypt is slow on purpose, so it isn't done holding the lock
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil || !ok {
+		return Session{}, ErrBadCredentials
+	}
+	s.unfail(addr, now)
+
+	id, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return Session{}, err
+	}
+	sess := &Session{ID: id, User: u.Name, Role: u.Role, Expires: now.Add(s.SessionTTL).UTC()}
+	s.expire(now)
+	s.sessions[id] = sess
+	return *sess, nil
+}
+
+// failed counts the failures from addr within FailureWindow, forgetting
+// older ones; callers hold s.mu
+func (s *Store) failed(addr string, now time.Time) int {
+	recent := s.failures[addr][:0]
+	for _, t := range s.failures[addr] {
+		if now.Sub(t) < FailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(s.failures, addr)
+	} else {
+		s.failures[addr] = recent
+	}
+	return len(recent)
+}
+
+// unfail forgets one failure from addr at t; callers hold s.mu
+func (s *Store) unfail(addr string, t time.Time) {
+	failures := s.failures[addr]
+	for i := range failures {
+		if failures[i].Equal(t) {
+			s.failures[addr] = append(failures[:i], failures[i+1:]...)
+			break
+		}
+	}
+	if len(s.failures[addr]) == 0 {
+		delete(s.failures, addr)
+	}
+}
+
+// expire drops sessions that have expired; callers hold s.mu
+func (s *Store) expire(now time.Time) {
+	for id, sess := range s.sessions {
+		if !now.Before(sess.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Logout ends a session
+func (s *Store) Logout(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// session returns who session id belongs to, if it hasn't expired
+func (s *Store) session(id string) (Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(sess.ID), []byte(id)) != 1 {
+		return Identity{}, ErrUnauthenticated
+	}
+	if !s.now().Before(sess.Expires) {
+		delete(s.sessions, id)
+		return Identity{}, ErrUnauthenticated
+	}
+	return Identity{Name: sess.User, Role: sess.Role}, nil
+}
+
+// Authenticate returns who made r, from an API token or session given as
+// "Authorization: Bearer ...", or a session cookie
+func (s *Store) Authenticate(r *http.Request) (Identity, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		const bearer = "Bearer "
+		if !strings.HasPrefix(h, bearer) {
+			return Identity{}, ErrUnauthenticated
+		}
+		secret := strings.TrimSpace(strings.TrimPrefix(h, bearer))
+		if strings.HasPrefix(secret, tokenPrefix) {
+			return s.token(secret)
+		}
+		return s.session(secret)
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		return s.session(c.Value)
+	}
+	return Identity{}, ErrUnauthenticated
+}
+
+// SessionID returns the session r was made with, if any
+func SessionID(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		if secret := strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")); !strings.HasPrefix(secret, tokenPrefix) {
+			return secret
+		}
+		return ""
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying who made a request
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns who made a request, if it was authenticated
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+func dummy() []byte {
+	dummyOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), cost)
+	})
+	return dummyHash
+}
+
+// host drops the port from addr
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/catalog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/firmware"
+)
+
+// latestVersion in a bench target means the newest firmware in the catalog
+const latestVersion = "latest"
+
+// newBench sets up the bench pipeline to upgrade devices to targets and
+// appends results to resultsFile
+func newBench(devices *device.Registry, fw *firmware.Server, cat *catalog.Catalog, targets map[string]bench.Target, resultsFile string, retries int, timeout time.Duration) (*bench.Pipeline, error) {
+	if err := resolveTargets(targets, fw, cat); err != nil {
+		return nil, err
+	}
+
+	results, err := os.OpenFile(resultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open bench results: %w", err)
+	}
+
+	cfg := bench.Config{
+		Targets: targets,
+		Retries: retries,
+		Timeout: timeout,
+	}
+	return bench.NewPipeline(cfg, devices, results), nil
+}
+
+// loadBenchTargets reads a JSON map of device model to firmware target
+func loadBenchTargets(file string) (map[string]bench.Target, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read bench targets: %w", err)
+	}
+	targets := make(map[string]bench.Target)
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("could not parse bench targets %s: %w", file, err)
+	}
+	return targets, nil
+}
+
+// resolveTargets fills in the URL of targets that have none from the local
+// firmware repository, resolving a version of "latest" through the catalog
+func resolveTargets(targets map[string]bench.Target, fw *firmware.Server, cat *catalog.Catalog) error {
+	for model, t := range targets {
+		if t.URL != "" {
+			continue
+		}
+		if fw == nil {
+			return fmt.Errorf("firmware target for %s has no url and no firmware repository is configured", model)
+		}
+
+		var img firmware.Image
+		var err error
+		if t.Version == latestVersion {
+			if cat == nil {
+				return fmt.Errorf("firmware target for %s wants the latest firmware but no catalog is configured", model)
+			}
+			e, err := cat.Latest(model)
+			if err != nil {
+				return err
+			}
+			img, err = cat.Fetch(context.Background(), e)
+			if err != nil {
+				return err
+			}
+			t.Version = img.Version
+		} else {
+			img, err = fw.Repository().Lookup(model, t.Version)
+			if err != nil {
+				return err
+			}
+		}
+		t.URL = fw.URL(img)
+		t.MD5Sum = img.MD5
+		targets[model] = t
+	}
+	return nil
+}
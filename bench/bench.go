@@ -0,0 +1,323 @@
+// Package bench implements the unattended adopt, upgrade, default
+// pipeline for preparing devices on a staging bench before deployment.
+//
+// Every device that informs while the pipeline runs is walked through:
+//
+//	adopt   - hand the device its own authkey via setparam
+//	upgrade - send an upgrade and wait for it to reboot onto the target
+//	reset   - send set-default and wait for it to come back at defaults
+//
+// Each step is retried when the device doesn't get there in time, and a
+// result is recorded once the device is done or has failed.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/version"
+)
+
+// Stage is a step of the bench pipeline
+type Stage string
+
+// Pipeline stages, in order
+const (
+	StageAdopt   Stage = "adopt"
+	StageUpgrade Stage = "upgrade"
+	StageReset   Stage = "reset"
+	StageDone    Stage = "done"
+	StageFailed  Stage = "failed"
+)
+
+// Target is the firmware a model should be upgraded to
+type Target struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	MD5Sum  string `json:"md5sum"`
+	// When further limits upgrades to devices whose version matches, e.g.
+	// "4.x"; devices are never downgraded either way
+	When *version.Constraint `json:"when,omitempty"`
+}
+
+// NeedsUpgrade reports whether a device on current should be upgraded
+func (t Target) NeedsUpgrade(current string) bool {
+	if version.Compare(current, t.Version) >= 0 {
+		return false
+	}
+	return t.When == nil || t.When.MatchString(current)
+}
+
+// Reached reports whether a device on current is running the target
+func (t Target) Reached(current string) bool {
+	return version.Compare(current, t.Version) == 0
+}
+
+// Config controls how the pipeline treats devices
+type Config struct {
+	// Targets maps device model (as reported in inform) to firmware
+	Targets map[string]Target
+	// Retries is how many times a stage is retried before giving up
+	Retries int
+	// Timeout is how long to wait for a device to finish a stage
+	Timeout time.Duration
+}
+
+// Result is the outcome of running a device through the pipeline
+type Result struct {
+	MAC         string    `json:"mac"`
+	Model       string    `json:"model"`
+	Serial      string    `json:"serial"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Stage       Stage     `json:"stage"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+}
+
+// Pipeline tracks every device going through the bench
+type Pipeline struct {
+	mu      sync.Mutex
+	cfg     Config
+	devices *device.Registry
+	results io.Writer
+	runs    map[string]*run
+	now     func() time.Time
+}
+
+type run struct {
+	result   Result
+	stage    Stage
+	target   Target
+	attempts int
+	sentAt   time.Time
+}
+
+// NewPipeline creates a bench pipeline. Results are written to results as
+// JSON lines when each device finishes; results may be nil.
+func NewPipeline(cfg Config, devices *device.Registry, results io.Writer) *Pipeline {
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Minute
+	}
+
+	return &Pipeline{
+		cfg:     cfg,
+		devices: devices,
+		results: results,
+		runs:    make(map[string]*run),
+		now:     time.Now,
+	}
+}
+
+// Handle advances dev through the pipeline given its state before this
+// inform (prev). It returns the response to send, or nil if the device
+// has nothing left to do.
+func (p *Pipeline) Handle(dev device.Device, prev device.Device) inform.Response {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	r, ok := p.runs[dev.MAC]
+	if !ok {
+		r = &run{
+			stage: StageAdopt,
+			result: Result{
+				MAC:         dev.MAC,
+				Model:       dev.Model,
+				Serial:      dev.Serial,
+				FromVersion: dev.Version,
+				Started:     now,
+			},
+		}
+		p.runs[dev.MAC] = r
+
+		target, ok := p.cfg.Targets[dev.Model]
+		if !ok {
+			p.finish(r, StageFailed, fmt.Errorf("no firmware target for model %s", dev.Model))
+			return nil
+		}
+		r.target = target
+		r.result.ToVersion = target.Version
+
+		if !target.NeedsUpgrade(dev.Version) && dev.Default {
+			glog.Infof("bench: %s already on %s at defaults", dev.MAC, dev.Version)
+			p.finish(r, StageDone, nil)
+			return nil
+		}
+		glog.Infof("bench: %s (%s) starting on %s, target %s", dev.MAC, dev.Model, dev.Version, target.Version)
+	}
+
+	switch r.stage {
+	case StageAdopt:
+		return p.adopt(r, dev, now)
+	case StageUpgrade:
+		return p.upgrade(r, dev, prev, now)
+	case StageReset:
+		return p.reset(r, dev, now)
+	}
+
+	return nil
+}
+
+// Results returns the results of all devices that have finished
+func (p *Pipeline) Results() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var out []Result
+	for _, r := range p.runs {
+		if r.stage == StageDone || r.stage == StageFailed {
+			out = append(out, r.result)
+		}
+	}
+	return out
+}
+
+// Active reports whether mac is part way through the pipeline
+func (p *Pipeline) Active(mac string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.runs[mac]
+	return ok && r.stage != StageDone && r.stage != StageFailed
+}
+
+func (p *Pipeline) adopt(r *run, dev device.Device, now time.Time) inform.Response {
+	if dev.Adopted {
+		glog.Infof("bench: %s adopted", dev.MAC)
+		p.advance(r, StageUpgrade)
+		if !r.target.NeedsUpgrade(dev.Version) {
+			p.advance(r, StageReset)
+			return p.reset(r, dev, now)
+		}
+		return p.upgrade(r, dev, dev, now)
+	}
+
+	if !p.due(r, now) {
+		return nil
+	}
+	if err := p.retry(r, now); err != nil {
+		return nil
+	}
+
+	// retries resend the key already sent, in case the device took it but
+	// hasn't informed with it yet
+	key := dev.AuthKey
+	if key == "" {
+		var err error
+		if key, err = inform.NewAuthKey(); err != nil {
+			glog.Errorf("bench: %s: %s", dev.MAC, err)
+			return nil
+		}
+		if _, err := p.devices.Update(dev.MAC, func(d *device.Device) { d.AuthKey = key }); err != nil {
+			glog.Errorf("bench: %s: could not store authkey: %s", dev.MAC, err)
+			return nil
+		}
+	}
+
+	glog.Infof("bench: %s sending adoption (attempt %d)", dev.MAC, r.attempts)
+	return inform.NewSetParamResponse(inform.MgmtCfg(key, inform.InitialCfgVersion), "")
+}
+
+func (p *Pipeline) upgrade(r *run, dev device.Device, prev device.Device, now time.Time) inform.Response {
+	if r.target.Reached(dev.Version) {
+		glog.Infof("bench: %s upgraded to %s", dev.MAC, dev.Version)
+		p.advance(r, StageReset)
+		return p.reset(r, dev, now)
+	}
+
+	if !r.sentAt.IsZero() && dev.Rebooted(prev) {
+		glog.Warningf("bench: %s rebooted on %s, wanted %s", dev.MAC, dev.Version, r.target.Version)
+		r.sentAt = time.Time{}
+	}
+	if !p.due(r, now) {
+		return nil
+	}
+	if err := p.retry(r, now); err != nil {
+		return nil
+	}
+
+	glog.Infof("bench: %s sending upgrade to %s (attempt %d)", dev.MAC, r.target.Version, r.attempts)
+	return inform.NewUpgradeResponse(r.target.URL, r.target.Version, r.target.MD5Sum)
+}
+
+func (p *Pipeline) reset(r *run, dev device.Device, now time.Time) inform.Response {
+	if !r.sentAt.IsZero() && dev.Default && !dev.Adopted {
+		if r.target.NeedsUpgrade(dev.Version) {
+			p.finish(r, StageFailed, fmt.Errorf("came back from reset on %s", dev.Version))
+			return nil
+		}
+		glog.Infof("bench: %s back at defaults on %s", dev.MAC, dev.Version)
+		p.finish(r, StageDone, nil)
+		return nil
+	}
+
+	if !p.due(r, now) || !dev.Adopted {
+		return nil
+	}
+	if err := p.retry(r, now); err != nil {
+		return nil
+	}
+
+	glog.Infof("bench: %s sending set-default (attempt %d)", dev.MAC, r.attempts)
+	return inform.NewSetDefaultResponse()
+}
+
+// due reports whether the current stage's command should be (re)sent
+func (p *Pipeline) due(r *run, now time.Time) bool {
+	return r.sentAt.IsZero() || now.Sub(r.sentAt) >= p.cfg.Timeout
+}
+
+// retry counts an attempt at the current stage, failing the run once
+// retries are exhausted
+func (p *Pipeline) retry(r *run, now time.Time) error {
+	if r.attempts > p.cfg.Retries {
+		err := fmt.Errorf("%s did not complete after %d attempts", r.stage, r.attempts)
+		p.finish(r, StageFailed, err)
+		return err
+	}
+	r.attempts++
+	r.result.Attempts++
+	r.sentAt = now
+	return nil
+}
+
+func (p *Pipeline) advance(r *run, stage Stage) {
+	r.stage = stage
+	r.attempts = 0
+	r.sentAt = time.Time{}
+}
+
+func (p *Pipeline) finish(r *run, stage Stage, err error) {
+	failedAt := r.stage
+	r.stage = stage
+	r.result.Stage = stage
+	r.result.Finished = p.now()
+	if err != nil {
+		r.result.Error = fmt.Sprintf("%s: %s", failedAt, err)
+		glog.Errorf("bench: %s failed: %s", r.result.MAC, r.result.Error)
+	}
+
+	if p.results == nil {
+		return
+	}
+	line, err := json.Marshal(r.result)
+	if err != nil {
+		glog.Errorf("bench: could not encode result for %s: %s", r.result.MAC, err)
+		return
+	}
+	if _, err := p.results.Write(append(line, '\n')); err != nil {
+		glog.Errorf("bench: could not record result for %s: %s", r.result.MAC, err)
+	}
+}
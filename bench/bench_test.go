@@ -0,0 +1,185 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/version"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMAC = "74:83:c2:0f:15:b0"
+
+var testTarget = Target{Version: "2.0.9.1234", URL: "http://fw/usmini.bin", MD5Sum: "d41d8cd98f00b204e9800998ecf8427e"}
+
+type bench struct {
+	t       *testing.T
+	p       *Pipeline
+	reg     *device.Registry
+	results *bytes.Buffer
+	now     time.Time
+	info    inform.Info
+}
+
+func newBench(t *testing.T, retries int) *bench {
+	reg, err := device.NewRegistry("")
+	assert.Nil(t, err)
+	b := &bench{
+		t:       t,
+		reg:     reg,
+		results: &bytes.Buffer{},
+		now:     time.Unix(1600000000, 0),
+		info: inform.Info{
+			MAC: testMAC, Model: "USMINI", Version: "1.6.1.525",
+			Default: true, Uptime: 100,
+		},
+	}
+	cfg := Config{
+		Targets: map[string]Target{"USMINI": testTarget},
+		Retries: retries,
+		Timeout: time.Minute,
+	}
+	b.p = NewPipeline(cfg, reg, b.results)
+	b.p.now = func() time.Time { return b.now }
+	return b
+}
+
+// inform simulates the device informing, adopted meaning it used its own key
+func (b *bench) inform(adopted bool) inform.Response {
+	b.now = b.now.Add(10 * time.Second)
+	cur, prev, err := b.reg.Observe(b.info.MAC, b.info, adopted)
+	assert.Nil(b.t, err)
+	return b.p.Handle(cur, prev)
+}
+
+func TestPipelineHappyPath(t *testing.T) {
+	b := newBench(t, 1)
+
+	res := b.inform(false)
+	sp, ok := res.(inform.SetParamResponse)
+	assert.True(t, ok, "unadopted device should be sent setparam")
+	assert.True(t, b.p.Active(testMAC))
+	d, _ := b.reg.Get(testMAC)
+	assert.Contains(t, sp.MgmtCfg, "authkey="+d.AuthKey)
+
+	b.info.Default = false
+	b.info.Uptime += 10
+	res = b.inform(true)
+	up, ok := res.(inform.UpgradeResponse)
+	assert.True(t, ok, "adopted device should be sent upgrade")
+	assert.Equal(t, testTarget.URL, up.URL)
+
+	b.info.Uptime += 10
+	assert.Nil(t, b.inform(true), "nothing to do while upgrade is in flight")
+
+	b.info.Version = testTarget.Version
+	b.info.Uptime = 20
+	res = b.inform(true)
+	_, ok = res.(inform.SetDefaultResponse)
+	assert.True(t, ok, "upgraded device should be reset")
+
+	b.info.Default = true
+	b.info.Uptime = 15
+	assert.Nil(t, b.inform(false))
+
+	results := b.p.Results()
+	assert.Len(t, results, 1)
+	assert.Equal(t, StageDone, results[0].Stage)
+	assert.Equal(t, "1.6.1.525", results[0].FromVersion)
+	assert.Equal(t, 3, results[0].Attempts)
+
+	var recorded Result
+	assert.Nil(t, json.Unmarshal(b.results.Bytes(), &recorded))
+	assert.Equal(t, StageDone, recorded.Stage)
+
+	assert.Nil(t, b.inform(false), "finished devices are left alone")
+	assert.False(t, b.p.Active(testMAC))
+}
+
+func TestPipelineUpgradeRetry(t *testing.T) {
+	b := newBench(t, 1)
+	b.inform(false)
+	b.info.Default = false
+	_, ok := b.inform(true).(inform.UpgradeResponse)
+	assert.True(t, ok)
+
+	// device reboots but is still on the old version
+	b.info.Uptime = 5
+	_, ok = b.inform(true).(inform.UpgradeResponse)
+	assert.True(t, ok, "failed upgrade should be retried")
+
+	b.info.Uptime = 4
+	assert.Nil(t, b.inform(true), "retries exhausted")
+
+	results := b.p.Results()
+	assert.Len(t, results, 1)
+	assert.Equal(t, StageFailed, results[0].Stage)
+	assert.Contains(t, results[0].Error, "upgrade")
+}
+
+func TestPipelineAdoptRetry(t *testing.T) {
+	b := newBench(t, 1)
+	first, ok := b.inform(false).(inform.SetParamResponse)
+	assert.True(t, ok)
+
+	b.now = b.now.Add(2 * time.Minute)
+	again, ok := b.inform(false).(inform.SetParamResponse)
+	assert.True(t, ok, "adoption is resent")
+	assert.Equal(t, first.MgmtCfg, again.MgmtCfg, "with the same authkey")
+}
+
+func TestPipelineAdoptTimeout(t *testing.T) {
+	b := newBench(t, 0)
+	_, ok := b.inform(false).(inform.SetParamResponse)
+	assert.True(t, ok)
+	assert.Nil(t, b.inform(false), "wait for adoption before resending")
+
+	b.now = b.now.Add(2 * time.Minute)
+	assert.Nil(t, b.inform(false))
+	assert.Equal(t, StageFailed, b.p.Results()[0].Stage)
+}
+
+func TestPipelineUnknownModel(t *testing.T) {
+	b := newBench(t, 1)
+	b.info.Model = "U7PG2"
+	assert.Nil(t, b.inform(false))
+	assert.Contains(t, b.p.Results()[0].Error, "no firmware target")
+}
+
+func TestPipelineUpgradePolicy(t *testing.T) {
+	test := []struct {
+		Version string
+		When    string
+		Upgrade bool
+	}{
+		{"1.6.1.525", "", true},
+		{"3.0.0.1", "", false},
+		{"1.6.1.525", "1.5.x", false},
+		{"1.5.0.1", "1.5.x", true},
+		{"3.0.0.1", ">= 1.0", false},
+	}
+
+	for _, tc := range test {
+		b := newBench(t, 1)
+		b.info.Version = tc.Version
+		b.info.Default = false
+		target := testTarget
+		if tc.When != "" {
+			target.When = version.MustParseConstraint(tc.When)
+		}
+		b.p.cfg.Targets["USMINI"] = target
+
+		_, ok := b.inform(false).(inform.SetParamResponse)
+		assert.True(t, ok, "%s %s: should be adopted", tc.Version, tc.When)
+
+		res := b.inform(true)
+		_, upgrade := res.(inform.UpgradeResponse)
+		_, reset := res.(inform.SetDefaultResponse)
+		assert.Equal(t, tc.Upgrade, upgrade, "%s %s: upgrade", tc.Version, tc.When)
+		assert.Equal(t, !tc.Upgrade, reset, "%s %s: skip straight to reset", tc.Version, tc.When)
+	}
+}
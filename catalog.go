@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/catalog"
+	"github.com/jda/nanofi/firmware"
+)
+
+// startCatalog syncs the firmware repository behind fw with the remote
+// index once, then keeps it in sync every interval
+func startCatalog(fw *firmware.Server, url string, channel string, models string, interval time.Duration) (*catalog.Catalog, error) {
+	if fw == nil {
+		return nil, fmt.Errorf("the firmware catalog needs -firmware-dir to download into")
+	}
+
+	cfg := catalog.Config{
+		URL:       url,
+		Channel:   channel,
+		StateFile: filepath.Join(fw.Repository().Root(), ".catalog.json"),
+	}
+	c, err := catalog.New(cfg, fw.Repository())
+	if err != nil {
+		return nil, err
+	}
+
+	var want []string
+	for _, m := range strings.Split(models, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			want = append(want, m)
+		}
+	}
+
+	if err := c.Sync(context.Background(), want); err != nil {
+		// a stale cache is still useful, so carry on
+		glog.Errorf("catalog: initial sync failed: %s", err)
+	}
+
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				if err := c.Sync(context.Background(), want); err != nil {
+					glog.Errorf("catalog: sync failed: %s", err)
+				}
+			}
+		}()
+	}
+
+	return c, nil
+}
@@ -0,0 +1,394 @@
+// Package catalog keeps the local firmware repository in sync with a
+// remote firmware index in the format of Ubiquiti's firmware update feed,
+// so the latest firmware for a model can be resolved and cached without
+// anyone downloading images by hand.
+package catalog
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/firmware"
+	"github.com/jda/nanofi/version"
+)
+
+// DefaultChannel is the release channel used when none is configured
+const DefaultChannel = "release"
+
+// ErrNotFound is returned when the index has no firmware for a model
+var ErrNotFound = errors.New("no firmware in catalog")
+
+// ErrChecksum is returned when a downloaded image doesn't match the index
+var ErrChecksum = errors.New("firmware checksum mismatch")
+
+// ErrInvalidEntry is returned for index entries whose platform, version or
+// file name can't safely be used as a path in the repository
+var ErrInvalidEntry = errors.New("invalid firmware entry")
+
+// safeName matches the platform, version and file name of an entry, which
+// become paths in the repository
+var safeName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validName reports whether s is safe as a single path element
+func validName(s string) bool {
+	return safeName.MatchString(s) && !strings.Contains(s, "..")
+}
+
+// Entry is one firmware release listed in the index
+type Entry struct {
+	ID       string    `json:"id"`
+	Channel  string    `json:"channel"`
+	Product  string    `json:"product"`
+	Platform string    `json:"platform"`
+	Version  string    `json:"version"`
+	FileSize int64     `json:"file_size"`
+	SHA256   string    `json:"sha256_checksum"`
+	MD5      string    `json:"md5"`
+	Created  time.Time `json:"created"`
+	Links    struct {
+		Data struct {
+			Href string `json:"href"`
+		} `json:"data"`
+	} `json:"_links"`
+}
+
+// URL is where the image for this entry can be downloaded
+func (e Entry) URL() string {
+	return e.Links.Data.Href
+}
+
+// FirmwareVersion is the entry version in the form devices report it, e.g.
+// v4.3.28+11361.210526.1345 becomes 4.3.28.11361
+func (e Entry) FirmwareVersion() string {
+	v, err := version.Parse(e.Version)
+	if err != nil {
+		return strings.TrimSpace(e.Version)
+	}
+	return v.String()
+}
+
+type index struct {
+	Embedded struct {
+		Firmware []Entry `json:"firmware"`
+	} `json:"_embedded"`
+}
+
+// Config controls where the catalog comes from and where it keeps state
+type Config struct {
+	// URL of the JSON firmware index
+	URL string
+	// Channel to take releases from; defaults to release
+	Channel string
+	// StateFile caches the index and its validators between runs
+	StateFile string
+	// Client is used for all requests; defaults to http.DefaultClient
+	Client *http.Client
+}
+
+type state struct {
+	ETag         string  `json:"etag"`
+	LastModified string  `json:"last_modified"`
+	Entries      []Entry `json:"entries"`
+}
+
+// Catalog is a cached copy of the remote index plus the means to fetch
+// images from it into a firmware repository
+type Catalog struct {
+	cfg  Config
+	repo *firmware.Repository
+
+	mu    sync.RWMutex
+	state state
+}
+
+// New creates a catalog that downloads into repo, loading any index cached
+// in cfg.StateFile
+func New(cfg Config, repo *firmware.Repository) (*Catalog, error) {
+	if cfg.Channel == "" {
+		cfg.Channel = DefaultChannel
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	c := &Catalog{cfg: cfg, repo: repo}
+	if cfg.StateFile == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.StateFile)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read catalog state: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return nil, fmt.Errorf("could not parse catalog state %s: %w", cfg.StateFile, err)
+	}
+
+	return c, nil
+}
+
+// Refresh fetches the index if it has changed since the last fetch,
+// reporting whether it had
+func (c *Catalog) Refresh(ctx context.Context) (changed bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	c.mu.RLock()
+	if c.state.ETag != "" {
+		req.Header.Set("If-None-Match", c.state.ETag)
+	}
+	if c.state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", c.state.LastModified)
+	}
+	c.mu.RUnlock()
+
+	res, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not fetch firmware index: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		glog.V(1).Infof("catalog: index unchanged")
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("could not fetch firmware index: %s", res.Status)
+	}
+
+	var idx index
+	if err := json.NewDecoder(res.Body).Decode(&idx); err != nil {
+		return false, fmt.Errorf("could not parse firmware index: %w", err)
+	}
+
+	c.mu.Lock()
+	c.state = state{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Entries:      idx.Embedded.Firmware,
+	}
+	err = c.save()
+	c.mu.Unlock()
+	glog.Infof("catalog: index lists %d releases", len(idx.Embedded.Firmware))
+
+	return true, err
+}
+
+// save writes the cached index; callers hold c.mu
+func (c *Catalog) save() error {
+	if c.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.cfg.StateFile, data, 0644); err != nil {
+		return fmt.Errorf("could not save catalog state: %w", err)
+	}
+	return nil
+}
+
+// Latest returns the newest release for model on the configured channel
+func (c *Catalog) Latest(model string) (Entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var best Entry
+	found := false
+	for _, e := range c.state.Entries {
+		if e.Platform != model || e.Channel != c.cfg.Channel {
+			continue
+		}
+		if !found || version.Compare(e.FirmwareVersion(), best.FirmwareVersion()) > 0 {
+			best = e
+			found = true
+		}
+	}
+	if !found {
+		return best, fmt.Errorf("%w for %s on %s", ErrNotFound, model, c.cfg.Channel)
+	}
+	return best, nil
+}
+
+// Fetch makes sure the image for e is in the repository, downloading it
+// (resuming any earlier partial download) and verifying its checksums
+func (c *Catalog) Fetch(ctx context.Context, e Entry) (firmware.Image, error) {
+	fwVersion := e.FirmwareVersion()
+	if !validName(e.Platform) || !validName(fwVersion) {
+		return firmware.Image{}, fmt.Errorf("%w: platform %q, version %q", ErrInvalidEntry, e.Platform, fwVersion)
+	}
+	if img, err := c.repo.Lookup(e.Platform, fwVersion); err == nil {
+		return img, nil
+	}
+
+	name := path.Base(e.URL())
+	if name == "." || name == "/" || !strings.HasSuffix(name, ".bin") {
+		name = e.Platform + "-" + fwVersion + ".bin"
+	}
+	if !validName(name) {
+		return firmware.Image{}, fmt.Errorf("%w: file name %q", ErrInvalidEntry, name)
+	}
+	dir := filepath.Join(c.repo.Root(), e.Platform, fwVersion)
+	if rel, err := filepath.Rel(c.repo.Root(), dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return firmware.Image{}, fmt.Errorf("%w: %s is outside the repository", ErrInvalidEntry, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return firmware.Image{}, fmt.Errorf("could not create firmware directory: %w", err)
+	}
+	dest := filepath.Join(dir, name)
+
+	if err := c.download(ctx, e, dest+".part"); err != nil {
+		return firmware.Image{}, err
+	}
+	if err := os.Rename(dest+".part", dest); err != nil {
+		return firmware.Image{}, fmt.Errorf("could not move firmware into place: %w", err)
+	}
+
+	if err := c.repo.Rescan(); err != nil {
+		return firmware.Image{}, err
+	}
+	return c.repo.Lookup(e.Platform, fwVersion)
+}
+
+// download fetches e to part, resuming from whatever is already there
+func (c *Catalog) download(ctx context.Context, e Entry, part string) error {
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open download: %w", err)
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.URL(), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	res, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download %s: %w", e.URL(), err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		glog.Infof("catalog: resuming %s at %d bytes", e.URL(), offset)
+	case http.StatusOK:
+		// server ignored the range, start over
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		glog.Infof("catalog: downloading %s", e.URL())
+	case http.StatusRequestedRangeNotSatisfiable:
+		// already have all of it
+	default:
+		return fmt.Errorf("could not download %s: %s", e.URL(), res.Status)
+	}
+
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err := io.Copy(f, res.Body); err != nil {
+			return fmt.Errorf("download of %s interrupted: %w", e.URL(), err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := verify(part, e); err != nil {
+		// a bad download can't be resumed into a good one
+		os.Remove(part)
+		return err
+	}
+	return nil
+}
+
+// verify checks the file at path against the size and checksums in e
+func verify(path string, e Entry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sha := sha256.New()
+	md := md5.New()
+	size, err := io.Copy(io.MultiWriter(sha, md), f)
+	if err != nil {
+		return err
+	}
+
+	if e.FileSize > 0 && size != e.FileSize {
+		return fmt.Errorf("%w: %s is %d bytes, want %d", ErrChecksum, e.URL(), size, e.FileSize)
+	}
+	if err := match("sha256", sha, e.SHA256, e); err != nil {
+		return err
+	}
+	return match("md5", md, e.MD5, e)
+}
+
+func match(name string, h hash.Hash, want string, e Entry) error {
+	if want == "" {
+		return nil
+	}
+	if have := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(have, want) {
+		return fmt.Errorf("%w: %s %s is %s, want %s", ErrChecksum, e.URL(), name, have, want)
+	}
+	return nil
+}
+
+// Sync refreshes the index and fetches the latest firmware for each model
+func (c *Catalog) Sync(ctx context.Context, models []string) error {
+	if _, err := c.Refresh(ctx); err != nil {
+		return err
+	}
+
+	for _, model := range models {
+		e, err := c.Latest(model)
+		if err != nil {
+			glog.Warningf("catalog: %s", err)
+			continue
+		}
+		img, err := c.Fetch(ctx, e)
+		if err != nil {
+			return fmt.Errorf("could not fetch %s %s: %w", model, e.Version, err)
+		}
+		glog.Infof("catalog: latest for %s is %s (%s)", model, img.Version, img.Path)
+	}
+
+	return nil
+}
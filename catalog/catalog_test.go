@@ -0,0 +1,199 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/firmware"
+	"github.com/stretchr/testify/assert"
+)
+
+var testImage = bytes.Repeat([]byte("firmware"), 512)
+
+// feed stands in for the remote firmware index and CDN
+type feed struct {
+	t          *testing.T
+	srv        *httptest.Server
+	indexHits  int
+	notMod     int
+	ranges     []string
+	corruptSHA bool
+}
+
+func newFeed(t *testing.T) *feed {
+	f := &feed{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/firmware", f.index)
+	mux.HandleFunc("/fw/", func(w http.ResponseWriter, r *http.Request) {
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "fw.bin", time.Unix(1600000000, 0), bytes.NewReader(testImage))
+	})
+	f.srv = httptest.NewServer(mux)
+	return f
+}
+
+func (f *feed) index(w http.ResponseWriter, r *http.Request) {
+	f.indexHits++
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		f.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	sha := sha256.Sum256(testImage)
+	shaHex := hex.EncodeToString(sha[:])
+	if f.corruptSHA {
+		shaHex = "00" + shaHex[2:]
+	}
+	md := md5.Sum(testImage)
+
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"_embedded":{"firmware":[
+		{"id":"a","channel":"release","product":"unifi-firmware","platform":"U7PG2","version":"v4.3.20+11298.200704.1347",
+		 "file_size":%d,"sha256_checksum":"%s","md5":"%s","_links":{"data":{"href":"%s/fw/U7PG2/BZ.qca956x.v4.3.20.11298.200704.1347.bin"}}},
+		{"id":"b","channel":"release","product":"unifi-firmware","platform":"U7PG2","version":"v4.3.28+11361.210526.1345",
+		 "file_size":%d,"sha256_checksum":"%s","md5":"%s","_links":{"data":{"href":"%s/fw/U7PG2/BZ.qca956x.v4.3.28.11361.210526.1345.bin"}}},
+		{"id":"c","channel":"beta","product":"unifi-firmware","platform":"U7PG2","version":"v6.0.0+12000.210601.0000",
+		 "file_size":1,"_links":{"data":{"href":"%s/fw/beta.bin"}}},
+		{"id":"d","channel":"release","product":"unifi-firmware","platform":"US8P60","version":"v4.3.10+9999.200101.0000",
+		 "file_size":1,"_links":{"data":{"href":"%s/fw/US8P60/US.bcm5334x.bin"}}}
+	]}}`, len(testImage), shaHex, hex.EncodeToString(md[:]), f.srv.URL,
+		len(testImage), shaHex, hex.EncodeToString(md[:]), f.srv.URL, f.srv.URL, f.srv.URL)
+}
+
+func newCatalog(t *testing.T, f *feed) (*Catalog, string) {
+	dir, err := ioutil.TempDir("", "nanofi-catalog")
+	assert.Nil(t, err)
+	repo, err := firmware.NewRepository(dir)
+	assert.Nil(t, err)
+
+	c, err := New(Config{URL: f.srv.URL + "/api/firmware", StateFile: filepath.Join(dir, ".catalog.json")}, repo)
+	assert.Nil(t, err)
+	return c, dir
+}
+
+func TestRefreshConditional(t *testing.T) {
+	f := newFeed(t)
+	defer f.srv.Close()
+	c, dir := newCatalog(t, f)
+	defer os.RemoveAll(dir)
+
+	changed, err := c.Refresh(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	changed, err = c.Refresh(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, changed, "second fetch should be answered with 304")
+	assert.Equal(t, 1, f.notMod)
+
+	// validators and entries survive a restart
+	c2, err := New(c.cfg, c.repo)
+	assert.Nil(t, err)
+	_, err = c2.Latest("U7PG2")
+	assert.Nil(t, err)
+	changed, err = c2.Refresh(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, changed)
+}
+
+func TestLatest(t *testing.T) {
+	f := newFeed(t)
+	defer f.srv.Close()
+	c, dir := newCatalog(t, f)
+	defer os.RemoveAll(dir)
+
+	_, err := c.Refresh(context.Background())
+	assert.Nil(t, err)
+
+	e, err := c.Latest("U7PG2")
+	assert.Nil(t, err)
+	assert.Equal(t, "4.3.28.11361", e.FirmwareVersion(), "beta releases are ignored on release channel")
+
+	_, err = c.Latest("U7NHD")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestFetchResume(t *testing.T) {
+	f := newFeed(t)
+	defer f.srv.Close()
+	c, dir := newCatalog(t, f)
+	defer os.RemoveAll(dir)
+
+	_, err := c.Refresh(context.Background())
+	assert.Nil(t, err)
+	e, _ := c.Latest("U7PG2")
+
+	// pretend an earlier download got halfway
+	vdir := filepath.Join(dir, "U7PG2", "4.3.28.11361")
+	assert.Nil(t, os.MkdirAll(vdir, 0755))
+	part := filepath.Join(vdir, "BZ.qca956x.v4.3.28.11361.210526.1345.bin.part")
+	assert.Nil(t, ioutil.WriteFile(part, testImage[:1000], 0644))
+
+	img, err := c.Fetch(context.Background(), e)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bytes=1000-"}, f.ranges)
+	assert.Equal(t, "U7PG2/4.3.28.11361/BZ.qca956x.v4.3.28.11361.210526.1345.bin", img.Path)
+	assert.Equal(t, int64(len(testImage)), img.Size)
+
+	_, err = os.Stat(part)
+	assert.True(t, os.IsNotExist(err), "partial file should be renamed into place")
+
+	// already cached, so no new download
+	_, err = c.Fetch(context.Background(), e)
+	assert.Nil(t, err)
+	assert.Len(t, f.ranges, 1)
+}
+
+func TestFetchBadChecksum(t *testing.T) {
+	f := newFeed(t)
+	f.corruptSHA = true
+	defer f.srv.Close()
+	c, dir := newCatalog(t, f)
+	defer os.RemoveAll(dir)
+
+	err := c.Sync(context.Background(), []string{"U7PG2"})
+	assert.True(t, errors.Is(err, ErrChecksum))
+	_, err = c.repo.Lookup("U7PG2", "4.3.28.11361")
+	assert.True(t, errors.Is(err, firmware.ErrNoImage), "bad image must not reach the repository")
+}
+
+func TestFetchTraversal(t *testing.T) {
+	f := newFeed(t)
+	defer f.srv.Close()
+	c, dir := newCatalog(t, f)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		platform string
+		version  string
+		href     string
+	}{
+		{"platform", "../../tmp", "v4.3.28+11361.210526.1345", "/fw/a.bin"},
+		{"platform dots", "..", "v4.3.28+11361.210526.1345", "/fw/a.bin"},
+		{"version", "U7PG2", "../../../tmp", "/fw/a.bin"},
+		{"file name", "U7PG2", "v4.3.28+11361.210526.1345", "/fw/..bin"},
+	}
+	for _, tt := range tests {
+		var e Entry
+		e.Platform, e.Version = tt.platform, tt.version
+		e.Links.Data.Href = f.srv.URL + tt.href
+		_, err := c.Fetch(context.Background(), e)
+		assert.True(t, errors.Is(err, ErrInvalidEntry), tt.name)
+	}
+	assert.Empty(t, f.ranges, "nothing is downloaded")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+)
+
+// apClient is a wireless client and the access point it's on
+type apClient struct {
+	device.Client
+	AP string `json:"ap"`
+}
+
+// clientsHandler lists the wireless clients of every access point
+func (c *controller) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	out := []apClient{}
+	for _, d := range c.devices.List() {
+		for _, cl := range d.Clients {
+			out = append(out, apClient{Client: cl, AP: d.MAC})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		glog.Errorf("could not write clients: %s", err)
+	}
+}
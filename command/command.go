@@ -0,0 +1,471 @@
+// Package command queues commands for devices and delivers them as the
+// reply to the device's next inform. Commands are kept in a JSON file so
+// they survive restarts, expire if the device doesn't pick them up in time,
+// and are only reported applied once later informs show the device did what
+// it was told: uptime resetting after a reboot, a new firmware version or a
+// new cfgversion.
+package command
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/version"
+)
+
+// DefaultTTL is how long a command without an expiry has to be applied
+const DefaultTTL = time.Hour
+
+// keepDone is how long finished commands are kept for reporting
+const keepDone = 7 * 24 * time.Hour
+
+// Kind is what a command does
+type Kind string
+
+// Command kinds
+const (
+	KindReboot     Kind = "reboot"
+	KindLocate     Kind = "locate"
+	KindUpgrade    Kind = "upgrade"
+	KindSetParam   Kind = "setparam"
+	KindSetDefault Kind = "setdefault"
+	KindRaw        Kind = "raw"
+)
+
+// Status is where a command is up to
+type Status string
+
+// Command statuses
+const (
+	// StatusQueued commands are waiting for the device to inform
+	StatusQueued Status = "queued"
+	// StatusSent commands have been delivered and are waiting to be confirmed
+	StatusSent Status = "sent"
+	// StatusApplied commands were seen to take effect
+	StatusApplied Status = "applied"
+	// StatusDelivered commands were received but have no visible effect to
+	// confirm
+	StatusDelivered Status = "delivered"
+	// StatusFailed commands were seen not to take effect
+	StatusFailed Status = "failed"
+	// StatusUnconfirmed commands were sent but not seen to take effect
+	// before they expired
+	StatusUnconfirmed Status = "unconfirmed"
+	// StatusExpired commands were never picked up by the device
+	StatusExpired Status = "expired"
+	// StatusCancelled commands were withdrawn before being sent
+	StatusCancelled Status = "cancelled"
+)
+
+// ErrNotFound is returned for unknown command IDs
+var ErrNotFound = errors.New("no such command")
+
+// ErrNotQueued is returned when cancelling a command already sent
+var ErrNotQueued = errors.New("command is no longer queued")
+
+// Command is a single command for a device
+type Command struct {
+	ID   string `json:"id"`
+	MAC  string `json:"mac"`
+	Kind Kind   `json:"kind"`
+
+	// URL, Version and MD5Sum are the firmware for upgrade
+	URL     string `json:"url,omitempty"`
+	Version string `json:"version,omitempty"`
+	MD5Sum  string `json:"md5sum,omitempty"`
+	// MgmtCfg and SystemCfg are pushed by setparam
+	MgmtCfg   string `json:"mgmt_cfg,omitempty"`
+	SystemCfg string `json:"system_cfg,omitempty"`
+	// Off turns locate off rather than on
+	Off bool `json:"off,omitempty"`
+	// Raw is sent as is by raw
+	Raw json.RawMessage `json:"raw,omitempty"`
+
+	// By is who queued the command, for the audit log
+	By string `json:"by,omitempty"`
+
+	Status  Status    `json:"status"`
+	Result  string    `json:"result,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Sent    time.Time `json:"sent"`
+	Done    time.Time `json:"done"`
+	// CfgVersion is the device's cfgversion when the command was sent
+	CfgVersion string `json:"sent_cfgversion,omitempty"`
+}
+
+// Finished reports whether the command is done with, one way or another
+func (c Command) Finished() bool {
+	return c.Status != StatusQueued && c.Status != StatusSent
+}
+
+// validate checks the command has what its kind needs
+func (c Command) validate() error {
+	switch c.Kind {
+	case KindReboot, KindLocate, KindSetDefault:
+	case KindUpgrade:
+		if c.URL == "" || c.Version == "" {
+			return fmt.Errorf("upgrade needs a url and version")
+		}
+	case KindSetParam:
+		if c.MgmtCfg == "" && c.SystemCfg == "" {
+			return fmt.Errorf("setparam needs mgmt_cfg or system_cfg")
+		}
+	case KindRaw:
+		var v struct {
+			Type string `json:"_type"`
+		}
+		if err := json.Unmarshal(c.Raw, &v); err != nil || v.Type == "" {
+			return fmt.Errorf("raw needs a JSON object with a _type")
+		}
+	default:
+		return fmt.Errorf("unknown command kind %q", c.Kind)
+	}
+	return nil
+}
+
+// response is what's sent to the device
+func (c Command) response() inform.Response {
+	switch c.Kind {
+	case KindReboot:
+		return inform.NewRebootResponse()
+	case KindLocate:
+		if c.Off {
+			return inform.NewCmdResponse("unset-locate")
+		}
+		return inform.NewCmdResponse("set-locate")
+	case KindUpgrade:
+		return inform.NewUpgradeResponse(c.URL, c.Version, c.MD5Sum)
+	case KindSetParam:
+		return inform.NewSetParamResponse(c.MgmtCfg, c.SystemCfg)
+	case KindSetDefault:
+		return inform.NewSetDefaultResponse()
+	}
+	return rawResponse(c.Raw)
+}
+
+// rawResponse is a reply given verbatim
+type rawResponse json.RawMessage
+
+// JSON returns json representation of response
+func (r rawResponse) JSON() ([]byte, error) {
+	return []byte(r), nil
+}
+
+// Queue holds the commands for every device
+type Queue struct {
+	mu       sync.Mutex
+	path     string
+	commands []*Command
+	now      func() time.Time
+}
+
+// NewQueue creates a queue backed by the file at path, loading any
+// commands already saved there. An empty path keeps the queue in memory.
+func NewQueue(path string) (*Queue, error) {
+	q := &Queue{path: path, now: time.Now}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read command queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.commands); err != nil {
+		return nil, fmt.Errorf("could not parse command queue %s: %w", path, err)
+	}
+
+	return q, nil
+}
+
+// Add queues c, returning it as queued
+func (q *Queue) Add(c Command) (Command, error) {
+	mac, err := device.NormalizeMAC(c.MAC)
+	if err != nil {
+		return Command{}, err
+	}
+	if err := c.validate(); err != nil {
+		return Command{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Command{}, fmt.Errorf("could not generate command ID: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	c.ID = hex.EncodeToString(id)
+	c.MAC = mac
+	c.Status = StatusQueued
+	c.Result = ""
+	c.Created = now
+	c.Sent, c.Done, c.CfgVersion = time.Time{}, time.Time{}, ""
+	if c.Expires.IsZero() {
+		c.Expires = now.Add(DefaultTTL)
+	} else if !c.Expires.After(now) {
+		return Command{}, fmt.Errorf("command expires in the past: %s", c.Expires)
+	}
+
+	q.commands = append(q.commands, &c)
+	return c, q.save()
+}
+
+// Cancel withdraws a queued command
+func (q *Queue) Cancel(id string) (Command, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.commands {
+		if c.ID != id {
+			continue
+		}
+		if c.Status != StatusQueued {
+			return *c, ErrNotQueued
+		}
+		q.finish(c, StatusCancelled, "", q.now())
+		return *c, q.save()
+	}
+	return Command{}, ErrNotFound
+}
+
+// Get returns the command with the given ID
+func (q *Queue) Get(id string) (Command, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(q.now())
+	for _, c := range q.commands {
+		if c.ID == id {
+			return *c, true
+		}
+	}
+	return Command{}, false
+}
+
+// List returns the commands for mac, or for every device if mac is empty,
+// oldest first
+func (q *Queue) List(mac string) []Command {
+	if mac != "" {
+		mac, _ = device.NormalizeMAC(mac)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(q.now())
+	out := []Command{}
+	for _, c := range q.commands {
+		if mac == "" || c.MAC == mac {
+			out = append(out, *c)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// Confirm checks an inform from dev, prev being how it was before, against
+// the command last sent to it
+func (q *Queue) Confirm(dev device.Device, prev device.Device) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	for _, c := range q.commands {
+		if c.MAC != dev.MAC || c.Status != StatusSent {
+			continue
+		}
+		status, result := confirm(c, dev, prev)
+		if status == StatusSent {
+			continue
+		}
+		q.finish(c, status, result, now)
+		glog.Infof("command: %s %s %s: %s", c.MAC, c.Kind, c.Status, c.Result)
+	}
+	q.expire(now)
+}
+
+// confirm judges whether dev shows the effect of c
+func confirm(c *Command, dev device.Device, prev device.Device) (Status, string) {
+	rebooted := dev.Rebooted(prev)
+
+	switch c.Kind {
+	case KindReboot:
+		if rebooted {
+			return StatusApplied, "uptime reset"
+		}
+	case KindUpgrade:
+		if version.Compare(dev.Version, c.Version) == 0 {
+			return StatusApplied, "running " + dev.Version
+		}
+		if rebooted {
+			return StatusFailed, "rebooted on " + dev.Version
+		}
+	case KindSetParam:
+		if want := cfgVersion(c.MgmtCfg); want != "" {
+			if dev.CfgVersion == want {
+				return StatusApplied, "cfgversion " + want
+			}
+		} else if dev.CfgVersion != c.CfgVersion {
+			return StatusApplied, "cfgversion " + dev.CfgVersion
+		}
+	case KindSetDefault:
+		if dev.Default {
+			return StatusApplied, "at defaults"
+		}
+	case KindLocate:
+		return StatusDelivered, ""
+	case KindRaw:
+		switch {
+		case rebooted:
+			return StatusApplied, "uptime reset"
+		case dev.Version != prev.Version:
+			return StatusApplied, "running " + dev.Version
+		case dev.CfgVersion != c.CfgVersion:
+			return StatusApplied, "cfgversion " + dev.CfgVersion
+		}
+	}
+	return StatusSent, ""
+}
+
+// cfgVersion returns the cfgversion set in a mgmt_cfg, if any
+func cfgVersion(mgmtCfg string) string {
+	for _, line := range strings.Split(mgmtCfg, "\n") {
+		if strings.HasPrefix(line, "cfgversion=") {
+			return strings.TrimPrefix(line, "cfgversion=")
+		}
+	}
+	return ""
+}
+
+// Next returns the response for the next command queued for dev, or nil if
+// there is none. Commands are sent one at a time, so nothing is sent while
+// an earlier command is still waiting to be confirmed.
+func (q *Queue) Next(dev device.Device) inform.Response {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.expire(now)
+
+	var next *Command
+	for _, c := range q.commands {
+		if c.MAC != dev.MAC {
+			continue
+		}
+		if c.Status == StatusSent {
+			return nil
+		}
+		if c.Status == StatusQueued && next == nil {
+			next = c
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	next.Status = StatusSent
+	next.Sent = now
+	next.CfgVersion = dev.CfgVersion
+	if err := q.save(); err != nil {
+		glog.Errorf("%s", err)
+	}
+	glog.Infof("command: %s sending %s (%s)", next.MAC, next.Kind, next.ID)
+	return next.response()
+}
+
+// Pending reports whether mac has commands queued or awaiting confirmation
+func (q *Queue) Pending(mac string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	for _, c := range q.commands {
+		if c.MAC == mac && !c.Finished() && now.Before(c.Expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish closes a command out; callers hold q.mu
+func (q *Queue) finish(c *Command, status Status, result string, now time.Time) {
+	c.Status = status
+	c.Result = result
+	c.Done = now
+}
+
+// expire closes out commands past their expiry and forgets ones finished
+// long ago, saving if anything changed; callers hold q.mu
+func (q *Queue) expire(now time.Time) {
+	changed := false
+	kept := q.commands[:0]
+	for _, c := range q.commands {
+		if c.Finished() && now.Sub(c.Done) > keepDone {
+			changed = true
+			continue
+		}
+		kept = append(kept, c)
+		if c.Finished() || now.Before(c.Expires) {
+			continue
+		}
+		if c.Status == StatusQueued {
+			q.finish(c, StatusExpired, "not picked up", now)
+		} else {
+			q.finish(c, StatusUnconfirmed, "no sign of it being applied", now)
+		}
+		glog.Warningf("command: %s %s %s", c.MAC, c.Kind, c.Status)
+		changed = true
+	}
+	q.commands = kept
+
+	if changed {
+		if err := q.save(); err != nil {
+			glog.Errorf("%s", err)
+		}
+	}
+}
+
+// save writes the queue file; callers hold q.mu
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(q.commands, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not save command queue: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save command queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save command queue: %w", err)
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
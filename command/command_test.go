@@ -0,0 +1,169 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/stretchr/testify/assert"
+)
+
+const mac = "74:83:c2:0f:15:b0"
+
+func newTestQueue(t *testing.T, path string) (*Queue, *time.Time) {
+	q, err := NewQueue(path)
+	assert.Nil(t, err)
+	now := time.Unix(1600000000, 0)
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func testDevice(uptime uint64) device.Device {
+	return device.Device{MAC: mac, Version: "4.3.20.11298", CfgVersion: "aaaa", Uptime: uptime, LastSeen: time.Unix(1600000000, 0)}
+}
+
+func TestAddValidation(t *testing.T) {
+	q, _ := newTestQueue(t, "")
+
+	tests := []struct {
+		cmd Command
+		ok  bool
+	}{
+		{Command{MAC: mac, Kind: KindReboot}, true},
+		{Command{MAC: "74-83-C2-0F-15-B0", Kind: KindLocate}, true},
+		{Command{MAC: mac, Kind: KindUpgrade, URL: "http://fw/x.bin"}, false},
+		{Command{MAC: mac, Kind: KindUpgrade, URL: "http://fw/x.bin", Version: "4.3.21"}, true},
+		{Command{MAC: mac, Kind: KindSetParam}, false},
+		{Command{MAC: mac, Kind: KindRaw, Raw: json.RawMessage(`{"cmd":"x"}`)}, false},
+		{Command{MAC: mac, Kind: KindRaw, Raw: json.RawMessage(`{"_type":"cmd","cmd":"x"}`)}, true},
+		{Command{MAC: mac, Kind: "explode"}, false},
+		{Command{MAC: "nope", Kind: KindReboot}, false},
+		{Command{MAC: mac, Kind: KindReboot, Expires: time.Unix(1, 0)}, false},
+	}
+	for _, tt := range tests {
+		c, err := q.Add(tt.cmd)
+		assert.Equal(t, tt.ok, err == nil, "%+v: %v", tt.cmd, err)
+		if tt.ok {
+			assert.Equal(t, mac, c.MAC)
+			assert.Equal(t, StatusQueued, c.Status)
+			assert.Equal(t, time.Unix(1600000000, 0).Add(DefaultTTL), c.Expires)
+		}
+	}
+}
+
+func TestDeliverAndConfirm(t *testing.T) {
+	q, now := newTestQueue(t, "")
+	reboot, _ := q.Add(Command{MAC: mac, Kind: KindReboot})
+	upgrade, _ := q.Add(Command{MAC: mac, Kind: KindUpgrade, URL: "http://fw/x.bin", Version: "4.3.21.11325"})
+
+	dev := testDevice(1000)
+	assert.True(t, q.Pending(mac))
+	assert.IsType(t, inform.RebootResponse{}, q.Next(dev))
+	assert.Nil(t, q.Next(dev), "one command at a time")
+
+	q.Confirm(testDevice(1010), dev)
+	c, _ := q.Get(reboot.ID)
+	assert.Equal(t, StatusSent, c.Status, "still up")
+
+	q.Confirm(testDevice(5), testDevice(1010))
+	c, _ = q.Get(reboot.ID)
+	assert.Equal(t, StatusApplied, c.Status)
+
+	assert.IsType(t, inform.UpgradeResponse{}, q.Next(testDevice(5)))
+	*now = now.Add(time.Minute)
+	upgraded := testDevice(3)
+	upgraded.Version = "4.3.21.11325"
+	q.Confirm(upgraded, testDevice(5))
+	c, _ = q.Get(upgrade.ID)
+	assert.Equal(t, StatusApplied, c.Status)
+	assert.Equal(t, *now, c.Done)
+	assert.False(t, q.Pending(mac))
+	assert.Nil(t, q.Next(upgraded))
+}
+
+func TestConfirm(t *testing.T) {
+	before := testDevice(1000)
+	newCfg := testDevice(1010)
+	newCfg.CfgVersion = "bbbb"
+	rebooted := testDevice(5)
+	defaulted := testDevice(5)
+	defaulted.Default = true
+
+	tests := []struct {
+		name string
+		cmd  Command
+		dev  device.Device
+		want Status
+	}{
+		{"setparam with cfgversion", Command{Kind: KindSetParam, MgmtCfg: "cfgversion=bbbb\n"}, newCfg, StatusApplied},
+		{"setparam other cfgversion", Command{Kind: KindSetParam, MgmtCfg: "cfgversion=cccc\n"}, newCfg, StatusSent},
+		{"setparam any change", Command{Kind: KindSetParam, SystemCfg: "x=1\n"}, newCfg, StatusApplied},
+		{"setparam unchanged", Command{Kind: KindSetParam, SystemCfg: "x=1\n"}, testDevice(1010), StatusSent},
+		{"setdefault", Command{Kind: KindSetDefault}, defaulted, StatusApplied},
+		{"setdefault not yet", Command{Kind: KindSetDefault}, rebooted, StatusSent},
+		{"upgrade rebooted on old", Command{Kind: KindUpgrade, Version: "4.3.21.11325"}, rebooted, StatusFailed},
+		{"locate", Command{Kind: KindLocate}, testDevice(1010), StatusDelivered},
+		{"raw", Command{Kind: KindRaw}, rebooted, StatusApplied},
+		{"raw nothing", Command{Kind: KindRaw}, testDevice(1010), StatusSent},
+	}
+	for _, tt := range tests {
+		tt.cmd.CfgVersion = before.CfgVersion
+		got, _ := confirm(&tt.cmd, tt.dev, before)
+		assert.Equal(t, tt.want, got, tt.name)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	q, now := newTestQueue(t, "")
+	queued, _ := q.Add(Command{MAC: mac, Kind: KindReboot, Expires: now.Add(time.Minute)})
+	sent, _ := q.Add(Command{MAC: "74:83:c2:00:00:01", Kind: KindReboot, Expires: now.Add(time.Minute)})
+	other := testDevice(1000)
+	other.MAC = sent.MAC
+	assert.NotNil(t, q.Next(other))
+
+	*now = now.Add(2 * time.Minute)
+	assert.Nil(t, q.Next(testDevice(1000)), "expired commands aren't sent")
+	c, _ := q.Get(queued.ID)
+	assert.Equal(t, StatusExpired, c.Status)
+	c, _ = q.Get(sent.ID)
+	assert.Equal(t, StatusUnconfirmed, c.Status)
+
+	*now = now.Add(keepDone + time.Minute)
+	assert.Len(t, q.List(""), 0, "old commands are forgotten")
+}
+
+func TestCancelAndPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-command")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "commands.json")
+
+	q, _ := newTestQueue(t, path)
+	a, _ := q.Add(Command{MAC: mac, Kind: KindLocate})
+	b, _ := q.Add(Command{MAC: mac, Kind: KindSetParam, MgmtCfg: "cfgversion=bbbb\n"})
+	assert.NotNil(t, q.Next(testDevice(1000)))
+
+	_, err = q.Cancel(a.ID)
+	assert.True(t, errors.Is(err, ErrNotQueued))
+	_, err = q.Cancel("nope")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	reloaded, _ := newTestQueue(t, path)
+	cmds := reloaded.List(mac)
+	assert.Len(t, cmds, 2)
+	assert.Equal(t, StatusSent, cmds[0].Status)
+	assert.Equal(t, StatusQueued, cmds[1].Status)
+
+	c, err := reloaded.Cancel(b.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusCancelled, c.Status)
+	reloaded.Confirm(testDevice(1010), testDevice(1000))
+	assert.Nil(t, reloaded.Next(testDevice(1010)))
+	assert.False(t, reloaded.Pending(mac))
+}
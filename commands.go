@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/api"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+	"github.com/jda/nanofi/command"
+)
+
+// requestActor names whoever made r, for commands queued outside the API
+func requestActor(r *http.Request) string {
+	if id, ok := auth.FromContext(r.Context()); ok {
+		return id.String()
+	}
+	return "anonymous"
+}
+
+// commandsHandler lists commands with GET, optionally for ?mac=, queues one
+// with POST and cancels ?id= with DELETE. Setparam configs, and the authkeys
+// in them, are never shown
+func (c *controller) commandsHandler(w http.ResponseWriter, r *http.Request) {
+	var out interface{}
+	status := http.StatusOK
+
+	switch r.Method {
+	case http.MethodGet:
+		cmds := []command.Command{}
+		for _, cmd := range c.commands.List(r.URL.Query().Get("mac")) {
+			cmds = append(cmds, api.WithoutCfg(cmd))
+		}
+		out = cmds
+	case http.MethodPost:
+		var cmd command.Command
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, "invalid command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd.By = requestActor(r)
+		queued, err := c.commands.Add(cmd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		glog.Infof("%s: queued %s for %s (%s)", r.RemoteAddr, queued.Kind, queued.MAC, queued.ID)
+		c.record(audit.Entry{Actor: cmd.By, Remote: r.RemoteAddr, Action: audit.ActionCommand, Device: queued.MAC, Detail: string(queued.Kind) + " " + queued.ID})
+		out, status = api.WithoutCfg(queued), http.StatusCreated
+	case http.MethodDelete:
+		cancelled, err := c.commands.Cancel(r.URL.Query().Get("id"))
+		if errors.Is(err, command.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		c.record(audit.Entry{Actor: requestActor(r), Remote: r.RemoteAddr, Action: audit.ActionCancel, Device: cancelled.MAC, Detail: string(cancelled.Kind) + " " + cancelled.ID})
+		out = api.WithoutCfg(cancelled)
+	default:
+		http.Error(w, "invalid method for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		glog.Errorf("could not write commands: %s", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+)
+
+// loadPolicy reads a JSON map of device model to allowed firmware versions,
+// e.g. {"U7PG2": ">= 4.3.28"}
+func loadPolicy(file string) (device.Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read firmware policy: %w", err)
+	}
+	var policy device.Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("could not parse firmware policy %s: %w", file, err)
+	}
+	return policy, nil
+}
+
+// setPolicy replaces the firmware policy
+func (c *controller) setPolicy(policy device.Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = policy
+}
+
+// complianceHandler reports the firmware compliance of every known device
+func (c *controller) complianceHandler(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	policy := c.policy
+	c.mu.RUnlock()
+	report := device.Compliance(c.devices.List(), policy)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		glog.Errorf("could not write compliance report: %s", err)
+	}
+}
@@ -0,0 +1,659 @@
+// Package config reads nanofi's declarative configuration file, written in
+// YAML or, on OpenWRT, in UCI: listeners, where state is stored, secrets,
+// adoption, firmware, and the site, group and device templates devices are
+// configured from.
+//
+// Errors point at the line of the file they're about. Values tagged
+// !secret are looked up by name in the secrets file, so the config can be
+// kept in git without them, and NANOFI_* environment variables override
+// the settings that name one.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/sshadopt"
+	"github.com/jda/nanofi/template"
+	"github.com/jda/nanofi/uci"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownSecret is returned for !secret values the secrets file lacks
+var ErrUnknownSecret = errors.New("unknown secret")
+
+// secretTag marks values to take from the secrets file
+const secretTag = "!secret"
+
+// Config is the configuration file
+type Config struct {
+	Listen Listen `yaml:"listen"`
+	// TLS is the management listener's certificate
+	TLS TLS `yaml:"tls"`
+	// InformURL is the URL devices use to reach the inform listener
+	InformURL string `yaml:"inform_url" env:"NANOFI_INFORM_URL"`
+	// Storage is the directory state files are kept in
+	Storage string `yaml:"storage" env:"NANOFI_STORAGE"`
+	// Secrets is a YAML file of named secrets, relative to the config file
+	Secrets  string   `yaml:"secrets" env:"NANOFI_SECRETS"`
+	Adoption Adoption `yaml:"adoption"`
+	Firmware Firmware `yaml:"firmware"`
+	DHCP     DHCP     `yaml:"dhcp"`
+
+	// Default, Sites, Groups and Devices are template layers; see package
+	// template
+	Default      map[string]interface{}            `yaml:"default"`
+	Sites        map[string]map[string]interface{} `yaml:"sites"`
+	Groups       map[string]map[string]interface{} `yaml:"groups"`
+	Devices      map[string]map[string]interface{} `yaml:"devices"`
+	SiteDevices  map[string][]string               `yaml:"site_devices"`
+	GroupDevices map[string][]string               `yaml:"group_devices"`
+
+	path string
+	// lines maps dot separated paths in the file to their line
+	lines map[string]int
+}
+
+// Listen is the addresses nanofi listens on; empty addresses are off
+type Listen struct {
+	Inform    string `yaml:"inform" env:"NANOFI_LISTEN"`
+	Firmware  string `yaml:"firmware" env:"NANOFI_FIRMWARE_LISTEN"`
+	STUN      string `yaml:"stun" env:"NANOFI_STUN_LISTEN"`
+	Discovery string `yaml:"discovery" env:"NANOFI_DISCOVERY_LISTEN"`
+	// API is the TLS listener for the management API and pages
+	API string `yaml:"api" env:"NANOFI_API_LISTEN"`
+}
+
+// TLS is the certificate the management listener serves, self-signed if
+// not set, and the CAs client certificates must be signed by, if any
+type TLS struct {
+	Cert     string `yaml:"cert" env:"NANOFI_TLS_CERT"`
+	Key      string `yaml:"key" env:"NANOFI_TLS_KEY"`
+	ClientCA string `yaml:"client_ca" env:"NANOFI_TLS_CLIENT_CA"`
+}
+
+// Adoption is how devices at defaults are adopted
+type Adoption struct {
+	// SSH runs set-inform over SSH on discovered devices at defaults
+	SSH bool `yaml:"ssh" env:"NANOFI_SSH_ADOPT"`
+	// Scan is a subnet to scan for SSH at startup
+	Scan string `yaml:"scan"`
+	// Credentials are tried instead of the factory defaults
+	Credentials []sshadopt.Credential `yaml:"credentials"`
+}
+
+// Firmware is where firmware is served from and what devices should run
+type Firmware struct {
+	Dir string `yaml:"dir" env:"NANOFI_FIRMWARE_DIR"`
+	// URL is the base URL devices use to reach the firmware listener
+	URL string `yaml:"url" env:"NANOFI_FIRMWARE_URL"`
+	// Policy is the versions each model may run
+	Policy device.Policy `yaml:"policy"`
+	// Targets are what bench mode upgrades each model to
+	Targets map[string]bench.Target `yaml:"targets"`
+}
+
+// DHCP is the DHCP server nanofi runs on Interface, if set
+type DHCP struct {
+	Interface string `yaml:"interface"`
+	// Range is the first and last address to lease, as first,last
+	Range  string `yaml:"range"`
+	Domain string `yaml:"domain"`
+	// Router and DNS are handed out with leases; none if unset
+	Router string   `yaml:"router"`
+	DNS    []string `yaml:"dns"`
+}
+
+// Load reads, checks and validates the config file at path
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	return Parse(path, data)
+}
+
+// Parse checks and validates config read from path, which may be YAML or
+// UCI
+func Parse(path string, data []byte) (*Config, error) {
+	c := &Config{path: path, lines: make(map[string]int)}
+
+	var root *yaml.Node
+	if isUCI(data) {
+		f, err := uci.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if root, err = fromUCI(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(doc.Content) == 0 {
+			return c, nil
+		}
+		root = doc.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: config must be a mapping", path, root.Line)
+	}
+
+	if err := c.resolveSecrets(root); err != nil {
+		return nil, err
+	}
+	c.index(root, "")
+	if err := c.check(root, reflect.TypeOf(*c), ""); err != nil {
+		return nil, err
+	}
+	if err := root.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := applyEnv(reflect.ValueOf(c).Elem()); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resolveSecrets replaces !secret values with those from the secrets file
+func (c *Config) resolveSecrets(root *yaml.Node) error {
+	file := os.Getenv("NANOFI_SECRETS")
+	line := 0
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "secrets" && file == "" {
+			file, line = root.Content[i+1].Value, root.Content[i+1].Line
+		}
+	}
+
+	var secrets map[string]string
+	load := func() error {
+		if secrets != nil {
+			return nil
+		}
+		if file == "" {
+			return fmt.Errorf("no secrets file")
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(c.path), file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = yaml.Unmarshal(data, &secrets)
+		}
+		if err != nil {
+			if line != 0 {
+				return fmt.Errorf("%s:%d: could not load secrets: %w", c.path, line, err)
+			}
+			return fmt.Errorf("could not load secrets: %w", err)
+		}
+		if secrets == nil {
+			secrets = make(map[string]string)
+		}
+		return nil
+	}
+
+	var walk func(n *yaml.Node) error
+	walk = func(n *yaml.Node) error {
+		if n.Tag == secretTag {
+			if n.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%s:%d: !secret takes a secret's name", c.path, n.Line)
+			}
+			if err := load(); err != nil {
+				return err
+			}
+			v, ok := secrets[n.Value]
+			if !ok {
+				return fmt.Errorf("%s:%d: %w %q", c.path, n.Line, ErrUnknownSecret, n.Value)
+			}
+			n.Tag, n.Value, n.Style = "!!str", v, 0
+		}
+		for _, child := range n.Content {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// index records the line of every path under n
+func (c *Config) index(n *yaml.Node, path string) {
+	c.lines[path] = n.Line
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := join(path, n.Content[i].Value)
+			c.index(n.Content[i+1], key)
+			// point at the key rather than the value's first line
+			c.lines[key] = n.Content[i].Line
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			c.index(item, join(path, strconv.Itoa(i)))
+		}
+	}
+}
+
+func join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// check compares n against the type it will be decoded into, rejecting
+// unknown fields and values of the wrong shape
+func (c *Config) check(n *yaml.Node, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Tag == "!!null" {
+		return nil
+	}
+
+	if reflect.PtrTo(t).Implements(textUnmarshaler) {
+		if n.Kind != yaml.ScalarNode {
+			return c.errorf(n.Line, path, "expected a string")
+		}
+		u := reflect.New(t).Interface().(encoding.TextUnmarshaler)
+		if err := u.UnmarshalText([]byte(n.Value)); err != nil {
+			return c.errorf(n.Line, path, "%s", err)
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return c.errorf(n.Line, path, "expected a mapping")
+		}
+		fields := fieldsByTag(t, "yaml")
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			f, ok := fields[key]
+			if !ok {
+				return c.errorf(n.Content[i].Line, join(path, key), "unknown setting")
+			}
+			if err := c.check(n.Content[i+1], f.Type, join(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return c.errorf(n.Line, path, "expected a mapping")
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if err := c.check(n.Content[i+1], t.Elem(), join(path, n.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return c.errorf(n.Line, path, "expected a list")
+		}
+		for i, item := range n.Content {
+			if err := c.check(item, t.Elem(), join(path, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	case reflect.Interface:
+	default:
+		if n.Kind != yaml.ScalarNode {
+			return c.errorf(n.Line, path, "expected a %s", t.Kind())
+		}
+	}
+	return nil
+}
+
+// fieldsByTag returns t's fields by the name the struct tag tag gives them,
+// such as yaml or json
+func fieldsByTag(t reflect.Type, tag string) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get(tag), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// applyEnv sets fields tagged with env from the environment
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyEnv(fv); err != nil {
+				return err
+			}
+			continue
+		}
+		name := f.Tag.Get("env")
+		s, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String:
+			fv.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("%s: %q isn't true or false", name, s)
+			}
+			fv.SetBool(b)
+		}
+	}
+	return nil
+}
+
+// errorf is an error about the value at path, on line
+func (c *Config) errorf(line int, path string, format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s: %s", c.path, line, path, fmt.Sprintf(format, a...))
+}
+
+// Errorf is an error about the value at path, pointing at its line if it's
+// in the file
+func (c *Config) Errorf(path string, format string, a ...interface{}) error {
+	for p := path; ; p = p[:strings.LastIndexByte(p, '.')] {
+		if line, ok := c.lines[p]; ok && p != "" {
+			return c.errorf(line, path, format, a...)
+		}
+		if !strings.Contains(p, ".") {
+			break
+		}
+	}
+	return fmt.Errorf("%s: %s: %s", c.path, path, fmt.Sprintf(format, a...))
+}
+
+// Validate checks settings that YAML types alone don't
+func (c *Config) Validate() error {
+	for _, l := range []struct {
+		path string
+		addr string
+	}{
+		{"listen.inform", c.Listen.Inform},
+		{"listen.firmware", c.Listen.Firmware},
+		{"listen.stun", c.Listen.STUN},
+		{"listen.discovery", c.Listen.Discovery},
+		{"listen.api", c.Listen.API},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(l.addr); err != nil {
+			return c.Errorf(l.path, "listen address must be host:port or :port")
+		}
+	}
+
+	if c.TLS.Cert != "" && c.TLS.Key == "" {
+		return c.Errorf("tls.cert", "certificate needs a key")
+	}
+	if c.TLS.Key != "" && c.TLS.Cert == "" {
+		return c.Errorf("tls.key", "key needs a certificate")
+	}
+
+	if c.InformURL != "" {
+		if err := checkURL(c.InformURL); err != nil {
+			return c.Errorf("inform_url", "%s", err)
+		}
+	}
+	if c.Firmware.URL != "" {
+		if err := checkURL(c.Firmware.URL); err != nil {
+			return c.Errorf("firmware.url", "%s", err)
+		}
+	}
+
+	if c.Adoption.Scan != "" {
+		if _, _, err := net.ParseCIDR(c.Adoption.Scan); err != nil {
+			return c.Errorf("adoption.scan", "scan must be a subnet like 192.168.1.0/24")
+		}
+	}
+	if (c.Adoption.SSH || c.Adoption.Scan != "") && c.InformURL == "" {
+		return c.Errorf("adoption", "SSH adoption needs inform_url")
+	}
+	for i, cred := range c.Adoption.Credentials {
+		if cred.User == "" {
+			return c.Errorf(fmt.Sprintf("adoption.credentials.%d", i), "credentials need a user")
+		}
+	}
+
+	if c.DHCP.Interface != "" && c.DHCP.Range == "" {
+		return c.Errorf("dhcp", "DHCP needs a range")
+	}
+	if c.DHCP.Router != "" && net.ParseIP(c.DHCP.Router).To4() == nil {
+		return c.Errorf("dhcp.router", "router must be an IPv4 address")
+	}
+	for i, ip := range c.DHCP.DNS {
+		if net.ParseIP(ip).To4() == nil {
+			return c.Errorf(fmt.Sprintf("dhcp.dns.%d", i), "DNS servers must be IPv4 addresses")
+		}
+	}
+
+	for _, model := range sortedKeys(c.Firmware.Targets) {
+		if c.Firmware.Targets[model].Version == "" {
+			return c.Errorf("firmware.targets."+model, "target needs a version")
+		}
+	}
+
+	return c.validateTemplates()
+}
+
+func sortedKeys(m map[string]bench.Target) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be an http or https URL", s)
+	}
+	return nil
+}
+
+// validateTemplates checks the MACs the template layers name and what
+// each layer sets
+func (c *Config) validateTemplates() error {
+	seen := make(map[string]string)
+	for mac := range c.Devices {
+		norm, err := device.NormalizeMAC(mac)
+		if err != nil {
+			return c.Errorf("devices."+mac, "%s", err)
+		}
+		if other, ok := seen[norm]; ok {
+			return c.Errorf("devices."+mac, "same device as %s", other)
+		}
+		seen[norm] = mac
+	}
+
+	for what, members := range map[string]map[string][]string{"site_devices": c.SiteDevices, "group_devices": c.GroupDevices} {
+		in := make(map[string]string)
+		for name, macs := range members {
+			for i, mac := range macs {
+				path := fmt.Sprintf("%s.%s.%d", what, name, i)
+				norm, err := device.NormalizeMAC(mac)
+				if err != nil {
+					return c.Errorf(path, "%s", err)
+				}
+				if other, ok := in[norm]; ok && other != name {
+					return c.Errorf(path, "%s is also in %s", mac, other)
+				}
+				in[norm] = name
+			}
+		}
+	}
+	t, err := c.Templates()
+	if err != nil {
+		return err
+	}
+	if path, err := CheckLayers(t); err != nil {
+		if mac := strings.TrimPrefix(path, "devices."); mac != path {
+			// t keys devices by normalized MAC, the file as written
+			for key := range c.Devices {
+				if norm, _ := device.NormalizeMAC(key); norm == mac {
+					path = "devices." + key
+				}
+			}
+		}
+		return c.Errorf(path, "%s", err)
+	}
+	return nil
+}
+
+// Templates returns the template layers in the config
+func (c *Config) Templates() (*template.Templates, error) {
+	layers := map[string]interface{}{
+		"default":       stringKeys(c.Default),
+		"sites":         stringKeys(c.Sites),
+		"groups":        stringKeys(c.Groups),
+		"devices":       stringKeys(c.Devices),
+		"site_devices":  c.SiteDevices,
+		"group_devices": c.GroupDevices,
+	}
+	data, err := json.Marshal(layers)
+	if err != nil {
+		return nil, fmt.Errorf("%s: templates: %w", c.path, err)
+	}
+	t, err := template.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: templates: %w", c.path, err)
+	}
+	return t, nil
+}
+
+// stringKeys converts the maps in v to have string keys, as JSON needs.
+// YAML keys can be numbers, as switch port numbers are.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = stringKeys(e)
+		}
+		return out
+	case map[string]map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = stringKeys(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = stringKeys(e)
+		}
+		return out
+	}
+	return v
+}
+
+// HasTemplates reports whether the config has any template layers
+func (c *Config) HasTemplates() bool {
+	return len(c.Default) > 0 || len(c.Sites) > 0 || len(c.Groups) > 0 || len(c.Devices) > 0
+}
+
+// DeviceError points err, about the config resolved for dev, at the most
+// specific layer dev takes config from
+func (c *Config) DeviceError(dev device.Device, err error) error {
+	for key := range c.Devices {
+		if norm, _ := device.NormalizeMAC(key); norm == dev.MAC {
+			return c.Errorf("devices."+key, "%s", err)
+		}
+	}
+	if _, ok := c.Groups[dev.Group]; ok {
+		return c.Errorf("groups."+dev.Group, "%s: %s", dev.MAC, err)
+	}
+	if _, ok := c.Sites[dev.Site]; ok {
+		return c.Errorf("sites."+dev.Site, "%s: %s", dev.MAC, err)
+	}
+	return c.Errorf("default", "%s: %s", dev.MAC, err)
+}
+
+// RestartNeeded lists the settings that differ in next but only take
+// effect when nanofi restarts
+func (c *Config) RestartNeeded(next *Config) []string {
+	var out []string
+	if c.Listen != next.Listen {
+		out = append(out, "listen")
+	}
+	if c.TLS != next.TLS {
+		out = append(out, "tls")
+	}
+	if c.InformURL != next.InformURL {
+		out = append(out, "inform_url")
+	}
+	if c.Storage != next.Storage {
+		out = append(out, "storage")
+	}
+	if !reflect.DeepEqual(c.Adoption, next.Adoption) {
+		out = append(out, "adoption")
+	}
+	if c.Firmware.Dir != next.Firmware.Dir || c.Firmware.URL != next.Firmware.URL {
+		out = append(out, "firmware")
+	}
+	if !equalJSON(c.Firmware.Targets, next.Firmware.Targets) {
+		out = append(out, "firmware.targets")
+	}
+	if !reflect.DeepEqual(c.DHCP, next.DHCP) {
+		out = append(out, "dhcp")
+	}
+	return out
+}
+
+// equalJSON compares values by their JSON, which constraints compare by
+func equalJSON(a interface{}, b interface{}) bool {
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	return bytes.Equal(aj, bj)
+}
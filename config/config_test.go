@@ -0,0 +1,340 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jda/nanofi/device"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `listen:
+  inform: ":8080"
+  stun: ":3478"
+inform_url: http://192.168.1.1:8080/inform
+storage: /var/lib/nanofi
+secrets: secrets.yaml
+adoption:
+  ssh: true
+  credentials:
+    - user: admin
+      password: !secret ssh
+firmware:
+  dir: /srv/firmware
+  policy:
+    U7PG2: ">= 4.3.28"
+  targets:
+    U7PG2: {version: 4.3.28.11361}
+default:
+  wlan:
+    wlans:
+      - {ssid: corp, security: wpa2, passphrase: !secret corp}
+sites:
+  warehouse:
+    mgmt: {timezone: America/Chicago}
+groups:
+  switches:
+    switch:
+      profiles: {uplink: {tagged_vlans: [20]}}
+      ports: {1: uplink}
+devices:
+  FC:EC:DA:00:00:01:
+    mgmt: {hostname: ap-dock}
+site_devices:
+  warehouse: [fc:ec:da:00:00:01]
+`
+
+func write(t *testing.T, dir string, name string, data string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	write(t, dir, "secrets.yaml", "ssh: hunter2\ncorp: correct horse\n")
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.Nil(t, err)
+	assert.Equal(t, ":8080", c.Listen.Inform)
+	assert.Equal(t, ":3478", c.Listen.STUN)
+	assert.Equal(t, "/var/lib/nanofi", c.Storage)
+	assert.True(t, c.Adoption.SSH)
+	assert.Equal(t, "hunter2", c.Adoption.Credentials[0].Password)
+	assert.True(t, c.Firmware.Policy["U7PG2"].MatchString("4.3.28"))
+	assert.Equal(t, "4.3.28.11361", c.Firmware.Targets["U7PG2"].Version)
+	assert.True(t, c.HasTemplates())
+
+	tpl, err := c.Templates()
+	assert.Nil(t, err)
+	dev := tpl.Place(device.Device{MAC: "fc:ec:da:00:00:01", Group: "switches"})
+	assert.Equal(t, "warehouse", dev.Site)
+	values := make(map[string]interface{})
+	for _, v := range tpl.Resolve(dev).Values() {
+		values[v.Path] = v.Value
+	}
+	assert.Equal(t, "ap-dock", values["mgmt.hostname"])
+	assert.Equal(t, "America/Chicago", values["mgmt.timezone"])
+	assert.Equal(t, "uplink", values["switch.ports.1"])
+	wlans := values["wlan.wlans"].([]interface{})
+	assert.Equal(t, "correct horse", wlans[0].(map[string]interface{})["passphrase"])
+}
+
+func TestEnv(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("NANOFI_LISTEN", ":9090")
+	os.Setenv("NANOFI_SSH_ADOPT", "false")
+	defer os.Unsetenv("NANOFI_LISTEN")
+	defer os.Unsetenv("NANOFI_SSH_ADOPT")
+
+	c, err := Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.Nil(t, err)
+	assert.Equal(t, ":9090", c.Listen.Inform)
+	assert.False(t, c.Adoption.SSH)
+	assert.Equal(t, ":3478", c.Listen.STUN, "unset variables leave the file's value")
+
+	os.Setenv("NANOFI_SSH_ADOPT", "sometimes")
+	_, err = Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.EqualError(t, err, `NANOFI_SSH_ADOPT: "sometimes" isn't true or false`)
+}
+
+func TestErrors(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"syntax", "listen:\n  inform: [\n", "nanofi.yaml: yaml: line 2: did not find expected node content"},
+		{"not a mapping", "- a\n", "nanofi.yaml:1: config must be a mapping"},
+		{"unknown setting", "listen:\n  inform: \":8080\"\n  informs: \":8081\"\n", "nanofi.yaml:3: listen.informs: unknown setting"},
+		{"wrong shape", "adoption:\n  credentials: admin\n", "nanofi.yaml:2: adoption.credentials: expected a list"},
+		{"wrong type", "adoption:\n  ssh: sometimes\n", "line 2: cannot unmarshal"},
+		{"bad constraint", "firmware:\n  policy:\n    U7PG2: \">= \"\n", "nanofi.yaml:3: firmware.policy.U7PG2:"},
+		{"bad listen", "listen:\n  stun: 3478\n", "nanofi.yaml:2: listen.stun: listen address must be host:port or :port"},
+		{"cert without key", "tls:\n  cert: /etc/nanofi/cert.pem\n", "nanofi.yaml:2: tls.cert: certificate needs a key"},
+		{"bad url", "inform_url: 192.168.1.1\n", "nanofi.yaml:1: inform_url:"},
+		{"ssh without url", "adoption:\n  ssh: true\n", "nanofi.yaml:1: adoption: SSH adoption needs inform_url"},
+		{"bad scan", "inform_url: http://a:8080/inform\nadoption:\n  scan: lan\n", "nanofi.yaml:3: adoption.scan:"},
+		{"target without version", "firmware:\n  targets:\n    U7PG2: {url: http://a/fw.bin}\n", "nanofi.yaml:3: firmware.targets.U7PG2: target needs a version"},
+		{"DHCP without range", "dhcp:\n  interface: eth1\n", "nanofi.yaml:1: dhcp: DHCP needs a range"},
+		{"bad DHCP router", "dhcp:\n  router: gateway\n", "nanofi.yaml:2: dhcp.router: router must be an IPv4 address"},
+		{"bad DHCP DNS", "dhcp:\n  dns: [9.9.9.9, \"::1\"]\n", "nanofi.yaml:2: dhcp.dns.1: DNS servers must be IPv4 addresses"},
+		{"bad device", "devices:\n  ap-1:\n    mgmt: {}\n", "nanofi.yaml:2: devices.ap-1:"},
+		{"unknown default key", "default:\n  wlna: {}\n", "nanofi.yaml:1: default: json: unknown field \"wlna\""},
+		{"bad group WLAN", "groups:\n  lobby:\n    wlan:\n      wlans: [{ssid: guest, security: bogus}]\n", "nanofi.yaml:2: groups.lobby: wlan: wlan 1 (guest):"},
+		{"bad site mgmt", "sites:\n  warehouse:\n    mgmt: {timezone: chicago}\n", "nanofi.yaml:2: sites.warehouse: mgmt: timezone \"chicago\""},
+		{"bad device layer", "devices:\n  FC:EC:DA:00:00:01:\n    switch: {ports: {1: uplink}}\n", "nanofi.yaml:2: devices.FC:EC:DA:00:00:01: switch: port 1: no profile"},
+		{"device twice", "devices:\n  fc:ec:da:00:00:01: {}\n  FC-EC-DA-00-00-01: {}\n", "same device as"},
+		{"two sites", "site_devices:\n  a: [fc:ec:da:00:00:01]\n  b: [fc:ec:da:00:00:01]\n", "is also in"},
+		{"unknown secret", "secrets: secrets.yaml\ninform_url: !secret nope\n", "nanofi.yaml:2: unknown secret \"nope\""},
+		{"no secrets file", "inform_url: !secret ssh\n", "no secrets file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(write(t, dir, "nanofi.yaml", tt.config))
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestDeviceError(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "nanofi.yaml")
+
+	err = c.DeviceError(device.Device{MAC: "fc:ec:da:00:00:01"}, assert.AnError)
+	assert.Equal(t, path+":31: devices.FC:EC:DA:00:00:01: "+assert.AnError.Error(), err.Error())
+	err = c.DeviceError(device.Device{MAC: "fc:ec:da:00:00:02", Site: "warehouse"}, assert.AnError)
+	assert.Equal(t, path+":23: sites.warehouse: fc:ec:da:00:00:02: "+assert.AnError.Error(), err.Error())
+	err = c.DeviceError(device.Device{MAC: "fc:ec:da:00:00:03", Site: "office"}, assert.AnError)
+	assert.Equal(t, path+":18: default: fc:ec:da:00:00:03: "+assert.AnError.Error(), err.Error())
+}
+
+func TestRestartNeeded(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	a, err := Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.Nil(t, err)
+	b, err := Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.Nil(t, err)
+	assert.Empty(t, a.RestartNeeded(b))
+
+	b.Listen.Inform = ":9090"
+	b.Sites = nil
+	b.Firmware.Policy = nil
+	assert.Equal(t, []string{"listen"}, a.RestartNeeded(b), "templates and policy reload")
+}
+
+const testUCI = `package nanofi
+
+config nanofi 'main'
+	option listen_inform ':8080'
+	option listen_stun ':3478'
+	option inform_url 'http://192.168.1.1:8080/inform'
+	option storage '/var/lib/nanofi'
+	option secrets 'secrets.yaml'
+	option adoption_ssh 'yes'
+	option firmware_dir '/srv/firmware'
+	list firmware_policy 'U7PG2=>= 4.3.28'
+
+config adoption_credentials
+	option user 'admin'
+	option password '!secret ssh'
+
+config firmware_targets
+	option name 'U7PG2'
+	option version '4.3.28.11361'
+
+config wlan_wlans
+	option layer 'default'
+	option ssid 'corp'
+	option security 'wpa2'
+	option passphrase '!secret corp'
+
+config site
+	option name 'warehouse'
+	option mgmt_timezone 'America/Chicago'
+	list device 'fc:ec:da:00:00:01'
+
+config group
+	option name 'switches'
+	list switch_ports '1=uplink'
+
+config switch_profiles
+	option layer 'group:switches'
+	option name 'uplink'
+	list tagged_vlans '20'
+
+config device
+	option mac 'FC:EC:DA:00:00:01'
+	option mgmt_hostname 'ap-dock'
+`
+
+func TestLoadUCI(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(write(t, dir, "nanofi", testUCI))
+	assert.Nil(t, err)
+	y, err := Load(write(t, dir, "nanofi.yaml", testConfig))
+	assert.Nil(t, err)
+
+	assert.Equal(t, y.Listen, c.Listen)
+	assert.Equal(t, y.Storage, c.Storage)
+	assert.True(t, equalJSON(y.Adoption, c.Adoption))
+	assert.True(t, equalJSON(y.Firmware, c.Firmware))
+	assert.Equal(t, "hunter2", c.Adoption.Credentials[0].Password)
+
+	yt, err := y.Templates()
+	assert.Nil(t, err)
+	ct, err := c.Templates()
+	assert.Nil(t, err)
+	assert.True(t, equalJSON(yt, ct), "templates")
+
+	path := filepath.Join(dir, "nanofi")
+	err = c.DeviceError(device.Device{MAC: "fc:ec:da:00:00:01"}, assert.AnError)
+	assert.Equal(t, path+":41: devices.FC:EC:DA:00:00:01: "+assert.AnError.Error(), err.Error())
+}
+
+func TestDHCP(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	y, err := Load(write(t, dir, "nanofi.yaml", "dhcp:\n  interface: eth1\n  range: 192.168.1.50,192.168.1.99\n  router: 192.168.1.254\n  dns: [192.168.1.254, 9.9.9.9]\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, DHCP{Interface: "eth1", Range: "192.168.1.50,192.168.1.99", Router: "192.168.1.254", DNS: []string{"192.168.1.254", "9.9.9.9"}}, y.DHCP)
+
+	c, err := Load(write(t, dir, "nanofi", "config nanofi 'main'\n\toption dhcp_interface 'eth1'\n\toption dhcp_range '192.168.1.50,192.168.1.99'\n\toption dhcp_router '192.168.1.254'\n\tlist dhcp_dns '192.168.1.254'\n\tlist dhcp_dns '9.9.9.9'\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, y.DHCP, c.DHCP)
+
+	next := *y
+	next.DHCP.DNS = []string{"9.9.9.9"}
+	assert.Equal(t, []string{"dhcp"}, y.RestartNeeded(&next))
+}
+
+func TestUCIErrors(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"syntax", "config nanofi\n\toption storage 'a\n", "nanofi: line 2: invalid UCI: unterminated quote"},
+		{"unknown setting", "config nanofi\n\toption storage a\n\toption listen_informs ':8080'\n", "nanofi: line 3: listen_informs: unknown setting"},
+		{"unknown section", "config nanofi\n\nconfig radios\n", `nanofi: line 3: unknown section type "radios"`},
+		{"section as option", "config nanofi\n\toption adoption_credentials admin\n", "line 2: adoption_credentials: is a section"},
+		{"bad boolean", "config nanofi\n\toption adoption_ssh sometimes\n", `line 2: "sometimes" isn't a boolean`},
+		{"bad value", "config nanofi\n\n\toption listen_stun 3478\n", "nanofi:3: listen.stun: listen address must be host:port or :port"},
+		{"bad layer", "config wlan_wlans\n\toption layer office\n", "line 1: layer must be"},
+		{"unnamed site", "config site\n\tlist device fc:ec:da:00:00:01\n", "line 1: site sections need a name"},
+		{"bad device", "config device\n\toption mac ap-1\n", "nanofi:1: devices.ap-1:"},
+		{"unknown secret", "config nanofi\n\toption secrets secrets.yaml\n\toption inform_url '!secret nope'\n", "nanofi:3: unknown secret \"nope\""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(write(t, dir, "nanofi", tt.config))
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	u, err := YAMLToUCI([]byte(testConfig))
+	assert.Nil(t, err)
+	assert.Contains(t, string(u), "config adoption_credentials\n\toption user 'admin'\n\toption password '!secret ssh'\n")
+	assert.Contains(t, string(u), "config switch_profiles\n\toption layer 'group:switches'\n\toption name 'uplink'\n\tlist tagged_vlans '20'\n")
+
+	y, err := UCIToYAML(u)
+	assert.Nil(t, err)
+	assert.Contains(t, string(y), "passphrase: !secret corp")
+	again, err := YAMLToUCI(y)
+	assert.Nil(t, err)
+	assert.Equal(t, string(u), string(again))
+
+	_, err = YAMLToUCI([]byte("listen:\n  informs: \":8080\"\n"))
+	assert.EqualError(t, err, "line 2: listen_informs: unknown setting")
+}
+
+func TestRedact(t *testing.T) {
+	v := map[string]interface{}{
+		"wlan": map[string]interface{}{
+			"wlans": []interface{}{map[string]interface{}{"ssid": "corp", "passphrase": "correct horse"}},
+		},
+		"mgmt": map[string]interface{}{"ssh": map[string]interface{}{"password_hash": nil}},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"wlan": map[string]interface{}{
+			"wlans": []interface{}{map[string]interface{}{"ssid": "corp", "passphrase": Redacted}},
+		},
+		"mgmt": map[string]interface{}{"ssh": map[string]interface{}{"password_hash": nil}},
+	}, Redact(v))
+	assert.True(t, Secret("passphrase"))
+	assert.False(t, Secret("ssid"))
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/mgmt"
+	"github.com/jda/nanofi/template"
+	"github.com/jda/nanofi/usw"
+	"github.com/jda/nanofi/wlan"
+)
+
+// Layer is what a template layer sets, and what the layers resolve to for
+// a device
+type Layer struct {
+	WLAN   *wlan.Config  `json:"wlan,omitempty"`
+	Switch *usw.Config   `json:"switch,omitempty"`
+	Mgmt   mgmt.Settings `json:"mgmt"`
+}
+
+// Validate checks every part of the config that's set
+func (l Layer) Validate() error {
+	if l.WLAN != nil {
+		if err := l.WLAN.Validate(); err != nil {
+			return fmt.Errorf("wlan: %w", err)
+		}
+	}
+	if l.Switch != nil {
+		if err := l.Switch.Validate(); err != nil {
+			return fmt.Errorf("switch: %w", err)
+		}
+	}
+	if err := l.Mgmt.Validate(); err != nil {
+		return fmt.Errorf("mgmt: %w", err)
+	}
+	return nil
+}
+
+// CheckLayers checks that each of t's layers sets only what a Layer has,
+// and that it's valid resolved over the layers beneath it. It returns the
+// path of the first layer that isn't, e.g. sites.warehouse.
+func CheckLayers(t *template.Templates) (string, error) {
+	check := func(l template.Layer, dev device.Device) error {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		var own Layer
+		if err := dec.Decode(&own); err != nil {
+			return err
+		}
+		var cfg Layer
+		if err := t.Resolve(dev).Decode(&cfg); err != nil {
+			return err
+		}
+		return cfg.Validate()
+	}
+
+	if err := check(t.Default, device.Device{}); err != nil {
+		return "default", err
+	}
+	for _, name := range layerNames(t.Sites) {
+		if err := check(t.Sites[name], device.Device{Site: name}); err != nil {
+			return "sites." + name, err
+		}
+	}
+	for _, name := range layerNames(t.Groups) {
+		if err := check(t.Groups[name], device.Device{Group: name}); err != nil {
+			return "groups." + name, err
+		}
+	}
+	for _, mac := range layerNames(t.Devices) {
+		if err := check(t.Devices[mac], t.Place(device.Device{MAC: mac})); err != nil {
+			return "devices." + mac, err
+		}
+	}
+	return "", nil
+}
+
+func layerNames(m map[string]template.Layer) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Redacted replaces secret values in config that's shown
+const Redacted = "********"
+
+// secretKeys are layer keys whose values aren't shown
+var secretKeys = map[string]bool{"passphrase": true, "password_hash": true}
+
+// Secret reports whether the layer key key holds a secret
+func Secret(key string) bool {
+	return secretKeys[key]
+}
+
+// Redact returns v, decoded from JSON, with secrets in any objects within
+// it hidden
+func Redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if secretKeys[k] && e != nil {
+				out[k] = Redacted
+			} else {
+				out[k] = Redact(e)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = Redact(e)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,670 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jda/nanofi/uci"
+	"gopkg.in/yaml.v3"
+)
+
+// The config file can also be written in UCI, as /etc/config/nanofi on
+// OpenWRT. Settings are options of the nanofi section, named by their path
+// with _ between the parts:
+//
+//	config nanofi 'main'
+//		option inform_url 'http://192.168.1.1:8080/inform'
+//		option listen_inform ':8080'
+//		option adoption_ssh '1'
+//		list firmware_policy 'U7PG2=>= 4.3.28'
+//
+// Lists of values are UCI lists, and maps of values lists of key=value.
+// Lists and maps of objects are sections of their own, typed by their path;
+// map entries name their key with a name option:
+//
+//	config adoption_credentials
+//		option user 'admin'
+//		option password '!secret ssh'
+//
+//	config firmware_targets
+//		option name 'U7PG2'
+//		option version '4.3.28.11361'
+//
+// Template layers are default, site, group and device sections. Sites and
+// groups are named with a name option and list their devices; devices are
+// named with a mac option. Objects in a layer's lists and maps are
+// sections that say which layer they belong to:
+//
+//	config site
+//		option name 'warehouse'
+//		option mgmt_timezone 'America/Chicago'
+//		list device 'fc:ec:da:00:00:01'
+//
+//	config wlan_wlans
+//		option layer 'site:warehouse'
+//		option ssid 'corp'
+//
+// Values of the form "!secret name" are taken from the secrets file.
+
+var (
+	configType = reflect.TypeOf(Config{})
+	layerType  = reflect.TypeOf(Layer{})
+)
+
+// uciSection is the section holding settings outside template layers
+const uciSection = "nanofi"
+
+// Options with a meaning of their own in sections
+const (
+	uciName   = "name"
+	uciMAC    = "mac"
+	uciLayer  = "layer"
+	uciDevice = "device"
+)
+
+// layerKeys are the config's template keys, with the section type each
+// layer is written as
+var layerKeys = map[string]string{
+	"default": "default",
+	"sites":   "site",
+	"groups":  "group",
+	"devices": "device",
+}
+
+// memberKeys are where site and group sections' device lists go
+var memberKeys = map[string]string{
+	"site":  "site_devices",
+	"group": "group_devices",
+}
+
+// memberLayers are where site and group sections' layers go
+var memberLayers = map[string]string{
+	"site":  "sites",
+	"group": "groups",
+}
+
+// isUCI reports whether data is UCI rather than YAML
+func isUCI(data []byte) bool {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		word := strings.Fields(line)[0]
+		return word == "config" || word == "package"
+	}
+	return false
+}
+
+// UCIToYAML converts a UCI config file to YAML
+func UCIToYAML(data []byte) ([]byte, error) {
+	f, err := uci.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	root, err := fromUCI(f)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// YAMLToUCI converts a YAML config file to UCI
+func YAMLToUCI(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	f := &uci.File{Package: "nanofi"}
+	if len(doc.Content) == 0 {
+		return []byte(f.Render()), nil
+	}
+	if err := toUCI(doc.Content[0], f); err != nil {
+		return nil, err
+	}
+	return []byte(f.Render()), nil
+}
+
+// fromUCI builds the YAML document equivalent to f, with each value on the
+// line of the option it came from
+func fromUCI(f *uci.File) (*yaml.Node, error) {
+	root := mappingNode(1)
+	for _, s := range f.Sections {
+		var err error
+		switch s.Type {
+		case uciSection:
+			err = setOptions(root, s.Options, configType, "yaml", nil)
+		case "default":
+			err = setOptions(lookup(root, s.Line, "default"), s.Options, layerType, "json", nil)
+		case "site", "group":
+			err = fromMembers(root, s)
+		case "device":
+			mac, ok := s.Get(uciMAC)
+			if !ok {
+				return nil, fmt.Errorf("line %d: device sections need a mac", s.Line)
+			}
+			err = setOptions(lookup(root, s.Line, "devices", mac), s.Options, layerType, "json", []string{uciMAC})
+		default:
+			err = fromItem(root, s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// fromMembers adds a site or group section's layer and devices to root
+func fromMembers(root *yaml.Node, s *uci.Section) error {
+	name, ok := s.Get(uciName)
+	if !ok {
+		return fmt.Errorf("line %d: %s sections need a name", s.Line, s.Type)
+	}
+	if o := s.Option(uciDevice); o != nil {
+		seq := lookupSeq(root, o.Line, memberKeys[s.Type], name)
+		for _, mac := range o.Values {
+			seq.Content = append(seq.Content, scalarNode(mac, o.Line))
+		}
+	}
+	var options []*uci.Option
+	for _, o := range s.Options {
+		if o.Name != uciName && o.Name != uciDevice {
+			options = append(options, o)
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return setOptions(lookup(root, s.Line, memberLayers[s.Type], name), options, layerType, "json", nil)
+}
+
+// fromItem adds a section holding an object in a list or map to root
+func fromItem(root *yaml.Node, s *uci.Section) error {
+	parent, t, tag := root, configType, "yaml"
+	if ref, ok := s.Get(uciLayer); ok {
+		var err error
+		if parent, err = layerNode(root, ref, s.Line); err != nil {
+			return err
+		}
+		t, tag = layerType, "json"
+	}
+
+	path, ft, ok := resolve(t, s.Type, tag)
+	if !ok || !isItems(ft) {
+		return fmt.Errorf("line %d: unknown section type %q", s.Line, s.Type)
+	}
+	ft = deref(ft)
+	item := mappingNode(s.Line)
+	if err := setOptions(item, s.Options, deref(ft.Elem()), tag, []string{uciName, uciLayer}); err != nil {
+		return err
+	}
+
+	if ft.Kind() == reflect.Slice {
+		seq := lookupSeq(parent, s.Line, path...)
+		seq.Content = append(seq.Content, item)
+		return nil
+	}
+	key, ok := s.Get(uciName)
+	if !ok {
+		return fmt.Errorf("line %d: %s sections need a name", s.Line, s.Type)
+	}
+	m := lookup(parent, s.Line, path...)
+	m.Content = append(m.Content, scalarNode(key, s.Line), item)
+	return nil
+}
+
+// layerNode returns the layer named by ref, such as site:warehouse
+func layerNode(root *yaml.Node, ref string, line int) (*yaml.Node, error) {
+	if ref == "default" {
+		return lookup(root, line, "default"), nil
+	}
+	i := strings.IndexByte(ref, ':')
+	if i > 0 {
+		for key, typ := range layerKeys {
+			if typ == ref[:i] && key != "default" {
+				return lookup(root, line, key, ref[i+1:]), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("line %d: layer must be default, site:<name>, group:<name> or device:<mac>, not %q", line, ref)
+}
+
+// setOptions sets the values options give for fields of t in m, skipping
+// the options in skip
+func setOptions(m *yaml.Node, options []*uci.Option, t reflect.Type, tag string, skip []string) error {
+options:
+	for _, o := range options {
+		for _, name := range skip {
+			if o.Name == name {
+				continue options
+			}
+		}
+		path, ft, ok := resolve(t, o.Name, tag)
+		if !ok {
+			return fmt.Errorf("line %d: %s: unknown setting", o.Line, o.Name)
+		}
+		v, err := valueNode(o, ft)
+		if err != nil {
+			return err
+		}
+		parent := lookup(m, o.Line, path[:len(path)-1]...)
+		parent.Content = append(parent.Content, scalarNode(path[len(path)-1], o.Line), v)
+	}
+	return nil
+}
+
+// valueNode converts o's values to a node of type t
+func valueNode(o *uci.Option, t reflect.Type) (*yaml.Node, error) {
+	t = deref(t)
+	switch {
+	case isScalar(t) || t.Kind() == reflect.Interface:
+		if !o.List {
+			return typedNode(o.Value(), t, o.Line)
+		}
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: o.Line}
+		for _, v := range o.Values {
+			n, err := typedNode(v, nil, o.Line)
+			if err != nil {
+				return nil, err
+			}
+			seq.Content = append(seq.Content, n)
+		}
+		return seq, nil
+	case t.Kind() == reflect.Slice && isScalar(deref(t.Elem())):
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: o.Line}
+		for _, v := range o.Values {
+			n, err := typedNode(v, t.Elem(), o.Line)
+			if err != nil {
+				return nil, err
+			}
+			seq.Content = append(seq.Content, n)
+		}
+		return seq, nil
+	case t.Kind() == reflect.Map && isScalar(deref(t.Elem())):
+		m := mappingNode(o.Line)
+		for _, v := range o.Values {
+			i := strings.IndexByte(v, '=')
+			if i < 0 {
+				return nil, fmt.Errorf("line %d: %s: %q must be key=value", o.Line, o.Name, v)
+			}
+			n, err := typedNode(v[i+1:], t.Elem(), o.Line)
+			if err != nil {
+				return nil, err
+			}
+			m.Content = append(m.Content, scalarNode(v[:i], o.Line), n)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("line %d: %s: is a section of its own rather than an option", o.Line, o.Name)
+}
+
+// typedNode converts the UCI value v to a node of type t, or leaves YAML to
+// decide its type if t is nil
+func typedNode(v string, t reflect.Type, line int) (*yaml.Node, error) {
+	n := scalarNode(v, line)
+	if strings.HasPrefix(v, secretTag+" ") {
+		n.Tag, n.Value = secretTag, strings.TrimSpace(v[len(secretTag):])
+		return n, nil
+	}
+	if t == nil {
+		n.Tag = ""
+		return n, nil
+	}
+	t = deref(t)
+	switch {
+	case reflect.PtrTo(t).Implements(textUnmarshaler) || t.Kind() == reflect.String:
+	case t.Kind() == reflect.Bool:
+		b, ok := uciBool(v)
+		if !ok {
+			return nil, fmt.Errorf("line %d: %q isn't a boolean", line, v)
+		}
+		n.Tag, n.Value = "!!bool", strconv.FormatBool(b)
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		n.Tag = "!!int"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		n.Tag = "!!float"
+	default:
+		n.Tag = ""
+	}
+	return n, nil
+}
+
+// uciBool parses the booleans UCI accepts
+func uciBool(v string) (bool, bool) {
+	switch strings.ToLower(v) {
+	case "1", "yes", "on", "true", "enabled":
+		return true, true
+	case "0", "no", "off", "false", "disabled":
+		return false, true
+	}
+	return false, false
+}
+
+func scalarNode(v string, line int) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v, Line: line}
+}
+
+func mappingNode(line int) *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line}
+}
+
+// lookup returns the mapping at path under m, creating it if need be
+func lookup(m *yaml.Node, line int, path ...string) *yaml.Node {
+	for _, key := range path {
+		m = child(m, key, line, yaml.MappingNode)
+	}
+	return m
+}
+
+// lookupSeq returns the sequence at path under m, creating it if need be
+func lookupSeq(m *yaml.Node, line int, path ...string) *yaml.Node {
+	m = lookup(m, line, path[:len(path)-1]...)
+	return child(m, path[len(path)-1], line, yaml.SequenceNode)
+}
+
+func child(m *yaml.Node, key string, line int, kind yaml.Kind) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	n := mappingNode(line)
+	if kind == yaml.SequenceNode {
+		n = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+	}
+	m.Content = append(m.Content, scalarNode(key, line), n)
+	return n
+}
+
+// resolve finds the field of t an option name refers to, the name being
+// the field's path with _ between the parts
+func resolve(t reflect.Type, name string, tag string) ([]string, reflect.Type, bool) {
+	t = deref(t)
+	if t.Kind() != reflect.Struct {
+		return nil, nil, false
+	}
+	fields := fieldsByTag(t, tag)
+	if f, ok := fields[name]; ok {
+		return []string{name}, f.Type, true
+	}
+
+	// field names have _ in them too, so try the longest first
+	names := make([]string, 0, len(fields))
+	for n := range fields {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, n := range names {
+		if !strings.HasPrefix(name, n+"_") {
+			continue
+		}
+		if path, ft, ok := resolve(fields[n].Type, name[len(n)+1:], tag); ok {
+			return append([]string{n}, path...), ft, true
+		}
+	}
+	return nil, nil, false
+}
+
+// toUCI adds the sections equivalent to the YAML config root to f
+func toUCI(root *yaml.Node, f *uci.File) error {
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: config must be a mapping", root.Line)
+	}
+	main := f.Add(uciSection, "main")
+	fields := fieldsByTag(configType, "yaml")
+
+	members := make(map[string]map[string]*uci.Section)
+	for typ := range memberKeys {
+		members[typ] = make(map[string]*uci.Section)
+	}
+	var memberLists []*yaml.Node
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, v := root.Content[i].Value, root.Content[i+1]
+		if key == memberKeys["site"] || key == memberKeys["group"] {
+			memberLists = append(memberLists, root.Content[i], v)
+			continue
+		}
+		typ, isLayer := layerKeys[key]
+		if !isLayer {
+			ft, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("line %d: %s: unknown setting", root.Content[i].Line, key)
+			}
+			if err := toOptions(f, main, key, v, ft.Type, "yaml", ""); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if typ == "default" {
+			if err := toLayer(f, f.Add(typ, ""), v, "default"); err != nil {
+				return err
+			}
+			continue
+		}
+		if v.Kind != yaml.MappingNode {
+			return fmt.Errorf("line %d: %s: expected a mapping", v.Line, key)
+		}
+		for j := 0; j+1 < len(v.Content); j += 2 {
+			name := v.Content[j].Value
+			s := f.Add(typ, "")
+			if typ == "device" {
+				s.Set(uciMAC, name)
+			} else {
+				s.Set(uciName, name)
+				members[typ][name] = s
+			}
+			if err := toLayer(f, s, v.Content[j+1], typ+":"+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	// devices go in the sections of the sites and groups they're in
+	for i := 0; i+1 < len(memberLists); i += 2 {
+		typ := "site"
+		if memberLists[i].Value == memberKeys["group"] {
+			typ = "group"
+		}
+		v := memberLists[i+1]
+		if v.Kind != yaml.MappingNode {
+			return fmt.Errorf("line %d: %s: expected a mapping", v.Line, memberLists[i].Value)
+		}
+		for j := 0; j+1 < len(v.Content); j += 2 {
+			name, macs := v.Content[j].Value, v.Content[j+1]
+			s, ok := members[typ][name]
+			if !ok {
+				s = f.Add(typ, "")
+				s.Set(uciName, name)
+				members[typ][name] = s
+			}
+			if macs.Kind != yaml.SequenceNode {
+				return fmt.Errorf("line %d: %s.%s: expected a list", macs.Line, memberLists[i].Value, name)
+			}
+			for _, mac := range macs.Content {
+				s.Add(uciDevice, mac.Value)
+			}
+		}
+	}
+
+	if len(main.Options) == 0 {
+		f.Sections = f.Sections[1:]
+	}
+	return nil
+}
+
+// toLayer writes the template layer n into s
+func toLayer(f *uci.File, s *uci.Section, n *yaml.Node, ref string) error {
+	if n.Tag == "!!null" {
+		return nil
+	}
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: %s: expected a mapping", n.Line, ref)
+	}
+	fields := fieldsByTag(layerType, "json")
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := n.Content[i].Value
+		ft, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("line %d: %s: unknown setting", n.Content[i].Line, key)
+		}
+		if err := toOptions(f, s, key, n.Content[i+1], ft.Type, "json", ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toOptions writes n, of type t, as option name of s, or as sections of its
+// own for lists and maps of objects. Sections within a template layer name
+// it with ref.
+func toOptions(f *uci.File, s *uci.Section, name string, n *yaml.Node, t reflect.Type, tag string, ref string) error {
+	t = deref(t)
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Tag == "!!null" {
+		return nil
+	}
+
+	switch {
+	case n.Kind == yaml.ScalarNode:
+		if !isScalar(t) && t.Kind() != reflect.Interface {
+			return fmt.Errorf("line %d: %s: expected a %s", n.Line, name, t.Kind())
+		}
+		s.Set(name, uciValue(n, t))
+	case t.Kind() == reflect.Struct && n.Kind == yaml.MappingNode:
+		fields := fieldsByTag(t, tag)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			ft, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("line %d: %s_%s: unknown setting", n.Content[i].Line, name, key)
+			}
+			if err := toOptions(f, s, name+"_"+key, n.Content[i+1], ft.Type, tag, ref); err != nil {
+				return err
+			}
+		}
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Interface) && n.Kind == yaml.SequenceNode:
+		var elem reflect.Type
+		if t.Kind() == reflect.Slice {
+			elem = deref(t.Elem())
+		}
+		if elem == nil || isScalar(elem) {
+			for _, item := range n.Content {
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: %s: can't be written as UCI", item.Line, name)
+				}
+				s.Add(name, uciValue(item, elem))
+			}
+			return nil
+		}
+		for _, item := range n.Content {
+			if err := toItem(f, name, "", item, elem, tag, ref); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Map && n.Kind == yaml.MappingNode:
+		elem := deref(t.Elem())
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, v := n.Content[i].Value, n.Content[i+1]
+			if isScalar(elem) {
+				if v.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: %s.%s: expected a %s", v.Line, name, key, elem.Kind())
+				}
+				s.Add(name, key+"="+uciValue(v, elem))
+				continue
+			}
+			if err := toItem(f, name, key, v, elem, tag, ref); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("line %d: %s: can't be written as UCI", n.Line, name)
+	}
+	return nil
+}
+
+// toItem writes an object in a list or map as a section of type typ, named
+// key if it's in a map
+func toItem(f *uci.File, typ string, key string, n *yaml.Node, t reflect.Type, tag string, ref string) error {
+	if t.Kind() != reflect.Struct || n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: %s: expected a mapping", n.Line, typ)
+	}
+	s := f.Add(typ, "")
+	if ref != "" {
+		s.Set(uciLayer, ref)
+	}
+	if key != "" {
+		s.Set(uciName, key)
+	}
+	fields := fieldsByTag(t, tag)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		name := n.Content[i].Value
+		ft, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("line %d: %s.%s: unknown setting", n.Content[i].Line, typ, name)
+		}
+		if err := toOptions(f, s, name, n.Content[i+1], ft.Type, tag, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uciValue is the UCI value for the scalar n of type t
+func uciValue(n *yaml.Node, t reflect.Type) string {
+	if n.Tag == secretTag {
+		return secretTag + " " + n.Value
+	}
+	if t != nil && t.Kind() == reflect.Bool {
+		if b, ok := uciBool(n.Value); ok {
+			if b {
+				return "1"
+			}
+			return "0"
+		}
+	}
+	return n.Value
+}
+
+// isScalar reports whether values of t are written as a single string
+func isScalar(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(textUnmarshaler) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Map, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// isItems reports whether t is a list or map of objects
+func isItems(t reflect.Type) bool {
+	t = deref(t)
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Map) && deref(t.Elem()).Kind() == reflect.Struct && !isScalar(deref(t.Elem()))
+}
+
+func deref(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
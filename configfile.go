@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/config"
+	"github.com/jda/nanofi/template"
+)
+
+// stateFlags are the files -config's storage directory holds
+var stateFlags = []string{"devices", "commands", "config-events", "bench-results", "rollout-events", "dhcp-leases", "api-self-signed", "auth", "audit"}
+
+// configFile is the -config file and what nanofi took from it rather than
+// from flags
+type configFile struct {
+	path    string
+	running *config.Config
+	// templates and policy are reloaded from the file on SIGHUP
+	templates bool
+	policy    bool
+}
+
+// givenFlags returns the flags set on the command line
+func givenFlags() map[string]bool {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
+
+// applyConfig fills in the flags not given on the command line from cfg
+func applyConfig(cfg *config.Config, given map[string]bool) error {
+	set := func(name string, value string) error {
+		if value == "" || given[name] {
+			return nil
+		}
+		return flag.Set(name, value)
+	}
+
+	if cfg.Storage != "" {
+		if err := os.MkdirAll(cfg.Storage, 0755); err != nil {
+			return fmt.Errorf("could not create storage: %w", err)
+		}
+		for _, name := range stateFlags {
+			if err := set(name, filepath.Join(cfg.Storage, flag.Lookup(name).DefValue)); err != nil {
+				return err
+			}
+		}
+	}
+
+	settings := map[string]string{
+		"listen":           cfg.Listen.Inform,
+		"firmware-listen":  cfg.Listen.Firmware,
+		"stun-listen":      cfg.Listen.STUN,
+		"discovery-listen": cfg.Listen.Discovery,
+		"api-listen":       cfg.Listen.API,
+		"api-cert":         cfg.TLS.Cert,
+		"api-key":          cfg.TLS.Key,
+		"api-client-ca":    cfg.TLS.ClientCA,
+		"inform-url":       cfg.InformURL,
+		"ssh-adopt-scan":   cfg.Adoption.Scan,
+		"firmware-dir":     cfg.Firmware.Dir,
+		"firmware-url":     cfg.Firmware.URL,
+		"dhcp-interface":   cfg.DHCP.Interface,
+		"dhcp-range":       cfg.DHCP.Range,
+		"dhcp-domain":      cfg.DHCP.Domain,
+		"dhcp-router":      cfg.DHCP.Router,
+		"dhcp-dns":         strings.Join(cfg.DHCP.DNS, ","),
+	}
+	if cfg.Adoption.SSH {
+		settings["ssh-adopt"] = "true"
+	}
+	for name, value := range settings {
+		if err := set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// templatesFrom returns the templates in the config file, unless flags
+// give them
+func (f *configFile) templatesFrom(path string, wlanPath string, switchPath string, mgmtPath string) (*template.Templates, error) {
+	if !f.templates {
+		if f.running.HasTemplates() {
+			glog.Warningf("config: using templates from flags rather than %s", f.path)
+		}
+		return loadTemplates(path, wlanPath, switchPath, mgmtPath)
+	}
+	return f.running.Templates()
+}
+
+// watch reloads the config file on SIGHUP
+func (f *configFile) watch(c *controller) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := f.reload(c); err != nil {
+				glog.Errorf("config: not reloading: %s", err)
+			}
+		}
+	}()
+}
+
+// reload applies the config file again if it's valid. Templates and the
+// firmware policy change in place; anything else needs a restart.
+func (f *configFile) reload(c *controller) error {
+	next, err := config.Load(f.path)
+	if err != nil {
+		return err
+	}
+
+	var t *template.Templates
+	if f.templates {
+		if t, err = next.Templates(); err != nil {
+			return err
+		}
+		if dev, err := checkTemplates(t, c.devices); err != nil {
+			return next.DeviceError(dev, err)
+		}
+		c.provision.setTemplates(t)
+	}
+	if f.policy {
+		c.setPolicy(next.Firmware.Policy)
+	}
+
+	restart := f.running.RestartNeeded(next)
+	for _, name := range restart {
+		glog.Warningf("config: restart nanofi to apply the change to %s", name)
+	}
+	f.running = next
+	glog.Infof("config: reloaded %s", f.path)
+	c.record(audit.Entry{
+		Actor:  actorReload,
+		Action: audit.ActionReload,
+		Target: f.path,
+		After:  audit.Value(map[string]interface{}{"templates": f.templates, "policy": f.policy, "restart_needed": restart}),
+	})
+	return nil
+}
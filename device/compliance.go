@@ -0,0 +1,65 @@
+package device
+
+import (
+	"sort"
+
+	"github.com/jda/nanofi/version"
+)
+
+// Policy maps device model to the firmware versions it is allowed to run
+type Policy map[string]*version.Constraint
+
+// ComplianceStatus is how a device's firmware compares to policy
+type ComplianceStatus string
+
+// Compliance statuses
+const (
+	Compliant    ComplianceStatus = "compliant"
+	NonCompliant ComplianceStatus = "noncompliant"
+	NoPolicy     ComplianceStatus = "nopolicy"
+)
+
+// ComplianceEntry is one device's line in a compliance report
+type ComplianceEntry struct {
+	MAC      string           `json:"mac"`
+	Model    string           `json:"model"`
+	Version  string           `json:"version"`
+	Policy   string           `json:"policy,omitempty"`
+	Status   ComplianceStatus `json:"status"`
+	Hostname string           `json:"hostname,omitempty"`
+}
+
+// Compliance checks the firmware of each device against policy. Entries are
+// sorted with non-compliant devices first, then by model and MAC.
+func Compliance(devices []Device, policy Policy) []ComplianceEntry {
+	out := make([]ComplianceEntry, 0, len(devices))
+	for _, d := range devices {
+		e := ComplianceEntry{
+			MAC:      d.MAC,
+			Model:    d.Model,
+			Version:  d.Version,
+			Status:   NoPolicy,
+			Hostname: d.Hostname,
+		}
+		if c, ok := policy[d.Model]; ok && c != nil {
+			e.Policy = c.String()
+			e.Status = NonCompliant
+			if c.MatchString(d.Version) {
+				e.Status = Compliant
+			}
+		}
+		out = append(out, e)
+	}
+
+	rank := map[ComplianceStatus]int{NonCompliant: 0, NoPolicy: 1, Compliant: 2}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Status != out[j].Status {
+			return rank[out[i].Status] < rank[out[j].Status]
+		}
+		if out[i].Model != out[j].Model {
+			return out[i].Model < out[j].Model
+		}
+		return out[i].MAC < out[j].MAC
+	})
+	return out
+}
@@ -0,0 +1,34 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/jda/nanofi/version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompliance(t *testing.T) {
+	devices := []Device{
+		{MAC: "74:83:c2:0f:15:b0", Model: "USMINI", Version: "1.6.1.525"},
+		{MAC: "78:8a:20:00:00:01", Model: "U7PG2", Version: "4.3.20.11298"},
+		{MAC: "78:8a:20:00:00:02", Model: "U7PG2", Version: "4.3.28.11361"},
+		{MAC: "fc:ec:da:00:00:01", Model: "U6LR", Version: "6.5.28.14491"},
+	}
+	policy := Policy{
+		"USMINI": version.MustParseConstraint(">= 1.2.1"),
+		"U7PG2":  version.MustParseConstraint(">= 4.3.28"),
+	}
+
+	report := Compliance(devices, policy)
+	assert.Len(t, report, 4)
+
+	assert.Equal(t, "78:8a:20:00:00:01", report[0].MAC)
+	assert.Equal(t, NonCompliant, report[0].Status)
+	assert.Equal(t, ">= 4.3.28", report[0].Policy)
+	assert.Equal(t, NoPolicy, report[1].Status)
+	assert.Equal(t, "U6LR", report[1].Model)
+	assert.Equal(t, Compliant, report[2].Status)
+	assert.Equal(t, "U7PG2", report[2].Model)
+	assert.Equal(t, Compliant, report[3].Status)
+	assert.Equal(t, "USMINI", report[3].Model)
+}
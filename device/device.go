@@ -0,0 +1,128 @@
+// Package device keeps track of UniFi devices that have informed nanofi
+// along with the per-device state (authkey, firmware, adoption) that
+// the controller needs to remember between informs.
+package device
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrUnknownDevice is returned when a device is not in the registry
+var ErrUnknownDevice = errors.New("unknown device")
+
+// ErrInvalidMAC is returned when a device hardware address can't be parsed
+var ErrInvalidMAC = errors.New("invalid hardware address")
+
+// Device is everything nanofi knows about a single UniFi device. Site and
+// Group are where the config templates put it; the registry doesn't keep
+// them, as they change with the config.
+type Device struct {
+	MAC        string           `json:"mac"`
+	Model      string           `json:"model"`
+	Type       string           `json:"type,omitempty"`
+	Serial     string           `json:"serial"`
+	Version    string           `json:"version"`
+	Hostname   string           `json:"hostname"`
+	Site       string           `json:"site,omitempty"`
+	Group      string           `json:"group,omitempty"`
+	DHCPName   string           `json:"dhcp_hostname,omitempty"`
+	IP         string           `json:"ip"`
+	CfgVersion string           `json:"cfgversion"`
+	Default    bool             `json:"default"`
+	Adopted    bool             `json:"adopted"`
+	AuthKey    string           `json:"authkey,omitempty"`
+	Uptime     uint64           `json:"uptime"`
+	FirstSeen  time.Time        `json:"first_seen"`
+	LastSeen   time.Time        `json:"last_seen"`
+	Discovered time.Time        `json:"discovered"`
+	Firmware   []FirmwareChange `json:"firmware,omitempty"`
+	Clients    []Client         `json:"clients,omitempty"`
+	Ports      []Port           `json:"ports,omitempty"`
+	STUN       *STUNActivity    `json:"stun,omitempty"`
+}
+
+// STUNActivity is a device's use of the STUN server
+type STUNActivity struct {
+	// Addr is the address and port the device's requests came from
+	Addr     string    `json:"addr"`
+	Requests uint64    `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Client is a wireless station associated with an access point
+type Client struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	ESSID    string `json:"essid"`
+	Signal   int    `json:"signal"`
+	Uptime   uint64 `json:"uptime"`
+}
+
+// Port is the state of a switch port as last reported
+type Port struct {
+	Index      int    `json:"index"`
+	Enabled    bool   `json:"enabled"`
+	Up         bool   `json:"up"`
+	Speed      int    `json:"speed"`
+	FullDuplex bool   `json:"full_duplex"`
+	PoE        bool   `json:"poe"`
+	PoEMode    string `json:"poe_mode,omitempty"`
+	STPState   string `json:"stp_state,omitempty"`
+	Uplink     bool   `json:"uplink"`
+}
+
+// FirmwareChange records a device moving from one firmware version to another
+type FirmwareChange struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// Device kinds
+const (
+	KindAP      = "uap"
+	KindSwitch  = "usw"
+	KindGateway = "ugw"
+)
+
+// Kind is the kind of device, as reported or else guessed from its model
+func (d Device) Kind() string {
+	switch {
+	case d.Type != "":
+		return d.Type
+	case strings.HasPrefix(d.Model, "UGW"):
+		return KindGateway
+	case strings.HasPrefix(d.Model, "US"):
+		return KindSwitch
+	}
+	return KindAP
+}
+
+// Rebooted reports whether the device restarted between prev and d,
+// judged by uptime going backwards
+func (d Device) Rebooted(prev Device) bool {
+	return !prev.LastSeen.IsZero() && d.Uptime < prev.Uptime
+}
+
+// PreviousVersion returns the firmware the device ran before its current
+// version, or "" if no change has been recorded
+func (d Device) PreviousVersion() string {
+	if len(d.Firmware) == 0 {
+		return ""
+	}
+	return d.Firmware[len(d.Firmware)-1].From
+}
+
+// NormalizeMAC returns the canonical lowercase, colon separated form of
+// a hardware address
+func NormalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", ErrInvalidMAC
+	}
+	return hw.String(), nil
+}
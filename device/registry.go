@@ -0,0 +1,373 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jda/nanofi/atomicfile"
+	"github.com/jda/nanofi/inform"
+)
+
+// Registry holds all known devices keyed by MAC and optionally persists
+// them to a JSON file
+type Registry struct {
+	mu      sync.RWMutex
+	path    string
+	dirty   bool
+	devices map[string]*Device
+	now     func() time.Time
+}
+
+// NewRegistry creates a registry backed by the file at path, loading any
+// devices already saved there. An empty path keeps the registry in memory.
+func NewRegistry(path string) (*Registry, error) {
+	r := &Registry{
+		path:    path,
+		devices: make(map[string]*Device),
+		now:     time.Now,
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read device registry: %w", err)
+	}
+
+	var devices []*Device
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("could not parse device registry %s: %w", path, err)
+	}
+	for _, d := range devices {
+		// older registries kept sites and groups, which are now config's
+		d.Site, d.Group = "", ""
+		r.devices[d.MAC] = d
+	}
+
+	return r, nil
+}
+
+// Get returns a copy of the device with the given MAC
+func (r *Registry) Get(mac string) (Device, bool) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return Device{}, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.devices[mac]
+	if !ok {
+		return Device{}, false
+	}
+	return d.copy(), true
+}
+
+// ByIP returns a copy of the device last seen at ip
+func (r *Registry) ByIP(ip string) (Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, d := range r.devices {
+		if d.IP == ip {
+			return d.copy(), true
+		}
+	}
+	return Device{}, false
+}
+
+// List returns copies of all known devices ordered by MAC
+func (r *Registry) List() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		out = append(out, d.copy())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+	return out
+}
+
+// Observe records a decoded inform from mac. adopted reports whether the
+// inform was encrypted with the device's own authkey rather than the
+// factory default. It returns the device as updated and as it was before.
+func (r *Registry) Observe(mac string, info inform.Info, adopted bool) (cur Device, prev Device, err error) {
+	mac, err = NormalizeMAC(mac)
+	if err != nil {
+		return cur, prev, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	d, ok := r.devices[mac]
+	if !ok {
+		d = &Device{MAC: mac, FirstSeen: now}
+		r.devices[mac] = d
+		r.dirty = true
+	}
+	prev = d.copy()
+
+	if d.Version != "" && info.Version != "" && d.Version != info.Version {
+		d.Firmware = append(d.Firmware, FirmwareChange{From: d.Version, To: info.Version, At: now})
+	}
+
+	if d.Model != info.Model || d.Type != info.Type || d.Serial != info.Serial || d.Version != info.Version ||
+		d.Hostname != info.Hostname || d.IP != info.IP || d.CfgVersion != info.CfgVersion ||
+		d.Default != info.Default || d.Adopted != adopted {
+		r.dirty = true
+	}
+
+	d.Model = info.Model
+	d.Type = info.Type
+	d.Serial = info.Serial
+	d.Version = info.Version
+	d.Hostname = info.Hostname
+	d.IP = info.IP
+	d.CfgVersion = info.CfgVersion
+	d.Default = info.Default
+	d.Adopted = adopted
+	d.Uptime = uint64(info.Uptime)
+	d.LastSeen = now
+
+	// clients and port states change with every inform, so like uptime
+	// they don't make the registry worth saving
+	d.Clients = d.Clients[:0]
+	for _, vap := range info.VAPs {
+		for _, sta := range vap.Stations {
+			d.Clients = append(d.Clients, Client{
+				MAC:      sta.MAC,
+				IP:       sta.IP,
+				Hostname: sta.Hostname,
+				ESSID:    vap.ESSID,
+				Signal:   sta.Signal,
+				Uptime:   uint64(sta.Uptime),
+			})
+		}
+	}
+
+	d.Ports = d.Ports[:0]
+	for _, p := range info.Ports {
+		d.Ports = append(d.Ports, Port{
+			Index:      p.Index,
+			Enabled:    p.Enabled,
+			Up:         p.Up,
+			Speed:      p.Speed,
+			FullDuplex: p.FullDuplex,
+			PoE:        p.PoE,
+			PoEMode:    p.PoEMode,
+			STPState:   p.STPState,
+			Uplink:     p.Uplink,
+		})
+	}
+
+	return d.copy(), prev, nil
+}
+
+// Discover records a device heard through discovery rather than inform.
+// Devices that have informed already know more about themselves than
+// discovery can tell, so only the time they were discovered is updated.
+func (r *Registry) Discover(mac string, info inform.Info) (Device, error) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return Device{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	d, ok := r.devices[mac]
+	if !ok {
+		d = &Device{MAC: mac, FirstSeen: now}
+		r.devices[mac] = d
+		r.dirty = true
+	}
+	d.Discovered = now
+	if !d.LastSeen.IsZero() {
+		return d.copy(), nil
+	}
+
+	if d.Model != info.Model || d.Type != info.Type || d.Serial != info.Serial || d.Version != info.Version ||
+		d.Hostname != info.Hostname || d.IP != info.IP || d.Default != info.Default {
+		r.dirty = true
+	}
+	d.Model = info.Model
+	d.Type = info.Type
+	d.Serial = info.Serial
+	d.Version = info.Version
+	d.Hostname = info.Hostname
+	d.IP = info.IP
+	d.Default = info.Default
+	d.Uptime = uint64(info.Uptime)
+
+	return d.copy(), nil
+}
+
+// Pending returns copies of devices that have not been adopted, ordered
+// by MAC
+func (r *Registry) Pending() []Device {
+	var out []Device
+	for _, d := range r.List() {
+		if !d.Adopted {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// ObserveSTUN records a STUN binding request from addr by the device last
+// seen at ip, returning the device if there was one
+func (r *Registry) ObserveSTUN(ip string, addr string) (Device, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range r.devices {
+		if d.IP != ip {
+			continue
+		}
+		if d.STUN == nil {
+			d.STUN = &STUNActivity{}
+		}
+		// a new mapping is worth keeping, another request isn't
+		if d.STUN.Addr != addr {
+			d.STUN.Addr = addr
+			r.dirty = true
+		}
+		d.STUN.Requests++
+		d.STUN.LastSeen = r.now()
+		return d.copy(), true
+	}
+	return Device{}, false
+}
+
+// NameLookup finds the address and hostname a MAC was given by DHCP
+type NameLookup func(mac string) (ip string, hostname string, ok bool)
+
+// Enrich fills in DHCP hostnames for the device with the given MAC and for
+// any of its clients that didn't report their own name or address
+func (r *Registry) Enrich(mac string, lookup NameLookup) (Device, error) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return Device{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[mac]
+	if !ok {
+		return Device{}, ErrUnknownDevice
+	}
+
+	if _, name, ok := lookup(mac); ok && name != d.DHCPName {
+		d.DHCPName = name
+		r.dirty = true
+	}
+	for i := range d.Clients {
+		c := &d.Clients[i]
+		ip, name, ok := lookup(c.MAC)
+		if !ok {
+			continue
+		}
+		if c.Hostname == "" {
+			c.Hostname = name
+		}
+		if c.IP == "" {
+			c.IP = ip
+		}
+	}
+
+	return d.copy(), nil
+}
+
+// Update applies fn to the device with the given MAC
+func (r *Registry) Update(mac string, fn func(d *Device)) (Device, error) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return Device{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[mac]
+	if !ok {
+		return Device{}, ErrUnknownDevice
+	}
+	fn(d)
+	r.dirty = true
+
+	return d.copy(), nil
+}
+
+// Forget removes a device from the registry
+func (r *Registry) Forget(mac string) error {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.devices[mac]; !ok {
+		return ErrUnknownDevice
+	}
+	delete(r.devices, mac)
+	r.dirty = true
+
+	return nil
+}
+
+// Save writes the registry to disk if anything worth keeping has changed
+// since the last save. Uptime and last seen alone don't count, to spare
+// the flash on small routers.
+func (r *Registry) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.path == "" || !r.dirty {
+		return nil
+	}
+
+	devices := make([]*Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MAC < devices[j].MAC })
+
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode device registry: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(r.path, data, 0600); err != nil {
+		return fmt.Errorf("could not save device registry: %w", err)
+	}
+	r.dirty = false
+
+	return nil
+}
+
+func (d *Device) copy() Device {
+	c := *d
+	c.Firmware = append([]FirmwareChange(nil), d.Firmware...)
+	c.Clients = append([]Client(nil), d.Clients...)
+	c.Ports = append([]Port(nil), d.Ports...)
+	if d.STUN != nil {
+		stun := *d.STUN
+		c.STUN = &stun
+	}
+	return c
+}
@@ -0,0 +1,184 @@
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/inform"
+	"github.com/stretchr/testify/assert"
+)
+
+var sampleInfo = inform.Info{
+	MAC:        "74:83:c2:0f:15:b0",
+	Serial:     "7483C20F15B0",
+	Model:      "USMINI",
+	Version:    "1.6.1.525",
+	Hostname:   "USW_MINI",
+	IP:         "192.168.1.61",
+	CfgVersion: "?",
+	Default:    true,
+	Uptime:     155,
+}
+
+func TestObserve(t *testing.T) {
+	r, err := NewRegistry("")
+	assert.Nil(t, err)
+
+	cur, prev, err := r.Observe("74:83:C2:0F:15:B0", sampleInfo, false)
+	assert.Nil(t, err)
+	assert.True(t, prev.LastSeen.IsZero(), "first inform has no previous state")
+	assert.Equal(t, "74:83:c2:0f:15:b0", cur.MAC, "mac should be normalized")
+	assert.Equal(t, "USMINI", cur.Model)
+
+	info := sampleInfo
+	info.Version = "2.0.0.1"
+	info.Uptime = 12
+	cur, prev, err = r.Observe(sampleInfo.MAC, info, true)
+	assert.Nil(t, err)
+	assert.True(t, cur.Rebooted(prev), "uptime went backwards")
+	assert.True(t, cur.Adopted)
+	assert.Equal(t, "1.6.1.525", cur.PreviousVersion())
+	assert.Len(t, cur.Firmware, 1)
+
+	byIP, ok := r.ByIP("192.168.1.61")
+	assert.True(t, ok)
+	assert.Equal(t, cur.MAC, byIP.MAC)
+
+	_, err = r.Update("00:00:00:00:00:01", func(d *Device) {})
+	assert.Equal(t, ErrUnknownDevice, err)
+
+	_, _, err = r.Observe("not a mac", info, false)
+	assert.Equal(t, ErrInvalidMAC, err)
+}
+
+func TestRegistryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+
+	r, err := NewRegistry(path)
+	assert.Nil(t, err)
+	r.now = func() time.Time { return time.Unix(1600000000, 0).UTC() }
+	_, _, err = r.Observe(sampleInfo.MAC, sampleInfo, false)
+	assert.Nil(t, err)
+	_, err = r.Update(sampleInfo.MAC, func(d *Device) {
+		d.AuthKey = "c0b2991c003a7ab6a9db093e216836a8"
+		// as older registries kept
+		d.Site, d.Group = "warehouse", "aps"
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, r.Save())
+
+	r2, err := NewRegistry(path)
+	assert.Nil(t, err)
+	d, ok := r2.Get(sampleInfo.MAC)
+	assert.True(t, ok, "device should survive reload")
+	assert.Equal(t, "c0b2991c003a7ab6a9db093e216836a8", d.AuthKey)
+	assert.Equal(t, time.Unix(1600000000, 0).UTC(), d.FirstSeen)
+	assert.Empty(t, d.Site, "sites and groups come from config")
+	assert.Empty(t, d.Group)
+
+	assert.Nil(t, r2.Forget(sampleInfo.MAC))
+	assert.Len(t, r2.List(), 0)
+}
+
+func TestDiscover(t *testing.T) {
+	r, err := NewRegistry("")
+	assert.Nil(t, err)
+
+	info := inform.Info{Model: "U7PG2", Type: KindAP, Version: "4.3.20.11298", IP: "192.168.1.62", Default: true}
+	d, err := r.Discover("78:8A:20:01:02:03", info)
+	assert.Nil(t, err)
+	assert.Equal(t, "U7PG2", d.Model)
+	assert.Equal(t, KindAP, d.Type)
+	r.dirty = false
+	_, err = r.Discover("78:8A:20:01:02:03", info)
+	assert.Nil(t, err)
+	assert.False(t, r.dirty, "discovering a device again changes nothing to save")
+	assert.True(t, d.LastSeen.IsZero(), "discovered devices haven't informed")
+	assert.False(t, d.Discovered.IsZero())
+
+	_, _, err = r.Observe(sampleInfo.MAC, sampleInfo, true)
+	assert.Nil(t, err)
+	d, err = r.Discover(sampleInfo.MAC, inform.Info{Model: "bogus", Version: "0.0.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "USMINI", d.Model, "inform wins over discovery")
+
+	pending := r.Pending()
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "78:8a:20:01:02:03", pending[0].MAC)
+}
+
+func TestEnrich(t *testing.T) {
+	r, err := NewRegistry("")
+	assert.Nil(t, err)
+
+	info := sampleInfo
+	info.VAPs = []inform.VAP{{ESSID: "lab", Stations: []inform.Station{
+		{MAC: "3c:22:fb:00:00:01"},
+		{MAC: "3c:22:fb:00:00:02", IP: "192.168.1.78", Hostname: "own-name"},
+	}}}
+	_, _, err = r.Observe(info.MAC, info, true)
+	assert.Nil(t, err)
+
+	leases := map[string][2]string{
+		info.MAC:            {"192.168.1.61", "usw-mini"},
+		"3c:22:fb:00:00:01": {"192.168.1.77", "laptop"},
+		"3c:22:fb:00:00:02": {"192.168.1.78", "phone"},
+	}
+	lookup := func(mac string) (string, string, bool) {
+		l, ok := leases[mac]
+		return l[0], l[1], ok
+	}
+
+	d, err := r.Enrich(info.MAC, lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, "usw-mini", d.DHCPName)
+	assert.Equal(t, "lab", d.Clients[0].ESSID)
+	assert.Equal(t, "laptop", d.Clients[0].Hostname)
+	assert.Equal(t, "192.168.1.77", d.Clients[0].IP)
+	assert.Equal(t, "own-name", d.Clients[1].Hostname, "names devices report win")
+
+	_, err = r.Enrich("00:00:00:00:00:01", lookup)
+	assert.Equal(t, ErrUnknownDevice, err)
+}
+
+func TestObserveSTUN(t *testing.T) {
+	r, err := NewRegistry("")
+	assert.Nil(t, err)
+	_, _, err = r.Observe(sampleInfo.MAC, sampleInfo, true)
+	assert.Nil(t, err)
+
+	_, ok := r.ObserveSTUN("192.168.1.99", "192.168.1.99:3478")
+	assert.False(t, ok, "not a device")
+
+	d, ok := r.ObserveSTUN(sampleInfo.IP, "203.0.113.7:40000")
+	assert.True(t, ok)
+	assert.Equal(t, "203.0.113.7:40000", d.STUN.Addr)
+	d, _ = r.ObserveSTUN(sampleInfo.IP, "203.0.113.7:40000")
+	assert.Equal(t, uint64(2), d.STUN.Requests)
+
+	d.STUN.Requests = 100
+	stored, _ := r.Get(sampleInfo.MAC)
+	assert.Equal(t, uint64(2), stored.STUN.Requests, "copies don't share activity")
+}
+
+func TestKind(t *testing.T) {
+	tests := []struct {
+		dev  Device
+		want string
+	}{
+		{Device{Type: "usw", Model: "U7PG2"}, KindSwitch},
+		{Device{Model: "US8P60"}, KindSwitch},
+		{Device{Model: "USMINI"}, KindSwitch},
+		{Device{Model: "UGW3"}, KindGateway},
+		{Device{Model: "UFLHD"}, KindAP},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.dev.Kind(), tt.dev.Model)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/dhcp"
+	"github.com/jda/nanofi/inform"
+)
+
+// startDHCP serves addresses from poolRange ("first,last", as in dnsmasq's
+// dhcp-range) on iface, pointing Ubiquiti devices at the interface's own
+// address. router and dns, a comma separated list, are handed out if set.
+// Leases to Ubiquiti devices are recorded in the device registry.
+func (c *controller) startDHCP(iface string, poolRange string, leaseTime time.Duration, leaseFile string, domain string, router string, dns string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return err
+	}
+	var ipnet *net.IPNet
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			ipnet = n
+			break
+		}
+	}
+	if ipnet == nil {
+		return fmt.Errorf("%s has no IPv4 address", iface)
+	}
+
+	bounds := strings.Split(poolRange, ",")
+	if len(bounds) != 2 {
+		return fmt.Errorf("DHCP range must be first,last: %q", poolRange)
+	}
+	start, end := net.ParseIP(strings.TrimSpace(bounds[0])), net.ParseIP(strings.TrimSpace(bounds[1]))
+	if start == nil || end == nil || !ipnet.Contains(start) || !ipnet.Contains(end) {
+		return fmt.Errorf("DHCP range %s is not within %s", poolRange, ipnet)
+	}
+
+	cfg := dhcp.Config{
+		Interface: iface,
+		ServerIP:  ipnet.IP.To4(),
+		Netmask:   ipnet.Mask,
+		Domain:    domain,
+	}
+	if router != "" {
+		if cfg.Router = net.ParseIP(router).To4(); cfg.Router == nil {
+			return fmt.Errorf("DHCP router must be an IPv4 address: %q", router)
+		}
+	} else {
+		glog.Warningf("dhcp: no -dhcp-router, so clients on %s get no default route", iface)
+	}
+	if dns != "" {
+		for _, s := range strings.Split(dns, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s)).To4()
+			if ip == nil {
+				return fmt.Errorf("DHCP DNS servers must be IPv4 addresses: %q", s)
+			}
+			cfg.DNS = append(cfg.DNS, ip)
+		}
+	}
+
+	pool, err := dhcp.NewPool(start, end, leaseTime, leaseFile)
+	if err != nil {
+		return err
+	}
+	srv := dhcp.NewServer(cfg, pool)
+	srv.OnLease = c.recordLease
+	c.names = func(mac string) (string, string, bool) {
+		l, ok := pool.Lookup(mac)
+		return l.IP, l.Hostname, ok
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(context.Background()); err != nil {
+			glog.Fatalf("DHCP server failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+// recordLease notes a device's address as soon as it has one, so devices
+// at defaults show up as pending before they inform
+func (c *controller) recordLease(l dhcp.Lease) {
+	if _, ok := c.devices.Get(l.MAC); !ok && !strings.Contains(l.VendorClass, "ubnt") {
+		return
+	}
+
+	info := inform.Info{MAC: l.MAC, IP: l.IP, Hostname: l.Hostname}
+	if d, ok := c.devices.Get(l.MAC); ok {
+		info.Model, info.Serial, info.Version = d.Model, d.Serial, d.Version
+		if d.Hostname != "" {
+			info.Hostname = d.Hostname
+		}
+		info.Default = d.Default
+	}
+	if _, err := c.devices.Discover(l.MAC, info); err != nil {
+		glog.Warningf("dhcp: %s: %s", l.MAC, err)
+		return
+	}
+	if err := c.devices.Save(); err != nil {
+		glog.Errorf("%s", err)
+	}
+}
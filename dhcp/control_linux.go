@@ -0,0 +1,23 @@
+package dhcp
+
+import (
+	"syscall"
+)
+
+// control binds the socket to iface, so the server only answers on the
+// staging network, and allows it to broadcast replies
+func control(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			if serr == nil && iface != "" {
+				serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
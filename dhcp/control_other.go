@@ -0,0 +1,16 @@
+// +build !linux
+
+package dhcp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control refuses to serve; binding to an interface and broadcasting
+// replies is only implemented for Linux
+func control(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("the DHCP server is only supported on Linux")
+	}
+}
@@ -0,0 +1,218 @@
+package dhcp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	serverIP = net.IPv4(192, 168, 1, 1).To4()
+	devMAC   = net.HardwareAddr{0x74, 0x83, 0xc2, 0x0f, 0x15, 0xb0}
+)
+
+func newTestServer(t *testing.T, path string) (*Server, *Pool) {
+	pool, err := NewPool(net.IPv4(192, 168, 1, 50), net.IPv4(192, 168, 1, 52), time.Hour, path)
+	assert.Nil(t, err)
+	cfg := Config{ServerIP: serverIP, Netmask: net.CIDRMask(24, 32), Domain: "lab"}
+	return NewServer(cfg, pool), pool
+}
+
+func request(msgType byte, mac net.HardwareAddr, opts map[byte][]byte) *Packet {
+	p := &Packet{
+		Op:      OpRequest,
+		XID:     0xdeadbeef,
+		CHAddr:  mac,
+		Options: map[byte][]byte{OptMessageType: {msgType}},
+	}
+	for k, v := range opts {
+		p.Options[k] = v
+	}
+	// go through the wire format like a real client
+	decoded, err := Decode(p.Encode())
+	if err != nil {
+		panic(err)
+	}
+	return decoded
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	p := &Packet{
+		Op:     OpReply,
+		XID:    42,
+		Flags:  flagBroadcast,
+		YIAddr: net.IPv4(192, 168, 1, 50).To4(),
+		CHAddr: devMAC,
+		Options: map[byte][]byte{
+			OptMessageType: {Offer},
+			OptHostname:    []byte("USW_MINI"),
+			OptVendorClass: long,
+		},
+	}
+	b := p.Encode()
+	assert.True(t, len(b) >= 300)
+
+	d, err := Decode(b)
+	assert.Nil(t, err)
+	assert.Equal(t, p.XID, d.XID)
+	assert.Equal(t, p.Flags, d.Flags)
+	assert.Equal(t, "192.168.1.50", d.YIAddr.String())
+	assert.Equal(t, devMAC, d.CHAddr)
+	assert.Equal(t, byte(Offer), d.MessageType())
+	assert.Equal(t, long, d.Options[OptVendorClass], "long options are split and rejoined")
+
+	_, err = Decode(b[:100])
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
+
+func TestServerLease(t *testing.T) {
+	s, pool := newTestServer(t, "")
+	var leased []Lease
+	s.OnLease = func(l Lease) { leased = append(leased, l) }
+
+	ubnt := map[byte][]byte{OptVendorClass: []byte("ubnt"), OptHostname: []byte("USW_MINI")}
+	offer := s.Handle(request(Discover, devMAC, ubnt))
+	assert.Equal(t, byte(Offer), offer.MessageType())
+	assert.Equal(t, "192.168.1.50", offer.YIAddr.String())
+	assert.Equal(t, []byte{0x01, 0x04, 192, 168, 1, 1}, offer.Options[OptVendorSpecific])
+	assert.Equal(t, []byte{255, 255, 255, 0}, offer.Options[OptSubnetMask])
+	assert.Equal(t, "lab", string(offer.Options[OptDomainName]))
+	assert.Nil(t, offer.Options[OptRouter], "no router unless one is set")
+	assert.Nil(t, offer.Options[OptDNS])
+
+	opts := map[byte][]byte{OptRequestedIP: offer.YIAddr, OptServerID: serverIP}
+	for k, v := range ubnt {
+		opts[k] = v
+	}
+	ack := s.Handle(request(Request, devMAC, opts))
+	assert.Equal(t, byte(Ack), ack.MessageType())
+	assert.Equal(t, []byte{0, 0, 0x0e, 0x10}, ack.Options[OptLeaseTime])
+	assert.Len(t, leased, 1)
+	assert.Equal(t, "USW_MINI", leased[0].Hostname)
+	assert.Equal(t, "ubnt", leased[0].VendorClass)
+	assert.Len(t, pool.Leases(), 1)
+	l, ok := pool.Lookup(devMAC.String())
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.1.50", l.IP)
+
+	laptop := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	offer = s.Handle(request(Discover, laptop, nil))
+	assert.Equal(t, "192.168.1.51", offer.YIAddr.String())
+	assert.Nil(t, offer.Options[OptVendorSpecific], "option 43 is only for Ubiquiti devices")
+
+	nak := s.Handle(request(Request, laptop, map[byte][]byte{OptRequestedIP: net.IPv4(192, 168, 1, 50).To4()}))
+	assert.Equal(t, byte(Nak), nak.MessageType(), "address belongs to someone else")
+
+	other := s.Handle(request(Request, laptop, map[byte][]byte{OptServerID: {10, 0, 0, 1}}))
+	assert.Nil(t, other, "requests for other servers are ignored")
+
+	assert.Nil(t, s.Handle(request(Release, devMAC, nil)))
+	assert.Len(t, pool.Leases(), 0)
+}
+
+func TestServerOptions(t *testing.T) {
+	pool, err := NewPool(net.IPv4(192, 168, 1, 50), net.IPv4(192, 168, 1, 52), time.Hour, "")
+	assert.Nil(t, err)
+	s := NewServer(Config{
+		ServerIP: serverIP,
+		Netmask:  net.CIDRMask(24, 32),
+		Router:   net.IPv4(192, 168, 1, 254),
+		DNS:      []net.IP{net.IPv4(192, 168, 1, 254), net.IPv4(9, 9, 9, 9)},
+	}, pool)
+
+	offer := s.Handle(request(Discover, devMAC, nil))
+	assert.Equal(t, []byte{192, 168, 1, 254}, offer.Options[OptRouter])
+	assert.Equal(t, []byte{192, 168, 1, 254, 9, 9, 9, 9}, offer.Options[OptDNS])
+}
+
+func TestServerDecline(t *testing.T) {
+	s, pool := newTestServer(t, "")
+	now := time.Unix(1600000000, 0)
+	pool.now = func() time.Time { return now }
+
+	offer := s.Handle(request(Discover, devMAC, nil))
+	ack := s.Handle(request(Request, devMAC, map[byte][]byte{OptRequestedIP: offer.YIAddr}))
+	assert.Equal(t, byte(Ack), ack.MessageType())
+	assert.Nil(t, s.Handle(request(Decline, devMAC, map[byte][]byte{OptRequestedIP: offer.YIAddr})))
+	assert.Len(t, pool.Leases(), 0)
+
+	offer = s.Handle(request(Discover, devMAC, map[byte][]byte{OptRequestedIP: net.IPv4(192, 168, 1, 50).To4()}))
+	assert.Equal(t, "192.168.1.51", offer.YIAddr.String(), "declined addresses aren't offered")
+	laptop := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	nak := s.Handle(request(Request, laptop, map[byte][]byte{OptRequestedIP: net.IPv4(192, 168, 1, 50).To4()}))
+	assert.Equal(t, byte(Nak), nak.MessageType())
+
+	now = now.Add(2 * time.Hour)
+	offer = s.Handle(request(Discover, laptop, nil))
+	assert.Equal(t, "192.168.1.50", offer.YIAddr.String(), "until a lease time has passed")
+}
+
+func TestPoolExhaustion(t *testing.T) {
+	_, pool := newTestServer(t, "")
+	now := time.Unix(1600000000, 0)
+	pool.now = func() time.Time { return now }
+
+	for i := byte(0); i < 3; i++ {
+		mac := net.HardwareAddr{0x02, 0, 0, 0, 0, i}.String()
+		ip, err := pool.Offer(mac, nil)
+		assert.Nil(t, err)
+		_, err = pool.Ack(mac, ip, "", "")
+		assert.Nil(t, err)
+	}
+
+	_, err := pool.Offer(devMAC.String(), nil)
+	assert.Equal(t, ErrPoolExhausted, err)
+
+	now = now.Add(2 * time.Hour)
+	ip, err := pool.Offer(devMAC.String(), nil)
+	assert.Nil(t, err, "expired leases are reused")
+	assert.Equal(t, "192.168.1.50", ip.String())
+}
+
+func TestPoolPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-dhcp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	_, pool := newTestServer(t, path)
+	_, err = pool.Ack(devMAC.String(), net.IPv4(192, 168, 1, 52), "USW_MINI", "ubnt")
+	assert.Nil(t, err)
+
+	_, reloaded := newTestServer(t, path)
+	ip, err := reloaded.Offer(devMAC.String(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.52", ip.String(), "clients keep their address across restarts")
+
+	_, err = NewPool(net.IPv4(192, 168, 1, 60), net.IPv4(192, 168, 1, 50), time.Hour, "")
+	assert.NotNil(t, err)
+}
+
+func TestPoolRangeChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-dhcp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	_, pool := newTestServer(t, path)
+	_, err = pool.Ack(devMAC.String(), net.IPv4(192, 168, 1, 52), "USW_MINI", "ubnt")
+	assert.Nil(t, err)
+
+	moved, err := NewPool(net.IPv4(192, 168, 1, 100), net.IPv4(192, 168, 1, 102), time.Hour, path)
+	assert.Nil(t, err)
+	ip, err := moved.Offer(devMAC.String(), net.IPv4(192, 168, 1, 52))
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.100", ip.String(), "leases outside the range aren't offered")
+	_, err = moved.Ack(devMAC.String(), ip, "USW_MINI", "ubnt")
+	assert.Nil(t, err, "so the client can take what is")
+}
@@ -0,0 +1,199 @@
+// Package dhcp is a minimal DHCPv4 server, just enough to stand up a
+// staging network for devices: a single lease pool, a lease file, and
+// Ubiquiti's vendor option 43 pointing devices at the controller.
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// BOOTP operations
+const (
+	OpRequest = 1
+	OpReply   = 2
+)
+
+// Message types (option 53)
+const (
+	Discover = 1
+	Offer    = 2
+	Request  = 3
+	Decline  = 4
+	Ack      = 5
+	Nak      = 6
+	Release  = 7
+	Inform   = 8
+)
+
+// Option codes
+const (
+	OptPad            = 0
+	OptSubnetMask     = 1
+	OptRouter         = 3
+	OptDNS            = 6
+	OptHostname       = 12
+	OptDomainName     = 15
+	OptBroadcast      = 28
+	OptVendorSpecific = 43
+	OptRequestedIP    = 50
+	OptLeaseTime      = 51
+	OptMessageType    = 53
+	OptServerID       = 54
+	OptParamList      = 55
+	OptRenewalTime    = 58
+	OptRebindingTime  = 59
+	OptVendorClass    = 60
+	OptClientID       = 61
+	OptEnd            = 255
+)
+
+// flagBroadcast asks for replies to be broadcast
+const flagBroadcast = 0x8000
+
+const (
+	fixedLen = 236
+	magic    = 0x63825363
+)
+
+// ErrMalformed is returned for packets that aren't valid DHCP
+var ErrMalformed = errors.New("malformed DHCP packet")
+
+// Packet is a DHCP message
+type Packet struct {
+	Op      byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options map[byte][]byte
+}
+
+// Decode parses a DHCP message
+func Decode(b []byte) (*Packet, error) {
+	if len(b) < fixedLen+4 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformed, len(b))
+	}
+	if binary.BigEndian.Uint32(b[fixedLen:]) != magic {
+		return nil, fmt.Errorf("%w: no magic cookie", ErrMalformed)
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, fmt.Errorf("%w: hardware address length %d", ErrMalformed, hlen)
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  ip4(b[12:16]),
+		YIAddr:  ip4(b[16:20]),
+		SIAddr:  ip4(b[20:24]),
+		GIAddr:  ip4(b[24:28]),
+		CHAddr:  append(net.HardwareAddr(nil), b[28:28+hlen]...),
+		Options: make(map[byte][]byte),
+	}
+
+	opts := b[fixedLen+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == OptEnd {
+			break
+		}
+		if code == OptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("%w: option %d truncated", ErrMalformed, code)
+		}
+		l := int(opts[1])
+		// options may be split and are concatenated (RFC 3396)
+		p.Options[code] = append(p.Options[code], opts[2:2+l]...)
+		opts = opts[2+l:]
+	}
+
+	return p, nil
+}
+
+// Encode serializes the message, options in ascending order
+func (p *Packet) Encode() []byte {
+	b := make([]byte, fixedLen+4, 576)
+	b[0] = p.Op
+	b[1] = 1 // ethernet
+	b[2] = byte(len(p.CHAddr))
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	binary.BigEndian.PutUint32(b[fixedLen:], magic)
+
+	for code := 1; code < OptEnd; code++ {
+		v, ok := p.Options[byte(code)]
+		if !ok {
+			continue
+		}
+		for {
+			n := len(v)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, byte(code), byte(n))
+			b = append(b, v[:n]...)
+			v = v[n:]
+			if len(v) == 0 {
+				break
+			}
+		}
+	}
+	b = append(b, OptEnd)
+
+	// some clients ignore replies shorter than a BOOTP packet
+	for len(b) < 300 {
+		b = append(b, OptPad)
+	}
+	return b
+}
+
+// MessageType returns the DHCP message type, or 0 for plain BOOTP
+func (p *Packet) MessageType() byte {
+	if v := p.Options[OptMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// IPOption returns an option holding a single IPv4 address
+func (p *Packet) IPOption(code byte) net.IP {
+	if v := p.Options[code]; len(v) == 4 {
+		return ip4(v)
+	}
+	return nil
+}
+
+// UbiquitiOption returns the value of vendor option 43 that points
+// Ubiquiti devices at the controller: sub-option 1 holding its address
+func UbiquitiOption(controller net.IP) []byte {
+	return append([]byte{0x01, 0x04}, controller.To4()...)
+}
+
+func ip4(b []byte) net.IP {
+	return net.IPv4(b[0], b[1], b[2], b[3]).To4()
+}
+
+func uint32Option(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
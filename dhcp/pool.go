@@ -0,0 +1,277 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrPoolExhausted is returned when there are no free addresses to offer
+var ErrPoolExhausted = errors.New("no free addresses in pool")
+
+// ErrNotOffered is returned when a client requests an address it can't have
+var ErrNotOffered = errors.New("address not available to client")
+
+// Lease is an address handed to a client
+type Lease struct {
+	MAC         string    `json:"mac"`
+	IP          string    `json:"ip"`
+	Hostname    string    `json:"hostname,omitempty"`
+	VendorClass string    `json:"vendor_class,omitempty"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Pool hands out addresses from a range, remembering leases in a file so
+// clients keep their address across restarts
+type Pool struct {
+	mu     sync.Mutex
+	start  uint32
+	end    uint32
+	ttl    time.Duration
+	path   string
+	leases map[string]*Lease
+	// declined holds addresses clients found in use until they can be
+	// offered again
+	declined map[uint32]time.Time
+	now      func() time.Time
+}
+
+// NewPool creates a pool of the addresses from start to end inclusive,
+// loading leases from path. An empty path keeps leases in memory.
+func NewPool(start net.IP, end net.IP, ttl time.Duration, path string) (*Pool, error) {
+	if start.To4() == nil || end.To4() == nil {
+		return nil, fmt.Errorf("DHCP pool must be IPv4: %s-%s", start, end)
+	}
+	p := &Pool{
+		start:    binary.BigEndian.Uint32(start.To4()),
+		end:      binary.BigEndian.Uint32(end.To4()),
+		ttl:      ttl,
+		path:     path,
+		leases:   make(map[string]*Lease),
+		declined: make(map[uint32]time.Time),
+		now:      time.Now,
+	}
+	if p.end < p.start {
+		return nil, fmt.Errorf("DHCP pool ends before it starts: %s-%s", start, end)
+	}
+	if path == "" {
+		return p, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read leases: %w", err)
+	}
+	var leases []*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("could not parse leases %s: %w", path, err)
+	}
+	for _, l := range leases {
+		p.leases[l.MAC] = l
+	}
+
+	return p, nil
+}
+
+// TTL is how long leases last
+func (p *Pool) TTL() time.Duration {
+	return p.ttl
+}
+
+// Offer picks an address for mac: the one it already has, the one it
+// asked for if that's free, or else the first free address. A lease that
+// has expired, been declined or fallen out of the range is dropped rather
+// than offered, as it couldn't be acked.
+func (p *Pool) Offer(mac string, requested net.IP) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.leases[mac]; ok {
+		ip := net.ParseIP(l.IP)
+		if ip != nil && p.now().Before(l.Expires) && p.free(mac, ip) {
+			return ip.To4(), nil
+		}
+		delete(p.leases, mac)
+	}
+	if requested != nil && p.free(mac, requested) {
+		return requested.To4(), nil
+	}
+	for i := p.start; i <= p.end && i >= p.start; i++ {
+		ip := fromUint(i)
+		if p.free(mac, ip) {
+			return ip, nil
+		}
+	}
+	return nil, ErrPoolExhausted
+}
+
+// Ack commits ip to mac, failing if it can't have it
+func (p *Pool) Ack(mac string, ip net.IP, hostname string, vendorClass string) (Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.free(mac, ip) {
+		return Lease{}, fmt.Errorf("%w: %s for %s", ErrNotOffered, ip, mac)
+	}
+	l := &Lease{
+		MAC:         mac,
+		IP:          ip.String(),
+		Hostname:    hostname,
+		VendorClass: vendorClass,
+		Expires:     p.now().Add(p.ttl),
+	}
+	p.leases[mac] = l
+
+	return *l, p.save()
+}
+
+// Release gives up mac's lease
+func (p *Pool) Release(mac string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.leases[mac]; !ok {
+		return nil
+	}
+	delete(p.leases, mac)
+	return p.save()
+}
+
+// Decline gives up mac's lease on ip, or its lease if ip is nil, because
+// something else is using the address. The address isn't offered again for
+// a lease time. It returns the address declined, or nil if mac held none.
+func (p *Pool) Decline(mac string, ip net.IP) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.leases[mac]
+	if ip == nil && ok {
+		ip = net.ParseIP(l.IP)
+	}
+	if ip == nil || ip.To4() == nil {
+		return nil, nil
+	}
+	n := toUint(ip)
+	if n < p.start || n > p.end {
+		return nil, nil
+	}
+	p.declined[n] = p.now().Add(p.ttl)
+
+	if !ok || l.IP != ip.String() {
+		return ip.To4(), nil
+	}
+	delete(p.leases, mac)
+	return ip.To4(), p.save()
+}
+
+// Lookup returns the lease held by mac
+func (p *Pool) Lookup(mac string) (Lease, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.leases[mac]
+	if !ok {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// Leases returns the current leases ordered by address
+func (p *Pool) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]Lease, 0, len(p.leases))
+	for _, l := range p.leases {
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return toUint(net.ParseIP(out[i].IP)) < toUint(net.ParseIP(out[j].IP))
+	})
+	return out
+}
+
+// free reports whether ip is in the pool and not leased to anyone but mac;
+// callers hold p.mu
+func (p *Pool) free(mac string, ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	n := toUint(ip)
+	if n < p.start || n > p.end {
+		return false
+	}
+
+	now := p.now()
+	if until, ok := p.declined[n]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(p.declined, n)
+	}
+	for other, l := range p.leases {
+		if l.IP != ip.String() || other == mac {
+			continue
+		}
+		if now.Before(l.Expires) {
+			return false
+		}
+		// expired, so it can be reused
+		delete(p.leases, other)
+	}
+	return true
+}
+
+// save writes the lease file; callers hold p.mu
+func (p *Pool) save() error {
+	if p.path == "" {
+		return nil
+	}
+
+	leases := make([]*Lease, 0, len(p.leases))
+	for _, l := range p.leases {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].MAC < leases[j].MAC })
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not save leases: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save leases: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save leases: %w", err)
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+func toUint(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	return 0
+}
+
+func fromUint(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
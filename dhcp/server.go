@@ -0,0 +1,211 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Ports DHCP servers and clients use
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+// Config describes the network the server hands out addresses on
+type Config struct {
+	// Interface to serve on; all interfaces if empty
+	Interface string
+	// ServerIP is the server's address on the served network
+	ServerIP net.IP
+	// Netmask of the served network
+	Netmask net.IPMask
+	// Router handed to clients; none if nil, as when devices only need to
+	// reach the controller on the same network
+	Router net.IP
+	// DNS servers handed to clients; none if empty
+	DNS []net.IP
+	// Domain handed to clients, if set
+	Domain string
+	// Controller is the address sent to Ubiquiti devices in option 43;
+	// ServerIP if nil
+	Controller net.IP
+}
+
+// Server answers DHCP requests from a single pool
+type Server struct {
+	cfg  Config
+	pool *Pool
+
+	// OnLease is called whenever a lease is granted or renewed
+	OnLease func(l Lease)
+}
+
+// NewServer creates a server handing out addresses from pool
+func NewServer(cfg Config, pool *Pool) *Server {
+	if cfg.Controller == nil {
+		cfg.Controller = cfg.ServerIP
+	}
+	return &Server{cfg: cfg, pool: pool}
+}
+
+// Handle returns the reply to req, or nil if it needs none
+func (s *Server) Handle(req *Packet) *Packet {
+	if req.Op != OpRequest || len(req.CHAddr) != 6 {
+		return nil
+	}
+	mac := req.CHAddr.String()
+
+	// requests for another server are none of our business
+	if id := req.IPOption(OptServerID); id != nil && !id.Equal(s.cfg.ServerIP) {
+		return nil
+	}
+
+	switch req.MessageType() {
+	case Discover:
+		ip, err := s.pool.Offer(mac, req.IPOption(OptRequestedIP))
+		if err != nil {
+			glog.Warningf("dhcp: no offer for %s: %s", mac, err)
+			return nil
+		}
+		glog.V(1).Infof("dhcp: offering %s to %s", ip, mac)
+		return s.reply(req, Offer, ip)
+
+	case Request:
+		ip := req.IPOption(OptRequestedIP)
+		if ip == nil {
+			// renewing
+			ip = req.CIAddr
+		}
+		l, err := s.pool.Ack(mac, ip, string(req.Options[OptHostname]), string(req.Options[OptVendorClass]))
+		if err != nil {
+			glog.Warningf("dhcp: %s", err)
+			return s.reply(req, Nak, net.IPv4zero)
+		}
+		glog.Infof("dhcp: leased %s to %s (%s)", l.IP, mac, l.Hostname)
+		if s.OnLease != nil {
+			s.OnLease(l)
+		}
+		return s.reply(req, Ack, ip)
+
+	case Release:
+		if err := s.pool.Release(mac); err != nil {
+			glog.Errorf("dhcp: %s", err)
+		}
+
+	case Decline:
+		ip, err := s.pool.Decline(mac, req.IPOption(OptRequestedIP))
+		if err != nil {
+			glog.Errorf("dhcp: %s", err)
+		} else if ip != nil {
+			glog.Warningf("dhcp: %s declined %s as something else is using it; not offering it for %s", mac, ip, s.pool.TTL())
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) reply(req *Packet, msgType byte, yiaddr net.IP) *Packet {
+	res := &Packet{
+		Op:     OpReply,
+		XID:    req.XID,
+		Flags:  req.Flags,
+		YIAddr: yiaddr,
+		SIAddr: s.cfg.ServerIP,
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+		Options: map[byte][]byte{
+			OptMessageType: {msgType},
+			OptServerID:    s.cfg.ServerIP.To4(),
+		},
+	}
+	if msgType == Nak {
+		return res
+	}
+
+	ttl := uint32(s.pool.TTL() / time.Second)
+	res.Options[OptLeaseTime] = uint32Option(ttl)
+	res.Options[OptRenewalTime] = uint32Option(ttl / 2)
+	res.Options[OptRebindingTime] = uint32Option(ttl * 7 / 8)
+	res.Options[OptSubnetMask] = []byte(s.cfg.Netmask)
+	if s.cfg.Router != nil {
+		res.Options[OptRouter] = s.cfg.Router.To4()
+	}
+	if len(s.cfg.DNS) > 0 {
+		var dns []byte
+		for _, ip := range s.cfg.DNS {
+			dns = append(dns, ip.To4()...)
+		}
+		res.Options[OptDNS] = dns
+	}
+	if s.cfg.Domain != "" {
+		res.Options[OptDomainName] = []byte(s.cfg.Domain)
+	}
+
+	// same match as dnsmasq's vendor:ubnt
+	if strings.Contains(string(req.Options[OptVendorClass]), "ubnt") {
+		res.Options[OptVendorSpecific] = UbiquitiOption(s.cfg.Controller)
+	}
+
+	return res
+}
+
+// ListenAndServe answers requests on the configured interface until ctx
+// is done
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	lc := net.ListenConfig{Control: control(s.cfg.Interface)}
+	pc, err := lc.ListenPacket(ctx, "udp4", ":"+strconv.Itoa(ServerPort))
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	glog.Infof("serving DHCP on %s as %s", s.cfg.Interface, s.cfg.ServerIP)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		req, err := Decode(buf[:n])
+		if err != nil {
+			glog.V(1).Infof("dhcp: from %s: %s", from, err)
+			continue
+		}
+		res := s.Handle(req)
+		if res == nil {
+			continue
+		}
+
+		if _, err := pc.WriteTo(res.Encode(), replyAddr(req, res)); err != nil {
+			glog.Errorf("dhcp: could not reply to %s: %s", req.CHAddr, err)
+		}
+	}
+}
+
+// replyAddr is where a reply goes, per RFC 2131 4.1
+func replyAddr(req *Packet, res *Packet) *net.UDPAddr {
+	switch {
+	case req.GIAddr != nil && !req.GIAddr.Equal(net.IPv4zero):
+		return &net.UDPAddr{IP: req.GIAddr, Port: ServerPort}
+	case res.MessageType() == Nak, req.Flags&flagBroadcast != 0:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+	case req.CIAddr != nil && !req.CIAddr.Equal(net.IPv4zero):
+		return &net.UDPAddr{IP: req.CIAddr, Port: ClientPort}
+	}
+	// the client has no address yet and we can't unicast to it without
+	// writing the ARP cache, so broadcast
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/discovery"
+	"github.com/jda/nanofi/fwimage"
+	"github.com/jda/nanofi/inform"
+)
+
+// probeTimeout is how long to wait for replies to each discovery probe
+const probeTimeout = 3 * time.Second
+
+// startDiscovery listens for device announcements on listenAddr and, if
+// interval is set, broadcasts probes that often. Devices found are added
+// to the registry so they show up as pending before they ever inform.
+func (c *controller) startDiscovery(listenAddr string, interval time.Duration) error {
+	l, err := discovery.Listen(listenAddr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		glog.Infof("listening for device discovery on: %s", listenAddr)
+		err := l.Serve(func(r discovery.Record, from *net.UDPAddr) {
+			c.recordDiscovery(r)
+		})
+		glog.Errorf("discovery listener stopped: %s", err)
+	}()
+
+	if interval > 0 {
+		go func() {
+			for {
+				for _, v := range []byte{discovery.V1, discovery.V2} {
+					records, err := discovery.Probe(context.Background(), discovery.BroadcastAddr, v, probeTimeout)
+					if err != nil {
+						glog.Errorf("discovery: probe failed: %s", err)
+					}
+					for _, r := range records {
+						c.recordDiscovery(r)
+					}
+				}
+				time.Sleep(interval)
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (c *controller) recordDiscovery(r discovery.Record) {
+	info := inform.Info{
+		MAC:      r.MAC,
+		Serial:   r.Serial,
+		Model:    r.Platform,
+		Version:  r.Firmware,
+		Hostname: r.Hostname,
+		Default:  r.Default,
+		Uptime:   inform.Uptime(r.Uptime),
+	}
+	if info.Model == "" {
+		info.Model = r.Model
+	}
+	if len(r.IPs) > 0 {
+		info.IP = r.IPs[0].String()
+	}
+	// v1 firmware strings carry the board and build date, e.g.
+	// BZ.mt7621.v4.3.20.11298.200704; keep just the version
+	_, info.Version, _ = fwimage.ParseVersionString(info.Version)
+
+	d, err := c.devices.Discover(r.MAC, info)
+	if err != nil {
+		glog.Warningf("discovery: %s: %s", r.MAC, err)
+		return
+	}
+	glog.V(1).Infof("discovery: %s (%s) at %s on %s", d.MAC, d.Model, d.IP, d.Version)
+
+	if err := c.devices.Save(); err != nil {
+		glog.Errorf("%s", err)
+	}
+
+	if c.sshAdopt != nil && d.Default && !d.Adopted && d.IP != "" {
+		c.sshAdopt.adopt(d.IP)
+	}
+}
+
+// pendingHandler lists devices that have not been adopted, without the
+// authkeys of those approved
+func (c *controller) pendingHandler(w http.ResponseWriter, r *http.Request) {
+	var pending []device.Device
+	for _, d := range c.devices.Pending() {
+		d.AuthKey = ""
+		pending = append(pending, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pending); err != nil {
+		glog.Errorf("could not write pending devices: %s", err)
+	}
+}
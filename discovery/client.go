@@ -0,0 +1,179 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// BroadcastAddr is where probes are sent to reach every device on the
+// local network
+var BroadcastAddr = "255.255.255.255:" + strconv.Itoa(Port)
+
+// maxPacket is larger than any discovery packet seen in practice
+const maxPacket = 2048
+
+// Probe sends a probe of the given protocol version to addr, which may be
+// a broadcast or unicast address, and collects replies until timeout or
+// ctx is done. Replies from the same device are merged into one record.
+func Probe(ctx context.Context, addr string, version byte, timeout time.Duration) ([]Record, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(ProbePacket(version), raddr); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var out []Record
+	seen := make(map[string]int)
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return out, nil
+			}
+			return out, err
+		}
+
+		r, err := Decode(buf[:n])
+		if err != nil {
+			glog.V(1).Infof("discovery: bad reply from %s: %s", from, err)
+			continue
+		}
+		if r.MAC == "" {
+			// our own probe, or someone else's
+			continue
+		}
+		if len(r.IPs) == 0 {
+			r.IPs = []net.IP{from.IP}
+		}
+
+		if i, ok := seen[r.MAC]; ok {
+			// devices answer on every interface and both versions
+			out[i] = merge(out[i], r)
+			continue
+		}
+		seen[r.MAC] = len(out)
+		out = append(out, r)
+	}
+}
+
+// merge fills fields missing from a with those in b
+func merge(a Record, b Record) Record {
+	for _, ip := range b.IPs {
+		found := false
+		for _, have := range a.IPs {
+			if have.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a.IPs = append(a.IPs, ip)
+		}
+	}
+	if a.Firmware == "" {
+		a.Firmware = b.Firmware
+	}
+	if a.Hostname == "" {
+		a.Hostname = b.Hostname
+	}
+	if a.Platform == "" {
+		a.Platform = b.Platform
+	}
+	if a.Model == "" {
+		a.Model = b.Model
+	}
+	if a.Serial == "" {
+		a.Serial = b.Serial
+	}
+	if b.Version > a.Version {
+		// only v2 reports default state reliably
+		a.Default = b.Default
+		a.Version = b.Version
+	}
+	return a
+}
+
+// Listener receives unsolicited announcements and probe replies
+type Listener struct {
+	conn *net.UDPConn
+}
+
+// Listen listens for discovery packets on addr, e.g. ":10001"
+func Listen(addr string) (*Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{conn: conn}, nil
+}
+
+// Addr is the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve calls fn for every device record received until the listener is
+// closed. Probes and undecodable packets are ignored.
+func (l *Listener) Serve(fn func(r Record, from *net.UDPAddr)) error {
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		r, err := Decode(buf[:n])
+		if err != nil {
+			glog.V(1).Infof("discovery: bad packet from %s: %s", from, err)
+			continue
+		}
+		if r.MAC == "" {
+			continue
+		}
+		if len(r.IPs) == 0 {
+			r.IPs = []net.IP{from.IP}
+		}
+		fn(r, from)
+	}
+}
+
+// Close stops the listener
+func (l *Listener) Close() error {
+	return l.conn.Close()
+}
@@ -0,0 +1,288 @@
+// Package discovery speaks the UniFi discovery protocol. Devices answer
+// probes on UDP port 10001 and periodically announce themselves with
+// packets of the form:
+//
+//	version (1) | command (1) | length (2) | TLV...
+//
+// where each TLV is a one byte type, a two byte big endian length and the
+// value. Version 1 is the original protocol, version 2 is used by newer
+// firmware and adds a few fields.
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Port is the UDP port devices listen and announce on
+const Port = 10001
+
+// Protocol versions
+const (
+	V1 = 1
+	V2 = 2
+)
+
+// Commands
+const (
+	CmdProbe     = 0x00
+	CmdProbeV2   = 0x08
+	CmdAnnounce  = 0x06
+	CmdAnnounce2 = 0x09
+)
+
+// Field types
+const (
+	TypeHWAddr          = 0x01
+	TypeHWAddrIP        = 0x02
+	TypeFirmware        = 0x03
+	TypeUptime          = 0x0a
+	TypeHostname        = 0x0b
+	TypePlatform        = 0x0c
+	TypeESSID           = 0x0d
+	TypeWirelessMode    = 0x0e
+	TypeSequence        = 0x12
+	TypeSerial          = 0x13
+	TypeModel           = 0x14
+	TypeModelV2         = 0x15
+	TypeFirmwareV2      = 0x16
+	TypeDefault         = 0x17
+	TypeLocating        = 0x18
+	TypeDHCPClient      = 0x19
+	TypeDHCPClientBound = 0x1a
+	TypeRequiredVersion = 0x1b
+	TypeSSHPort         = 0x1c
+)
+
+const headerLen = 4
+
+// ErrShort is returned for packets too short to hold what they claim
+var ErrShort = errors.New("discovery packet truncated")
+
+// ErrVersion is returned for packets of an unknown protocol version
+var ErrVersion = errors.New("unsupported discovery version")
+
+// Field is a single TLV from a discovery packet
+type Field struct {
+	Type  byte
+	Value []byte
+}
+
+// Packet is a decoded discovery packet
+type Packet struct {
+	Version byte
+	Cmd     byte
+	Fields  []Field
+}
+
+// Record is what a device says about itself in a discovery reply or
+// announcement
+type Record struct {
+	Version         byte
+	Cmd             byte
+	MAC             string
+	IPs             []net.IP
+	Firmware        string
+	Hostname        string
+	Platform        string
+	Model           string
+	ESSID           string
+	Serial          string
+	RequiredVersion string
+	Uptime          uint64
+	Default         bool
+	Locating        bool
+	SSHPort         int
+}
+
+// ProbePacket returns a probe for the given protocol version
+func ProbePacket(version byte) []byte {
+	if version == V2 {
+		return []byte{V2, CmdProbeV2, 0, 0}
+	}
+	return []byte{V1, CmdProbe, 0, 0}
+}
+
+// DecodePacket splits a discovery packet into its fields
+func DecodePacket(b []byte) (Packet, error) {
+	var p Packet
+	if len(b) < headerLen {
+		return p, ErrShort
+	}
+	p.Version, p.Cmd = b[0], b[1]
+	if p.Version != V1 && p.Version != V2 {
+		return p, fmt.Errorf("%w: %d", ErrVersion, p.Version)
+	}
+
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	body := b[headerLen:]
+	if len(body) < n {
+		return p, fmt.Errorf("%w: header says %d bytes, got %d", ErrShort, n, len(body))
+	}
+	body = body[:n]
+
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return p, fmt.Errorf("%w: partial field header", ErrShort)
+		}
+		t, l := body[0], int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+l {
+			return p, fmt.Errorf("%w: field 0x%02x wants %d bytes", ErrShort, t, l)
+		}
+		p.Fields = append(p.Fields, Field{Type: t, Value: body[3 : 3+l]})
+		body = body[3+l:]
+	}
+
+	return p, nil
+}
+
+// Encode serializes the packet
+func (p Packet) Encode() ([]byte, error) {
+	n := 0
+	for _, f := range p.Fields {
+		if len(f.Value) > 0xffff {
+			return nil, fmt.Errorf("discovery field 0x%02x too long", f.Type)
+		}
+		n += 3 + len(f.Value)
+	}
+	if n > 0xffff {
+		return nil, fmt.Errorf("discovery packet too long")
+	}
+
+	b := make([]byte, headerLen, headerLen+n)
+	b[0], b[1] = p.Version, p.Cmd
+	binary.BigEndian.PutUint16(b[2:4], uint16(n))
+	for _, f := range p.Fields {
+		b = append(b, f.Type, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(f.Value)))
+		b = append(b, f.Value...)
+	}
+	return b, nil
+}
+
+// Decode parses a discovery reply or announcement. Unknown fields are
+// skipped. Probes decode to a record with no MAC.
+func Decode(b []byte) (Record, error) {
+	p, err := DecodePacket(b)
+	if err != nil {
+		return Record{}, err
+	}
+
+	r := Record{Version: p.Version, Cmd: p.Cmd}
+	for _, f := range p.Fields {
+		v := f.Value
+		switch f.Type {
+		case TypeHWAddr:
+			if len(v) == 6 {
+				r.MAC = net.HardwareAddr(v).String()
+			}
+		case TypeHWAddrIP:
+			if len(v) == 10 {
+				r.MAC = net.HardwareAddr(v[:6]).String()
+				r.IPs = append(r.IPs, net.IP(append([]byte(nil), v[6:]...)))
+			}
+		case TypeFirmware, TypeFirmwareV2:
+			r.Firmware = string(v)
+		case TypeUptime:
+			r.Uptime = beUint(v)
+		case TypeHostname:
+			r.Hostname = string(v)
+		case TypePlatform:
+			r.Platform = string(v)
+		case TypeModel, TypeModelV2:
+			r.Model = string(v)
+		case TypeESSID:
+			r.ESSID = string(v)
+		case TypeSerial:
+			if len(v) == 6 {
+				r.Serial = fmt.Sprintf("%X", v)
+			} else {
+				r.Serial = string(v)
+			}
+		case TypeRequiredVersion:
+			r.RequiredVersion = string(v)
+		case TypeDefault:
+			r.Default = beUint(v) != 0
+		case TypeLocating:
+			r.Locating = beUint(v) != 0
+		case TypeSSHPort:
+			r.SSHPort = int(beUint(v))
+		}
+	}
+
+	return r, nil
+}
+
+// Encode serializes the record as a reply in its version of the protocol
+func (r Record) Encode() ([]byte, error) {
+	p := Packet{Version: r.Version, Cmd: r.Cmd}
+	if p.Version == 0 {
+		p.Version = V1
+	}
+
+	hw, err := net.ParseMAC(r.MAC)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("invalid discovery MAC %q", r.MAC)
+	}
+	p.add(TypeHWAddr, hw)
+	for _, ip := range r.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			p.add(TypeHWAddrIP, append(append([]byte(nil), hw...), ip4...))
+		}
+	}
+
+	firmware, model := byte(TypeFirmware), byte(TypeModel)
+	if p.Version == V2 {
+		firmware, model = TypeFirmwareV2, TypeModelV2
+	}
+	p.addString(firmware, r.Firmware)
+	p.addString(TypeHostname, r.Hostname)
+	p.addString(TypePlatform, r.Platform)
+	p.addString(model, r.Model)
+	p.addString(TypeESSID, r.ESSID)
+	p.addString(TypeSerial, r.Serial)
+	p.addString(TypeRequiredVersion, r.RequiredVersion)
+
+	uptime := make([]byte, 4)
+	binary.BigEndian.PutUint32(uptime, uint32(r.Uptime))
+	p.add(TypeUptime, uptime)
+	if p.Version == V2 {
+		p.add(TypeDefault, []byte{boolByte(r.Default)})
+		p.add(TypeLocating, []byte{boolByte(r.Locating)})
+	}
+	if r.SSHPort > 0 {
+		port := make([]byte, 4)
+		binary.BigEndian.PutUint32(port, uint32(r.SSHPort))
+		p.add(TypeSSHPort, port)
+	}
+
+	return p.Encode()
+}
+
+func (p *Packet) add(t byte, v []byte) {
+	p.Fields = append(p.Fields, Field{Type: t, Value: v})
+}
+
+func (p *Packet) addString(t byte, s string) {
+	if s != "" {
+		p.add(t, []byte(s))
+	}
+}
+
+// beUint reads a big endian unsigned integer of up to 8 bytes
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sampleV1 is a discovery reply from a UAP-AC-Pro at defaults
+var sampleV1 = []byte{
+	0x01, 0x00, 0x00, 0x52,
+	0x02, 0x00, 0x0a, 0x78, 0x8a, 0x20, 0x01, 0x02, 0x03, 0xc0, 0xa8, 0x01, 0x3d,
+	0x01, 0x00, 0x06, 0x78, 0x8a, 0x20, 0x01, 0x02, 0x03,
+	0x0a, 0x00, 0x04, 0x00, 0x00, 0x01, 0x2c,
+	0x0b, 0x00, 0x04, 'U', 'B', 'N', 'T',
+	0x0c, 0x00, 0x05, 'U', '7', 'P', 'G', '2',
+	0x03, 0x00, 0x1e, 'B', 'Z', '.', 'm', 't', '7', '6', '2', '1', '.', 'v', '4', '.', '3', '.', '2', '0', '.', '1', '1', '2', '9', '8', '.', '2', '0', '0', '7', '0', '4',
+	0x10, 0x00, 0x02, 0xe5, 0x37,
+}
+
+func TestDecodeV1(t *testing.T) {
+	r, err := Decode(sampleV1)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(V1), r.Version)
+	assert.Equal(t, "78:8a:20:01:02:03", r.MAC)
+	assert.Equal(t, []net.IP{net.IPv4(192, 168, 1, 61).To4()}, r.IPs)
+	assert.Equal(t, uint64(300), r.Uptime)
+	assert.Equal(t, "UBNT", r.Hostname)
+	assert.Equal(t, "U7PG2", r.Platform)
+	assert.Equal(t, "BZ.mt7621.v4.3.20.11298.200704", r.Firmware)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	test := []struct {
+		In   []byte
+		Want error
+	}{
+		{[]byte{0x01, 0x00}, ErrShort},
+		{[]byte{0x03, 0x00, 0x00, 0x00}, ErrVersion},
+		{[]byte{0x01, 0x00, 0x00, 0x10, 0x01}, ErrShort},
+		{[]byte{0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x06, 0x78}, ErrShort},
+	}
+
+	for _, tc := range test {
+		_, err := Decode(tc.In)
+		assert.True(t, errors.Is(err, tc.Want), "%x: %v", tc.In, err)
+	}
+
+	r, err := Decode(ProbePacket(V2))
+	assert.Nil(t, err)
+	assert.Equal(t, "", r.MAC, "probes carry no device")
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, v := range []byte{V1, V2} {
+		in := Record{
+			Version:  v,
+			Cmd:      CmdAnnounce2,
+			MAC:      "74:83:c2:0f:15:b0",
+			IPs:      []net.IP{net.IPv4(192, 168, 1, 61).To4()},
+			Firmware: "1.6.1.525",
+			Hostname: "USW_MINI",
+			Platform: "USMINI",
+			Model:    "USW-Flex-Mini",
+			Serial:   "7483C20F15B0",
+			Uptime:   155,
+			Default:  v == V2,
+			SSHPort:  22,
+		}
+		b, err := in.Encode()
+		assert.Nil(t, err)
+
+		out, err := Decode(b)
+		assert.Nil(t, err)
+		assert.Equal(t, in, out, "v%d", v)
+	}
+
+	_, err := Record{MAC: "nope"}.Encode()
+	assert.NotNil(t, err)
+}
+
+// responder answers probes like a device would
+func responder(t *testing.T, r Record) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+
+	go func() {
+		buf := make([]byte, maxPacket)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			probe, err := DecodePacket(buf[:n])
+			if err != nil || len(probe.Fields) != 0 {
+				continue
+			}
+			reply := r
+			reply.Version = probe.Version
+			b, _ := reply.Encode()
+			conn.WriteToUDP(b, from)
+		}
+	}()
+	return conn
+}
+
+func TestProbe(t *testing.T) {
+	dev := responder(t, Record{MAC: "74:83:c2:0f:15:b0", Platform: "USMINI", Firmware: "1.6.1.525", Default: true})
+	defer dev.Close()
+
+	records, err := Probe(context.Background(), dev.LocalAddr().String(), V2, 200*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "74:83:c2:0f:15:b0", records[0].MAC)
+	assert.True(t, records[0].Default)
+	assert.Equal(t, "127.0.0.1", records[0].IPs[0].String(), "source address stands in for a missing IP")
+}
+
+func TestListener(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	got := make(chan Record, 1)
+	go l.Serve(func(r Record, from *net.UDPAddr) { got <- r })
+
+	conn, err := net.Dial("udp4", l.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write(ProbePacket(V1))
+	announce, err := Record{Version: V2, Cmd: CmdAnnounce2, MAC: "74:83:c2:0f:15:b0", Platform: "USMINI", Default: true}.Encode()
+	assert.Nil(t, err)
+	conn.Write(announce)
+
+	select {
+	case r := <-got:
+		assert.Equal(t, "74:83:c2:0f:15:b0", r.MAC)
+		assert.Equal(t, byte(CmdAnnounce2), r.Cmd)
+	case <-time.After(time.Second):
+		t.Fatal("no announcement received")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/dnsmasq"
+)
+
+// leaseCheckInterval is how often the dnsmasq leases file is checked
+const leaseCheckInterval = 10 * time.Second
+
+// writeDnsmasqConf writes the dnsmasq options pointing devices at the host
+// in informURL to path
+func writeDnsmasqConf(path string, informURL string) error {
+	u, err := url.Parse(informURL)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("an inform URL is required to generate dnsmasq options")
+	}
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil {
+		return fmt.Errorf("option 43 needs the controller's address, not a name: %s", u.Hostname())
+	}
+
+	conf, err := dnsmasq.Options(ip)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("could not write dnsmasq options: %w", err)
+	}
+	glog.Infof("wrote dnsmasq options for %s to %s", ip, path)
+	return nil
+}
+
+// followDnsmasq uses the dnsmasq leases file at path to name devices and
+// their clients
+func (c *controller) followDnsmasq(path string) {
+	lf := dnsmasq.NewLeaseFile(path)
+	c.names = func(mac string) (string, string, bool) {
+		l, ok := lf.Lookup(mac)
+		return l.IP, l.Hostname, ok
+	}
+	go lf.Follow(context.Background(), leaseCheckInterval, func() {
+		glog.V(1).Infof("dnsmasq: %d leases in %s", len(lf.Leases()), path)
+	})
+}
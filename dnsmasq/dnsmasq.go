@@ -0,0 +1,195 @@
+// Package dnsmasq integrates nanofi with a dnsmasq that is already handing
+// out addresses: it generates the dhcp-option lines that point Ubiquiti
+// devices at the controller, and follows the dnsmasq leases file so MACs
+// can be matched to addresses and hostnames.
+package dnsmasq
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultLeaseFile is where dnsmasq keeps leases on most distributions
+const DefaultLeaseFile = "/var/lib/misc/dnsmasq.leases"
+
+// Options returns dnsmasq configuration pointing Ubiquiti devices at the
+// controller with vendor option 43, ready to drop into /etc/dnsmasq.d
+func Options(controller net.IP) (string, error) {
+	ip := controller.To4()
+	if ip == nil {
+		return "", fmt.Errorf("controller address must be IPv4: %s", controller)
+	}
+	return "# generated by nanofi: point Ubiquiti devices at the controller\n" +
+		"dhcp-option=vendor:ubnt,1," + ip.String() + "\n", nil
+}
+
+// Lease is one line of a dnsmasq leases file
+type Lease struct {
+	Expires  time.Time `json:"expires"`
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	ClientID string    `json:"client_id,omitempty"`
+}
+
+// ParseLeases reads a dnsmasq leases file, whose lines look like
+//
+//	1613761234 74:83:c2:0f:15:b0 192.168.1.61 USW_MINI 01:74:83:c2:0f:15:b0
+//
+// with * standing in for a missing hostname or client ID. IPv6 leases
+// and the duid line are skipped.
+func ParseLeases(r io.Reader) ([]Lease, error) {
+	var out []Lease
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || f[0] == "duid" {
+			continue
+		}
+		if len(f) < 4 {
+			return out, fmt.Errorf("dnsmasq leases line %d: want at least 4 fields, got %d", line, len(f))
+		}
+
+		expires, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			return out, fmt.Errorf("dnsmasq leases line %d: bad expiry: %w", line, err)
+		}
+		hw, err := net.ParseMAC(f[1])
+		if err != nil || len(hw) != 6 {
+			// DHCPv6 leases have an IAID here
+			continue
+		}
+		ip := net.ParseIP(f[2])
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+
+		l := Lease{MAC: hw.String(), IP: ip.String()}
+		if expires > 0 {
+			// 0 means the lease never expires
+			l.Expires = time.Unix(expires, 0)
+		}
+		if f[3] != "*" {
+			l.Hostname = f[3]
+		}
+		if len(f) > 4 && f[4] != "*" {
+			l.ClientID = f[4]
+		}
+		out = append(out, l)
+	}
+
+	return out, sc.Err()
+}
+
+// LeaseFile follows a dnsmasq leases file. dnsmasq rewrites the whole file
+// whenever a lease changes, so it is reloaded whenever it changes.
+type LeaseFile struct {
+	path string
+
+	mu      sync.RWMutex
+	leases  map[string]Lease
+	modTime time.Time
+	size    int64
+}
+
+// NewLeaseFile creates a follower for the leases file at path
+func NewLeaseFile(path string) *LeaseFile {
+	return &LeaseFile{path: path, leases: make(map[string]Lease)}
+}
+
+// Reload reads the leases file if it has changed since it was last read,
+// reporting whether it had
+func (lf *LeaseFile) Reload() (bool, error) {
+	st, err := os.Stat(lf.path)
+	if err != nil {
+		return false, err
+	}
+
+	lf.mu.RLock()
+	same := st.ModTime().Equal(lf.modTime) && st.Size() == lf.size
+	lf.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	f, err := os.Open(lf.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	leases, err := ParseLeases(f)
+	if err != nil {
+		return false, err
+	}
+
+	byMAC := make(map[string]Lease, len(leases))
+	for _, l := range leases {
+		byMAC[l.MAC] = l
+	}
+
+	lf.mu.Lock()
+	lf.leases = byMAC
+	lf.modTime = st.ModTime()
+	lf.size = st.Size()
+	lf.mu.Unlock()
+
+	return true, nil
+}
+
+// Follow reloads the leases file every interval until ctx is done, calling
+// changed after each reload that found changes
+func (lf *LeaseFile) Follow(ctx context.Context, interval time.Duration, changed func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ok, err := lf.Reload()
+		if err != nil {
+			glog.Warningf("dnsmasq: %s", err)
+		} else if ok && changed != nil {
+			changed()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Lookup returns the lease for mac
+func (lf *LeaseFile) Lookup(mac string) (Lease, bool) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return Lease{}, false
+	}
+
+	lf.mu.RLock()
+	defer lf.mu.RUnlock()
+	l, ok := lf.leases[hw.String()]
+	return l, ok
+}
+
+// Leases returns every lease currently in the file
+func (lf *LeaseFile) Leases() []Lease {
+	lf.mu.RLock()
+	defer lf.mu.RUnlock()
+
+	out := make([]Lease, 0, len(lf.leases))
+	for _, l := range lf.leases {
+		out = append(out, l)
+	}
+	return out
+}
@@ -0,0 +1,76 @@
+package dnsmasq
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sampleLeases = `1613761234 74:83:c2:0f:15:b0 192.168.1.61 USW_MINI 01:74:83:c2:0f:15:b0
+1613761300 e0:63:da:85:aa:c5 192.168.1.69 * *
+0 3c:22:fb:00:00:01 192.168.1.77 laptop *
+duid 00:01:00:01:27:a8:5e:2b:3c:22:fb:00:00:01
+1613761400 1234567 fd00::77 laptop 00:01:00:01:27:a8:5e:2b:3c:22:fb:00:00:01
+`
+
+func TestOptions(t *testing.T) {
+	conf, err := Options(net.IPv4(192, 168, 1, 1))
+	assert.Nil(t, err)
+	// the line from the lab dnsmasq.conf
+	assert.Contains(t, conf, "\ndhcp-option=vendor:ubnt,1,192.168.1.1\n")
+
+	_, err = Options(net.ParseIP("fd00::1"))
+	assert.NotNil(t, err)
+}
+
+func TestParseLeases(t *testing.T) {
+	leases, err := ParseLeases(strings.NewReader(sampleLeases))
+	assert.Nil(t, err)
+	assert.Len(t, leases, 3, "IPv6 leases and the duid are skipped")
+
+	assert.Equal(t, Lease{
+		Expires: time.Unix(1613761234, 0), MAC: "74:83:c2:0f:15:b0", IP: "192.168.1.61",
+		Hostname: "USW_MINI", ClientID: "01:74:83:c2:0f:15:b0",
+	}, leases[0])
+	assert.Equal(t, "", leases[1].Hostname)
+	assert.True(t, leases[2].Expires.IsZero(), "infinite lease")
+
+	_, err = ParseLeases(strings.NewReader("soon 74:83:c2:0f:15:b0 192.168.1.61 *\n"))
+	assert.NotNil(t, err)
+	_, err = ParseLeases(strings.NewReader("1613761234 74:83:c2:0f:15:b0\n"))
+	assert.NotNil(t, err)
+}
+
+func TestLeaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nanofi-dnsmasq")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsmasq.leases")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(sampleLeases), 0644))
+
+	lf := NewLeaseFile(path)
+	changed, err := lf.Reload()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = lf.Reload()
+	assert.Nil(t, err)
+	assert.False(t, changed, "unchanged file isn't reread")
+
+	l, ok := lf.Lookup("74:83:C2:0F:15:B0")
+	assert.True(t, ok)
+	assert.Equal(t, "USW_MINI", l.Hostname)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("1613761234 74:83:c2:0f:15:b0 192.168.1.62 renamed *\n"), 0644))
+	changed, err = lf.Reload()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	l, _ = lf.Lookup("74:83:c2:0f:15:b0")
+	assert.Equal(t, "renamed", l.Hostname)
+	assert.Len(t, lf.Leases(), 1)
+}
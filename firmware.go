@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/firmware"
+)
+
+// startFirmwareServer indexes the local firmware repository and serves it
+// to devices on listenAddr. baseURL is how devices reach that listener.
+func startFirmwareServer(devices *device.Registry, dir string, listenAddr string, baseURL string) (*firmware.Server, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("a firmware URL reachable by devices is required")
+	}
+
+	repo, err := firmware.NewRepository(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := firmware.NewServer(repo, baseURL)
+	srv.Identify = func(ip string) string {
+		if d, ok := devices.ByIP(ip); ok {
+			return d.MAC
+		}
+		return ""
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(firmware.PathPrefix, srv)
+
+	go func() {
+		glog.Infof("serving firmware from %s on: %s", dir, listenAddr)
+		if err := http.ListenAndServe(listenAddr, mux); err != nil { // nosemgrep: go.lang.security.audit.net.use-tls.use-tls
+			glog.Fatalf("firmware server failed: %s", err)
+		}
+	}()
+
+	return srv, nil
+}
@@ -0,0 +1,288 @@
+// Package firmware keeps a local repository of UniFi firmware images and
+// serves them to devices over HTTP, so upgrades work on networks that
+// can't reach Ubiquiti's CDN.
+//
+// Images are laid out on disk as <root>/<model>/<version>/<name>.bin, or
+// dropped straight into <root> to be indexed by what their header says.
+package firmware
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/fwimage"
+	"github.com/jda/nanofi/version"
+)
+
+// ErrNoImage is returned when the repository has no image for a model/version
+var ErrNoImage = errors.New("no firmware image")
+
+// Image is a single firmware file in the repository
+type Image struct {
+	Model   string `json:"model"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	MD5     string `json:"md5"`
+	SHA256  string `json:"sha256"`
+	// Platform is the board family from the image header, if it has one
+	Platform string `json:"platform,omitempty"`
+	// Verified is set when the image header and CRCs have been checked
+	Verified bool `json:"verified"`
+}
+
+type imageKey struct {
+	model   string
+	version string
+}
+
+// Repository indexes the firmware images found under a directory
+type Repository struct {
+	mu     sync.RWMutex
+	root   string
+	images map[imageKey]Image
+	byPath map[string]Image
+}
+
+// NewRepository indexes the firmware images under root
+func NewRepository(root string) (*Repository, error) {
+	r := &Repository{root: root}
+	if err := r.Rescan(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Root is the directory the repository indexes
+func (r *Repository) Root() string {
+	return r.root
+}
+
+// Rescan rebuilds the index from disk, picking up added or removed images
+func (r *Repository) Rescan() error {
+	idx := &index{
+		images: make(map[imageKey]Image),
+		byPath: make(map[string]Image),
+	}
+
+	entries, err := ioutil.ReadDir(r.root)
+	if err != nil {
+		return fmt.Errorf("could not read firmware repository: %w", err)
+	}
+
+	for _, m := range entries {
+		if !m.IsDir() {
+			if strings.HasSuffix(m.Name(), ".bin") {
+				if err := r.indexLoose(idx, m.Name()); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		versions, err := ioutil.ReadDir(filepath.Join(r.root, m.Name()))
+		if err != nil {
+			return fmt.Errorf("could not read firmware for %s: %w", m.Name(), err)
+		}
+
+		for _, v := range versions {
+			if !v.IsDir() {
+				continue
+			}
+			dir := filepath.Join(m.Name(), v.Name())
+			files, err := ioutil.ReadDir(filepath.Join(r.root, dir))
+			if err != nil {
+				return fmt.Errorf("could not read firmware for %s %s: %w", m.Name(), v.Name(), err)
+			}
+
+			for _, f := range files {
+				if f.IsDir() || !strings.HasSuffix(f.Name(), ".bin") {
+					continue
+				}
+				if err := r.indexLayout(idx, m.Name(), v.Name(), filepath.ToSlash(filepath.Join(dir, f.Name()))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.images = idx.images
+	r.byPath = idx.byPath
+	r.mu.Unlock()
+	glog.Infof("firmware: indexed %d images in %s", len(idx.images), r.root)
+
+	return nil
+}
+
+type index struct {
+	images map[imageKey]Image
+	byPath map[string]Image
+}
+
+func (idx *index) add(img Image) {
+	k := imageKey{img.Model, img.Version}
+	if dup, ok := idx.images[k]; ok {
+		glog.Warningf("firmware: %s duplicates %s for %s %s, ignoring", img.Path, dup.Path, img.Model, img.Version)
+		return
+	}
+	idx.images[k] = img
+	idx.byPath[img.Path] = img
+}
+
+// indexLoose indexes an image dropped in the repository root under every
+// model its header says it applies to
+func (r *Repository) indexLoose(idx *index, path string) error {
+	fw, err := fwimage.ParseFile(filepath.Join(r.root, path))
+	if err != nil {
+		glog.Warningf("firmware: skipping %s: %s", path, err)
+		return nil
+	}
+	if len(fw.Models) == 0 {
+		glog.Warningf("firmware: skipping %s: unknown platform %q, file it under <model>/<version>/", path, fw.Platform)
+		return nil
+	}
+
+	sums, err := r.checksum(path)
+	if err != nil {
+		return err
+	}
+	for _, model := range fw.Models {
+		img := sums
+		img.Model = model
+		img.Version = fw.Version
+		img.Platform = fw.Platform
+		img.Verified = true
+		idx.add(img)
+	}
+
+	return nil
+}
+
+// indexLayout indexes an image filed under <model>/<version>/, refusing
+// images whose header says they are for a different board. Images without
+// a UBNT header, or for a platform fwimage doesn't know, are trusted.
+func (r *Repository) indexLayout(idx *index, model string, version string, path string) error {
+	img, err := r.checksum(path)
+	if err != nil {
+		return err
+	}
+	img.Model = model
+	img.Version = version
+
+	fw, err := fwimage.ParseFile(filepath.Join(r.root, filepath.FromSlash(path)))
+	switch {
+	case errors.Is(err, fwimage.ErrNoMagic):
+		// not every device family uses UBNT images; trust the layout
+	case err != nil:
+		glog.Errorf("firmware: refusing %s: %s", path, err)
+		return nil
+	case len(fw.Models) > 0 && !fw.Supports(model):
+		glog.Errorf("firmware: refusing %s: %s image is for %s, not %s", path, fw.Platform, strings.Join(fw.Models, ", "), model)
+		return nil
+	default:
+		if fw.Version != version {
+			glog.Warningf("firmware: %s is filed as %s but its header says %s", path, version, fw.Version)
+		}
+		img.Platform = fw.Platform
+		img.Verified = true
+	}
+
+	idx.add(img)
+	return nil
+}
+
+// checksum sizes and checksums the file at path (relative to root)
+func (r *Repository) checksum(path string) (img Image, err error) {
+	f, err := os.Open(filepath.Join(r.root, filepath.FromSlash(path)))
+	if err != nil {
+		return img, fmt.Errorf("could not open firmware image: %w", err)
+	}
+	defer f.Close()
+
+	md5sum := md5.New()
+	sha := sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5sum, sha), f)
+	if err != nil {
+		return img, fmt.Errorf("could not checksum %s: %w", path, err)
+	}
+
+	return Image{
+		Path:   path,
+		Size:   size,
+		MD5:    hex.EncodeToString(md5sum.Sum(nil)),
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+	}, nil
+}
+
+// Lookup finds the image for a model and version
+func (r *Repository) Lookup(model string, version string) (Image, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	img, ok := r.images[imageKey{model, version}]
+	if !ok {
+		return img, fmt.Errorf("%w for %s %s", ErrNoImage, model, version)
+	}
+	return img, nil
+}
+
+// Images lists every indexed image ordered by model then version
+func (r *Repository) Images() []Image {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]Image, 0, len(r.images))
+	for _, img := range r.images {
+		out = append(out, img)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Model != out[j].Model {
+			return out[i].Model < out[j].Model
+		}
+		return version.Compare(out[i].Version, out[j].Version) < 0
+	})
+	return out
+}
+
+// Latest returns the newest image in the repository for model
+func (r *Repository) Latest(model string) (Image, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var best Image
+	found := false
+	for k, img := range r.images {
+		if k.model != model {
+			continue
+		}
+		if !found || version.Compare(img.Version, best.Version) > 0 {
+			best = img
+			found = true
+		}
+	}
+	if !found {
+		return best, fmt.Errorf("%w for %s", ErrNoImage, model)
+	}
+	return best, nil
+}
+
+// byRelPath finds an image by its path relative to the repository root
+func (r *Repository) byRelPath(path string) (Image, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	img, ok := r.byPath[path]
+	return img, ok
+}
@@ -0,0 +1,165 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRepo creates a repository directory holding the given files, keyed
+// by path relative to the root
+func testRepo(t *testing.T, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "nanofi-firmware")
+	assert.Nil(t, err)
+
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	}
+	return dir
+}
+
+func TestRepositoryIndex(t *testing.T) {
+	dir := testRepo(t, map[string][]byte{
+		"USMINI/2.0.9.1234/US.mt7621.v2.0.9.1234.bin": []byte("hello"),
+		"USMINI/2.0.9.1234/README":                    []byte("not firmware"),
+		"U7PG2/4.3.20.11298/BZ.qca956x.v4.3.20.bin":   []byte("world"),
+		"stray.bin": []byte("ignored"),
+	})
+	defer os.RemoveAll(dir)
+
+	repo, err := NewRepository(dir)
+	assert.Nil(t, err)
+	assert.Len(t, repo.Images(), 2)
+
+	img, err := repo.Lookup("USMINI", "2.0.9.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "USMINI/2.0.9.1234/US.mt7621.v2.0.9.1234.bin", img.Path)
+	assert.Equal(t, int64(5), img.Size)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", img.MD5)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", img.SHA256)
+
+	_, err = repo.Lookup("USMINI", "1.0.0")
+	assert.True(t, errors.Is(err, ErrNoImage))
+}
+
+func TestRepositoryLatest(t *testing.T) {
+	dir := testRepo(t, map[string][]byte{
+		"U7PG2/4.3.9.10000/a.bin":   []byte("aaaa"),
+		"U7PG2/4.3.28.11361/b.bin":  []byte("bbbb"),
+		"U7PG2/4.3.20.11298/c.bin":  []byte("cccc"),
+		"US8P60/6.5.28.14491/d.bin": []byte("dddd"),
+	})
+	defer os.RemoveAll(dir)
+
+	repo, err := NewRepository(dir)
+	assert.Nil(t, err)
+
+	img, err := repo.Latest("U7PG2")
+	assert.Nil(t, err)
+	assert.Equal(t, "4.3.28.11361", img.Version, "versions compare numerically, not as strings")
+
+	images := repo.Images()
+	assert.Equal(t, "4.3.9.10000", images[0].Version)
+	assert.Equal(t, "4.3.28.11361", images[2].Version)
+
+	_, err = repo.Latest("U7NHD")
+	assert.True(t, errors.Is(err, ErrNoImage))
+}
+
+// ubntImage builds a minimal single section UBNT firmware image
+func ubntImage(version string) []byte {
+	var b bytes.Buffer
+	hdr := make([]byte, 260)
+	copy(hdr, "UBNT")
+	copy(hdr[4:], version)
+	b.Write(hdr)
+	binary.Write(&b, binary.BigEndian, []uint32{crc32.ChecksumIEEE(hdr), 0})
+
+	part := make([]byte, 56)
+	copy(part, "PART")
+	copy(part[4:], "kernel")
+	binary.BigEndian.PutUint32(part[48:], 4)
+	part = append(part, "data"...)
+	b.Write(part)
+	binary.Write(&b, binary.BigEndian, []uint32{crc32.ChecksumIEEE(part), 0})
+
+	sum := crc32.ChecksumIEEE(b.Bytes())
+	b.WriteString("END.")
+	binary.Write(&b, binary.BigEndian, []uint32{sum, 0})
+	return b.Bytes()
+}
+
+func TestRepositoryHeaders(t *testing.T) {
+	ap := ubntImage("BZ.qca956x.v4.3.20.11298.200704.1347")
+	corrupt := append([]byte(nil), ap...)
+	corrupt[300] ^= 0xff
+
+	dir := testRepo(t, map[string][]byte{
+		"BZ.qca956x.v4.3.20.11298.200704.1347.bin": ap,
+		"US8P60/4.3.20.11298/wrong-board.bin":      ap,
+		"U7LT/4.3.21.11325/corrupt.bin":            corrupt,
+		"junk.bin":                                 []byte("junk"),
+	})
+	defer os.RemoveAll(dir)
+
+	repo, err := NewRepository(dir)
+	assert.Nil(t, err)
+
+	img, err := repo.Lookup("U7PG2", "4.3.20.11298")
+	assert.Nil(t, err, "loose image should be indexed from its header")
+	assert.True(t, img.Verified)
+	assert.Equal(t, "BZ.qca956x", img.Platform)
+
+	_, err = repo.Lookup("US8P60", "4.3.20.11298")
+	assert.True(t, errors.Is(err, ErrNoImage), "AP image filed under a switch must be refused")
+
+	_, err = repo.Lookup("U7LT", "4.3.21.11325")
+	assert.True(t, errors.Is(err, ErrNoImage), "corrupt image must be refused")
+}
+
+func TestServerRanges(t *testing.T) {
+	dir := testRepo(t, map[string][]byte{
+		"USMINI/2.0.9.1234/fw.bin": []byte("0123456789"),
+	})
+	defer os.RemoveAll(dir)
+
+	repo, err := NewRepository(dir)
+	assert.Nil(t, err)
+	srv := NewServer(repo, "http://192.168.1.1:8081/")
+	srv.Identify = func(ip string) string { return "74:83:c2:0f:15:b0" }
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	img, _ := repo.Lookup("USMINI", "2.0.9.1234")
+	assert.Equal(t, "http://192.168.1.1:8081/firmware/USMINI/2.0.9.1234/fw.bin", srv.URL(img))
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+PathPrefix+img.Path, nil)
+	req.Header.Set("Range", "bytes=4-")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, "456789", string(body))
+
+	dls := srv.Downloads()
+	assert.Len(t, dls, 1)
+	assert.True(t, dls[0].Done, "range to the end completes the download")
+	assert.Equal(t, "74:83:c2:0f:15:b0", dls[0].Device)
+
+	res, err = http.Get(ts.URL + PathPrefix + "../../etc/passwd")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -0,0 +1,199 @@
+package firmware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PathPrefix is the URL path under which images are served
+const PathPrefix = "/firmware/"
+
+// progressStep is how often, in percent, download progress is logged
+const progressStep = 25
+
+// Download is the progress of a device fetching an image
+type Download struct {
+	Client  string    `json:"client"`
+	Device  string    `json:"device,omitempty"`
+	Path    string    `json:"path"`
+	Sent    int64     `json:"sent"`
+	Size    int64     `json:"size"`
+	Started time.Time `json:"started"`
+	Done    bool      `json:"done"`
+}
+
+// Server serves repository images over HTTP, with range request support
+// so devices can resume interrupted downloads
+type Server struct {
+	repo    *Repository
+	baseURL string
+
+	// Identify optionally maps a client IP to a device name for logging
+	Identify func(ip string) string
+
+	mu        sync.Mutex
+	downloads map[string]*Download
+}
+
+// NewServer creates a server for repo. baseURL is the scheme, host and port
+// devices use to reach it, e.g. http://192.168.1.1:8081
+func NewServer(repo *Repository, baseURL string) *Server {
+	return &Server{
+		repo:      repo,
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		downloads: make(map[string]*Download),
+	}
+}
+
+// Repository is the repository this server serves images from
+func (s *Server) Repository() *Repository {
+	return s.repo
+}
+
+// URL is where devices can download img from this server
+func (s *Server) URL(img Image) string {
+	return s.baseURL + PathPrefix + img.Path
+}
+
+// Downloads returns the progress of downloads seen since startup
+func (s *Server) Downloads() []Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Download, 0, len(s.downloads))
+	for _, d := range s.downloads {
+		out = append(out, *d)
+	}
+	return out
+}
+
+// ServeHTTP serves an indexed image. Only files in the index are served so
+// the rest of the filesystem is never exposed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "invalid method for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rel := strings.TrimPrefix(r.URL.Path, PathPrefix)
+	img, ok := s.repo.byRelPath(rel)
+	if !ok {
+		glog.Warningf("%s: request for unknown firmware %s", r.RemoteAddr, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.repo.Root(), filepath.FromSlash(img.Path)))
+	if err != nil {
+		glog.Errorf("%s: could not open firmware %s: %s", r.RemoteAddr, img.Path, err)
+		http.Error(w, "firmware unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		glog.Errorf("%s: could not stat firmware %s: %s", r.RemoteAddr, img.Path, err)
+		http.Error(w, "firmware unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	dl := s.track(r, img)
+	pw := &progressWriter{ResponseWriter: w, server: s, dl: dl}
+	http.ServeContent(pw, r, filepath.Base(img.Path), info.ModTime(), f)
+	pw.finish()
+}
+
+// track starts (or resumes) tracking a client's download of img
+func (s *Server) track(r *http.Request, img Image) *Download {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	dev := ""
+	if s.Identify != nil {
+		dev = s.Identify(ip)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip + " " + img.Path
+	dl, ok := s.downloads[key]
+	if !ok || dl.Done {
+		dl = &Download{Client: ip, Device: dev, Path: img.Path, Size: img.Size, Started: time.Now()}
+		s.downloads[key] = dl
+		glog.Infof("firmware: %s starting download of %s", dl.who(), img.Path)
+	} else {
+		glog.Infof("firmware: %s resuming download of %s at %d bytes", dl.who(), img.Path, dl.Sent)
+	}
+	return dl
+}
+
+func (d *Download) who() string {
+	if d.Device != "" {
+		return d.Device + " (" + d.Client + ")"
+	}
+	return d.Client
+}
+
+// progressWriter counts body bytes sent and logs download progress
+type progressWriter struct {
+	http.ResponseWriter
+	server *Server
+	dl     *Download
+	offset int64
+	logged int64
+}
+
+func (pw *progressWriter) WriteHeader(status int) {
+	if status == http.StatusPartialContent {
+		// resume from wherever the range starts
+		var start, end, size int64
+		if n, _ := fmt.Sscanf(pw.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); n == 3 {
+			pw.offset = start
+		}
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.ResponseWriter.Write(b)
+
+	pw.server.mu.Lock()
+	pw.offset += int64(n)
+	if pw.offset > pw.dl.Sent {
+		pw.dl.Sent = pw.offset
+	}
+	sent, size := pw.dl.Sent, pw.dl.Size
+	pw.server.mu.Unlock()
+
+	if size > 0 {
+		pct := sent * 100 / size
+		if pct/progressStep > pw.logged/progressStep && pct < 100 {
+			pw.logged = pct
+			glog.Infof("firmware: %s %d%% of %s", pw.dl.who(), pct, pw.dl.Path)
+		}
+	}
+
+	return n, err
+}
+
+func (pw *progressWriter) finish() {
+	pw.server.mu.Lock()
+	defer pw.server.mu.Unlock()
+
+	if pw.dl.Size > 0 && pw.dl.Sent >= pw.dl.Size && !pw.dl.Done {
+		pw.dl.Done = true
+		glog.Infof("firmware: %s finished download of %s in %s", pw.dl.who(), pw.dl.Path, time.Since(pw.dl.Started).Round(time.Second))
+	}
+}
@@ -0,0 +1,240 @@
+// Package fwimage parses and validates UniFi firmware (.bin) images so
+// nanofi can tell what board and version an image is for before pushing
+// it to a device.
+//
+// Images start with a UBNT header holding a version string, followed by
+// PART sections each carrying its own CRC, and end with an END. (or, for
+// signed images, ENDS) trailer whose CRC covers everything before it.
+// All integers are big endian and all CRCs are CRC-32 (IEEE).
+package fwimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	magicUBNT    = "UBNT"
+	magicOPEN    = "OPEN"
+	magicPART    = "PART"
+	magicEND     = "END."
+	magicSigned  = "ENDS"
+	versionLen   = 256
+	partNameLen  = 16
+	partPadLen   = 12
+	maxPartCount = 64
+)
+
+// ErrNoMagic is returned when data is not a UBNT firmware image
+var ErrNoMagic = errors.New("missing UBNT firmware magic")
+
+// ErrTruncated is returned when an image ends before its END. trailer
+var ErrTruncated = errors.New("truncated firmware image")
+
+// ErrBadCRC is returned when a header, section or image CRC doesn't match
+var ErrBadCRC = errors.New("firmware CRC mismatch")
+
+// ErrBadSection is returned for unrecognized or malformed sections
+var ErrBadSection = errors.New("malformed firmware section")
+
+// Section is a PART entry in a firmware image
+type Section struct {
+	Name      string `json:"name"`
+	Index     uint32 `json:"index"`
+	MemAddr   uint32 `json:"mem_addr"`
+	BaseAddr  uint32 `json:"base_addr"`
+	EntryAddr uint32 `json:"entry_addr"`
+	DataSize  uint32 `json:"data_size"`
+	PartSize  uint32 `json:"part_size"`
+	Offset    int64  `json:"offset"`
+	CRC       uint32 `json:"crc"`
+}
+
+// Image describes a parsed and verified firmware image
+type Image struct {
+	// VersionString is the raw header version, e.g. BZ.qca956x.v4.3.20.11298.200704.1347
+	VersionString string `json:"version_string"`
+	// Platform is the board family, e.g. BZ.qca956x
+	Platform string `json:"platform"`
+	// Version is the firmware version, e.g. 4.3.20.11298
+	Version string `json:"version"`
+	// BuildDate is the trailing build stamp, e.g. 200704.1347
+	BuildDate string    `json:"build_date,omitempty"`
+	Sections  []Section `json:"sections"`
+	Signed    bool      `json:"signed"`
+	Size      int64     `json:"size"`
+	// Models are the device models this image is known to apply to
+	Models []string `json:"models"`
+}
+
+// Supports reports whether the image is known to apply to model
+func (img *Image) Supports(model string) bool {
+	for _, m := range img.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFile parses and verifies the firmware image at path
+func ParseFile(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse reads and verifies a firmware image, checking every CRC
+func Parse(rdr io.Reader) (*Image, error) {
+	whole := crc32.NewIEEE()
+	cr := &countingReader{r: io.TeeReader(rdr, whole)}
+	img := &Image{}
+
+	hdr := make([]byte, 4+versionLen)
+	if _, err := io.ReadFull(cr, hdr[:4]); err != nil {
+		return nil, ErrTruncated
+	}
+	magic := string(hdr[:4])
+	if magic != magicUBNT && magic != magicOPEN {
+		return nil, ErrNoMagic
+	}
+	if _, err := io.ReadFull(cr, hdr[4:]); err != nil {
+		return nil, ErrTruncated
+	}
+
+	var hcrc [8]byte
+	if _, err := io.ReadFull(cr, hcrc[:]); err != nil {
+		return nil, ErrTruncated
+	}
+	if got := crc32.ChecksumIEEE(hdr); got != binary.BigEndian.Uint32(hcrc[:4]) {
+		return nil, fmt.Errorf("%w in header: have %08x, want %08x", ErrBadCRC, got, binary.BigEndian.Uint32(hcrc[:4]))
+	}
+
+	img.VersionString = cString(hdr[4:])
+	img.Platform, img.Version, img.BuildDate = ParseVersionString(img.VersionString)
+	img.Models = Models(img.Platform)
+
+	for {
+		sumBefore := whole.Sum32()
+		var magic [4]byte
+		if _, err := io.ReadFull(cr, magic[:]); err != nil {
+			return nil, ErrTruncated
+		}
+
+		switch string(magic[:]) {
+		case magicPART:
+			if len(img.Sections) >= maxPartCount {
+				return nil, fmt.Errorf("%w: more than %d sections", ErrBadSection, maxPartCount)
+			}
+			s, err := readSection(cr, magic[:])
+			if err != nil {
+				return nil, err
+			}
+			img.Sections = append(img.Sections, s)
+
+		case magicEND, magicSigned:
+			var trailer [8]byte
+			if _, err := io.ReadFull(cr, trailer[:]); err != nil {
+				return nil, ErrTruncated
+			}
+			if want := binary.BigEndian.Uint32(trailer[:4]); sumBefore != want {
+				return nil, fmt.Errorf("%w in image trailer: have %08x, want %08x", ErrBadCRC, sumBefore, want)
+			}
+			img.Signed = string(magic[:]) == magicSigned
+			if img.Signed {
+				// the RSA signature that follows isn't something we can verify
+				if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+					return nil, err
+				}
+			}
+			img.Size = cr.n
+			return img, nil
+
+		default:
+			return nil, fmt.Errorf("%w: unknown section magic %q at offset %d", ErrBadSection, magic[:], cr.n-4)
+		}
+	}
+}
+
+// readSection reads a PART header (after its magic), its data and CRC
+func readSection(cr *countingReader, magic []byte) (s Section, err error) {
+	s.Offset = cr.n - 4
+	partCRC := crc32.NewIEEE()
+	partCRC.Write(magic)
+
+	hdr := make([]byte, partNameLen+partPadLen+6*4)
+	if _, err := io.ReadFull(cr, hdr); err != nil {
+		return s, ErrTruncated
+	}
+	partCRC.Write(hdr)
+
+	s.Name = cString(hdr[:partNameLen])
+	fields := bytes.NewReader(hdr[partNameLen+partPadLen:])
+	binary.Read(fields, binary.BigEndian, &s.MemAddr)
+	binary.Read(fields, binary.BigEndian, &s.Index)
+	binary.Read(fields, binary.BigEndian, &s.BaseAddr)
+	binary.Read(fields, binary.BigEndian, &s.EntryAddr)
+	binary.Read(fields, binary.BigEndian, &s.DataSize)
+	binary.Read(fields, binary.BigEndian, &s.PartSize)
+
+	if n, err := io.CopyN(partCRC, cr, int64(s.DataSize)); err != nil || n != int64(s.DataSize) {
+		return s, ErrTruncated
+	}
+
+	var trailer [8]byte
+	if _, err := io.ReadFull(cr, trailer[:]); err != nil {
+		return s, ErrTruncated
+	}
+	s.CRC = binary.BigEndian.Uint32(trailer[:4])
+	if got := partCRC.Sum32(); got != s.CRC {
+		return s, fmt.Errorf("%w in section %s: have %08x, want %08x", ErrBadCRC, s.Name, got, s.CRC)
+	}
+
+	return s, nil
+}
+
+var versionPattern = regexp.MustCompile(`^([A-Za-z0-9]+)\.([A-Za-z0-9]+)[._]v?(\d+\.\d+\.\d+)[.+](\d+)(?:\.(.*))?$`)
+
+// ParseVersionString splits a firmware header version string such as
+// BZ.qca956x.v4.3.20.11298.200704.1347 into its platform (BZ.qca956x),
+// version (4.3.20.11298) and build date (200704.1347). If the string isn't
+// in the expected form, version is the whole string and platform is empty.
+func ParseVersionString(s string) (platform string, version string, buildDate string) {
+	s = strings.TrimSpace(s)
+	m := versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", s, ""
+	}
+	return m[1] + "." + m[2], m[3] + "." + m[4], m[5]
+}
+
+// cString returns the NUL terminated string at the start of b
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,137 @@
+package fwimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPart struct {
+	name string
+	data []byte
+}
+
+// buildImage assembles a firmware image the way mkfwimage does
+func buildImage(version string, endMagic string, parts ...testPart) []byte {
+	var b bytes.Buffer
+
+	hdr := make([]byte, 4+versionLen)
+	copy(hdr, magicUBNT)
+	copy(hdr[4:], version)
+	b.Write(hdr)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(hdr))
+	binary.Write(&b, binary.BigEndian, uint32(0))
+
+	for i, p := range parts {
+		var ph bytes.Buffer
+		ph.WriteString(magicPART)
+		name := make([]byte, partNameLen+partPadLen)
+		copy(name, p.name)
+		ph.Write(name)
+		for _, v := range []uint32{0x80002000, uint32(i + 1), 0x9f050000, 0x80002000, uint32(len(p.data)), 0x100000} {
+			binary.Write(&ph, binary.BigEndian, v)
+		}
+		ph.Write(p.data)
+
+		b.Write(ph.Bytes())
+		binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(ph.Bytes()))
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	}
+
+	sum := crc32.ChecksumIEEE(b.Bytes())
+	b.WriteString(endMagic)
+	binary.Write(&b, binary.BigEndian, sum)
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	return b.Bytes()
+}
+
+var sampleImage = buildImage("BZ.qca956x.v4.3.20.11298.200704.1347", magicEND,
+	testPart{"kernel", []byte("not really a kernel")},
+	testPart{"rootfs", bytes.Repeat([]byte{0xa5}, 300)},
+)
+
+func TestParse(t *testing.T) {
+	img, err := Parse(bytes.NewReader(sampleImage))
+	assert.Nil(t, err)
+	assert.Equal(t, "BZ.qca956x", img.Platform)
+	assert.Equal(t, "4.3.20.11298", img.Version)
+	assert.Equal(t, "200704.1347", img.BuildDate)
+	assert.Equal(t, int64(len(sampleImage)), img.Size)
+	assert.False(t, img.Signed)
+	assert.Len(t, img.Sections, 2)
+	assert.Equal(t, "kernel", img.Sections[0].Name)
+	assert.Equal(t, "rootfs", img.Sections[1].Name)
+	assert.Equal(t, uint32(300), img.Sections[1].DataSize)
+	assert.True(t, img.Supports("U7PG2"))
+	assert.False(t, img.Supports("US8P60"), "AP firmware must not match a switch")
+}
+
+func TestParseSigned(t *testing.T) {
+	data := buildImage("US.bcm5334x.v3.9.54.9373.190919.1016", magicSigned, testPart{"kernel", []byte("k")})
+	data = append(data, bytes.Repeat([]byte{0x42}, 256)...)
+
+	img, err := Parse(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.True(t, img.Signed)
+	assert.True(t, img.Supports("US8P60"))
+}
+
+func TestParseCorrupt(t *testing.T) {
+	test := []struct {
+		Name string
+		Data func() []byte
+		Err  error
+	}{
+		{"not firmware", func() []byte { return []byte("hello world, this is not an image") }, ErrNoMagic},
+		{"short header", func() []byte { return sampleImage[:100] }, ErrTruncated},
+		{"wrong magic", func() []byte {
+			d := append([]byte(nil), sampleImage...)
+			copy(d, "NOPE")
+			return d
+		}, ErrNoMagic},
+		{"header crc", func() []byte {
+			d := append([]byte(nil), sampleImage...)
+			d[10] ^= 0xff
+			return d
+		}, ErrBadCRC},
+		{"section crc", func() []byte {
+			d := append([]byte(nil), sampleImage...)
+			d[len(d)-100] ^= 0xff
+			return d
+		}, ErrBadCRC},
+		{"truncated", func() []byte { return sampleImage[:len(sampleImage)-40] }, ErrTruncated},
+		{"trailer crc", func() []byte {
+			d := append([]byte(nil), sampleImage...)
+			d[len(d)-5] ^= 0xff
+			return d
+		}, ErrBadCRC},
+	}
+
+	for _, tc := range test {
+		_, err := Parse(bytes.NewReader(tc.Data()))
+		assert.True(t, errors.Is(err, tc.Err), "%s: want %v, have %v", tc.Name, tc.Err, err)
+	}
+}
+
+func TestParseVersionString(t *testing.T) {
+	test := []struct {
+		In, Platform, Version, BuildDate string
+	}{
+		{"BZ.qca956x.v4.3.20.11298.200704.1347", "BZ.qca956x", "4.3.20.11298", "200704.1347"},
+		{"US.bcm5334x.v3.9.54.9373.190919.1016", "US.bcm5334x", "3.9.54.9373", "190919.1016"},
+		{"BZ.mt7621_6.5.28+14491.230127.2313", "BZ.mt7621", "6.5.28.14491", "230127.2313"},
+		{"U7HD.ipq806x.v4.0.80.10875", "U7HD.ipq806x", "4.0.80.10875", ""},
+		{"something else", "", "something else", ""},
+	}
+
+	for _, tc := range test {
+		p, v, d := ParseVersionString(tc.In)
+		assert.Equal(t, tc.Platform, p, tc.In)
+		assert.Equal(t, tc.Version, v, tc.In)
+		assert.Equal(t, tc.BuildDate, d, tc.In)
+	}
+}
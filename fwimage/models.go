@@ -0,0 +1,32 @@
+package fwimage
+
+import "sort"
+
+// platforms maps firmware platform identifiers (the start of the header
+// version string) to the device models, as reported in inform, that run
+// that firmware. Unknown platforms map to no models, so images for them
+// can't be matched to a model by their header alone: they're only served
+// when filed under a model's directory, which is then trusted.
+var platforms = map[string][]string{
+	// UAP, UAP-LR, UAP-Outdoor
+	"BZ.ar7240": {"BZ2", "BZ2LR", "U2O"},
+	// UAP-AC-Lite, -LR, -Pro, -EDU, -M, -M-Pro, -IW
+	"BZ.qca956x": {"U7LT", "U7LR", "U7PG2", "U7EDU", "U7MSH", "U7MP", "U7IW"},
+	// UAP-AC (v1), UAP-AC-Outdoor
+	"BZ.qca955x": {"U7P", "U7O"},
+	// UAP-nanoHD, UAP-FlexHD, UAP-BeaconHD
+	"BZ.mt7621": {"U7NHD", "UFLHD", "UHDIW"},
+	// UAP-AC-HD, UAP-AC-SHD, UAP-XG
+	"U7HD.ipq806x": {"U7HD", "U7SHD", "U7XG"},
+	// USW-8-60W, -8-150W, -16/24/48 (PoE) gen 1
+	"US.bcm5334x": {"US8", "US8P60", "US8P150", "US16P150", "US24", "US24P250", "US24P500", "US48", "US48P500"},
+	// USW-Lite-8-PoE, USW-Lite-16-PoE, USW-16/24/48 gen 2
+	"USW.mt7621": {"USL8LP", "USL16LP", "USL16P", "USL24", "USL48"},
+}
+
+// Models returns the device models firmware for platform applies to
+func Models(platform string) []string {
+	models := append([]string(nil), platforms[platform]...)
+	sort.Strings(models)
+	return models
+}
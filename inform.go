@@ -2,13 +2,15 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
 	"github.com/jda/nanofi/inform"
 )
 
-func informHandler(w http.ResponseWriter, r *http.Request) {
+func (c *controller) informHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		glog.Warningf("%s: unsupported method %s on %s", r.RemoteAddr, r.Method, r.RequestURI)
 		http.Error(w, "invalid method for this endpoint", http.StatusMethodNotAllowed)
@@ -22,7 +24,14 @@ func informHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imsg, err := inform.DecodeHeader(r.Body)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Errorf("%s: could not read inform: %s", r.RemoteAddr, err)
+		http.Error(w, "inform read error", http.StatusBadRequest)
+		return
+	}
+
+	imsg, err := inform.DecodeHeader(bytes.NewReader(body))
 	if err != nil {
 		glog.Errorf("%s: could not parse inform header: %s", r.RemoteAddr, err)
 		http.Error(w, "inform header error", http.StatusInternalServerError)
@@ -30,41 +39,50 @@ func informHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	glog.Infof("inform header: %+v", imsg)
 
-	// check if known - hwaddr
-
-	payload, err := imsg.DecodePayload(r.Body, "")
+	payload, adopted, err := c.decodePayload(&imsg, body[40:])
 	if err != nil {
 		glog.Errorf("%s: could not decrypt inform payload: %s", r.RemoteAddr, err)
 		http.Error(w, "payload decrypt error", http.StatusInternalServerError)
 		return
 	}
+	glog.V(2).Infof("got request from: %s\n%s", r.RemoteAddr, payload)
 
-	//
-
-	glog.Infof("got request from: %s\n%s", r.RemoteAddr, payload)
-
-	noop := inform.NewNoOpResponse(22)
-	// TODO what if we reply in clear? just to test...
-	// also need function to set flagMask from flags so it's correct on response...
-	res, err := imsg.NewResponse(noop)
+	info, err := inform.ParseInfo(payload)
 	if err != nil {
-		glog.Errorf("%s: could not generate response payload: %s", r.RemoteAddr, err)
-		http.Error(w, "response generation error", http.StatusInternalServerError)
+		glog.Errorf("%s: %s", r.RemoteAddr, err)
+		http.Error(w, "payload parse error", http.StatusBadRequest)
 		return
 	}
-	glog.Infof("sending response:\n%+v", res)
 
-	resX := bytes.NewBuffer(res)
-	dH, err := inform.DecodeHeader(resX)
+	dev, prev, err := c.devices.Observe(imsg.HardwareAddr.String(), info, adopted)
 	if err != nil {
-		glog.Fatalf("failed to decode response: %s", err)
+		glog.Errorf("%s: could not record device %s: %s", r.RemoteAddr, imsg.HardwareAddr, err)
+		http.Error(w, "device error", http.StatusBadRequest)
+		return
+	}
+	if c.names != nil {
+		if enriched, err := c.devices.Enrich(dev.MAC, c.names); err == nil {
+			dev = enriched
+		}
+	}
+	glog.Infof("%s: inform from %s (%s) on %s, adopted: %t", r.RemoteAddr, dev.MAC, dev.Model, dev.Version, dev.Adopted)
+
+	c.auditObserved(dev, prev)
+
+	reply, actor, cmd := c.reply(dev, prev)
+	c.auditReply(dev, reply, actor, cmd)
+
+	if err := c.devices.Save(); err != nil {
+		glog.Errorf("%s", err)
 	}
 
-	dP, err := dH.DecodePayload(resX, "")
+	res, err := imsg.NewResponse(reply)
 	if err != nil {
-		glog.Fatalf("failed to decode response payload: %s", err)
+		glog.Errorf("%s: could not generate response payload: %s", r.RemoteAddr, err)
+		http.Error(w, "response generation error", http.StatusInternalServerError)
+		return
 	}
-	glog.Infof("got response payload: %s", dP)
+	glog.V(2).Infof("sending response:\n%+v", reply)
 
 	w.Header().Set("Content-Type", inform.InformContentType)
 	_, err = w.Write((res)) // nosemgrep: go.lang.security.audit.xss.no-direct-write-to-responsewriter.no-direct-write-to-responsewriter
@@ -77,3 +95,48 @@ func informHandler(w http.ResponseWriter, r *http.Request) {
 	return
 
 }
+
+// reply picks the response to an inform from dev, given its state before
+// the inform (prev). actor is who the reply is on behalf of, and cmd the
+// command it's for, if any.
+func (c *controller) reply(dev device.Device, prev device.Device) (reply inform.Response, actor string, cmd string) {
+	if c.bench != nil {
+		reply, actor = c.bench.Handle(dev, prev), actorBench
+	} else if c.rollout != nil {
+		reply, actor = c.rollout.Handle(dev, prev), actorRollout
+	}
+	// bench devices end up reset, so there's no point configuring them.
+	// Devices approved but yet to adopt take their key from the command
+	// queued for them.
+	if reply == nil && c.provision != nil && c.bench == nil && (dev.Adopted || !c.commands.Pending(dev.MAC)) {
+		reply, actor = c.provision.handle(dev), actorProvision
+	}
+	// queued commands wait for the bench or a rollout to be done with a
+	// device, but are confirmed regardless
+	c.commands.Confirm(dev, prev)
+	if reply == nil {
+		if reply = c.commands.Next(dev); reply != nil {
+			actor, cmd = c.sentCommand(dev.MAC)
+		}
+	}
+	if reply == nil {
+		reply = inform.NewNoOpResponse(c.interval.Interval(c.place(dev), c.busy(dev)))
+	}
+	return c.withSTUN(reply), actor, cmd
+}
+
+// decodePayload decrypts an inform with the device's own authkey if we
+// have one, falling back to the factory default key. adopted reports
+// whether the device's own key worked.
+func (c *controller) decodePayload(imsg *inform.Header, body []byte) (payload []byte, adopted bool, err error) {
+	if dev, ok := c.devices.Get(imsg.HardwareAddr.String()); ok && dev.AuthKey != "" {
+		payload, err = imsg.DecodePayload(bytes.NewReader(body), dev.AuthKey)
+		if err == nil {
+			return payload, true, nil
+		}
+		glog.Warningf("%s: authkey rejected, trying default: %s", dev.MAC, err)
+	}
+
+	payload, err = imsg.DecodePayload(bytes.NewReader(body), "")
+	return payload, false, err
+}
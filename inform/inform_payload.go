@@ -0,0 +1,103 @@
+package inform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Info is the subset of a decoded inform payload that nanofi acts on.
+// Devices send a great deal more; anything not listed here is ignored.
+type Info struct {
+	MAC             string `json:"mac"`
+	Serial          string `json:"serial"`
+	Model           string `json:"model"`
+	ModelDisplay    string `json:"model_display"`
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	RequiredVersion string `json:"required_version"`
+	Hostname        string `json:"hostname"`
+	IP              string `json:"ip"`
+	InformURL       string `json:"inform_url"`
+	CfgVersion      string `json:"cfgversion"`
+	Default         bool   `json:"default"`
+	State           int    `json:"state"`
+	Uptime          Uptime `json:"uptime"`
+	LastError       string `json:"last_error"`
+	VAPs            []VAP  `json:"vap_table"`
+	Ports           []Port `json:"port_table"`
+}
+
+// Port is the state of a switch port
+type Port struct {
+	Index      int    `json:"port_idx"`
+	Enabled    bool   `json:"enable"`
+	Up         bool   `json:"up"`
+	Speed      int    `json:"speed"`
+	FullDuplex bool   `json:"full_duplex"`
+	Autoneg    bool   `json:"autoneg"`
+	PoE        bool   `json:"port_poe"`
+	PoEMode    string `json:"poe_mode"`
+	STPState   string `json:"stp_state"`
+	Uplink     bool   `json:"is_uplink"`
+}
+
+// VAP is a wireless network an access point is serving
+type VAP struct {
+	ESSID    string    `json:"essid"`
+	BSSID    string    `json:"bssid"`
+	Radio    string    `json:"radio"`
+	Channel  int       `json:"channel"`
+	Stations []Station `json:"sta_table"`
+}
+
+// Station is a wireless client associated with a VAP
+type Station struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Signal   int    `json:"signal"`
+	Uptime   Uptime `json:"uptime"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	RxBytes  uint64 `json:"rx_bytes"`
+}
+
+// Uptime is device uptime in seconds. Some firmware reports it as a
+// JSON number and some as a string, so it accepts either.
+type Uptime uint64
+
+// UnmarshalJSON decodes uptime from a JSON number or string
+func (u *Uptime) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*u = 0
+		return nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid uptime %s: %w", b, err)
+	}
+	*u = Uptime(v)
+	return nil
+}
+
+// ParseInfo extracts device information from a decoded inform payload
+func ParseInfo(payload []byte) (info Info, err error) {
+	if err = json.Unmarshal(payload, &info); err != nil {
+		return info, fmt.Errorf("could not parse inform payload: %w", err)
+	}
+
+	// USW-Flex-Mini firmware pads its version with a trailing space
+	info.Version = strings.TrimSpace(info.Version)
+	info.MAC = strings.ToLower(info.MAC)
+	for i := range info.VAPs {
+		for j := range info.VAPs[i].Stations {
+			sta := &info.VAPs[i].Stations[j]
+			sta.MAC = strings.ToLower(sta.MAC)
+		}
+	}
+
+	return info, nil
+}
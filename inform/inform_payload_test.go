@@ -0,0 +1,122 @@
+package inform
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeSample(t *testing.T, sample []byte) []byte {
+	r := bytes.NewReader(sample)
+	ih, err := DecodeHeader(r)
+	assert.Nil(t, err, "sample header should decode")
+	payload, err := ih.DecodePayload(r, "")
+	assert.Nil(t, err, "sample payload should decode")
+	return payload
+}
+
+func TestParseInfo(t *testing.T) {
+	test := []struct {
+		Name   string
+		Sample []byte
+		Want   Info
+	}{
+		{"string uptime, padded version", sampleInform, Info{
+			MAC: "74:83:c2:0f:15:b0", Serial: "7483C20F15B0", Model: "USMINI",
+			Version: "1.6.1.525", Hostname: "USW_MINI", IP: "192.168.1.61",
+			CfgVersion: "?", Default: true, Uptime: 155,
+		}},
+		{"numeric uptime", sampleSnappyInform, Info{
+			MAC: "74:83:c2:d2:01:d8", Serial: "7483C2D201D8", Model: "US8P60",
+			Version: "3.9.54.9373", Hostname: "UBNT", IP: "192.168.1.96",
+			CfgVersion: "?", Default: true, Uptime: 163,
+		}},
+		{"access point", sampleSnappyInform2, Info{
+			MAC: "e0:63:da:85:aa:c5", Serial: "E063DA85AAC5", Model: "UFLHD",
+			Version: "4.0.42.10433", Hostname: "UBNT", IP: "192.168.1.69",
+			CfgVersion: "?", Default: true, Uptime: 83,
+		}},
+	}
+
+	for _, tc := range test {
+		info, err := ParseInfo(decodeSample(t, tc.Sample))
+		assert.Nil(t, err, tc.Name)
+		assert.Equal(t, tc.Want.MAC, info.MAC, tc.Name)
+		assert.Equal(t, tc.Want.Serial, info.Serial, tc.Name)
+		assert.Equal(t, tc.Want.Model, info.Model, tc.Name)
+		assert.Equal(t, tc.Want.Version, info.Version, tc.Name)
+		assert.Equal(t, tc.Want.Hostname, info.Hostname, tc.Name)
+		assert.Equal(t, tc.Want.IP, info.IP, tc.Name)
+		assert.Equal(t, tc.Want.CfgVersion, info.CfgVersion, tc.Name)
+		assert.Equal(t, tc.Want.Default, info.Default, tc.Name)
+		assert.Equal(t, tc.Want.Uptime, info.Uptime, tc.Name)
+	}
+}
+
+func TestParseInfoStations(t *testing.T) {
+	info, err := ParseInfo(decodeSample(t, sampleSnappyInform2))
+	assert.Nil(t, err)
+	assert.Len(t, info.VAPs, 2)
+	assert.Equal(t, "E063DA85AAC5", info.VAPs[1].ESSID)
+	assert.Equal(t, "ng", info.VAPs[1].Radio)
+	assert.Equal(t, 11, info.VAPs[1].Channel)
+	assert.Len(t, info.VAPs[1].Stations, 0)
+
+	info, err = ParseInfo([]byte(`{"mac":"E0:63:DA:85:AA:C5","vap_table":[{"essid":"lab","sta_table":[` +
+		`{"mac":"3C:22:FB:00:00:01","ip":"192.168.1.77","hostname":"","signal":-52,"uptime":"60"}]}]}`))
+	assert.Nil(t, err)
+	sta := info.VAPs[0].Stations[0]
+	assert.Equal(t, "3c:22:fb:00:00:01", sta.MAC, "station MACs are normalized too")
+	assert.Equal(t, -52, sta.Signal)
+	assert.Equal(t, Uptime(60), sta.Uptime)
+}
+
+func TestParseInfoPorts(t *testing.T) {
+	info, err := ParseInfo(decodeSample(t, sampleSnappyInform))
+	assert.Nil(t, err)
+	assert.Len(t, info.Ports, 8)
+	assert.Equal(t, Port{
+		Index: 1, Enabled: true, Up: true, Speed: 1000, FullDuplex: true, Autoneg: true,
+		STPState: "forwarding", Uplink: true,
+	}, info.Ports[0])
+	assert.True(t, info.Ports[4].PoE)
+	assert.Equal(t, "auto", info.Ports[4].PoEMode)
+}
+
+func TestParseInfoBadUptime(t *testing.T) {
+	_, err := ParseInfo([]byte(`{"uptime":"soon"}`))
+	assert.NotNil(t, err, "non-numeric uptime should not parse")
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	r := bytes.NewReader(sampleInform)
+	ih, err := DecodeHeader(r)
+	assert.Nil(t, err)
+	_, err = ih.DecodePayload(r, "")
+	assert.Nil(t, err)
+
+	res, err := ih.NewResponse(NewUpgradeResponse("http://fw/x.bin", "4.3.20.11298", "abc"))
+	assert.Nil(t, err, "response should encode")
+
+	rr := bytes.NewReader(res)
+	rh, err := DecodeHeader(rr)
+	assert.Nil(t, err, "response header should decode")
+	payload, err := rh.DecodePayload(rr, "")
+	assert.Nil(t, err, "response payload should decode")
+	assert.Contains(t, string(payload), `"_type":"upgrade"`)
+	assert.Contains(t, string(payload), `"url":"http://fw/x.bin"`)
+}
+
+func TestNewAuthKey(t *testing.T) {
+	k, err := NewAuthKey()
+	assert.Nil(t, err)
+	assert.Len(t, k, 32, "authkey should be 16 bytes hex encoded")
+	assert.NotEqual(t, defaultAuthKey, k)
+}
+
+func TestMgmtCfg(t *testing.T) {
+	cfg := MgmtCfg("0123456789abcdef0123456789abcdef", "1a2b3c4d5e6f7a8b")
+	assert.Contains(t, cfg, "\nauthkey=0123456789abcdef0123456789abcdef\n")
+	assert.Contains(t, cfg, "\ncfgversion=1a2b3c4d5e6f7a8b\n")
+}
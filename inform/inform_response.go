@@ -7,6 +7,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -27,7 +28,9 @@ https://github.com/jrjparks/OpnFi-rs/blob/master/lib_opnfi/src/inform/payload/mo
 https://community.ui.com/questions/AP-Upgrade-to-3-7-21-5389-fails/6d6c8ce1-f728-416b-aa86-7ffb25977c90
 */
 
-type informResponse interface {
+// Response is implemented by every message the controller can send back
+// to a device in reply to an inform
+type Response interface {
 	JSON() ([]byte, error)
 }
 
@@ -51,8 +54,118 @@ func NewNoOpResponse(sleepSeconds uint64) NoOpResponse {
 	return nr
 }
 
+// SetParamResponse pushes management and/or system configuration to a device
+type SetParamResponse struct {
+	Kind       string `json:"_type"`
+	MgmtCfg    string `json:"mgmt_cfg,omitempty"`
+	SystemCfg  string `json:"system_cfg,omitempty"`
+	ServerTime string `json:"server_time_in_utc"`
+}
+
+// JSON returns json representation of response
+func (r SetParamResponse) JSON() (response []byte, err error) {
+	response, err = json.Marshal(r)
+	return response, err
+}
+
+// NewSetParamResponse generates a new SetParamResponse bundle
+func NewSetParamResponse(mgmtCfg string, systemCfg string) SetParamResponse {
+	st := unifiServerTime()
+	return SetParamResponse{"setparam", mgmtCfg, systemCfg, st}
+}
+
+// InitialCfgVersion is the cfgversion given to newly adopted devices
+const InitialCfgVersion = "0000000000000000"
+
+// MgmtCfg builds the mgmt_cfg that adopts a device with authkey, tagged
+// with cfgversion
+func MgmtCfg(authkey string, cfgversion string) string {
+	return "capability=notif,fastapply-bg,notif-assoc-stat\n" +
+		"selfrun_guest_mode=pass\n" +
+		"cfgversion=" + cfgversion + "\n" +
+		"authkey=" + authkey + "\n" +
+		"use_aes_gcm=true\n" +
+		"report_crash=true\n"
+}
+
+// UpgradeResponse tells a device to fetch and install a firmware image
+type UpgradeResponse struct {
+	Kind       string `json:"_type"`
+	URL        string `json:"url"`
+	Version    string `json:"version"`
+	MD5Sum     string `json:"md5sum,omitempty"`
+	ServerTime string `json:"server_time_in_utc"`
+}
+
+// JSON returns json representation of response
+func (r UpgradeResponse) JSON() (response []byte, err error) {
+	response, err = json.Marshal(r)
+	return response, err
+}
+
+// NewUpgradeResponse generates a new UpgradeResponse bundle
+func NewUpgradeResponse(url string, version string, md5sum string) UpgradeResponse {
+	st := unifiServerTime()
+	return UpgradeResponse{"upgrade", url, version, md5sum, st}
+}
+
+// SetDefaultResponse tells a device to reset itself to factory defaults
+type SetDefaultResponse struct {
+	Kind       string `json:"_type"`
+	ServerTime string `json:"server_time_in_utc"`
+}
+
+// JSON returns json representation of response
+func (r SetDefaultResponse) JSON() (response []byte, err error) {
+	response, err = json.Marshal(r)
+	return response, err
+}
+
+// NewSetDefaultResponse generates a new SetDefaultResponse bundle
+func NewSetDefaultResponse() SetDefaultResponse {
+	st := unifiServerTime()
+	return SetDefaultResponse{"setdefault", st}
+}
+
+// RebootResponse tells a device to reboot
+type RebootResponse struct {
+	Kind       string `json:"_type"`
+	ServerTime string `json:"server_time_in_utc"`
+}
+
+// JSON returns json representation of response
+func (r RebootResponse) JSON() (response []byte, err error) {
+	response, err = json.Marshal(r)
+	return response, err
+}
+
+// NewRebootResponse generates a new RebootResponse bundle
+func NewRebootResponse() RebootResponse {
+	st := unifiServerTime()
+	return RebootResponse{"reboot", st}
+}
+
+// CmdResponse runs a named device command such as set-locate
+type CmdResponse struct {
+	Kind       string `json:"_type"`
+	Cmd        string `json:"cmd"`
+	ServerTime string `json:"server_time_in_utc"`
+}
+
+// JSON returns json representation of response
+func (r CmdResponse) JSON() (response []byte, err error) {
+	response, err = json.Marshal(r)
+	return response, err
+}
+
+// NewCmdResponse generates a new CmdResponse bundle
+func NewCmdResponse(cmd string) CmdResponse {
+	st := unifiServerTime()
+	return CmdResponse{"cmd", cmd, st}
+}
+
 // NewResponse serializes a unifi inform response
-func (ih *Header) NewResponse(ir informResponse) (encoded []byte, err error) {
+func (ih *Header) NewResponse(ir Response) (encoded []byte, err error) {
 	payload, err := ir.JSON()
 	if err != nil {
 		return nil, fmt.Errorf("response payload encode failed: %w", err)
@@ -175,3 +288,14 @@ func genIV() (iv []byte, err error) {
 	}
 	return iv, nil
 }
+
+// NewAuthKey generates a random per-device authkey suitable for handing
+// to a device in mgmt_cfg during adoption
+func NewAuthKey() (key string, err error) {
+	k := make([]byte, 16)
+	_, err = rand.Read(k)
+	if err != nil {
+		return key, fmt.Errorf("could not generate authkey: %w", err)
+	}
+	return hex.EncodeToString(k), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/interval"
+)
+
+// intervalPolicy is the file format for -interval-policy
+type intervalPolicy struct {
+	Busy   string            `json:"busy"`
+	Steady string            `json:"steady"`
+	Jitter float64           `json:"jitter"`
+	Sites  map[string]string `json:"sites"`
+	Groups map[string]string `json:"groups"`
+	// SiteDevices and GroupDevices assign devices, by MAC, to the sites
+	// and groups above
+	SiteDevices  map[string][]string `json:"site_devices"`
+	GroupDevices map[string][]string `json:"group_devices"`
+}
+
+// loadIntervalPolicy reads the inform interval policy in path
+func loadIntervalPolicy(path string) (*interval.Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read interval policy: %w", err)
+	}
+	var file intervalPolicy
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse interval policy %s: %w", path, err)
+	}
+
+	p := &interval.Policy{Jitter: file.Jitter}
+	if p.Busy, err = parseDuration(file.Busy); err != nil {
+		return nil, fmt.Errorf("invalid busy interval: %w", err)
+	}
+	if p.Steady, err = parseDuration(file.Steady); err != nil {
+		return nil, fmt.Errorf("invalid steady interval: %w", err)
+	}
+	if p.Sites, err = parseDurations(file.Sites); err != nil {
+		return nil, fmt.Errorf("invalid site interval: %w", err)
+	}
+	if p.Groups, err = parseDurations(file.Groups); err != nil {
+		return nil, fmt.Errorf("invalid group interval: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid interval policy %s: %w", path, err)
+	}
+
+	if p.DeviceSites, err = byMAC(file.SiteDevices); err != nil {
+		return nil, fmt.Errorf("invalid interval policy %s: site_devices: %w", path, err)
+	}
+	if p.DeviceGroups, err = byMAC(file.GroupDevices); err != nil {
+		return nil, fmt.Errorf("invalid interval policy %s: group_devices: %w", path, err)
+	}
+	return p, nil
+}
+
+// byMAC turns lists of members by name into the name for each member's
+// normalized MAC
+func byMAC(members map[string][]string) (map[string]string, error) {
+	out := make(map[string]string)
+	for name, macs := range members {
+		for _, mac := range macs {
+			norm, err := device.NormalizeMAC(mac)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if other, ok := out[norm]; ok && other != name {
+				return nil, fmt.Errorf("%s is in both %s and %s", norm, other, name)
+			}
+			out[norm] = name
+		}
+	}
+	return out, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseDurations(in map[string]string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration, len(in))
+	for k, v := range in {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = d
+	}
+	return out, nil
+}
+
+// busy reports whether dev has something in progress that calls for it to
+// inform often
+func (c *controller) busy(dev device.Device) bool {
+	return (c.bench != nil && c.bench.Active(dev.MAC)) ||
+		(c.rollout != nil && c.rollout.Active(dev.MAC)) ||
+		c.commands.Pending(dev.MAC)
+}
@@ -0,0 +1,129 @@
+// Package interval picks how often devices should inform. Devices with
+// something in progress are asked back within seconds so commands and
+// upgrades move quickly; everything else informs at a slower steady rate,
+// set per site or group and jittered so a site of devices powering up
+// together doesn't keep informing in lockstep.
+package interval
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/jda/nanofi/device"
+)
+
+// Defaults used for zero values in a Policy
+const (
+	DefaultBusy   = 3 * time.Second
+	DefaultSteady = 22 * time.Second
+	DefaultJitter = 0.1
+)
+
+// Policy decides the inform interval for each device
+type Policy struct {
+	// Busy is the interval for devices adopting, upgrading or with
+	// commands queued
+	Busy time.Duration
+	// Steady is the interval for everything else
+	Steady time.Duration
+	// Sites and Groups override Steady for devices in them; a device's
+	// group takes precedence over its site
+	Sites  map[string]time.Duration
+	Groups map[string]time.Duration
+	// DeviceSites and DeviceGroups put devices, by MAC, in a site and
+	// group here ahead of the ones they're otherwise in
+	DeviceSites  map[string]string
+	DeviceGroups map[string]string
+	// Jitter spreads steady intervals by up to this share either way, from
+	// 0 to 1; negative disables it
+	Jitter float64
+
+	// rand returns a number in [0, 1)
+	rand func() float64
+}
+
+// Validate checks the policy makes sense
+func (p *Policy) Validate() error {
+	if p.Busy != 0 && (p.Busy < time.Second || p.Busy > 5*time.Second) {
+		return fmt.Errorf("busy interval must be 1-5s, not %s", p.Busy)
+	}
+	if p.Jitter > 1 {
+		return fmt.Errorf("jitter must be at most 1, not %g", p.Jitter)
+	}
+	check := func(what string, d time.Duration) error {
+		if d < time.Second {
+			return fmt.Errorf("%s interval must be at least 1s, not %s", what, d)
+		}
+		return nil
+	}
+	if p.Steady != 0 {
+		if err := check("steady", p.Steady); err != nil {
+			return err
+		}
+	}
+	for site, d := range p.Sites {
+		if err := check("site "+site, d); err != nil {
+			return err
+		}
+	}
+	for group, d := range p.Groups {
+		if err := check("group "+group, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Interval returns the inform interval in seconds for dev. busy reports
+// whether the device has something in progress.
+func (p *Policy) Interval(dev device.Device, busy bool) uint64 {
+	if busy {
+		if p.Busy == 0 {
+			return seconds(DefaultBusy)
+		}
+		return seconds(p.Busy)
+	}
+
+	steady := p.Steady
+	if steady == 0 {
+		steady = DefaultSteady
+	}
+	site, group := dev.Site, dev.Group
+	if s, ok := p.DeviceSites[dev.MAC]; ok {
+		site = s
+	}
+	if g, ok := p.DeviceGroups[dev.MAC]; ok {
+		group = g
+	}
+	if d, ok := p.Sites[site]; ok && site != "" {
+		steady = d
+	}
+	if d, ok := p.Groups[group]; ok && group != "" {
+		steady = d
+	}
+
+	jitter := p.Jitter
+	if jitter == 0 {
+		jitter = DefaultJitter
+	}
+	if jitter > 0 {
+		r := p.rand
+		if r == nil {
+			r = rand.Float64
+		}
+		steady += time.Duration(float64(steady) * jitter * (2*r() - 1))
+	}
+
+	return seconds(steady)
+}
+
+// seconds rounds d to whole seconds, never less than one
+func seconds(d time.Duration) uint64 {
+	s := math.Round(d.Seconds())
+	if s < 1 {
+		return 1
+	}
+	return uint64(s)
+}
@@ -0,0 +1,74 @@
+package interval
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/device"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterval(t *testing.T) {
+	p := &Policy{
+		Steady: time.Minute,
+		Sites:  map[string]time.Duration{"lab": 30 * time.Second},
+		Groups: map[string]time.Duration{"canary": 10 * time.Second},
+		Jitter: -1,
+	}
+
+	tests := []struct {
+		name string
+		dev  device.Device
+		busy bool
+		want uint64
+	}{
+		{"steady", device.Device{}, false, 60},
+		{"busy", device.Device{Group: "canary"}, true, 3},
+		{"site", device.Device{Site: "lab"}, false, 30},
+		{"group beats site", device.Device{Site: "lab", Group: "canary"}, false, 10},
+		{"unknown group", device.Device{Site: "lab", Group: "other"}, false, 30},
+		{"policy site", device.Device{MAC: "fc:ec:da:00:00:01"}, false, 30},
+		{"policy group", device.Device{MAC: "fc:ec:da:00:00:02", Site: "lab"}, false, 10},
+		{"policy group beats own group", device.Device{MAC: "fc:ec:da:00:00:03", Group: "canary"}, false, 60},
+	}
+	p.DeviceSites = map[string]string{"fc:ec:da:00:00:01": "lab"}
+	p.DeviceGroups = map[string]string{"fc:ec:da:00:00:02": "canary", "fc:ec:da:00:00:03": "steady"}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, p.Interval(tt.dev, tt.busy), tt.name)
+	}
+
+	assert.Equal(t, uint64(22), (&Policy{Jitter: -1}).Interval(device.Device{}, false), "defaults")
+}
+
+func TestJitter(t *testing.T) {
+	r := 0.0
+	p := &Policy{Steady: 100 * time.Second, Jitter: 0.2, rand: func() float64 { return r }}
+
+	assert.Equal(t, uint64(80), p.Interval(device.Device{}, false))
+	r = 0.5
+	assert.Equal(t, uint64(100), p.Interval(device.Device{}, false))
+	r = 0.999999
+	assert.Equal(t, uint64(120), p.Interval(device.Device{}, false))
+	assert.Equal(t, uint64(3), p.Interval(device.Device{}, true), "busy intervals aren't jittered")
+
+	p = &Policy{Steady: time.Second, Jitter: 1, rand: func() float64 { return 0 }}
+	assert.Equal(t, uint64(1), p.Interval(device.Device{}, false), "never below a second")
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		p  Policy
+		ok bool
+	}{
+		{Policy{}, true},
+		{Policy{Busy: 5 * time.Second, Steady: time.Minute, Jitter: 0.5}, true},
+		{Policy{Busy: 10 * time.Second}, false},
+		{Policy{Jitter: 2}, false},
+		{Policy{Steady: time.Millisecond}, false},
+		{Policy{Groups: map[string]time.Duration{"canary": 0}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.p.Validate()
+		assert.Equal(t, tt.ok, err == nil, "%+v: %v", tt.p, err)
+	}
+}
@@ -3,22 +3,362 @@ package main
 import (
 	"flag"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/jda/nanofi/api"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/catalog"
+	"github.com/jda/nanofi/command"
+	"github.com/jda/nanofi/config"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/dnsmasq"
+	"github.com/jda/nanofi/firmware"
+	"github.com/jda/nanofi/interval"
+	"github.com/jda/nanofi/rollout"
 )
 
 func init() {
 	flag.Set("logtostderr", "true")
 }
 
+// controller holds the state shared by nanofi's handlers
+type controller struct {
+	// mu guards what a config reload changes in place
+	mu       sync.RWMutex
+	devices  *device.Registry
+	bench    *bench.Pipeline
+	firmware *firmware.Server
+	catalog  *catalog.Catalog
+	policy   device.Policy
+	rollout  *rollout.Rollout
+	commands *command.Queue
+	interval *interval.Policy
+	// provision pushes configuration to adopted devices
+	provision *provisioner
+	sshAdopt  *sshAdopter
+	// names looks up DHCP hostnames, from dnsmasq or our own DHCP server
+	names device.NameLookup
+	// stunURL is advertised to devices in mgmt_cfg when STUN is enabled
+	stunURL string
+	// audit records every change made to devices
+	audit *audit.Log
+	// pushed is the system_cfg last sent to each device
+	pushed pushedCfgs
+}
+
 func main() {
 	listenAddr := flag.String("listen", ":8080", "IP and port on which to listen")
+	devicesFile := flag.String("devices", "devices.json", "file in which to keep device state")
+	commandsFile := flag.String("commands", "commands.json", "file in which to keep commands queued for devices")
+	intervalPolicy := flag.String("interval-policy", "", "JSON inform interval policy of busy and steady intervals, per site and group")
+	wlanConfig := flag.String("wlan-config", "", "JSON WLAN and radio configuration to push to adopted access points")
+	switchConfig := flag.String("switch-config", "", "JSON switch port profiles to push to adopted switches")
+	mgmtConfigFile := flag.String("mgmt-config", "", "JSON management settings (address, DNS, NTP, syslog, SSH, LEDs, hostname) per site and device")
+	templatesFile := flag.String("templates", "", "JSON config templates of WLAN, switch and management settings per site, group and device")
+	configEvents := flag.String("config-events", "config-events.jsonl", "file to which config pushes and drift are appended")
+	firmwareDir := flag.String("firmware-dir", "", "directory of firmware images to serve to devices, laid out as <model>/<version>/<name>.bin")
+	firmwareListen := flag.String("firmware-listen", ":8081", "IP and port on which to serve firmware")
+	firmwareURL := flag.String("firmware-url", "", "base URL devices use to reach the firmware server, e.g. http://192.168.1.1:8081")
+	catalogURL := flag.String("catalog-url", "", "URL of a firmware index to sync -firmware-dir from")
+	catalogChannel := flag.String("catalog-channel", catalog.DefaultChannel, "firmware release channel to take from -catalog-url")
+	catalogModels := flag.String("catalog-models", "", "comma separated device models to keep the latest firmware for")
+	catalogInterval := flag.Duration("catalog-interval", 24*time.Hour, "how often to sync -catalog-url, 0 to sync only at startup")
+	benchMode := flag.Bool("bench", false, "run the unattended adopt, upgrade, default pipeline")
+	benchTargets := flag.String("bench-targets", "bench-targets.json", "JSON map of device model to firmware target for -bench")
+	benchResults := flag.String("bench-results", "bench-results.jsonl", "file to which -bench appends per-device results")
+	benchRetries := flag.Int("bench-retries", 3, "times -bench retries a failed stage")
+	benchTimeout := flag.Duration("bench-timeout", 0, "how long -bench waits for a device to finish a stage (default 10m)")
+	firmwarePolicy := flag.String("firmware-policy", "", "JSON map of device model to allowed firmware versions, reported on /compliance")
+	rolloutPlan := flag.String("rollout", "", "JSON rollout plan of firmware targets and waves to upgrade devices in")
+	rolloutEvents := flag.String("rollout-events", "rollout-events.jsonl", "file to which -rollout appends events")
+	rolloutRollback := flag.Bool("rollout-rollback", false, "roll devices on the -rollout targets back to their previous firmware")
+	discoveryListen := flag.String("discovery-listen", "", "IP and port on which to listen for device discovery announcements, e.g. :10001")
+	discoveryInterval := flag.Duration("discovery-interval", 0, "how often to broadcast discovery probes, 0 to only listen")
+	informURL := flag.String("inform-url", "", "URL devices use to reach -listen, e.g. http://192.168.1.1:8080/inform")
+	sshAdopt := flag.Bool("ssh-adopt", false, "run set-inform over SSH on discovered devices at defaults")
+	sshAdoptScan := flag.String("ssh-adopt-scan", "", "subnet to scan for SSH and run set-inform on, e.g. 192.168.1.0/24")
+	sshCredentials := flag.String("ssh-credentials", "", "JSON list of SSH credentials for -ssh-adopt to try (default ubnt/ubnt)")
+	dhcpInterface := flag.String("dhcp-interface", "", "interface on which to serve DHCP, pointing devices at this controller")
+	dhcpRange := flag.String("dhcp-range", "", "first and last address to lease with -dhcp-interface, e.g. 192.168.1.50,192.168.1.99")
+	dhcpLeaseTime := flag.Duration("dhcp-lease-time", time.Hour, "how long DHCP leases last")
+	dhcpLeases := flag.String("dhcp-leases", "dhcp-leases.json", "file in which to keep DHCP leases")
+	dhcpDomain := flag.String("dhcp-domain", "", "domain name handed out with DHCP leases")
+	dhcpRouter := flag.String("dhcp-router", "", "default gateway handed out with DHCP leases; none if empty")
+	dhcpDNS := flag.String("dhcp-dns", "", "comma separated DNS servers handed out with DHCP leases; none if empty")
+	dnsmasqConf := flag.String("dnsmasq-conf", "", "file to write dnsmasq options pointing devices at -inform-url to, e.g. /etc/dnsmasq.d/nanofi.conf")
+	dnsmasqLeases := flag.String("dnsmasq-leases", "", "dnsmasq leases file to name devices and clients from, e.g. "+dnsmasq.DefaultLeaseFile)
+	stunListen := flag.String("stun-listen", "", "IP and port on which to serve STUN for devices, e.g. :3478")
+	stunAdvertise := flag.String("stun-url", "", "STUN URL advertised to devices (default stun://<-inform-url host>:<-stun-listen port>/)")
+	apiListen := flag.String("api-listen", ":8443", "IP and port on which to serve the management API and pages over TLS, empty to serve them on -listen")
+	apiCert := flag.String("api-cert", "", "PEM certificate for -api-listen (default self-signed)")
+	apiKey := flag.String("api-key", "", "PEM key for -api-cert")
+	apiClientCA := flag.String("api-client-ca", "", "PEM CA certificates; -api-listen clients must present a certificate signed by one")
+	apiSelfSigned := flag.String("api-self-signed", "api-self-signed.pem", "file in which to keep the self-signed certificate used without -api-cert")
+	authFile := flag.String("auth", "auth.json", "file in which to keep the users and API tokens allowed to manage nanofi")
+	sessionTTL := flag.Duration("session-ttl", auth.DefaultSessionTTL, "how long management logins last")
+	auditFile := flag.String("audit", "audit.jsonl", "hash-chained log to which every change and who made it is appended")
+	configPath := flag.String("config", "", "YAML or UCI config file, e.g. /etc/config/nanofi; flags given on the command line override it")
 	flag.Parse()
 
-	http.HandleFunc("/inform", informHandler)
+	if args := flag.Args(); len(args) > 0 && args[0] == "uci" {
+		if err := convertUCI(os.Stdout, args[1:]); err != nil {
+			glog.Fatalf("%s", err)
+		}
+		return
+	}
+
+	given := givenFlags()
+	conf := &configFile{path: *configPath, running: &config.Config{}}
+	if *configPath != "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+		if err := applyConfig(cfg, given); err != nil {
+			glog.Fatalf("%s", err)
+		}
+		conf.running = cfg
+		conf.templates = !given["templates"] && !given["wlan-config"] && !given["switch-config"] && !given["mgmt-config"]
+		conf.policy = !given["firmware-policy"]
+	}
+
+	authStore, err := auth.NewStore(*authFile)
+	if err != nil {
+		glog.Fatalf("%s", err)
+	}
+	authStore.SessionTTL = *sessionTTL
+	auditLog, err := audit.Open(*auditFile)
+	if err != nil {
+		glog.Fatalf("%s", err)
+	}
+	if args := flag.Args(); len(args) > 0 && (args[0] == "user" || args[0] == "token") {
+		if err := manageAuth(os.Stdout, os.Stdin, authStore, auditLog, args); err != nil {
+			glog.Fatalf("%s", err)
+		}
+		return
+	}
+	if head, err := auditLog.Verify(); err != nil {
+		glog.Errorf("%s: %s", *auditFile, err)
+	} else {
+		glog.Infof("audit: %s has %d entries, last %s", *auditFile, head.Entries, head.Hash)
+	}
+
+	devices, err := device.NewRegistry(*devicesFile)
+	if err != nil {
+		glog.Fatalf("%s", err)
+	}
+
+	if args := flag.Args(); len(args) > 0 {
+		if len(args) != 3 || args[0] != "config" || args[1] != "explain" {
+			glog.Fatalf("usage: nanofi [flags] config explain <mac>")
+		}
+		templates, err := conf.templatesFrom(*templatesFile, *wlanConfig, *switchConfig, *mgmtConfigFile)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+		if err := explainConfig(os.Stdout, devices, templates, args[2]); err != nil {
+			glog.Fatalf("%s", err)
+		}
+		return
+	}
+	commands, err := command.NewQueue(*commandsFile)
+	if err != nil {
+		glog.Fatalf("%s", err)
+	}
+	c := &controller{devices: devices, commands: commands, interval: &interval.Policy{}, audit: auditLog}
+	// pages are the management pages outside the API
+	pages := http.NewServeMux()
+	if *intervalPolicy != "" {
+		c.interval, err = loadIntervalPolicy(*intervalPolicy)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+	}
+
+	if *dhcpInterface != "" {
+		if err := c.startDHCP(*dhcpInterface, *dhcpRange, *dhcpLeaseTime, *dhcpLeases, *dhcpDomain, *dhcpRouter, *dhcpDNS); err != nil {
+			glog.Fatalf("could not start DHCP server: %s", err)
+		}
+	}
+
+	if *dnsmasqConf != "" {
+		if err := writeDnsmasqConf(*dnsmasqConf, *informURL); err != nil {
+			glog.Fatalf("%s", err)
+		}
+	}
+	if *dnsmasqLeases != "" {
+		if *dhcpInterface != "" {
+			glog.Fatalf("-dnsmasq-leases and -dhcp-interface can't be used together")
+		}
+		c.followDnsmasq(*dnsmasqLeases)
+	}
+
+	if *sshAdopt || *sshAdoptScan != "" {
+		creds := conf.running.Adoption.Credentials
+		if *sshCredentials != "" {
+			if creds, err = loadSSHCredentials(*sshCredentials); err != nil {
+				glog.Fatalf("%s", err)
+			}
+		}
+		c.sshAdopt, err = newSSHAdopter(*informURL, creds)
+		if err != nil {
+			glog.Fatalf("could not set up SSH adoption: %s", err)
+		}
+		c.sshAdopt.record = c.record
+	}
+	if *sshAdoptScan != "" {
+		if err := c.sshAdopt.scan(*sshAdoptScan); err != nil {
+			glog.Fatalf("could not scan %s: %s", *sshAdoptScan, err)
+		}
+	}
+	if !*sshAdopt {
+		// a scan alone doesn't adopt whatever discovery turns up
+		c.sshAdopt = nil
+	}
+
+	if *discoveryListen != "" {
+		if err := c.startDiscovery(*discoveryListen, *discoveryInterval); err != nil {
+			glog.Fatalf("could not start discovery: %s", err)
+		}
+	}
+
+	if *configPath != "" || *templatesFile != "" || *wlanConfig != "" || *switchConfig != "" || *mgmtConfigFile != "" {
+		templates, err := conf.templatesFrom(*templatesFile, *wlanConfig, *switchConfig, *mgmtConfigFile)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+		if dev, err := checkTemplates(templates, devices); err != nil {
+			if conf.templates {
+				glog.Fatalf("%s", conf.running.DeviceError(dev, err))
+			}
+			if dev.MAC == "" {
+				glog.Fatalf("invalid config: %s", err)
+			}
+			glog.Fatalf("invalid config for %s: %s", placement(dev), err)
+		}
+		c.provision, err = newProvisioner(templates, *configEvents)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+		pages.HandleFunc("/config", c.configHandler)
+		pages.HandleFunc("/ports", c.portsHandler)
+		pages.HandleFunc("/settings", c.settingsHandler)
+	}
+
+	if *stunListen != "" {
+		c.stunURL = *stunAdvertise
+		if c.stunURL == "" {
+			c.stunURL, err = stunURL(*stunListen, *informURL)
+			if err != nil {
+				glog.Fatalf("%s", err)
+			}
+		}
+		c.startSTUN(*stunListen)
+		if c.provision != nil {
+			c.provision.stunURL = c.stunURL
+		}
+	}
+
+	if *firmwareDir != "" {
+		c.firmware, err = startFirmwareServer(devices, *firmwareDir, *firmwareListen, *firmwareURL)
+		if err != nil {
+			glog.Fatalf("could not start firmware server: %s", err)
+		}
+	}
+
+	if *catalogURL != "" {
+		c.catalog, err = startCatalog(c.firmware, *catalogURL, *catalogChannel, *catalogModels, *catalogInterval)
+		if err != nil {
+			glog.Fatalf("could not start firmware catalog: %s", err)
+		}
+	}
+
+	if *benchMode {
+		targets := conf.running.Firmware.Targets
+		if targets == nil || given["bench-targets"] {
+			if targets, err = loadBenchTargets(*benchTargets); err != nil {
+				glog.Fatalf("%s", err)
+			}
+		}
+		c.bench, err = newBench(devices, c.firmware, c.catalog, targets, *benchResults, *benchRetries, *benchTimeout)
+		if err != nil {
+			glog.Fatalf("could not start bench pipeline: %s", err)
+		}
+	}
+
+	if *rolloutPlan != "" {
+		if *benchMode {
+			glog.Fatalf("-rollout and -bench can't be used together")
+		}
+		c.rollout, err = startRollout(devices, c.firmware, c.catalog, *rolloutPlan, *rolloutEvents, *rolloutRollback, c.place, c.auditRollout)
+		if err != nil {
+			glog.Fatalf("could not start rollout: %s", err)
+		}
+		pages.HandleFunc("/rollout", c.rolloutHandler)
+	}
+
+	if *firmwarePolicy != "" {
+		c.policy, err = loadPolicy(*firmwarePolicy)
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+	} else {
+		c.policy = conf.running.Firmware.Policy
+	}
+	if *firmwarePolicy != "" || *configPath != "" {
+		pages.HandleFunc("/compliance", c.complianceHandler)
+	}
+
+	if *configPath != "" {
+		conf.watch(c)
+	}
+
+	apiServer := api.NewServer(devices, commands)
+	apiServer.Auth, apiServer.Audit = authStore, auditLog
+	if authStore.Empty() {
+		glog.Warningf("no users or API tokens in %s, so the management API refuses everything; add one with: nanofi user add <name> admin", *authFile)
+	}
+	apiServer.Firmware = c.firmware
+	apiServer.Place = c.place
+	if c.provision != nil {
+		apiServer.Config = c.provision.config
+		apiServer.ConfigStatus = c.provision.reconciler.Status
+		apiServer.Events["config"] = *configEvents
+	}
+	if c.rollout != nil {
+		apiServer.Events["rollout"] = *rolloutEvents
+	}
+	if c.bench != nil {
+		apiServer.Events["bench"] = *benchResults
+	}
+
+	pages.HandleFunc("/pending", c.pendingHandler)
+	pages.HandleFunc("/clients", c.clientsHandler)
+	pages.HandleFunc("/commands", c.commandsHandler)
+
+	// management is everything but inform, kept off the listener devices use
+	management := http.NewServeMux()
+	management.Handle(api.Prefix, apiServer)
+	management.Handle("/", apiServer.Protect(pages))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inform", c.informHandler)
+	if *apiListen != "" {
+		if err := startManagement(management, *apiListen, *apiCert, *apiKey, *apiClientCA, *apiSelfSigned, *informURL); err != nil {
+			glog.Fatalf("could not start management server: %s", err)
+		}
+	} else {
+		glog.Warningf("serving the management API unencrypted on %s", *listenAddr)
+		mux.Handle("/", management)
+	}
 
 	glog.Infof("about to listen on: %s", *listenAddr)
-	if err := http.ListenAndServe(*listenAddr, nil); err != nil { // nosemgrep: go.lang.security.audit.net.use-tls.use-tls
+	if err := http.ListenAndServe(*listenAddr, mux); err != nil { // nosemgrep: go.lang.security.audit.net.use-tls.use-tls
 		panic(err)
 	}
 }
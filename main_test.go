@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/auth"
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/command"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/interval"
+	"github.com/jda/nanofi/props"
+	"github.com/jda/nanofi/rollout"
+	"github.com/jda/nanofi/template"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testAP  = "fc:ec:da:00:00:01"
+	testKey = "00112233445566778899aabbccddeeff"
+)
+
+const testTemplates = `{
+  "default": {"wlan": {"wlans": [{"ssid": "corp", "security": "wpa2", "passphrase": "hunter2222"}]}},
+  "sites": {"warehouse": {"mgmt": {"timezone": "America/Chicago"}}},
+  "devices": {"fc:ec:da:00:00:01": {"mgmt": {"hostname": "ap-dock"}}},
+  "site_devices": {"warehouse": ["fc:ec:da:00:00:01"]}
+}`
+
+// testController returns a controller provisioning from testTemplates,
+// with testAP adopted on testKey
+func testController(t *testing.T) (*controller, string) {
+	dir, err := ioutil.TempDir("", "nanofi")
+	assert.Nil(t, err)
+	devices, err := device.NewRegistry("")
+	assert.Nil(t, err)
+	commands, err := command.NewQueue("")
+	assert.Nil(t, err)
+	tpl, err := template.Parse([]byte(testTemplates))
+	assert.Nil(t, err)
+
+	c := &controller{devices: devices, commands: commands, interval: &interval.Policy{Jitter: -1}}
+	c.provision, err = newProvisioner(tpl, filepath.Join(dir, "config-events.jsonl"))
+	assert.Nil(t, err)
+
+	informAs(t, c, inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Uptime: 100}, false)
+	_, err = devices.Update(testAP, func(d *device.Device) { d.AuthKey = testKey })
+	assert.Nil(t, err)
+	return c, dir
+}
+
+// informAs has testAP inform with info, returning the reply and who it's on
+// behalf of. Both are audited as informHandler does.
+func informAs(t *testing.T, c *controller, info inform.Info, adopted bool) (inform.Response, string) {
+	info.MAC = testAP
+	dev, prev, err := c.devices.Observe(testAP, info, adopted)
+	assert.Nil(t, err)
+	c.auditObserved(dev, prev)
+	reply, actor, cmd := c.reply(dev, prev)
+	c.auditReply(dev, reply, actor, cmd)
+	return reply, actor
+}
+
+func TestDesired(t *testing.T) {
+	c, dir := testController(t)
+	defer os.RemoveAll(dir)
+
+	dev, _ := c.devices.Get(testAP)
+	want, ok := c.provision.desired(dev)
+	assert.True(t, ok)
+	assert.Contains(t, want.MgmtCfg, "authkey="+testKey)
+
+	sys := want.SystemCfg
+	for _, line := range []string{
+		// the base config setparam would otherwise wipe out
+		"bridge.1.devname=br0",
+		"bridge.1.port.1.devname=eth0",
+		"netconf.1.devname=eth0",
+		"dhcpc.1.devname=br0",
+		"users.1.name=ubnt",
+		"sshd.status=enabled",
+		// layered on
+		"aaa.1.ssid=corp",
+		"resolv.host.1.name=ap-dock",
+		// from the site the templates put the device in
+		"system.timezone=America/Chicago",
+	} {
+		assert.Contains(t, sys, line+"\n")
+	}
+
+	c.provision.stunURL = "stun://192.0.2.1:3478/"
+	withSTUN, ok := c.provision.desired(dev)
+	assert.True(t, ok)
+	assert.Contains(t, withSTUN.MgmtCfg, "stun_url=stun://192.0.2.1:3478/\n")
+	assert.NotEqual(t, want.CfgVersion(), withSTUN.CfgVersion(), "stun_url is part of the cfgversion")
+}
+
+func TestReply(t *testing.T) {
+	c, dir := testController(t)
+	defer os.RemoveAll(dir)
+	up := inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Uptime: 200}
+
+	// a rollout comes before config
+	target := bench.Target{Version: "4.3.28.11361", URL: "http://fw/U7PG2.bin"}
+	c.rollout = rollout.New(rollout.Config{Targets: map[string]bench.Target{"U7PG2": target}}, c.devices, nil)
+	c.rollout.Start()
+	reply, actor := informAs(t, c, up, true)
+	assert.IsType(t, inform.UpgradeResponse{}, reply)
+	assert.Equal(t, actorRollout, actor)
+	c.rollout = nil
+
+	// then config
+	_, err := c.commands.Add(command.Command{MAC: testAP, Kind: command.KindReboot, By: "user:alice"})
+	assert.Nil(t, err)
+	up.Uptime += 10
+	reply, actor = informAs(t, c, up, true)
+	sp, ok := reply.(inform.SetParamResponse)
+	assert.True(t, ok, "config is pushed before queued commands")
+	assert.Equal(t, actorProvision, actor)
+	assert.Contains(t, sp.SystemCfg, "aaa.1.ssid=corp")
+
+	// then commands
+	up.Uptime += 10
+	up.CfgVersion = mgmtSettings(sp.MgmtCfg)["cfgversion"]
+	reply, actor = informAs(t, c, up, true)
+	assert.IsType(t, inform.RebootResponse{}, reply)
+	assert.Equal(t, "user:alice", actor)
+
+	// and nothing once those are done
+	up.Uptime = 5
+	reply, _ = informAs(t, c, up, true)
+	assert.IsType(t, inform.NoOpResponse{}, reply)
+
+	// reset by hand, it's adopted again with the same key
+	reset := inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Uptime: 10, Default: true}
+	reply, actor = informAs(t, c, reset, false)
+	sp, ok = reply.(inform.SetParamResponse)
+	assert.True(t, ok)
+	assert.Equal(t, actorProvision, actor)
+	assert.Equal(t, testKey, mgmtSettings(sp.MgmtCfg)["authkey"])
+	assert.Empty(t, sp.SystemCfg)
+
+	// then has its config pushed again
+	up = inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Uptime: 20, CfgVersion: inform.InitialCfgVersion}
+	reply, _ = informAs(t, c, up, true)
+	sp, ok = reply.(inform.SetParamResponse)
+	assert.True(t, ok)
+	assert.Contains(t, sp.SystemCfg, "aaa.1.ssid=corp")
+}
+
+func TestReplyApproved(t *testing.T) {
+	c, dir := testController(t)
+	defer os.RemoveAll(dir)
+
+	// approving queues the adoption, which is sent rather than provision's
+	approve, err := c.commands.Add(command.Command{MAC: testAP, Kind: command.KindSetParam, MgmtCfg: inform.MgmtCfg(testKey, inform.InitialCfgVersion), By: "user:alice"})
+	assert.Nil(t, err)
+	reply, actor := informAs(t, c, inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Uptime: 110, Default: true}, false)
+	assert.IsType(t, inform.SetParamResponse{}, reply)
+	assert.Equal(t, "user:alice", actor)
+	cmd, ok := c.commands.Get(approve.ID)
+	assert.True(t, ok)
+	assert.Equal(t, command.StatusSent, cmd.Status)
+}
+
+func TestReadOnlyAuthKeys(t *testing.T) {
+	c, dir := testController(t)
+	defer os.RemoveAll(dir)
+	// approved, so the key is in the device and the queued adoption
+	_, _, err := c.devices.Observe(testAP, inform.Info{MAC: testAP, Model: "U7PG2", Uptime: 10, Default: true}, false)
+	assert.Nil(t, err)
+	_, err = c.commands.Add(command.Command{MAC: testAP, Kind: command.KindSetParam, MgmtCfg: inform.MgmtCfg(testKey, inform.InitialCfgVersion), By: "user:alice"})
+	assert.Nil(t, err)
+
+	viewer := auth.Identity{Name: "bob", Role: auth.RoleReadOnly}
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/pending", c.pendingHandler},
+		{"/commands", c.commandsHandler},
+		{"/commands?mac=" + testAP, c.commandsHandler},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r = r.WithContext(auth.NewContext(r.Context(), viewer))
+			w := httptest.NewRecorder()
+			tc.handler(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), testAP)
+			assert.NotContains(t, w.Body.String(), testKey)
+		})
+	}
+}
+
+func TestCheckTemplates(t *testing.T) {
+	devices, err := device.NewRegistry("")
+	assert.Nil(t, err)
+
+	// no device is in the group, but its layer is still checked
+	tpl, err := template.Parse([]byte(`{"groups": {"lobby": {"wlan": {"wlans": [{"ssid": "guest", "security": "bogus"}]}}}}`))
+	assert.Nil(t, err)
+	dev, err := checkTemplates(tpl, devices)
+	assert.Empty(t, dev.MAC)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "groups.lobby: wlan:")
+	}
+
+	tpl, err = template.Parse([]byte(testTemplates))
+	assert.Nil(t, err)
+	_, err = checkTemplates(tpl, devices)
+	assert.Nil(t, err)
+}
+
+func TestAuditConfigPush(t *testing.T) {
+	c, dir := testController(t)
+	defer os.RemoveAll(dir)
+	var err error
+	c.audit, err = audit.Open(filepath.Join(dir, "audit.jsonl"))
+	assert.Nil(t, err)
+	defer c.audit.Close()
+
+	up := inform.Info{Model: "U7PG2", Version: "4.3.20.11298", Uptime: 200}
+	reply, _ := informAs(t, c, up, true)
+	assert.IsType(t, inform.SetParamResponse{}, reply)
+
+	tpl, err := template.Parse([]byte(`{"default": {"wlan": {"wlans": [{"ssid": "staff", "security": "wpa2", "passphrase": "hunter3333"}]}}}`))
+	assert.Nil(t, err)
+	c.provision.setTemplates(tpl)
+	up.Uptime += 10
+	reply, _ = informAs(t, c, up, true)
+	assert.IsType(t, inform.SetParamResponse{}, reply)
+
+	pushes, err := c.audit.Query(audit.Filter{Action: audit.ActionConfigPush})
+	assert.Nil(t, err)
+	if !assert.Len(t, pushes, 2) {
+		return
+	}
+	changes := func(e audit.Entry) map[string]props.Change {
+		var after struct {
+			SystemCfg []props.Change `json:"system_cfg"`
+		}
+		assert.Nil(t, json.Unmarshal(e.After, &after))
+		out := make(map[string]props.Change)
+		for _, ch := range after.SystemCfg {
+			out[ch.Key] = ch
+		}
+		return out
+	}
+
+	// the first push since startup adds everything
+	first := changes(pushes[0])
+	assert.Equal(t, props.Change{Kind: props.Added, Key: "aaa.1.ssid", New: "corp"}, first["aaa.1.ssid"])
+	assert.Equal(t, props.Change{Kind: props.Added, Key: "aaa.1.wpa.psk", New: audit.Fingerprint("hunter2222")}, first["aaa.1.wpa.psk"])
+	assert.Equal(t, props.Added, first["resolv.host.1.name"].Kind)
+
+	second := changes(pushes[1])
+	assert.Equal(t, props.Change{Kind: props.Changed, Key: "aaa.1.ssid", Old: "corp", New: "staff"}, second["aaa.1.ssid"])
+	assert.Equal(t, props.Change{Kind: props.Changed, Key: "aaa.1.wpa.psk", Old: audit.Fingerprint("hunter2222"), New: audit.Fingerprint("hunter3333")}, second["aaa.1.wpa.psk"])
+	assert.Equal(t, props.Removed, second["resolv.host.1.name"].Kind)
+	assert.NotContains(t, second, "bridge.1.devname", "unchanged values aren't listed")
+
+	for _, e := range pushes {
+		assert.NotContains(t, string(e.After), "hunter")
+	}
+}
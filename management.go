@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/tlscert"
+)
+
+// startManagement serves the management API and pages over TLS. Without a
+// certificate it makes a self-signed one in selfSigned, kept for next time.
+// Certificates and client CAs are reloaded on SIGHUP.
+func startManagement(handler http.Handler, listenAddr string, certFile string, keyFile string, clientCA string, selfSigned string, informURL string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("-api-cert and -api-key go together")
+	}
+	if certFile == "" {
+		created, err := tlscert.SelfSigned(selfSigned, certHosts(listenAddr, informURL))
+		if err != nil {
+			return err
+		}
+		if created {
+			glog.Infof("management: created self-signed certificate %s", selfSigned)
+		}
+		certFile, keyFile = selfSigned, selfSigned
+	}
+
+	certs, err := tlscert.New(certFile, keyFile, clientCA)
+	if err != nil {
+		return err
+	}
+	glog.Infof("management: certificate fingerprint %s", tlscert.Fingerprint(certs.Certificate()))
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := certs.Reload(); err != nil {
+				glog.Errorf("management: keeping old certificate: %s", err)
+				continue
+			}
+			glog.Infof("management: reloaded certificate, fingerprint %s", tlscert.Fingerprint(certs.Certificate()))
+		}
+	}()
+
+	srv := &http.Server{Addr: listenAddr, Handler: handler, TLSConfig: certs.Config()}
+	go func() {
+		glog.Infof("serving management API on: %s", listenAddr)
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			glog.Fatalf("management server failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+// certHosts returns the names a self-signed certificate should cover: this
+// host, the listen address and the address devices inform
+func certHosts(listenAddr string, informURL string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	if host, _, err := net.SplitHostPort(listenAddr); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	if u, err := url.Parse(informURL); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
@@ -0,0 +1,373 @@
+// Package mgmt models a device's own management settings: its address and
+// management VLAN, DNS, NTP and timezone, remote syslog, SSH access, LEDs
+// and hostname. Settings are validated and rendered into the device's
+// mgmt_cfg and system_cfg.
+package mgmt
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/props"
+	"github.com/jda/nanofi/syscfg"
+	"golang.org/x/crypto/ssh"
+)
+
+// Network modes
+const (
+	DHCP   = "dhcp"
+	Static = "static"
+)
+
+var (
+	hostnameRE = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+	timezoneRE = regexp.MustCompile(`^(UTC|[A-Za-z_]+(/[A-Za-z0-9_+-]+)+)$`)
+	userRE     = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	cryptRE    = regexp.MustCompile(`^\$(1|5|6)\$[^$]+\$[./A-Za-z0-9]+$`)
+)
+
+// Network is how the device gets its management address
+type Network struct {
+	// Mode is dhcp or static
+	Mode string `json:"mode"`
+	// Address is the static address with prefix length, e.g. 192.168.1.10/24
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	// VLAN is the management VLAN; 0 leaves management untagged
+	VLAN int `json:"vlan,omitempty"`
+}
+
+// SSH is the device's SSH login
+type SSH struct {
+	Username string `json:"username"`
+	// PasswordHash is a crypt(3) hash, e.g. from openssl passwd -6
+	PasswordHash   string   `json:"password_hash"`
+	AuthorizedKeys []string `json:"authorized_keys,omitempty"`
+}
+
+// Settings are a device's management settings. Unset fields keep the
+// values of the base config they're layered onto, from package syscfg.
+type Settings struct {
+	Hostname string   `json:"hostname,omitempty"`
+	Network  *Network `json:"network,omitempty"`
+	NTP      []string `json:"ntp,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+	// Syslog is a remote syslog host, with an optional port
+	Syslog string `json:"syslog,omitempty"`
+	SSH    *SSH   `json:"ssh,omitempty"`
+	LEDs   *bool  `json:"leds,omitempty"`
+}
+
+// Empty is whether no setting is set
+func (s Settings) Empty() bool {
+	return s.Hostname == "" && s.Network == nil && len(s.NTP) == 0 && s.Timezone == "" &&
+		s.Syslog == "" && s.SSH == nil && s.LEDs == nil
+}
+
+// Validate checks every setting that is set
+func (s Settings) Validate() error {
+	if s.Hostname != "" && !hostnameRE.MatchString(s.Hostname) {
+		return fmt.Errorf("hostname %q isn't a valid host name", s.Hostname)
+	}
+	if s.Network != nil {
+		if err := s.Network.validate(); err != nil {
+			return fmt.Errorf("network: %w", err)
+		}
+	}
+	for _, server := range s.NTP {
+		if net.ParseIP(server) == nil && !validHost(server) {
+			return fmt.Errorf("NTP server %q isn't an address or host name", server)
+		}
+	}
+	if s.Timezone != "" && !timezoneRE.MatchString(s.Timezone) {
+		return fmt.Errorf("timezone %q isn't a zone name like Europe/London", s.Timezone)
+	}
+	if s.Syslog != "" {
+		if _, _, err := splitSyslog(s.Syslog); err != nil {
+			return err
+		}
+	}
+	if s.SSH != nil {
+		if err := s.SSH.validate(); err != nil {
+			return fmt.Errorf("ssh: %w", err)
+		}
+	}
+	return nil
+}
+
+func validHost(h string) bool {
+	if len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if !hostnameRE.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n Network) validate() error {
+	switch n.Mode {
+	case DHCP:
+		if n.Address != "" || n.Gateway != "" {
+			return fmt.Errorf("address and gateway are only for static")
+		}
+	case Static:
+		ip, subnet, err := net.ParseCIDR(n.Address)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("static address must be IPv4 with a prefix length, e.g. 192.168.1.10/24")
+		}
+		gw := net.ParseIP(n.Gateway)
+		if gw == nil || !subnet.Contains(gw) {
+			return fmt.Errorf("gateway %q must be an address in %s", n.Gateway, subnet)
+		}
+		if gw.Equal(ip) {
+			return fmt.Errorf("gateway can't be the device's own address")
+		}
+	default:
+		return fmt.Errorf("mode must be dhcp or static")
+	}
+	for _, dns := range n.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("DNS server %q isn't an address", dns)
+		}
+	}
+	if n.VLAN < 0 || n.VLAN > 4094 {
+		return fmt.Errorf("VLAN %d out of range", n.VLAN)
+	}
+	return nil
+}
+
+func (s SSH) validate() error {
+	if !userRE.MatchString(s.Username) {
+		return fmt.Errorf("username %q isn't valid", s.Username)
+	}
+	if !cryptRE.MatchString(s.PasswordHash) {
+		return fmt.Errorf("password_hash must be a crypt hash, e.g. from openssl passwd -6")
+	}
+	for i, k := range s.AuthorizedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+			return fmt.Errorf("authorized key %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// splitSyslog splits a syslog target into host and port, 514 by default
+func splitSyslog(target string) (string, int, error) {
+	host, port := target, 514
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return "", 0, fmt.Errorf("syslog port %q isn't valid", p)
+		}
+		host, port = h, n
+	}
+	if net.ParseIP(host) == nil && !validHost(host) {
+		return "", 0, fmt.Errorf("syslog host %q isn't an address or host name", host)
+	}
+	return host, port, nil
+}
+
+// Render produces the mgmt_cfg and system_cfg properties for s
+func Render(s Settings) (mgmtCfg *props.Node, systemCfg *props.Node, err error) {
+	if err := s.Validate(); err != nil {
+		return nil, nil, err
+	}
+	mgmtCfg, systemCfg = props.New(), props.New()
+
+	if s.Hostname != "" {
+		systemCfg.Set("resolv.host.1.name", s.Hostname)
+	}
+	if n := s.Network; n != nil {
+		renderNetwork(systemCfg, *n)
+	}
+	if len(s.NTP) > 0 {
+		for i, server := range s.NTP {
+			systemCfg.Set("ntpclient."+strconv.Itoa(i+1)+".server", server)
+			systemCfg.SetEnabled("ntpclient."+strconv.Itoa(i+1)+".status", true)
+		}
+		systemCfg.SetEnabled("ntpclient.status", true)
+	}
+	if s.Timezone != "" {
+		systemCfg.Set("system.timezone", s.Timezone)
+	}
+	if s.Syslog != "" {
+		host, port, _ := splitSyslog(s.Syslog)
+		systemCfg.SetEnabled("syslog.remote.status", true)
+		systemCfg.Set("syslog.remote.ip", host)
+		systemCfg.Setf("syslog.remote.port", "%d", port)
+	}
+	if s.SSH != nil {
+		systemCfg.Set("users.1.name", s.SSH.Username)
+		systemCfg.Set("users.1.password", s.SSH.PasswordHash)
+		systemCfg.SetEnabled("users.1.status", true)
+		systemCfg.SetEnabled("users.status", true)
+		for i, k := range s.SSH.AuthorizedKeys {
+			key, comment, _, _, _ := ssh.ParseAuthorizedKey([]byte(k))
+			prefix := "sshd.auth.key." + strconv.Itoa(i+1) + "."
+			systemCfg.Set(prefix+"type", key.Type())
+			systemCfg.Set(prefix+"value", strings.TrimPrefix(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), key.Type()+" "))
+			if comment != "" {
+				systemCfg.Set(prefix+"comment", comment)
+			}
+			systemCfg.SetEnabled(prefix+"status", true)
+		}
+		systemCfg.SetEnabled("sshd.auth.key.status", len(s.SSH.AuthorizedKeys) > 0)
+	}
+	if s.LEDs != nil {
+		mgmtCfg.Set("led_enabled", strconv.FormatBool(*s.LEDs))
+	}
+
+	return mgmtCfg, systemCfg, nil
+}
+
+// renderNetwork puts the management address on the bridge devices are
+// managed through or, with a VLAN, on a bridge of its own over the tagged
+// uplink, which the untagged bridge stops asking DHCP for an address on
+func renderNetwork(n *props.Node, nw Network) {
+	dev := syscfg.Bridge
+	if nw.VLAN != 0 {
+		dev = fmt.Sprintf("%s.%d", syscfg.Bridge, nw.VLAN)
+		n.Setf("mgmt.vlan", "%d", nw.VLAN)
+
+		v := n.Append("vlan")
+		v.Set("devname", "eth0")
+		v.Setf("id", "%d", nw.VLAN)
+		v.SetEnabled("status", true)
+		n.SetEnabled("vlan.status", true)
+
+		br := n.Append("bridge")
+		br.Set("devname", dev)
+		br.Setf("port.1.devname", "eth0.%d", nw.VLAN)
+		br.SetEnabled("stp.status", false)
+		n.SetEnabled("bridge.status", true)
+
+		eth := n.Append("netconf")
+		eth.Setf("devname", "eth0.%d", nw.VLAN)
+		eth.Set("ip", "0.0.0.0")
+		eth.SetEnabled("up", true)
+		eth.SetEnabled("status", true)
+
+		untagged := n.Append("dhcpc")
+		untagged.Set("devname", syscfg.Bridge)
+		untagged.SetEnabled("status", false)
+	}
+
+	nc := n.Append("netconf")
+	nc.Set("devname", dev)
+	nc.SetEnabled("up", true)
+	nc.SetEnabled("status", true)
+	n.SetEnabled("netconf.status", true)
+	dhcpc := n.Append("dhcpc")
+	dhcpc.Set("devname", dev)
+
+	if nw.Mode == DHCP {
+		nc.Set("ip", "0.0.0.0")
+		dhcpc.SetEnabled("status", true)
+		n.SetEnabled("dhcpc.status", true)
+	} else {
+		ip, subnet, _ := parseCIDR(nw.Address)
+		dhcpc.SetEnabled("status", false)
+		n.SetEnabled("dhcpc.status", false)
+		nc.Set("ip", ip)
+		nc.Set("netmask", subnet)
+		route := n.Append("route")
+		route.Set("devname", dev)
+		route.Set("gateway", nw.Gateway)
+		route.Set("ip", "0.0.0.0")
+		route.Set("netmask", "0")
+		route.SetEnabled("status", true)
+		n.SetEnabled("route.status", true)
+	}
+
+	for i, dns := range nw.DNS {
+		n.Set("resolv.nameserver."+strconv.Itoa(i+1)+".ip", dns)
+		n.SetEnabled("resolv.nameserver."+strconv.Itoa(i+1)+".status", true)
+	}
+	if len(nw.DNS) > 0 {
+		n.SetEnabled("resolv.nameserver.status", true)
+	}
+}
+
+func parseCIDR(s string) (ip string, netmask string, err error) {
+	addr, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", "", err
+	}
+	return addr.String(), net.IP(subnet.Mask).String(), nil
+}
+
+// Check states
+const (
+	// Confirmed settings are reported by the device as set
+	Confirmed = "confirmed"
+	// Pending settings aren't in effect yet
+	Pending = "pending"
+	// Applied settings can't be seen in informs, but the device is running
+	// the config that carries them
+	Applied = "applied"
+)
+
+// Check is whether one setting has taken effect on a device
+type Check struct {
+	Setting string `json:"setting"`
+	Status  string `json:"status"`
+	Want    string `json:"want,omitempty"`
+	Got     string `json:"got,omitempty"`
+}
+
+// Confirm checks the settings in s against what dev reports. Informs only
+// show the hostname and address; the rest are applied once the device is
+// running the config carrying them, which converged reports.
+func Confirm(s Settings, dev device.Device, converged bool) []Check {
+	var out []Check
+	observed := func(setting string, want string, got string) {
+		c := Check{Setting: setting, Status: Pending, Want: want, Got: got}
+		if want == got {
+			c.Status = Confirmed
+		}
+		out = append(out, c)
+	}
+	applied := func(setting string) {
+		c := Check{Setting: setting, Status: Pending}
+		if converged {
+			c.Status = Applied
+		}
+		out = append(out, c)
+	}
+
+	if s.Hostname != "" {
+		observed("hostname", s.Hostname, dev.Hostname)
+	}
+	if n := s.Network; n != nil {
+		if n.Mode == Static {
+			ip, _, _ := parseCIDR(n.Address)
+			observed("network.address", ip, dev.IP)
+		} else {
+			applied("network")
+		}
+	}
+	if len(s.NTP) > 0 {
+		applied("ntp")
+	}
+	if s.Timezone != "" {
+		applied("timezone")
+	}
+	if s.Syslog != "" {
+		applied("syslog")
+	}
+	if s.SSH != nil {
+		applied("ssh")
+	}
+	if s.LEDs != nil {
+		applied("leds")
+	}
+	return out
+}
@@ -0,0 +1,182 @@
+package mgmt
+
+import (
+	"testing"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/syscfg"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOFBaBYtueGgWKmqhVWJkQdDp9rkJcqHx5uTiqn/mPoo lab"
+
+var off = false
+
+var testSettings = Settings{
+	Hostname: "ap-lobby",
+	Network: &Network{
+		Mode:    Static,
+		Address: "192.168.10.20/24",
+		Gateway: "192.168.10.1",
+		DNS:     []string{"192.168.10.1", "1.1.1.1"},
+		VLAN:    10,
+	},
+	NTP:      []string{"pool.ntp.org", "192.168.10.1"},
+	Timezone: "America/Chicago",
+	Syslog:   "logs.lab:1514",
+	SSH: &SSH{
+		Username:       "admin",
+		PasswordHash:   "$6$salt$IxDD3jeSOb5eB1CX5LBsqZFVkJdido3OUILO5Ifz5iwMuTS4XMS130MTSuDDl3aCI6WouIL9AjRbLCelDCy.g.",
+		AuthorizedKeys: []string{testKey},
+	},
+	LEDs: &off,
+}
+
+func TestRender(t *testing.T) {
+	m, n, err := Render(testSettings)
+	assert.Nil(t, err)
+	get := func(key string) string {
+		v, ok := n.Get(key)
+		assert.True(t, ok, key)
+		return v
+	}
+
+	assert.Equal(t, "ap-lobby", get("resolv.host.1.name"))
+	assert.Equal(t, "eth0", get("vlan.1.devname"))
+	assert.Equal(t, "10", get("vlan.1.id"))
+	assert.Equal(t, "br0.10", get("bridge.1.devname"))
+	assert.Equal(t, "eth0.10", get("bridge.1.port.1.devname"))
+	assert.Equal(t, "eth0.10", get("netconf.1.devname"))
+	assert.Equal(t, "br0.10", get("netconf.2.devname"))
+	assert.Equal(t, "192.168.10.20", get("netconf.2.ip"))
+	assert.Equal(t, "255.255.255.0", get("netconf.2.netmask"))
+	assert.Equal(t, "br0", get("dhcpc.1.devname"))
+	assert.Equal(t, "disabled", get("dhcpc.1.status"))
+	assert.Equal(t, "br0.10", get("dhcpc.2.devname"))
+	assert.Equal(t, "disabled", get("dhcpc.2.status"))
+	assert.Equal(t, "192.168.10.1", get("route.1.gateway"))
+	assert.Equal(t, "br0.10", get("route.1.devname"))
+	assert.Equal(t, "1.1.1.1", get("resolv.nameserver.2.ip"))
+	assert.Equal(t, "10", get("mgmt.vlan"))
+	assert.Equal(t, "pool.ntp.org", get("ntpclient.1.server"))
+	assert.Equal(t, "America/Chicago", get("system.timezone"))
+	assert.Equal(t, "logs.lab", get("syslog.remote.ip"))
+	assert.Equal(t, "1514", get("syslog.remote.port"))
+	assert.Equal(t, "admin", get("users.1.name"))
+	assert.Equal(t, "ssh-ed25519", get("sshd.auth.key.1.type"))
+	assert.Equal(t, "AAAAC3NzaC1lZDI1NTE5AAAAIOFBaBYtueGgWKmqhVWJkQdDp9rkJcqHx5uTiqn/mPoo", get("sshd.auth.key.1.value"))
+	assert.Equal(t, "lab", get("sshd.auth.key.1.comment"))
+
+	led, _ := m.Get("led_enabled")
+	assert.Equal(t, "false", led)
+
+	_, n, err = Render(Settings{Network: &Network{Mode: DHCP}, Syslog: "10.0.0.5"})
+	assert.Nil(t, err)
+	v, _ := n.Get("dhcpc.1.status")
+	assert.Equal(t, "enabled", v)
+	v, _ = n.Get("netconf.1.devname")
+	assert.Equal(t, "br0", v)
+	v, _ = n.Get("syslog.remote.port")
+	assert.Equal(t, "514", v)
+	assert.Nil(t, n.Child("route"))
+	assert.Nil(t, n.Child("users"))
+}
+
+func TestLayer(t *testing.T) {
+	// NTP alone keeps the rest of the base config
+	n := syscfg.Base(device.Device{Model: "U7LT"})
+	_, ntp, err := Render(Settings{NTP: []string{"192.168.10.1"}})
+	assert.Nil(t, err)
+	n.Layer(ntp)
+	assert.Len(t, n.List("ntpclient"), 1)
+	v, _ := n.Get("ntpclient.1.server")
+	assert.Equal(t, "192.168.10.1", v)
+	v, _ = n.Get("netconf.2.devname")
+	assert.Equal(t, syscfg.Bridge, v)
+	v, _ = n.Get("users.1.name")
+	assert.Equal(t, syscfg.FactoryUser, v)
+
+	// a management VLAN gets a bridge of its own, and the untagged one
+	// stops asking for an address
+	n = syscfg.Base(device.Device{Model: "U7LT"})
+	_, vlan, err := Render(Settings{Network: &Network{Mode: DHCP, VLAN: 10}})
+	assert.Nil(t, err)
+	n.Layer(vlan)
+	get := func(key string) string {
+		v, ok := n.Get(key)
+		assert.True(t, ok, key)
+		return v
+	}
+	assert.Equal(t, "br0", get("bridge.1.devname"))
+	assert.Equal(t, "br0.10", get("bridge.2.devname"))
+	assert.Equal(t, "eth0.10", get("bridge.2.port.1.devname"))
+	assert.Equal(t, "10", get("vlan.1.id"))
+	assert.Equal(t, "eth0.10", get("netconf.3.devname"))
+	assert.Equal(t, "br0.10", get("netconf.4.devname"))
+	assert.Equal(t, "br0", get("dhcpc.1.devname"))
+	assert.Equal(t, "disabled", get("dhcpc.1.status"))
+	assert.Equal(t, "br0.10", get("dhcpc.2.devname"))
+	assert.Equal(t, "enabled", get("dhcpc.2.status"))
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Settings
+		ok   bool
+	}{
+		{"full", testSettings, true},
+		{"empty", Settings{}, true},
+		{"bad hostname", Settings{Hostname: "ap_lobby"}, false},
+		{"no mode", Settings{Network: &Network{}}, false},
+		{"dhcp address", Settings{Network: &Network{Mode: DHCP, Address: "10.0.0.2/24"}}, false},
+		{"no prefix", Settings{Network: &Network{Mode: Static, Address: "10.0.0.2", Gateway: "10.0.0.1"}}, false},
+		{"gateway off subnet", Settings{Network: &Network{Mode: Static, Address: "10.0.0.2/24", Gateway: "10.0.1.1"}}, false},
+		{"gateway is self", Settings{Network: &Network{Mode: Static, Address: "10.0.0.2/24", Gateway: "10.0.0.2"}}, false},
+		{"bad dns", Settings{Network: &Network{Mode: DHCP, DNS: []string{"dns.lab"}}}, false},
+		{"bad vlan", Settings{Network: &Network{Mode: DHCP, VLAN: 4095}}, false},
+		{"bad ntp", Settings{NTP: []string{"pool ntp"}}, false},
+		{"bad timezone", Settings{Timezone: "Chicago time"}, false},
+		{"utc", Settings{Timezone: "UTC"}, true},
+		{"bad syslog port", Settings{Syslog: "logs.lab:0"}, false},
+		{"plain password", Settings{SSH: &SSH{Username: "admin", PasswordHash: "hunter22"}}, false},
+		{"bad user", Settings{SSH: &SSH{Username: "Admin!", PasswordHash: testSettings.SSH.PasswordHash}}, false},
+		{"bad key", Settings{SSH: &SSH{Username: "admin", PasswordHash: testSettings.SSH.PasswordHash, AuthorizedKeys: []string{"ssh-rsa nope"}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.s.Validate()
+			assert.Equal(t, tt.ok, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	assert.True(t, Settings{}.Empty())
+	assert.False(t, Settings{LEDs: &off}.Empty())
+	assert.False(t, testSettings.Empty())
+}
+
+func TestConfirm(t *testing.T) {
+	dev := device.Device{MAC: "fc:ec:da:00:00:01", Hostname: "UAP-AC-Lite", IP: "192.168.10.20"}
+	checks := Confirm(testSettings, dev, false)
+	byName := make(map[string]Check)
+	for _, c := range checks {
+		byName[c.Setting] = c
+	}
+	assert.Equal(t, Pending, byName["hostname"].Status)
+	assert.Equal(t, "UAP-AC-Lite", byName["hostname"].Got)
+	assert.Equal(t, Confirmed, byName["network.address"].Status)
+	assert.Equal(t, Pending, byName["ntp"].Status)
+
+	dev.Hostname = "ap-lobby"
+	for _, c := range Confirm(testSettings, dev, true) {
+		switch c.Setting {
+		case "hostname", "network.address":
+			assert.Equal(t, Confirmed, c.Status, c.Setting)
+		default:
+			assert.Equal(t, Applied, c.Status, c.Setting)
+		}
+	}
+}
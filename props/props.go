@@ -0,0 +1,439 @@
+// Package props reads and writes the flat property blobs UniFi devices take
+// their configuration in, mgmt_cfg and system_cfg:
+//
+//	# comment
+//	aaa.1.ssid=lab
+//	aaa.1.wpa=2
+//	aaa.1.wpa.psk=hunter22
+//
+// Keys are dot separated paths, with numeric segments making indexed lists.
+// A path may have both a value and children, as aaa.1.wpa does above.
+// Rendering is deterministic so rendered config can be hashed and diffed.
+package props
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrSyntax is returned for lines that aren't properties or comments
+var ErrSyntax = errors.New("invalid property")
+
+// Node is a point in a property tree
+type Node struct {
+	value    string
+	set      bool
+	children map[string]*Node
+}
+
+// New returns an empty tree
+func New() *Node {
+	return &Node{}
+}
+
+// Parse reads properties from r. Blank lines and lines starting with # are
+// skipped; later values for a key replace earlier ones.
+func Parse(r io.Reader) (*Node, error) {
+	root := New()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: %w: no '=' in %q", n, ErrSyntax, line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if err := checkKey(key); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		root.Set(key, unescape(line[eq+1:]))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read properties: %w", err)
+	}
+	return root, nil
+}
+
+// ParseString reads properties from s
+func ParseString(s string) (*Node, error) {
+	return Parse(strings.NewReader(s))
+}
+
+// checkKey rejects keys that wouldn't survive rendering
+func checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrSyntax)
+	}
+	for _, seg := range strings.Split(key, ".") {
+		if seg == "" {
+			return fmt.Errorf("%w: empty segment in key %q", ErrSyntax, key)
+		}
+	}
+	if strings.ContainsAny(key, "=# \t\n\\") {
+		return fmt.Errorf("%w: bad character in key %q", ErrSyntax, key)
+	}
+	return nil
+}
+
+// escape makes a value safe to put on one line
+func escape(v string) string {
+	if !strings.ContainsAny(v, "\\\n\r") {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	return r.Replace(v)
+}
+
+// unescape reverses escape. Backslashes not starting an escape are kept.
+func unescape(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i == len(v)-1 {
+			b.WriteByte(v[i])
+			continue
+		}
+		switch v[i+1] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte('\\')
+			continue
+		}
+		i++
+	}
+	return b.String()
+}
+
+// walk returns the node at path, creating it if create is set
+func (n *Node) walk(path string, create bool) *Node {
+	if path == "" {
+		return n
+	}
+	cur := n
+	for _, seg := range strings.Split(path, ".") {
+		next, ok := cur.children[seg]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if cur.children == nil {
+				cur.children = make(map[string]*Node)
+			}
+			next = &Node{}
+			cur.children[seg] = next
+		}
+		cur = next
+	}
+	return cur
+}
+
+// Get returns the value at path
+func (n *Node) Get(path string) (string, bool) {
+	c := n.walk(path, false)
+	if c == nil || !c.set {
+		return "", false
+	}
+	return c.value, true
+}
+
+// GetInt returns the integer value at path
+func (n *Node) GetInt(path string) (int, bool) {
+	v, ok := n.Get(path)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(v)
+	return i, err == nil
+}
+
+// GetBool returns the boolean value at path, written as true/false or
+// enabled/disabled
+func (n *Node) GetBool(path string) (bool, bool) {
+	v, _ := n.Get(path)
+	switch v {
+	case "true", "enabled":
+		return true, true
+	case "false", "disabled":
+		return false, true
+	}
+	return false, false
+}
+
+// SetEnabled sets path to enabled or disabled
+func (n *Node) SetEnabled(path string, on bool) *Node {
+	if on {
+		return n.Set(path, "enabled")
+	}
+	return n.Set(path, "disabled")
+}
+
+// Value returns the node's own value
+func (n *Node) Value() (string, bool) {
+	return n.value, n.set
+}
+
+// Set sets the value at path, creating any nodes on the way
+func (n *Node) Set(path string, value string) *Node {
+	c := n.walk(path, true)
+	c.value = value
+	c.set = true
+	return c
+}
+
+// Setf sets the value at path to a formatted value
+func (n *Node) Setf(path string, format string, a ...interface{}) *Node {
+	return n.Set(path, fmt.Sprintf(format, a...))
+}
+
+// Child returns the node at path, or nil if there isn't one
+func (n *Node) Child(path string) *Node {
+	return n.walk(path, false)
+}
+
+// Delete removes path and everything under it
+func (n *Node) Delete(path string) {
+	i := strings.LastIndexByte(path, '.')
+	parent := n
+	if i >= 0 {
+		parent = n.walk(path[:i], false)
+	}
+	if parent != nil {
+		delete(parent.children, path[i+1:])
+	}
+}
+
+// Keys returns the names of the node's children in render order
+func (n *Node) Keys() []string {
+	keys := make([]string, 0, len(n.children))
+	for k := range n.children {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	return keys
+}
+
+// less orders numeric segments numerically and before names. Segments
+// that are the same number, such as 01 and 1, are ordered as strings so
+// rendering doesn't depend on map order.
+func less(a string, b string) bool {
+	an, aerr := strconv.Atoi(a)
+	bn, berr := strconv.Atoi(b)
+	switch {
+	case aerr == nil && berr == nil && an != bn:
+		return an < bn
+	case aerr == nil && berr == nil:
+		return a < b
+	case aerr == nil:
+		return true
+	case berr == nil:
+		return false
+	}
+	return a < b
+}
+
+// List returns the indexed children of the node at path in order
+func (n *Node) List(path string) []*Node {
+	c := n.walk(path, false)
+	if c == nil {
+		return nil
+	}
+	var out []*Node
+	for _, k := range c.Keys() {
+		if _, err := strconv.Atoi(k); err == nil {
+			out = append(out, c.children[k])
+		}
+	}
+	return out
+}
+
+// Append adds the next item to the indexed list at path, numbering from 1
+func (n *Node) Append(path string) *Node {
+	c := n.walk(path, true)
+	next := 1
+	for k := range c.children {
+		if i, err := strconv.Atoi(k); err == nil && i >= next {
+			next = i + 1
+		}
+	}
+	return c.walk(strconv.Itoa(next), true)
+}
+
+// Merge copies every value in o into n, replacing values already there
+func (n *Node) Merge(o *Node) {
+	for _, p := range o.Properties() {
+		n.Set(p.Key, p.Value)
+	}
+}
+
+// Layer copies o onto n. Items of indexed lists that name an interface or
+// VLAN, by devname, phyname or id, are layered onto n's item naming the
+// same one, or added after n's items; any other list in o replaces n's.
+// Values outside lists replace n's, as with Merge.
+func (n *Node) Layer(o *Node) {
+	if o.set {
+		n.value, n.set = o.value, true
+	}
+	var items []string
+	for _, k := range o.Keys() {
+		if _, err := strconv.Atoi(k); err == nil {
+			items = append(items, k)
+			continue
+		}
+		n.walk(k, true).Layer(o.children[k])
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	if o.children[items[0]].identity() == "" {
+		// a plain list, such as users or NTP servers, replaces n's
+		for _, k := range n.Keys() {
+			if _, err := strconv.Atoi(k); err == nil {
+				delete(n.children, k)
+			}
+		}
+		for _, k := range items {
+			n.walk(k, true).Layer(o.children[k])
+		}
+		return
+	}
+	for _, k := range items {
+		item := o.children[k]
+		var into *Node
+		for _, mine := range n.List("") {
+			if mine.identity() == item.identity() {
+				into = mine
+				break
+			}
+		}
+		if into == nil {
+			into = n.Append("")
+		}
+		into.Layer(item)
+	}
+}
+
+// identity is what an interface or VLAN item is named by, or empty for
+// items of plain lists
+func (n *Node) identity() string {
+	var id []string
+	for _, k := range []string{"devname", "phyname", "id"} {
+		if v, ok := n.Get(k); ok {
+			id = append(id, k+"="+v)
+		}
+	}
+	return strings.Join(id, ",")
+}
+
+// Property is a single key and value
+type Property struct {
+	Key   string
+	Value string
+}
+
+// Properties returns every value in the tree in render order
+func (n *Node) Properties() []Property {
+	var out []Property
+	n.collect("", &out)
+	return out
+}
+
+func (n *Node) collect(prefix string, out *[]Property) {
+	if n.set && prefix != "" {
+		*out = append(*out, Property{prefix, n.value})
+	}
+	for _, k := range n.Keys() {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		n.children[k].collect(key, out)
+	}
+}
+
+// Render writes the tree out as properties, one per line
+func (n *Node) Render() string {
+	var b strings.Builder
+	for _, p := range n.Properties() {
+		b.WriteString(p.Key)
+		b.WriteByte('=')
+		b.WriteString(escape(p.Value))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// ChangeKind is how a property differs between two trees
+type ChangeKind string
+
+// Change kinds
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change is one difference between two trees
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	Key  string     `json:"key"`
+	Old  string     `json:"old,omitempty"`
+	New  string     `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return "+" + c.Key + "=" + escape(c.New)
+	case Removed:
+		return "-" + c.Key + "=" + escape(c.Old)
+	}
+	return "~" + c.Key + "=" + escape(c.Old) + " -> " + escape(c.New)
+}
+
+// Diff lists the changes that turn a into b: additions and changes in
+// render order, then removals
+func Diff(a *Node, b *Node) []Change {
+	old := make(map[string]string)
+	for _, p := range a.Properties() {
+		old[p.Key] = p.Value
+	}
+
+	var out []Change
+	for _, p := range b.Properties() {
+		v, ok := old[p.Key]
+		delete(old, p.Key)
+		if !ok {
+			out = append(out, Change{Kind: Added, Key: p.Key, New: p.Value})
+		} else if v != p.Value {
+			out = append(out, Change{Kind: Changed, Key: p.Key, Old: v, New: p.Value})
+		}
+	}
+	// what's left was removed; walk a again to keep them in order
+	for _, p := range a.Properties() {
+		if v, ok := old[p.Key]; ok {
+			out = append(out, Change{Kind: Removed, Key: p.Key, Old: v})
+		}
+	}
+	return out
+}
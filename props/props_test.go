@@ -0,0 +1,169 @@
+package props
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// trimmed from a UAP-AC-Lite system_cfg
+const sampleSystemCfg = `# system_cfg
+aaa.1.br.devname=br0
+aaa.1.devname=ath0
+aaa.1.ssid=lab
+aaa.1.status=enabled
+aaa.1.wpa=2
+aaa.1.wpa.1.pairwise=CCMP
+aaa.1.wpa.psk=hunter22
+aaa.10.devname=ath1
+aaa.2.devname=ath2
+aaa.status=enabled
+
+users.1.name=admin
+users.1.password=$1$xyz$abc=
+users.status=enabled
+`
+
+func TestParseRender(t *testing.T) {
+	n, err := ParseString(sampleSystemCfg)
+	assert.Nil(t, err)
+
+	v, ok := n.Get("aaa.1.wpa")
+	assert.True(t, ok)
+	assert.Equal(t, "2", v, "a path can have a value and children")
+	v, _ = n.Get("aaa.1.wpa.psk")
+	assert.Equal(t, "hunter22", v)
+	v, _ = n.Get("users.1.password")
+	assert.Equal(t, "$1$xyz$abc=", v, "only the first = splits")
+	_, ok = n.Get("aaa.1")
+	assert.False(t, ok)
+
+	items := n.List("aaa")
+	assert.Len(t, items, 3)
+	dev, _ := items[2].Get("devname")
+	assert.Equal(t, "ath1", dev, "lists are ordered numerically")
+
+	out := n.Render()
+	assert.Contains(t, out, "aaa.2.devname=ath2\naaa.10.devname=ath1\naaa.status=enabled\n")
+	again, err := ParseString(out)
+	assert.Nil(t, err)
+	assert.Equal(t, out, again.Render(), "rendering is stable")
+	assert.Empty(t, Diff(n, again))
+}
+
+func TestEscaping(t *testing.T) {
+	n := New()
+	n.Set("sshd.1.banner", "line one\nC:\\path")
+	out := n.Render()
+	assert.Equal(t, "sshd.1.banner=line one\\nC:\\\\path\n", out)
+
+	back, err := ParseString(out)
+	assert.Nil(t, err)
+	v, _ := back.Get("sshd.1.banner")
+	assert.Equal(t, "line one\nC:\\path", v)
+
+	back, _ = ParseString("x=a\\qb\\\n")
+	v, _ = back.Get("x")
+	assert.Equal(t, "a\\qb\\", v, "stray backslashes are kept")
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{"novalue\n", "=x\n", "a..b=1\n", "a b=1\n", ".a=1\n"} {
+		_, err := ParseString(in)
+		assert.True(t, errors.Is(err, ErrSyntax), "%q: %v", in, err)
+	}
+	_, err := ParseString("a=1\n\nbad\n")
+	assert.Contains(t, err.Error(), "line 3")
+}
+
+func TestBuild(t *testing.T) {
+	n := New()
+	w := n.Append("wireless")
+	w.Set("ssid", "lab")
+	w.SetEnabled("hide_ssid", false)
+	n.Append("wireless").Setf("vlan", "%d", 20)
+	n.SetEnabled("wireless.status", true)
+
+	assert.Equal(t, "wireless.1.hide_ssid=disabled\nwireless.1.ssid=lab\nwireless.2.vlan=20\nwireless.status=enabled\n", n.Render())
+	vlan, ok := n.GetInt("wireless.2.vlan")
+	assert.True(t, ok)
+	assert.Equal(t, 20, vlan)
+	on, ok := n.GetBool("wireless.status")
+	assert.True(t, ok)
+	assert.True(t, on)
+
+	n.Delete("wireless.1")
+	assert.Len(t, n.List("wireless"), 1)
+	n.Delete("nothing.here")
+
+	m := New()
+	m.Set("wireless.2.vlan", "30")
+	m.Set("radio.1.channel", "6")
+	n.Merge(m)
+	v, _ := n.Get("wireless.2.vlan")
+	assert.Equal(t, "30", v)
+}
+
+func TestOrder(t *testing.T) {
+	n := New()
+	for _, k := range []string{"radio", "1", "01", "10", "2", "001"} {
+		n.Set("x."+k, k)
+	}
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "x.001=001\nx.01=01\nx.1=1\nx.2=2\nx.10=10\nx.radio=radio\n", n.Render())
+	}
+}
+
+func TestLayer(t *testing.T) {
+	base, err := ParseString(`bridge.1.devname=br0
+bridge.1.port.1.devname=eth0
+netconf.1.devname=eth0
+netconf.2.devname=br0
+netconf.2.ip=0.0.0.0
+users.1.name=ubnt
+users.2.name=other
+sshd.port=22
+`)
+	assert.Nil(t, err)
+	top, err := ParseString(`bridge.1.devname=br0.20
+bridge.1.port.1.devname=eth0.20
+netconf.1.devname=br0
+netconf.1.ip=10.0.0.2
+users.1.name=admin
+vlan.1.devname=eth0
+vlan.1.id=20
+vlan.2.devname=eth0
+vlan.2.id=30
+`)
+	assert.Nil(t, err)
+	base.Layer(top)
+	assert.Equal(t, `bridge.1.devname=br0
+bridge.1.port.1.devname=eth0
+bridge.2.devname=br0.20
+bridge.2.port.1.devname=eth0.20
+netconf.1.devname=eth0
+netconf.2.devname=br0
+netconf.2.ip=10.0.0.2
+sshd.port=22
+users.1.name=admin
+vlan.1.devname=eth0
+vlan.1.id=20
+vlan.2.devname=eth0
+vlan.2.id=30
+`, base.Render())
+}
+
+func TestDiff(t *testing.T) {
+	a, _ := ParseString("a.1=x\na.2=y\nb=1\n")
+	b, _ := ParseString("a.1=x\na.2=z\nc=2\n")
+
+	changes := Diff(a, b)
+	assert.Equal(t, []Change{
+		{Kind: Changed, Key: "a.2", Old: "y", New: "z"},
+		{Kind: Added, Key: "c", New: "2"},
+		{Kind: Removed, Key: "b", Old: "1"},
+	}, changes)
+	assert.Equal(t, "~a.2=y -> z", changes[0].String())
+	assert.Equal(t, "-b=1", changes[2].String())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/config"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/mgmt"
+	"github.com/jda/nanofi/reconcile"
+	"github.com/jda/nanofi/syscfg"
+	"github.com/jda/nanofi/template"
+	"github.com/jda/nanofi/usw"
+	"github.com/jda/nanofi/wlan"
+)
+
+// provisioner keeps adopted devices on the configuration resolved for them
+type provisioner struct {
+	reconciler *reconcile.Reconciler
+
+	mu        sync.RWMutex
+	templates *template.Templates
+	// stunURL is advertised in mgmt_cfg when STUN is enabled
+	stunURL string
+}
+
+// newProvisioner creates a provisioner appending config events to eventsFile
+func newProvisioner(templates *template.Templates, eventsFile string) (*provisioner, error) {
+	events, err := os.OpenFile(eventsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config events: %w", err)
+	}
+	return &provisioner{
+		reconciler: reconcile.New(reconcile.DefaultMinBackoff, reconcile.DefaultMaxBackoff, events),
+		templates:  templates,
+	}, nil
+}
+
+// setTemplates replaces the templates devices' config is resolved from
+func (p *provisioner) setTemplates(t *template.Templates) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.templates = t
+}
+
+// place puts dev in the site and group the templates name
+func (p *provisioner) place(dev device.Device) device.Device {
+	p.mu.RLock()
+	t := p.templates
+	p.mu.RUnlock()
+	return t.Place(dev)
+}
+
+// config resolves and validates the config for dev
+func (p *provisioner) config(dev device.Device) (config.Layer, error) {
+	p.mu.RLock()
+	t := p.templates
+	p.mu.RUnlock()
+	return resolveConfig(t, dev)
+}
+
+// resolveConfig resolves and validates the config t gives dev, in the site
+// and group t puts it in
+func resolveConfig(t *template.Templates, dev device.Device) (config.Layer, error) {
+	var cfg config.Layer
+	if err := t.Resolve(t.Place(dev)).Decode(&cfg); err != nil {
+		return config.Layer{}, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// desired returns the config dev should have. Its system_cfg is the base
+// for dev's model with the WLAN, switch and management settings layered on,
+// as setparam replaces the whole file.
+func (p *provisioner) desired(dev device.Device) (reconcile.Desired, bool) {
+	cfg, err := p.config(dev)
+	if err != nil {
+		glog.Errorf("provision: %s: %s", dev.MAC, err)
+		return reconcile.Desired{}, false
+	}
+
+	mgmtCfg := inform.MgmtCfg(dev.AuthKey, "")
+	systemCfg := syscfg.Base(dev)
+	ok := false
+	switch dev.Kind() {
+	case device.KindAP:
+		if cfg.WLAN != nil {
+			n, err := wlan.Render(*cfg.WLAN)
+			if err != nil {
+				glog.Errorf("provision: %s: %s", dev.MAC, err)
+				return reconcile.Desired{}, false
+			}
+			systemCfg.Layer(n)
+			ok = true
+		}
+	case device.KindSwitch:
+		if cfg.Switch != nil {
+			n, err := usw.Render(*cfg.Switch, len(dev.Ports))
+			if err != nil {
+				glog.Errorf("provision: %s: %s", dev.MAC, err)
+				return reconcile.Desired{}, false
+			}
+			systemCfg.Layer(n)
+			ok = true
+		}
+	}
+
+	if !cfg.Mgmt.Empty() {
+		m, n, err := mgmt.Render(cfg.Mgmt)
+		if err != nil {
+			glog.Errorf("provision: %s: management settings: %s", dev.MAC, err)
+			return reconcile.Desired{}, false
+		}
+		mgmtCfg += m.Render()
+		systemCfg.Layer(n)
+		ok = true
+	}
+
+	if !ok {
+		return reconcile.Desired{}, false
+	}
+	// part of the config, so part of its cfgversion
+	if p.stunURL != "" {
+		mgmtCfg += "stun_url=" + p.stunURL + "\n"
+	}
+	return reconcile.Desired{MgmtCfg: mgmtCfg, SystemCfg: systemCfg.Render()}, true
+}
+
+// handle returns the setparam to send dev if its config needs pushing. A
+// device back at defaults, as after being reset by hand, is adopted again
+// with the key we hold for it, then has its config pushed.
+func (p *provisioner) handle(dev device.Device) inform.Response {
+	// only devices we hold the authkey for can be configured
+	if dev.AuthKey == "" {
+		return nil
+	}
+	if !dev.Adopted {
+		if !dev.Default {
+			return nil
+		}
+		glog.Infof("provision: %s is at defaults, adopting it again", dev.MAC)
+		return inform.NewSetParamResponse(inform.MgmtCfg(dev.AuthKey, inform.InitialCfgVersion), "")
+	}
+	want, ok := p.desired(dev)
+	if !ok {
+		return nil
+	}
+	return p.reconciler.Handle(dev, want)
+}
+
+// portMismatches is a switch's ports that don't match their profiles
+type portMismatches struct {
+	MAC        string         `json:"mac"`
+	Mismatches []usw.Mismatch `json:"mismatches"`
+}
+
+// portsHandler checks every switch's reported port states against its
+// switch config
+func (c *controller) portsHandler(w http.ResponseWriter, r *http.Request) {
+	out := []portMismatches{}
+	for _, d := range c.devices.List() {
+		if d.Kind() != device.KindSwitch || !d.Adopted {
+			continue
+		}
+		cfg, err := c.provision.config(d)
+		if err != nil || cfg.Switch == nil {
+			continue
+		}
+		out = append(out, portMismatches{MAC: d.MAC, Mismatches: usw.Check(*cfg.Switch, d.Ports)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		glog.Errorf("could not write port mismatches: %s", err)
+	}
+}
+
+// configHandler reports whether devices are running their config
+func (c *controller) configHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.provision.reconciler.Status()); err != nil {
+		glog.Errorf("could not write config status: %s", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Package reconcile keeps devices on the configuration rendered for them.
+// Rendered config is tagged with a cfgversion hashed from its contents, and
+// devices report the cfgversion they're running in every inform. A device
+// reporting anything else, because it was reset, changed by hand or failed
+// to apply a push, is sent its config again, backing off between attempts.
+package reconcile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+)
+
+// Backoff defaults
+const (
+	DefaultMinBackoff = 30 * time.Second
+	DefaultMaxBackoff = 30 * time.Minute
+)
+
+// EventKind identifies what happened to a device's config
+type EventKind string
+
+// Reconcile events
+const (
+	// EventPushed is config being sent to a device
+	EventPushed EventKind = "pushed"
+	// EventConverged is a device reporting the cfgversion it was sent
+	EventConverged EventKind = "converged"
+	// EventDrift is a device that was converged reporting another cfgversion
+	EventDrift EventKind = "drift"
+)
+
+// Event is something that happened to a device's config
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind EventKind `json:"kind"`
+	MAC  string    `json:"mac"`
+	// Want is the cfgversion of the rendered config, Reported what the
+	// device said it had
+	Want     string `json:"want"`
+	Reported string `json:"reported"`
+	Attempt  int    `json:"attempt,omitempty"`
+}
+
+// Desired is the configuration a device should run
+type Desired struct {
+	// MgmtCfg is mgmt_cfg; any cfgversion in it is replaced
+	MgmtCfg   string
+	SystemCfg string
+}
+
+// CfgVersion is the stable cfgversion of the desired config
+func (d Desired) CfgVersion() string {
+	h := sha256.New()
+	io.WriteString(h, withCfgVersion(d.MgmtCfg, ""))
+	// separate the two so moving a line from one to the other changes it
+	h.Write([]byte{0})
+	io.WriteString(h, d.SystemCfg)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Status is where a device is up to
+type Status struct {
+	MAC       string    `json:"mac"`
+	Want      string    `json:"want"`
+	Reported  string    `json:"reported"`
+	Converged bool      `json:"converged"`
+	Attempts  int       `json:"attempts"`
+	NextPush  time.Time `json:"next_push"`
+}
+
+type state struct {
+	want      string
+	converged bool
+	attempts  int
+	next      time.Time
+	reported  string
+}
+
+// Reconciler pushes config to devices until they report running it
+type Reconciler struct {
+	mu      sync.Mutex
+	min     time.Duration
+	max     time.Duration
+	events  io.Writer
+	devices map[string]*state
+	now     func() time.Time
+}
+
+// New creates a reconciler that backs off from min to max between pushes.
+// Events are written to events as JSON lines; events may be nil.
+func New(min time.Duration, max time.Duration, events io.Writer) *Reconciler {
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max < min {
+		max = DefaultMaxBackoff
+		if max < min {
+			max = min
+		}
+	}
+	return &Reconciler{
+		min:     min,
+		max:     max,
+		events:  events,
+		devices: make(map[string]*state),
+		now:     time.Now,
+	}
+}
+
+// Handle compares the cfgversion dev reported with the desired config,
+// returning a setparam to send if it needs pushing, or nil
+func (r *Reconciler) Handle(dev device.Device, want Desired) inform.Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	cfgversion := want.CfgVersion()
+	s, ok := r.devices[dev.MAC]
+	if !ok || s.want != cfgversion {
+		// new device or new config, so start over
+		s = &state{want: cfgversion}
+		r.devices[dev.MAC] = s
+	}
+	s.reported = dev.CfgVersion
+
+	if dev.CfgVersion == cfgversion {
+		if !s.converged {
+			s.converged = true
+			r.emit(Event{Kind: EventConverged, MAC: dev.MAC, Want: cfgversion, Reported: dev.CfgVersion, Attempt: s.attempts})
+			glog.Infof("reconcile: %s converged on %s", dev.MAC, cfgversion)
+		}
+		s.attempts = 0
+		s.next = time.Time{}
+		return nil
+	}
+
+	if s.converged {
+		s.converged = false
+		r.emit(Event{Kind: EventDrift, MAC: dev.MAC, Want: cfgversion, Reported: dev.CfgVersion})
+		glog.Warningf("reconcile: %s drifted to cfgversion %s, want %s", dev.MAC, dev.CfgVersion, cfgversion)
+	}
+	if now.Before(s.next) {
+		return nil
+	}
+
+	s.attempts++
+	s.next = now.Add(r.backoff(s.attempts))
+	r.emit(Event{Kind: EventPushed, MAC: dev.MAC, Want: cfgversion, Reported: dev.CfgVersion, Attempt: s.attempts})
+	glog.Infof("reconcile: %s pushing cfgversion %s (attempt %d)", dev.MAC, cfgversion, s.attempts)
+	return inform.NewSetParamResponse(withCfgVersion(want.MgmtCfg, cfgversion), want.SystemCfg)
+}
+
+// withCfgVersion sets the cfgversion line of mgmtCfg, removing it if
+// cfgversion is empty
+func withCfgVersion(mgmtCfg string, cfgversion string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(mgmtCfg, "\n") {
+		if line != "" && !strings.HasPrefix(line, "cfgversion=") {
+			b.WriteString(line)
+		}
+	}
+	if cfgversion != "" {
+		b.WriteString("cfgversion=" + cfgversion + "\n")
+	}
+	return b.String()
+}
+
+// backoff is how long to wait after the nth push
+func (r *Reconciler) backoff(n int) time.Duration {
+	d := r.min
+	for i := 1; i < n && d < r.max; i++ {
+		d *= 2
+	}
+	if d > r.max {
+		d = r.max
+	}
+	return d
+}
+
+// Status returns the state of every device the reconciler has seen
+func (r *Reconciler) Status() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]Status, 0, len(r.devices))
+	for mac, s := range r.devices {
+		out = append(out, Status{
+			MAC:       mac,
+			Want:      s.want,
+			Reported:  s.reported,
+			Converged: s.converged,
+			Attempts:  s.attempts,
+			NextPush:  s.next,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+	return out
+}
+
+func (r *Reconciler) emit(e Event) {
+	e.Time = r.now()
+	if r.events == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("reconcile: could not encode event: %s", err)
+		return
+	}
+	if _, err := r.events.Write(append(line, '\n')); err != nil {
+		glog.Errorf("reconcile: could not record event: %s", err)
+	}
+}
@@ -0,0 +1,75 @@
+package reconcile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/stretchr/testify/assert"
+)
+
+var want = Desired{MgmtCfg: "authkey=x\ncfgversion=0000000000000000\n", SystemCfg: "aaa.1.ssid=lab\n"}
+
+func TestCfgVersion(t *testing.T) {
+	v := want.CfgVersion()
+	assert.Len(t, v, 16)
+	assert.Equal(t, v, Desired{MgmtCfg: "authkey=x\n", SystemCfg: "aaa.1.ssid=lab\n"}.CfgVersion(), "stable")
+	assert.NotEqual(t, v, Desired{MgmtCfg: "authkey=x\naaa.1.ssid=lab\n"}.CfgVersion())
+	assert.NotEqual(t, v, Desired{MgmtCfg: "authkey=x\n", SystemCfg: "aaa.1.ssid=lab2\n"}.CfgVersion())
+	assert.Equal(t, v, Desired{MgmtCfg: "cfgversion=0000000000000000\nauthkey=x\n", SystemCfg: "aaa.1.ssid=lab\n"}.CfgVersion(),
+		"cfgversion doesn't count")
+}
+
+func TestReconcile(t *testing.T) {
+	events := &bytes.Buffer{}
+	r := New(time.Minute, 4*time.Minute, events)
+	now := time.Unix(1600000000, 0)
+	r.now = func() time.Time { return now }
+	dev := device.Device{MAC: "78:8a:20:00:00:01", CfgVersion: inform.InitialCfgVersion}
+
+	sp, ok := r.Handle(dev, want).(inform.SetParamResponse)
+	assert.True(t, ok, "unconfigured device gets pushed")
+	assert.Contains(t, sp.MgmtCfg, "cfgversion="+want.CfgVersion()+"\n")
+	assert.Equal(t, 1, strings.Count(sp.MgmtCfg, "cfgversion="))
+	assert.Contains(t, sp.MgmtCfg, "authkey=x\n")
+	assert.Equal(t, want.SystemCfg, sp.SystemCfg)
+
+	// failed applies back off: 1m, 2m, 4m, 4m
+	for _, wait := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		now = now.Add(wait - time.Second)
+		assert.Nil(t, r.Handle(dev, want), "backing off")
+		now = now.Add(time.Second)
+		assert.NotNil(t, r.Handle(dev, want), "pushed again after %s", wait)
+	}
+
+	dev.CfgVersion = want.CfgVersion()
+	assert.Nil(t, r.Handle(dev, want))
+	st := r.Status()
+	assert.Len(t, st, 1)
+	assert.True(t, st[0].Converged)
+	assert.Equal(t, 0, st[0].Attempts)
+
+	dev.CfgVersion = "0123456789abcdef"
+	assert.NotNil(t, r.Handle(dev, want), "drift is pushed straight away")
+
+	newWant := Desired{SystemCfg: "aaa.1.ssid=other\n"}
+	dev.CfgVersion = want.CfgVersion()
+	assert.NotNil(t, r.Handle(dev, newWant), "new config is pushed")
+
+	var kinds []EventKind
+	sc := bufio.NewScanner(events)
+	for sc.Scan() {
+		var e Event
+		assert.Nil(t, json.Unmarshal(sc.Bytes(), &e))
+		kinds = append(kinds, e.Kind)
+	}
+	assert.Equal(t, []EventKind{
+		EventPushed, EventPushed, EventPushed, EventPushed, EventPushed,
+		EventConverged, EventDrift, EventPushed, EventPushed,
+	}, kinds)
+}
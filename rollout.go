@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/catalog"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/firmware"
+	"github.com/jda/nanofi/rollout"
+)
+
+// rolloutCheckInterval is how often a rollout looks for devices that have
+// gone quiet
+const rolloutCheckInterval = time.Minute
+
+// rolloutPlan is the file format for -rollout
+type rolloutPlan struct {
+	Targets        map[string]bench.Target `json:"targets"`
+	Waves          []rollout.Wave          `json:"waves"`
+	Timeout        string                  `json:"timeout"`
+	MaxFailureRate float64                 `json:"max_failure_rate"`
+	RollbackOnHalt bool                    `json:"rollback_on_halt"`
+	// Groups assigns devices, by MAC, to the groups waves can name
+	Groups map[string][]string `json:"groups"`
+}
+
+// startRollout loads a rollout plan and starts it, or rolls its targets
+// back if rollback is set. Devices the plan's groups don't name are in the
+// group place puts them in. Events are appended to eventsFile and passed to
+// onEvent.
+func startRollout(devices *device.Registry, fw *firmware.Server, cat *catalog.Catalog, planFile string, eventsFile string, rollback bool, place func(device.Device) device.Device, onEvent func(rollout.Event)) (*rollout.Rollout, error) {
+	data, err := ioutil.ReadFile(planFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read rollout plan: %w", err)
+	}
+	var plan rolloutPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("could not parse rollout plan %s: %w", planFile, err)
+	}
+
+	if err := resolveTargets(plan.Targets, fw, cat); err != nil {
+		return nil, err
+	}
+
+	cfg := rollout.Config{
+		Targets:        plan.Targets,
+		Waves:          plan.Waves,
+		MaxFailureRate: plan.MaxFailureRate,
+		RollbackOnHalt: plan.RollbackOnHalt,
+		OnEvent:        onEvent,
+	}
+	if plan.Timeout != "" {
+		if cfg.Timeout, err = time.ParseDuration(plan.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid rollout timeout: %w", err)
+		}
+	}
+	if fw != nil {
+		cfg.Resolve = func(model string, version string) (bench.Target, error) {
+			img, err := fw.Repository().Lookup(model, version)
+			if err != nil {
+				return bench.Target{}, err
+			}
+			return bench.Target{Version: img.Version, URL: fw.URL(img), MD5Sum: img.MD5}, nil
+		}
+	}
+
+	groups, err := byMAC(plan.Groups)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rollout groups: %w", err)
+	}
+	cfg.Group = func(d device.Device) string {
+		if g, ok := groups[d.MAC]; ok {
+			return g
+		}
+		return place(d).Group
+	}
+
+	events, err := os.OpenFile(eventsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open rollout events: %w", err)
+	}
+
+	r := rollout.New(cfg, devices, events)
+	if rollback {
+		r.Rollback()
+	} else {
+		r.Start()
+	}
+
+	go func() {
+		for range time.Tick(rolloutCheckInterval) {
+			r.Check()
+		}
+	}()
+
+	return r, nil
+}
+
+// rolloutHandler reports the progress of the rollout
+func (c *controller) rolloutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.rollout.Status()); err != nil {
+		glog.Errorf("could not write rollout status: %s", err)
+	}
+}
@@ -0,0 +1,476 @@
+// Package rollout upgrades production devices in waves. A canary group or
+// percentage of devices is upgraded first, and the rollout only moves on to
+// the next wave once every device in the current one has informed back
+// healthy on the target firmware. Too many failures in a wave halt the
+// rollout, and upgraded devices can be rolled back to the firmware they ran
+// before.
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+)
+
+// Mode is what a rollout does to its devices
+type Mode string
+
+// Rollout modes
+const (
+	ModeUpgrade  Mode = "upgrade"
+	ModeRollback Mode = "rollback"
+)
+
+// State is where a rollout is up to
+type State string
+
+// Rollout states
+const (
+	StateIdle    State = "idle"
+	StateRunning State = "running"
+	StateHalted  State = "halted"
+	StateDone    State = "done"
+)
+
+// EventKind identifies what happened in a rollout event
+type EventKind string
+
+// Rollout events
+const (
+	EventWaveStarted   EventKind = "wave_started"
+	EventDeviceHealthy EventKind = "device_healthy"
+	EventDeviceFailed  EventKind = "device_failed"
+	EventHalted        EventKind = "halted"
+	EventCompleted     EventKind = "completed"
+	EventRollback      EventKind = "rollback_started"
+)
+
+// Wave selects the devices upgraded together. Group takes every device in
+// the named group; Percent takes devices until that share of the whole
+// rollout has been started.
+type Wave struct {
+	Group   string `json:"group,omitempty"`
+	Percent int    `json:"percent,omitempty"`
+}
+
+// Config controls how a rollout proceeds
+type Config struct {
+	// Targets maps device model to the firmware to roll out
+	Targets map[string]bench.Target
+	// Waves in order; a single wave of every device by default
+	Waves []Wave
+	// Timeout is how long a wave's devices have to come back healthy
+	Timeout time.Duration
+	// MaxFailureRate is the share of a wave, from 0 to 1, that may fail
+	// before the rollout halts; 0 halts on the first failure
+	MaxFailureRate float64
+	// RollbackOnHalt rolls upgraded devices back when the rollout halts
+	RollbackOnHalt bool
+	// Group returns the group waves find a device in; the device's own
+	// group if nil
+	Group func(dev device.Device) string
+	// Resolve finds the firmware to roll a model back to version
+	Resolve func(model string, version string) (bench.Target, error)
+	// OnEvent, if set, is called with every event, with the rollout locked
+	OnEvent func(Event)
+}
+
+// Event is something that happened during a rollout
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    EventKind `json:"kind"`
+	Mode    Mode      `json:"mode"`
+	Wave    int       `json:"wave"`
+	MAC     string    `json:"mac,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Status summarises a rollout
+type Status struct {
+	Mode    Mode  `json:"mode"`
+	State   State `json:"state"`
+	Wave    int   `json:"wave"`
+	Waves   int   `json:"waves"`
+	Devices int   `json:"devices"`
+	Pending int   `json:"pending"`
+	Healthy int   `json:"healthy"`
+	Failed  int   `json:"failed"`
+}
+
+type memberState int
+
+const (
+	memberQueued memberState = iota
+	memberWaiting
+	memberSent
+	memberHealthy
+	memberFailed
+)
+
+type member struct {
+	mac    string
+	model  string
+	group  string
+	from   string
+	target bench.Target
+	wave   int
+	state  memberState
+	sentAt time.Time
+}
+
+// Rollout tracks one rollout across all devices in the registry
+type Rollout struct {
+	mu      sync.Mutex
+	cfg     Config
+	devices *device.Registry
+	events  io.Writer
+	now     func() time.Time
+
+	mode        Mode
+	state       State
+	waves       []Wave
+	wave        int
+	waveStarted time.Time
+	members     map[string]*member
+	order       []*member
+	started     int
+}
+
+// New creates an idle rollout. Events are written to events as JSON lines;
+// events may be nil.
+func New(cfg Config, devices *device.Registry, events io.Writer) *Rollout {
+	if len(cfg.Waves) == 0 {
+		cfg.Waves = []Wave{{Percent: 100}}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Minute
+	}
+
+	return &Rollout{
+		cfg:     cfg,
+		devices: devices,
+		events:  events,
+		now:     time.Now,
+		mode:    ModeUpgrade,
+		state:   StateIdle,
+		members: make(map[string]*member),
+	}
+}
+
+// Start begins upgrading every known device that is behind its model's
+// target
+func (r *Rollout) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var members []*member
+	for _, d := range r.devices.List() {
+		t, ok := r.cfg.Targets[d.Model]
+		if !ok || !t.NeedsUpgrade(d.Version) {
+			continue
+		}
+		members = append(members, &member{mac: d.MAC, model: d.Model, group: r.group(d), from: d.Version, target: t})
+	}
+
+	r.begin(ModeUpgrade, r.cfg.Waves, members)
+}
+
+// Rollback returns the devices this rollout sent the upgrade to, in a single
+// wave, to the version they ran before. Started before any upgrade, as with
+// -rollout-rollback, it takes every device running its model's target back
+// to the previous version recorded in the device registry.
+func (r *Rollout) Rollback() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.mode == ModeUpgrade && r.state != StateIdle {
+		r.rollback()
+		return
+	}
+
+	var members []*member
+	for _, d := range r.devices.List() {
+		t, ok := r.cfg.Targets[d.Model]
+		if !ok || !t.Reached(d.Version) {
+			continue
+		}
+		members = append(members, &member{mac: d.MAC, model: d.Model, group: r.group(d), from: d.PreviousVersion()})
+	}
+	r.rollbackTo(members)
+}
+
+// rollback returns the members sent the upgrade to the version they ran
+// before. Devices that were never sent it, or are still on that version,
+// are left alone.
+func (r *Rollout) rollback() {
+	var members []*member
+	for _, m := range r.order {
+		if m.sentAt.IsZero() {
+			continue
+		}
+		if d, ok := r.devices.Get(m.mac); ok && d.Version == m.from {
+			continue
+		}
+		members = append(members, &member{mac: m.mac, model: m.model, group: m.group, from: m.from})
+	}
+	r.rollbackTo(members)
+}
+
+// rollbackTo begins rolling back each of from to its from version
+func (r *Rollout) rollbackTo(from []*member) {
+	var members []*member
+	for _, m := range from {
+		if m.from == "" {
+			glog.Warningf("rollout: %s has no previous firmware to roll back to", m.mac)
+			continue
+		}
+		if r.cfg.Resolve == nil {
+			glog.Warningf("rollout: no firmware source to roll %s back to %s", m.mac, m.from)
+			continue
+		}
+		back, err := r.cfg.Resolve(m.model, m.from)
+		if err != nil {
+			glog.Warningf("rollout: can't roll %s back to %s: %s", m.mac, m.from, err)
+			continue
+		}
+		m.target = back
+		members = append(members, m)
+	}
+
+	r.emit(EventRollback, "", fmt.Sprintf("rolling back %d devices", len(members)))
+	r.begin(ModeRollback, []Wave{{Percent: 100}}, members)
+}
+
+// group returns the group d is in
+func (r *Rollout) group(d device.Device) string {
+	if r.cfg.Group != nil {
+		return r.cfg.Group(d)
+	}
+	return d.Group
+}
+
+func (r *Rollout) begin(mode Mode, waves []Wave, members []*member) {
+	r.mode = mode
+	r.state = StateRunning
+	r.waves = waves
+	r.order = members
+	r.started = 0
+	r.members = make(map[string]*member, len(members))
+	for _, m := range members {
+		r.members[m.mac] = m
+	}
+
+	r.startWave(0, r.now())
+}
+
+// startWave moves the rollout on to wave i, skipping waves with no devices
+func (r *Rollout) startWave(i int, now time.Time) {
+	for ; i < len(r.waves); i++ {
+		r.wave = i
+		r.waveStarted = now
+
+		n := 0
+		for _, m := range r.pick(r.waves[i]) {
+			m.wave = i
+			m.state = memberWaiting
+			n++
+		}
+		r.started += n
+		if n > 0 {
+			r.emit(EventWaveStarted, "", fmt.Sprintf("%d devices", n))
+			return
+		}
+	}
+
+	r.state = StateDone
+	r.emit(EventCompleted, "", fmt.Sprintf("%d devices", len(r.order)))
+}
+
+// pick returns the queued members wave w should take
+func (r *Rollout) pick(w Wave) []*member {
+	var out []*member
+	if w.Group != "" {
+		for _, m := range r.order {
+			if m.state == memberQueued && m.group == w.Group {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+
+	want := (len(r.order)*w.Percent + 99) / 100
+	for _, m := range r.order {
+		if r.started+len(out) >= want {
+			break
+		}
+		if m.state == memberQueued {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Handle advances dev through the rollout given its state before this
+// inform (prev). It returns the response to send, or nil if the device
+// has nothing to do.
+func (r *Rollout) Handle(dev device.Device, prev device.Device) inform.Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	var res inform.Response
+
+	m, ok := r.members[dev.MAC]
+	if ok && r.state == StateRunning && m.wave == r.wave {
+		switch m.state {
+		case memberWaiting:
+			m.state = memberSent
+			m.sentAt = now
+			glog.Infof("rollout: %s sending %s to %s", r.mode, dev.MAC, m.target.Version)
+			res = inform.NewUpgradeResponse(m.target.URL, m.target.Version, m.target.MD5Sum)
+		case memberSent:
+			if m.target.Reached(dev.Version) {
+				m.state = memberHealthy
+				r.emit(EventDeviceHealthy, dev.MAC, "on "+dev.Version)
+			} else if dev.Rebooted(prev) {
+				r.fail(m, fmt.Sprintf("rebooted on %s, wanted %s", dev.Version, m.target.Version))
+			}
+		}
+	}
+
+	r.check(now)
+	return res
+}
+
+// Active reports whether mac is being upgraded in the current wave
+func (r *Rollout) Active(mac string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.members[mac]
+	return ok && r.state == StateRunning && m.wave == r.wave &&
+		(m.state == memberWaiting || m.state == memberSent)
+}
+
+// Check fails devices in the current wave that have run out of time and
+// moves the rollout on. Handle checks on every inform; Check is for when
+// devices go quiet.
+func (r *Rollout) Check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.check(r.now())
+}
+
+func (r *Rollout) check(now time.Time) {
+	if r.state != StateRunning {
+		return
+	}
+
+	size, failed, resolved := 0, 0, 0
+	for _, m := range r.order {
+		if m.wave != r.wave || m.state == memberQueued {
+			continue
+		}
+		switch m.state {
+		case memberWaiting:
+			if now.Sub(r.waveStarted) >= r.cfg.Timeout {
+				r.fail(m, "did not inform")
+			}
+		case memberSent:
+			if now.Sub(m.sentAt) >= r.cfg.Timeout {
+				r.fail(m, fmt.Sprintf("not on %s after %s", m.target.Version, r.cfg.Timeout))
+			}
+		}
+
+		size++
+		switch m.state {
+		case memberFailed:
+			failed++
+			resolved++
+		case memberHealthy:
+			resolved++
+		}
+	}
+
+	if size > 0 && float64(failed)/float64(size) > r.cfg.MaxFailureRate {
+		r.state = StateHalted
+		r.emit(EventHalted, "", fmt.Sprintf("%d of %d devices failed", failed, size))
+		if r.cfg.RollbackOnHalt && r.mode == ModeUpgrade {
+			r.rollback()
+		}
+		return
+	}
+
+	if resolved == size {
+		r.startWave(r.wave+1, now)
+	}
+}
+
+func (r *Rollout) fail(m *member, reason string) {
+	m.state = memberFailed
+	r.emit(EventDeviceFailed, m.mac, reason)
+}
+
+// Status returns a summary of the rollout
+func (r *Rollout) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Status{
+		Mode:    r.mode,
+		State:   r.state,
+		Wave:    r.wave + 1,
+		Waves:   len(r.waves),
+		Devices: len(r.order),
+	}
+	for _, m := range r.order {
+		switch m.state {
+		case memberHealthy:
+			s.Healthy++
+		case memberFailed:
+			s.Failed++
+		default:
+			s.Pending++
+		}
+	}
+	return s
+}
+
+func (r *Rollout) emit(kind EventKind, mac string, msg string) {
+	e := Event{
+		Time:    r.now(),
+		Kind:    kind,
+		Mode:    r.mode,
+		Wave:    r.wave + 1,
+		MAC:     mac,
+		Message: msg,
+	}
+	if kind == EventHalted || kind == EventDeviceFailed {
+		glog.Warningf("rollout: %s wave %d: %s %s %s", e.Mode, e.Wave, kind, mac, msg)
+	} else {
+		glog.Infof("rollout: %s wave %d: %s %s %s", e.Mode, e.Wave, kind, mac, msg)
+	}
+	if r.cfg.OnEvent != nil {
+		r.cfg.OnEvent(e)
+	}
+
+	if r.events == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("rollout: could not encode event: %s", err)
+		return
+	}
+	if _, err := r.events.Write(append(line, '\n')); err != nil {
+		glog.Errorf("rollout: could not record event: %s", err)
+	}
+}
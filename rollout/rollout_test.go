@@ -0,0 +1,220 @@
+package rollout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jda/nanofi/bench"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/inform"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTarget = bench.Target{Version: "4.3.28.11361", URL: "http://fw/u7pg2-4.3.28.bin"}
+
+type site struct {
+	t      *testing.T
+	r      *Rollout
+	reg    *device.Registry
+	events *bytes.Buffer
+	now    time.Time
+	info   map[string]inform.Info
+}
+
+// newSite creates a registry of n U7PG2s on 4.3.20, the first canaries of
+// them in the canary group
+func newSite(t *testing.T, n int, canaries int, cfg Config) *site {
+	reg, err := device.NewRegistry("")
+	assert.Nil(t, err)
+	s := &site{
+		t:      t,
+		reg:    reg,
+		events: &bytes.Buffer{},
+		now:    time.Unix(1600000000, 0),
+		info:   make(map[string]inform.Info),
+	}
+
+	groups := make(map[string]string)
+	for i := 0; i < n; i++ {
+		mac := fmt.Sprintf("78:8a:20:00:00:%02x", i)
+		s.info[mac] = inform.Info{MAC: mac, Model: "U7PG2", Version: "4.3.20.11298", Uptime: 1000}
+		s.inform(mac)
+		if i < canaries {
+			groups[mac] = "canary"
+		}
+	}
+	if cfg.Group == nil {
+		cfg.Group = func(d device.Device) string { return groups[d.MAC] }
+	}
+
+	if cfg.Targets == nil {
+		cfg.Targets = map[string]bench.Target{"U7PG2": testTarget}
+	}
+	s.r = New(cfg, reg, s.events)
+	s.r.now = func() time.Time { return s.now }
+	return s
+}
+
+func (s *site) inform(mac string) inform.Response {
+	s.now = s.now.Add(10 * time.Second)
+	info := s.info[mac]
+	info.Uptime += 10
+	s.info[mac] = info
+
+	cur, prev, err := s.reg.Observe(mac, info, true)
+	assert.Nil(s.t, err)
+	if s.r == nil {
+		return nil
+	}
+	return s.r.Handle(cur, prev)
+}
+
+// upgrade informs mac, expecting an upgrade, then has it come back on the
+// version it was sent, or on its old version if fail
+func (s *site) upgrade(mac string, fail bool) {
+	up, ok := s.inform(mac).(inform.UpgradeResponse)
+	assert.True(s.t, ok, "%s should be sent upgrade", mac)
+
+	info := s.info[mac]
+	if !fail {
+		info.Version = up.Version
+	}
+	info.Uptime = 0
+	s.info[mac] = info
+	s.inform(mac)
+}
+
+func (s *site) eventKinds() []EventKind {
+	var out []EventKind
+	sc := bufio.NewScanner(bytes.NewReader(s.events.Bytes()))
+	for sc.Scan() {
+		var e Event
+		assert.Nil(s.t, json.Unmarshal(sc.Bytes(), &e))
+		out = append(out, e.Kind)
+	}
+	return out
+}
+
+func TestRolloutWaves(t *testing.T) {
+	s := newSite(t, 10, 1, Config{Waves: []Wave{{Group: "canary"}, {Percent: 50}, {Percent: 100}}})
+	s.r.Start()
+
+	macs := make([]string, 0, 10)
+	for _, d := range s.reg.List() {
+		macs = append(macs, d.MAC)
+	}
+
+	assert.Nil(t, s.inform(macs[1]), "only the canary goes first")
+	assert.True(t, s.r.Active(macs[0]))
+	assert.False(t, s.r.Active(macs[1]))
+	s.upgrade(macs[0], false)
+	assert.Equal(t, 2, s.r.Status().Wave)
+
+	assert.Nil(t, s.inform(macs[5]), "second wave is half the site")
+	for _, mac := range macs[1:5] {
+		s.upgrade(mac, false)
+	}
+	assert.Equal(t, 3, s.r.Status().Wave)
+
+	for _, mac := range macs[5:] {
+		s.upgrade(mac, false)
+	}
+
+	st := s.r.Status()
+	assert.Equal(t, StateDone, st.State)
+	assert.Equal(t, 10, st.Healthy)
+	assert.Equal(t, EventCompleted, s.eventKinds()[len(s.eventKinds())-1])
+}
+
+func TestRolloutHalt(t *testing.T) {
+	var seen []EventKind
+	s := newSite(t, 10, 0, Config{Waves: []Wave{{Percent: 30}, {Percent: 100}}, MaxFailureRate: 0.4, OnEvent: func(e Event) { seen = append(seen, e.Kind) }})
+	s.r.Start()
+	macs := []string{"78:8a:20:00:00:00", "78:8a:20:00:00:01", "78:8a:20:00:00:02"}
+
+	s.upgrade(macs[0], true)
+	assert.Equal(t, StateRunning, s.r.Status().State, "one in three is within the threshold")
+	s.upgrade(macs[1], true)
+	assert.Equal(t, StateHalted, s.r.Status().State)
+	assert.Contains(t, s.eventKinds(), EventHalted)
+	assert.Equal(t, s.eventKinds(), seen)
+
+	assert.Nil(t, s.inform(macs[2]), "halted rollouts send nothing")
+	assert.Nil(t, s.inform("78:8a:20:00:00:05"))
+}
+
+func TestRolloutTimeout(t *testing.T) {
+	s := newSite(t, 2, 0, Config{Timeout: time.Minute, MaxFailureRate: 0.5})
+	s.r.Start()
+
+	s.upgrade("78:8a:20:00:00:00", false)
+	s.now = s.now.Add(2 * time.Minute)
+	s.r.Check()
+
+	st := s.r.Status()
+	assert.Equal(t, StateDone, st.State, "half may fail")
+	assert.Equal(t, 1, st.Failed)
+}
+
+func TestRolloutRollback(t *testing.T) {
+	resolve := func(model string, version string) (bench.Target, error) {
+		return bench.Target{Version: version, URL: "http://fw/" + model + "-" + version + ".bin"}, nil
+	}
+	s := newSite(t, 3, 0, Config{Waves: []Wave{{Percent: 50}, {Percent: 100}}, RollbackOnHalt: true, Resolve: resolve})
+	s.r.Start()
+
+	s.upgrade("78:8a:20:00:00:00", false)
+	s.upgrade("78:8a:20:00:00:01", true)
+
+	st := s.r.Status()
+	assert.Equal(t, ModeRollback, st.Mode)
+	assert.Equal(t, StateRunning, st.State)
+	assert.Equal(t, 1, st.Devices, "only the upgraded device is rolled back")
+
+	up, ok := s.inform("78:8a:20:00:00:00").(inform.UpgradeResponse)
+	assert.True(t, ok)
+	assert.Equal(t, "4.3.20.11298", up.Version)
+	assert.Equal(t, "http://fw/U7PG2-4.3.20.11298.bin", up.URL)
+
+	info := s.info["78:8a:20:00:00:00"]
+	info.Version = up.Version
+	s.info["78:8a:20:00:00:00"] = info
+	s.inform("78:8a:20:00:00:00")
+	assert.Equal(t, StateDone, s.r.Status().State)
+	assert.Equal(t, []EventKind{EventWaveStarted, EventDeviceHealthy, EventDeviceFailed, EventHalted, EventRollback, EventWaveStarted, EventDeviceHealthy, EventCompleted}, s.eventKinds())
+}
+
+func TestRolloutRollbackMembers(t *testing.T) {
+	resolve := func(model string, version string) (bench.Target, error) {
+		return bench.Target{Version: version, URL: "http://fw/" + model + "-" + version + ".bin"}, nil
+	}
+	s := newSite(t, 4, 0, Config{Waves: []Wave{{Percent: 50}, {Percent: 100}}, RollbackOnHalt: true, Resolve: resolve})
+
+	// upgraded by hand before the rollout, so not part of it
+	info := s.info["78:8a:20:00:00:03"]
+	info.Version = testTarget.Version
+	s.info["78:8a:20:00:00:03"] = info
+	s.inform("78:8a:20:00:00:03")
+
+	s.r.Start()
+	assert.Equal(t, 3, s.r.Status().Devices)
+	s.upgrade("78:8a:20:00:00:00", false)
+	s.upgrade("78:8a:20:00:00:01", true)
+
+	st := s.r.Status()
+	assert.Equal(t, ModeRollback, st.Mode)
+	assert.Equal(t, 1, st.Devices, "devices the rollout didn't upgrade are left alone")
+	assert.Nil(t, s.inform("78:8a:20:00:00:02"))
+	assert.Nil(t, s.inform("78:8a:20:00:00:03"))
+	_, ok := s.inform("78:8a:20:00:00:00").(inform.UpgradeResponse)
+	assert.True(t, ok)
+
+	// on demand with no upgrade under way, devices on the target go back
+	r := New(Config{Targets: s.r.cfg.Targets, Resolve: resolve}, s.reg, nil)
+	r.Rollback()
+	assert.Equal(t, 2, r.Status().Devices)
+}
@@ -1,6 +0,0 @@
-package main
-
-func loadSecrets(sfName string) error {
-
-	return nil
-}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/mgmt"
+)
+
+// settingsStatus is whether a device's management settings took effect
+type settingsStatus struct {
+	MAC    string       `json:"mac"`
+	Checks []mgmt.Check `json:"checks"`
+}
+
+// settingsHandler reports, per adopted device, whether each of its
+// management settings has taken effect
+func (c *controller) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	converged := make(map[string]bool)
+	for _, s := range c.provision.reconciler.Status() {
+		converged[s.MAC] = s.Converged
+	}
+
+	out := []settingsStatus{}
+	for _, d := range c.devices.List() {
+		if !d.Adopted {
+			continue
+		}
+		cfg, err := c.provision.config(d)
+		if err != nil || cfg.Mgmt.Empty() {
+			continue
+		}
+		out = append(out, settingsStatus{MAC: d.MAC, Checks: mgmt.Confirm(cfg.Mgmt, d, converged[d.MAC])})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		glog.Errorf("could not write management settings status: %s", err)
+	}
+}
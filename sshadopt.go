@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/audit"
+	"github.com/jda/nanofi/sshadopt"
+)
+
+// sshRetry is how long to wait before trying set-inform on a host again
+const sshRetry = 10 * time.Minute
+
+// sshAdopter runs set-inform over SSH on devices at defaults, at most once
+// per host every sshRetry
+type sshAdopter struct {
+	cfg sshadopt.Config
+	// record, if set, adds successful set-informs to the audit log
+	record func(audit.Entry)
+
+	mu    sync.Mutex
+	tried map[string]time.Time
+}
+
+// newSSHAdopter configures SSH adoption, trying creds instead of the
+// defaults if there are any
+func newSSHAdopter(informURL string, creds []sshadopt.Credential) (*sshAdopter, error) {
+	if informURL == "" {
+		return nil, fmt.Errorf("an inform URL reachable by devices is required")
+	}
+	cfg := sshadopt.Config{InformURL: informURL, Credentials: creds}
+	return &sshAdopter{cfg: cfg, tried: make(map[string]time.Time)}, nil
+}
+
+// loadSSHCredentials reads a JSON list of {"user": ..., "password": ...}
+func loadSSHCredentials(file string) ([]sshadopt.Credential, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read SSH credentials: %w", err)
+	}
+	var creds []sshadopt.Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("could not parse SSH credentials %s: %w", file, err)
+	}
+	return creds, nil
+}
+
+// adopt runs set-inform on host in the background unless it was tried
+// recently
+func (a *sshAdopter) adopt(host string) {
+	a.mu.Lock()
+	if last, ok := a.tried[host]; ok && time.Since(last) < sshRetry {
+		a.mu.Unlock()
+		return
+	}
+	a.tried[host] = time.Now()
+	a.mu.Unlock()
+
+	go a.report(sshadopt.SetInform(context.Background(), a.cfg, host))
+}
+
+// scan adopts every host in cidr with SSH open
+func (a *sshAdopter) scan(cidr string) error {
+	hosts, err := sshadopt.Scan(context.Background(), cidr, sshadopt.DefaultPort, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	glog.Infof("sshadopt: %d hosts in %s have SSH open", len(hosts), cidr)
+
+	go func() {
+		for _, res := range sshadopt.Adopt(context.Background(), a.cfg, hosts, 8) {
+			a.report(res)
+		}
+	}()
+	return nil
+}
+
+func (a *sshAdopter) report(res sshadopt.Result) {
+	if res.OK() {
+		glog.Infof("sshadopt: %s: set-inform %s as %s: %s", res.Host, a.cfg.InformURL, res.User, res.Output)
+		if a.record != nil {
+			a.record(audit.Entry{
+				Actor:  actorSSHAdopt,
+				Action: audit.ActionSetInform,
+				Target: res.Host,
+				Detail: "as " + res.User,
+				After:  audit.Value(map[string]string{"inform_url": a.cfg.InformURL}),
+			})
+		}
+	} else {
+		glog.Warningf("sshadopt: %s: %s", res.Host, res.Error)
+	}
+}
@@ -0,0 +1,84 @@
+package sshadopt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxScan keeps a typo like /8 from scanning millions of addresses
+const maxScan = 4096
+
+// Hosts returns the usable IPv4 addresses in cidr, leaving out the network
+// and broadcast addresses
+func Hosts(cidr string) ([]string, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("only IPv4 subnets can be scanned: %s", cidr)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	if size > maxScan {
+		return nil, fmt.Errorf("%s is too large to scan", cidr)
+	}
+
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	first, last := uint32(0), size-1
+	if size > 2 {
+		first, last = 1, size-2
+	}
+
+	out := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		b := make(net.IP, 4)
+		binary.BigEndian.PutUint32(b, base+i)
+		out = append(out, b.String())
+	}
+	return out, nil
+}
+
+// Scan returns the hosts in cidr accepting connections on port
+func Scan(ctx context.Context, cidr string, port int, timeout time.Duration) ([]string, error) {
+	hosts, err := Hosts(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	open := make([]bool, len(hosts))
+	sem := make(chan struct{}, 64)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var d net.Dialer
+			dctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			conn, err := d.DialContext(dctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err == nil {
+				conn.Close()
+				open[i] = true
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	var out []string
+	for i, host := range hosts {
+		if open[i] {
+			out = append(out, host)
+		}
+	}
+	return out, ctx.Err()
+}
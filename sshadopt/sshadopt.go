@@ -0,0 +1,261 @@
+// Package sshadopt points devices at factory defaults to nanofi by logging
+// in over SSH and running set-inform, the same as doing it by hand:
+//
+//	ssh ubnt@192.168.1.20
+//	set-inform http://192.168.1.1:8080/inform
+//
+// Devices only finish adopting after set-inform has been run a second time
+// once the controller has answered, so the command is repeated.
+package sshadopt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultPort is the SSH port devices listen on
+const DefaultPort = 22
+
+// DefaultCommand is run with the inform URL appended. set-inform itself is
+// a shell alias that isn't available to non-interactive sessions.
+const DefaultCommand = "mca-cli-op set-inform"
+
+// ErrNoCredentials is returned when none of the credentials were accepted
+var ErrNoCredentials = errors.New("no credentials accepted")
+
+// Credential is a username and password to try
+type Credential struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// DefaultCredentials are what devices ship with
+var DefaultCredentials = []Credential{{User: "ubnt", Password: "ubnt"}}
+
+// Config controls how devices are adopted
+type Config struct {
+	// InformURL is the URL devices are told to inform to
+	InformURL string
+	// Credentials are tried in order; DefaultCredentials if empty
+	Credentials []Credential
+	// Port devices run SSH on; DefaultPort if zero
+	Port int
+	// Command is run with the inform URL appended; DefaultCommand if empty
+	Command string
+	// Repeat is how many times set-inform is run; 2 if zero
+	Repeat int
+	// Interval is how long to wait between repeats; 10s if zero
+	Interval time.Duration
+	// Timeout bounds connecting and each command; 10s if zero
+	Timeout time.Duration
+}
+
+// Result is the outcome of adopting one device
+type Result struct {
+	Host   string `json:"host"`
+	User   string `json:"user,omitempty"`
+	Runs   int    `json:"runs"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// OK reports whether set-inform ran every time it was meant to
+func (r Result) OK() bool {
+	return r.Error == ""
+}
+
+func (cfg *Config) defaults() {
+	if len(cfg.Credentials) == 0 {
+		cfg.Credentials = DefaultCredentials
+	}
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+	if cfg.Command == "" {
+		cfg.Command = DefaultCommand
+	}
+	if cfg.Repeat <= 0 {
+		cfg.Repeat = 2
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+}
+
+// SetInform logs in to host and runs set-inform
+func SetInform(ctx context.Context, cfg Config, host string) Result {
+	cfg.defaults()
+	res := Result{Host: host}
+
+	if cfg.InformURL == "" {
+		res.Error = "no inform URL configured"
+		return res
+	}
+
+	client, user, err := dial(ctx, cfg, host)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer client.Close()
+	res.User = user
+
+	cmd := cfg.Command + " " + shellQuote(cfg.InformURL)
+	for i := 0; i < cfg.Repeat; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				res.Error = ctx.Err().Error()
+				return res
+			case <-time.After(cfg.Interval):
+			}
+		}
+
+		out, err := run(client, cmd, cfg.Timeout)
+		res.Output = strings.TrimSpace(out)
+		if err != nil {
+			res.Error = fmt.Sprintf("set-inform: %s", err)
+			return res
+		}
+		res.Runs++
+		glog.V(1).Infof("sshadopt: %s: %s", host, res.Output)
+	}
+
+	return res
+}
+
+// Adopt runs SetInform against every host, at most workers at a time
+func Adopt(ctx context.Context, cfg Config, hosts []string, workers int) []Result {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	results := make([]Result, len(hosts))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = SetInform(ctx, cfg, host)
+		}(i, host)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// dial tries each credential in turn, returning the client and the user
+// that worked
+func dial(ctx context.Context, cfg Config, host string) (*ssh.Client, string, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+	var lastErr error
+	for _, cred := range cfg.Credentials {
+		sc := &ssh.ClientConfig{
+			User: cred.User,
+			Auth: []ssh.AuthMethod{
+				ssh.Password(cred.Password),
+				ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					answers := make([]string, len(questions))
+					for i := range answers {
+						answers[i] = cred.Password
+					}
+					return answers, nil
+				}),
+			},
+			// devices at defaults generate a fresh host key on every reset,
+			// so there's nothing to check it against
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(), // nosemgrep: go.lang.security.audit.crypto.insecure_ssh.avoid-ssh-insecure-ignore-host-key
+			Timeout:         cfg.Timeout,
+		}
+
+		var d net.Dialer
+		dctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		conn, err := d.DialContext(dctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			// no point trying other credentials
+			return nil, "", fmt.Errorf("could not connect to %s: %w", addr, err)
+		}
+
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, sc)
+		if err != nil {
+			conn.Close()
+			lastErr = err
+			glog.V(1).Infof("sshadopt: %s: %s rejected: %s", addr, cred.User, err)
+			continue
+		}
+		conn.SetDeadline(time.Time{})
+		return ssh.NewClient(c, chans, reqs), cred.User, nil
+	}
+
+	return nil, "", fmt.Errorf("%w by %s: %v", ErrNoCredentials, addr, lastErr)
+}
+
+// run runs cmd in a new session, returning its combined output
+func run(client *ssh.Client, cmd string, timeout time.Duration) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var out lockedBuffer
+	session.Stdout = &out
+	session.Stderr = &out
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(cmd) }()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out after %s", timeout)
+		// closing the session ends Run, unless the device never answers
+		session.Close()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+	}
+	return out.String(), err
+}
+
+// lockedBuffer is a buffer stdout and stderr can both write to while it's
+// read
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,190 @@
+package sshadopt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// device stands in for a device's SSH server, recording commands run
+type device struct {
+	l        net.Listener
+	mu       sync.Mutex
+	commands []string
+}
+
+func newDevice(t *testing.T, user string, password string) *device {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	d := &device{l: l}
+	go d.serve(cfg)
+	return d
+}
+
+func (d *device) serve(cfg *ssh.ServerConfig) {
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				ch, reqs, err := nc.Accept()
+				if err != nil {
+					continue
+				}
+				go d.session(ch, reqs)
+			}
+		}()
+	}
+}
+
+func (d *device) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		cmd := string(req.Payload[4:])
+		req.Reply(true, nil)
+
+		d.mu.Lock()
+		d.commands = append(d.commands, cmd)
+		d.mu.Unlock()
+
+		status := uint32(0)
+		if strings.HasPrefix(cmd, DefaultCommand+" ") {
+			fmt.Fprintf(ch, "Adoption request sent to '%s'\n", strings.Trim(cmd[len(DefaultCommand)+1:], "'"))
+		} else {
+			fmt.Fprintf(ch, "sh: command not found\n")
+			status = 127
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, status)
+		ch.SendRequest("exit-status", false, b)
+		return
+	}
+}
+
+func (d *device) port() int {
+	return d.l.Addr().(*net.TCPAddr).Port
+}
+
+func (d *device) Commands() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.commands...)
+}
+
+func TestSetInform(t *testing.T) {
+	dev := newDevice(t, "ubnt", "ubnt")
+	defer dev.l.Close()
+
+	cfg := Config{
+		InformURL:   "http://192.168.1.1:8080/inform",
+		Credentials: []Credential{{"admin", "admin"}, {"ubnt", "ubnt"}},
+		Port:        dev.port(),
+		Interval:    time.Millisecond,
+	}
+	res := SetInform(context.Background(), cfg, "127.0.0.1")
+	assert.True(t, res.OK(), res.Error)
+	assert.Equal(t, "ubnt", res.User, "falls through to working credentials")
+	assert.Equal(t, 2, res.Runs)
+	assert.Equal(t, "Adoption request sent to 'http://192.168.1.1:8080/inform'", res.Output)
+	assert.Equal(t, []string{
+		"mca-cli-op set-inform 'http://192.168.1.1:8080/inform'",
+		"mca-cli-op set-inform 'http://192.168.1.1:8080/inform'",
+	}, dev.Commands())
+}
+
+func TestSetInformFailures(t *testing.T) {
+	dev := newDevice(t, "ubnt", "changed")
+	defer dev.l.Close()
+
+	cfg := Config{InformURL: "http://192.168.1.1:8080/inform", Port: dev.port(), Timeout: time.Second}
+	res := SetInform(context.Background(), cfg, "127.0.0.1")
+	assert.False(t, res.OK())
+	assert.Contains(t, res.Error, ErrNoCredentials.Error())
+
+	cfg.Credentials = []Credential{{"ubnt", "changed"}}
+	cfg.Command = "set-inform"
+	res = SetInform(context.Background(), cfg, "127.0.0.1")
+	assert.False(t, res.OK(), "non-zero exit is a failure")
+	assert.Equal(t, 0, res.Runs)
+	assert.Equal(t, "sh: command not found", res.Output)
+
+	closed := newDevice(t, "ubnt", "ubnt")
+	closed.l.Close()
+	res = SetInform(context.Background(), Config{InformURL: cfg.InformURL, Port: closed.port()}, "127.0.0.1")
+	assert.Contains(t, res.Error, "could not connect")
+}
+
+func TestAdopt(t *testing.T) {
+	dev := newDevice(t, "ubnt", "ubnt")
+	defer dev.l.Close()
+
+	cfg := Config{InformURL: "http://nanofi/inform", Port: dev.port(), Repeat: 1}
+	results := Adopt(context.Background(), cfg, []string{"127.0.0.1", "127.0.0.1"}, 2)
+	assert.Len(t, results, 2)
+	for _, r := range results {
+		assert.True(t, r.OK(), "%s: %s", r.Host, r.Error)
+	}
+	assert.Len(t, dev.Commands(), 2)
+}
+
+func TestHosts(t *testing.T) {
+	hosts, err := Hosts("192.168.1.0/30")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2"}, hosts)
+
+	hosts, err = Hosts("192.168.1.77/24")
+	assert.Nil(t, err)
+	assert.Len(t, hosts, 254)
+	assert.Equal(t, "192.168.1.254", hosts[253])
+
+	_, err = Hosts("10.0.0.0/8")
+	assert.NotNil(t, err)
+	_, err = Hosts("fd00::/120")
+	assert.NotNil(t, err)
+}
+
+func TestScan(t *testing.T) {
+	dev := newDevice(t, "ubnt", "ubnt")
+	defer dev.l.Close()
+
+	open, err := Scan(context.Background(), "127.0.0.0/30", dev.port(), time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, open)
+}
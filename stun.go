@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/jda/nanofi/inform"
+	"github.com/jda/nanofi/stun"
+)
+
+// startSTUN answers STUN binding requests on listenAddr, recording which
+// devices use it
+func (c *controller) startSTUN(listenAddr string) {
+	s := &stun.Server{OnBinding: func(from *net.UDPAddr) {
+		if dev, ok := c.devices.ObserveSTUN(from.IP.String(), from.String()); ok {
+			glog.V(1).Infof("stun: binding request from %s (%s)", dev.MAC, from)
+		} else {
+			glog.V(2).Infof("stun: binding request from unknown %s", from)
+		}
+	}}
+
+	go func() {
+		glog.Infof("listening for STUN on: %s", listenAddr)
+		if err := s.ListenAndServe(context.Background(), listenAddr); err != nil {
+			glog.Errorf("STUN server stopped: %s", err)
+		}
+	}()
+}
+
+// stunURL is the stun_url advertised to devices: the host from informURL
+// and the port from listenAddr
+func stunURL(listenAddr string, informURL string) (string, error) {
+	u, err := url.Parse(informURL)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("an inform URL or -stun-url is required to advertise STUN")
+	}
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", fmt.Errorf("bad STUN listen address %s: %w", listenAddr, err)
+	}
+	if port == "" || port == "0" {
+		port = strconv.Itoa(stun.DefaultPort)
+	}
+	return "stun://" + net.JoinHostPort(u.Hostname(), port) + "/", nil
+}
+
+// withSTUN adds stun_url to the mgmt_cfg of setparam replies that don't
+// have it already; config pushes have it as part of their cfgversion
+func (c *controller) withSTUN(reply inform.Response) inform.Response {
+	sp, ok := reply.(inform.SetParamResponse)
+	if !ok || c.stunURL == "" || sp.MgmtCfg == "" || strings.Contains(sp.MgmtCfg, "stun_url=") {
+		return reply
+	}
+	sp.MgmtCfg += "stun_url=" + c.stunURL + "\n"
+	return sp
+}
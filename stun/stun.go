@@ -0,0 +1,280 @@
+// Package stun is a minimal RFC 5389 STUN server that answers binding
+// requests, which is all UniFi devices use it for: learning the public
+// address and port their traffic to the controller is mapped to.
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+
+	"github.com/golang/glog"
+)
+
+// DefaultPort is the port STUN servers listen on
+const DefaultPort = 3478
+
+// Message types
+const (
+	BindingRequest  = 0x0001
+	BindingSuccess  = 0x0101
+	BindingError    = 0x0111
+	BindingIndicate = 0x0011
+)
+
+// Attributes
+const (
+	AttrMappedAddress     = 0x0001
+	AttrErrorCode         = 0x0009
+	AttrUnknownAttributes = 0x000a
+	AttrXORMappedAddress  = 0x0020
+	AttrSoftware          = 0x8022
+	AttrFingerprint       = 0x8028
+)
+
+// MagicCookie is in every RFC 5389 message
+const MagicCookie = 0x2112a442
+
+const (
+	headerLen      = 20
+	fingerprintXOR = 0x5354554e
+	software       = "nanofi"
+)
+
+// ErrNotSTUN is returned for packets that aren't STUN messages
+var ErrNotSTUN = errors.New("not a STUN message")
+
+// Message is a STUN message
+type Message struct {
+	Type          uint16
+	TransactionID [12]byte
+	Attributes    []Attribute
+}
+
+// Attribute is a single STUN attribute
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Decode parses a STUN message
+func Decode(b []byte) (*Message, error) {
+	if len(b) < headerLen || b[0]&0xc0 != 0 {
+		return nil, ErrNotSTUN
+	}
+	if binary.BigEndian.Uint32(b[4:8]) != MagicCookie {
+		return nil, fmt.Errorf("%w: no magic cookie", ErrNotSTUN)
+	}
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if n%4 != 0 || len(b) < headerLen+n {
+		return nil, fmt.Errorf("%w: bad length %d", ErrNotSTUN, n)
+	}
+
+	m := &Message{Type: binary.BigEndian.Uint16(b[0:2])}
+	copy(m.TransactionID[:], b[8:20])
+
+	attrs := b[headerLen : headerLen+n]
+	for len(attrs) > 0 {
+		if len(attrs) < 4 {
+			return nil, fmt.Errorf("%w: truncated attribute", ErrNotSTUN)
+		}
+		t, l := binary.BigEndian.Uint16(attrs[0:2]), int(binary.BigEndian.Uint16(attrs[2:4]))
+		padded := (l + 3) &^ 3
+		if len(attrs) < 4+padded {
+			return nil, fmt.Errorf("%w: attribute 0x%04x truncated", ErrNotSTUN, t)
+		}
+		m.Attributes = append(m.Attributes, Attribute{Type: t, Value: attrs[4 : 4+l]})
+		attrs = attrs[4+padded:]
+	}
+
+	return m, nil
+}
+
+// Encode serializes the message, adding a fingerprint if fingerprint is set
+func (m *Message) Encode(fingerprint bool) []byte {
+	b := make([]byte, headerLen, 128)
+	binary.BigEndian.PutUint16(b[0:2], m.Type)
+	binary.BigEndian.PutUint32(b[4:8], MagicCookie)
+	copy(b[8:20], m.TransactionID[:])
+
+	for _, a := range m.Attributes {
+		b = appendAttr(b, a.Type, a.Value)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen))
+
+	if fingerprint {
+		// the length covers the fingerprint before it's computed
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen+8))
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b)^fingerprintXOR)
+		b = appendAttr(b, AttrFingerprint, crc)
+	}
+	return b
+}
+
+func appendAttr(b []byte, t uint16, v []byte) []byte {
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint16(h[0:2], t)
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(v)))
+	b = append(b, h...)
+	b = append(b, v...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Get returns the first attribute of type t
+func (m *Message) Get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// XORAddress encodes addr as an XOR-MAPPED-ADDRESS value
+func XORAddress(addr *net.UDPAddr, txid [12]byte) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key[0:4], MagicCookie)
+	copy(key[4:], txid[:])
+
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	binary.BigEndian.PutUint16(v[2:4], uint16(addr.Port)^uint16(MagicCookie>>16))
+	for i := range ip {
+		v[4+i] = ip[i] ^ key[i]
+	}
+	return v
+}
+
+// ParseXORAddress decodes an XOR-MAPPED-ADDRESS value
+func ParseXORAddress(v []byte, txid [12]byte) (*net.UDPAddr, error) {
+	if len(v) != 8 && len(v) != 20 {
+		return nil, fmt.Errorf("bad XOR-MAPPED-ADDRESS length %d", len(v))
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key[0:4], MagicCookie)
+	copy(key[4:], txid[:])
+
+	ip := make(net.IP, len(v)-4)
+	for i := range ip {
+		ip[i] = v[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(v[2:4]) ^ uint16(MagicCookie>>16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func mappedAddress(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	binary.BigEndian.PutUint16(v[2:4], uint16(addr.Port))
+	copy(v[4:], ip)
+	return v
+}
+
+// Server answers STUN binding requests
+type Server struct {
+	// OnBinding is called with the source of every binding request answered
+	OnBinding func(from *net.UDPAddr)
+}
+
+// Handle returns the response to a request from from, or nil if there
+// should be none
+func (s *Server) Handle(b []byte, from *net.UDPAddr) []byte {
+	req, err := Decode(b)
+	if err != nil {
+		glog.V(2).Infof("stun: from %s: %s", from, err)
+		return nil
+	}
+	if req.Type != BindingRequest {
+		// indications get no response and we serve nothing else
+		return nil
+	}
+	_, fingerprint := req.Get(AttrFingerprint)
+
+	// attributes below 0x8000 must be understood, and a binding request
+	// needs none
+	var unknown []byte
+	for _, a := range req.Attributes {
+		if a.Type < 0x8000 {
+			unknown = append(unknown, byte(a.Type>>8), byte(a.Type))
+		}
+	}
+	if len(unknown) > 0 {
+		res := &Message{Type: BindingError, TransactionID: req.TransactionID}
+		res.Attributes = []Attribute{
+			{AttrErrorCode, append([]byte{0, 0, 4, 20}, "Unknown Attribute"...)},
+			{AttrUnknownAttributes, unknown},
+		}
+		return res.Encode(fingerprint)
+	}
+
+	if s.OnBinding != nil {
+		s.OnBinding(from)
+	}
+
+	res := &Message{Type: BindingSuccess, TransactionID: req.TransactionID}
+	res.Attributes = []Attribute{
+		{AttrXORMappedAddress, XORAddress(from, req.TransactionID)},
+		// for clients predating RFC 5389
+		{AttrMappedAddress, mappedAddress(from)},
+		{AttrSoftware, []byte(software)},
+	}
+	return res.Encode(fingerprint)
+}
+
+// ListenAndServe answers binding requests on addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, pc)
+}
+
+// Serve answers binding requests on pc until ctx is done
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn) error {
+	defer pc.Close()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		udp, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if res := s.Handle(buf[:n], udp); res != nil {
+			if _, err := pc.WriteTo(res, from); err != nil {
+				glog.Warningf("stun: could not answer %s: %s", from, err)
+			}
+		}
+	}
+}
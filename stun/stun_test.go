@@ -0,0 +1,114 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// transaction ID from the RFC 5769 test vectors
+var rfcTxID = [12]byte{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+
+func TestXORAddress(t *testing.T) {
+	// RFC 5769 2.2: 192.0.2.1 port 32853
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853}
+	v := XORAddress(addr, rfcTxID)
+	assert.Equal(t, []byte{0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43}, v)
+
+	back, err := ParseXORAddress(v, rfcTxID)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.1:32853", back.String())
+
+	// RFC 5769 2.3: 2001:db8:1234:5678:11:2233:4455:6677 port 32853
+	addr6 := &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853}
+	back, err = ParseXORAddress(XORAddress(addr6, rfcTxID), rfcTxID)
+	assert.Nil(t, err)
+	assert.True(t, addr6.IP.Equal(back.IP))
+}
+
+func TestHandleBinding(t *testing.T) {
+	var seen []string
+	s := &Server{OnBinding: func(from *net.UDPAddr) { seen = append(seen, from.String()) }}
+	from := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+
+	req := &Message{Type: BindingRequest, TransactionID: rfcTxID}
+	b := s.Handle(req.Encode(true), from)
+	res, err := Decode(b)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(BindingSuccess), res.Type)
+	assert.Equal(t, rfcTxID, res.TransactionID)
+	assert.Equal(t, []string{"203.0.113.7:40000"}, seen)
+
+	v, ok := res.Get(AttrXORMappedAddress)
+	assert.True(t, ok)
+	mapped, err := ParseXORAddress(v, res.TransactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, from.String(), mapped.String())
+
+	fp, ok := res.Get(AttrFingerprint)
+	assert.True(t, ok, "fingerprinted requests get fingerprinted responses")
+	want := crc32.ChecksumIEEE(b[:len(b)-8]) ^ fingerprintXOR
+	assert.Equal(t, want, binary.BigEndian.Uint32(fp))
+
+	auth := &Message{Type: BindingRequest, Attributes: []Attribute{{Type: 0x0006, Value: []byte("user")}}}
+	res, err = Decode(s.Handle(auth.Encode(false), from))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(BindingError), res.Type, "USERNAME isn't understood")
+	unknown, _ := res.Get(AttrUnknownAttributes)
+	assert.Equal(t, []byte{0x00, 0x06}, unknown)
+
+	assert.Nil(t, s.Handle([]byte("GET / HTTP/1.1\r\n\r\n"), from))
+	assert.Nil(t, s.Handle((&Message{Type: BindingIndicate}).Encode(false), from))
+	assert.Len(t, seen, 1)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	good := (&Message{Type: BindingRequest, Attributes: []Attribute{{AttrSoftware, []byte("x")}}}).Encode(false)
+
+	_, err := Decode(good[:10])
+	assert.True(t, errors.Is(err, ErrNotSTUN))
+	bad := append([]byte(nil), good...)
+	bad[4] = 0
+	_, err = Decode(bad)
+	assert.True(t, errors.Is(err, ErrNotSTUN))
+	_, err = Decode(good[:len(good)-4])
+	assert.True(t, errors.Is(err, ErrNotSTUN))
+
+	m, err := Decode(good)
+	assert.Nil(t, err)
+	v, _ := m.Get(AttrSoftware)
+	assert.Equal(t, "x", string(v), "padding is stripped")
+}
+
+func TestServe(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&Server{}).Serve(ctx, pc)
+
+	conn, err := net.Dial("udp4", pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	req := &Message{Type: BindingRequest, TransactionID: rfcTxID}
+	_, err = conn.Write(req.Encode(false))
+	assert.Nil(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	res, err := Decode(buf[:n])
+	assert.Nil(t, err)
+	v, _ := res.Get(AttrXORMappedAddress)
+	mapped, err := ParseXORAddress(v, rfcTxID)
+	assert.Nil(t, err)
+	assert.Equal(t, conn.LocalAddr().String(), mapped.String())
+}
@@ -0,0 +1,89 @@
+// Package syscfg renders the base system_cfg of each model of device: the
+// bridge and interfaces it's managed through, its DHCP client, login, SSH,
+// syslog and NTP. setparam replaces a device's whole system.cfg, so WLAN,
+// switch and management settings are layered onto this base with
+// props.Layer rather than sent alone.
+package syscfg
+
+import (
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/props"
+)
+
+// Bridge is the bridge devices are managed through
+const Bridge = "br0"
+
+// FactoryUser is the login devices keep unless management settings give
+// them another; its password is the factory default, ubnt
+const FactoryUser = "ubnt"
+
+// factoryPasswordHash is ubnt, as crypt(3) MD5
+const factoryPasswordHash = "$1$nanofi$YFDoT2nLEWCZ0DQ3MxWD51"
+
+// DefaultNTP is the NTP server devices use unless told otherwise
+const DefaultNTP = "0.ubnt.pool.ntp.org"
+
+// uplinks are the wired ports bridged for management by model, eth0 for
+// models not listed. Switches bridge their CPU port, eth0.
+var uplinks = map[string][]string{
+	"U7P":   {"eth0", "eth1"},
+	"U7PG2": {"eth0", "eth1"},
+	"U7HD":  {"eth0", "eth1"},
+}
+
+// Base returns the base system_cfg for dev's model
+func Base(dev device.Device) *props.Node {
+	n := props.New()
+
+	ports, ok := uplinks[dev.Model]
+	if !ok {
+		ports = []string{"eth0"}
+	}
+	br := n.Append("bridge")
+	br.Set("devname", Bridge)
+	br.Set("fd", "1")
+	br.SetEnabled("stp.status", false)
+	for _, port := range ports {
+		br.Append("port").Set("devname", port)
+	}
+	n.SetEnabled("bridge.status", true)
+
+	for _, port := range ports {
+		eth := n.Append("netconf")
+		eth.Set("devname", port)
+		eth.Set("ip", "0.0.0.0")
+		eth.SetEnabled("promisc", true)
+		eth.SetEnabled("up", true)
+		eth.SetEnabled("status", true)
+	}
+	mgmt := n.Append("netconf")
+	mgmt.Set("devname", Bridge)
+	mgmt.Set("ip", "0.0.0.0")
+	mgmt.SetEnabled("up", true)
+	mgmt.SetEnabled("status", true)
+	n.SetEnabled("netconf.status", true)
+
+	dhcpc := n.Append("dhcpc")
+	dhcpc.Set("devname", Bridge)
+	dhcpc.SetEnabled("status", true)
+	n.SetEnabled("dhcpc.status", true)
+
+	n.SetEnabled("resolv.status", true)
+
+	n.SetEnabled("sshd.status", true)
+	n.Set("sshd.port", "22")
+	user := n.Append("users")
+	user.Set("name", FactoryUser)
+	user.Set("password", factoryPasswordHash)
+	user.SetEnabled("status", true)
+	n.SetEnabled("users.status", true)
+
+	n.SetEnabled("syslog.status", true)
+	ntp := n.Append("ntpclient")
+	ntp.Set("server", DefaultNTP)
+	ntp.SetEnabled("status", true)
+	n.SetEnabled("ntpclient.status", true)
+
+	n.SetEnabled("unifi.status", true)
+	return n
+}
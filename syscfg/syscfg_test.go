@@ -0,0 +1,76 @@
+package syscfg
+
+import (
+	"testing"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/usw"
+	"github.com/jda/nanofi/wlan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBase(t *testing.T) {
+	tests := []struct {
+		model string
+		ports []string
+	}{
+		{"U7PG2", []string{"eth0", "eth1"}},
+		{"U7LT", []string{"eth0"}},
+	}
+	for _, tt := range tests {
+		n := Base(device.Device{Model: tt.model})
+		var ports []string
+		for _, p := range n.List("bridge.1.port") {
+			v, _ := p.Get("devname")
+			ports = append(ports, v)
+		}
+		assert.Equal(t, tt.ports, ports, tt.model)
+		v, _ := n.Get("dhcpc.1.devname")
+		assert.Equal(t, Bridge, v, tt.model)
+	}
+}
+
+func TestLayerWLAN(t *testing.T) {
+	n := Base(device.Device{Model: "U7PG2"})
+	w, err := wlan.Render(wlan.Config{WLANs: []wlan.WLAN{
+		{SSID: "lab", Security: wlan.WPA2, Passphrase: "hunter2222"},
+		{SSID: "guest", Security: wlan.Open, VLAN: 20},
+	}})
+	assert.Nil(t, err)
+	n.Layer(w)
+
+	get := func(key string) string {
+		v, ok := n.Get(key)
+		assert.True(t, ok, key)
+		return v
+	}
+	assert.Equal(t, Bridge, get("bridge.1.devname"), "the management bridge is kept")
+	assert.Equal(t, "eth0", get("bridge.1.port.1.devname"))
+	assert.Equal(t, "br0.20", get("bridge.2.devname"), "the WLAN's VLAN bridge is added")
+	assert.Equal(t, Bridge, get("netconf.3.devname"))
+	assert.Equal(t, "enabled", get("netconf.status"))
+	assert.Equal(t, FactoryUser, get("users.1.name"))
+	assert.Equal(t, "enabled", get("sshd.status"))
+	assert.Equal(t, "lab", get("aaa.1.ssid"))
+	assert.Equal(t, Bridge, get("aaa.1.br.devname"))
+}
+
+func TestLayerSwitch(t *testing.T) {
+	n := Base(device.Device{Model: "USMINI"})
+	sw, err := usw.Render(usw.Config{}, 5)
+	assert.Nil(t, err)
+	n.Layer(sw)
+
+	get := func(key string) string {
+		v, ok := n.Get(key)
+		assert.True(t, ok, key)
+		return v
+	}
+	assert.Equal(t, Bridge, get("bridge.1.devname"), "the management bridge is kept")
+	assert.Equal(t, "eth0", get("netconf.1.devname"))
+	assert.Equal(t, Bridge, get("netconf.2.devname"))
+	assert.Equal(t, Bridge, get("dhcpc.1.devname"))
+	assert.Equal(t, FactoryUser, get("users.1.name"))
+	assert.Equal(t, "enabled", get("switch.stp.status"))
+	assert.Len(t, n.List("switch.port"), 5)
+}
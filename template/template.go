@@ -0,0 +1,325 @@
+// Package template resolves device configuration through layers of
+// overrides: defaults for every device, then the device's site, then its
+// group, then the device itself. Each layer is a JSON object; objects are
+// merged key by key, anything else (strings, numbers, lists) replaces what
+// the layers below set, and null removes it. Every effective value
+// remembers which layer it came from and which layers it overrode.
+package template
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jda/nanofi/device"
+)
+
+// Level is where in the hierarchy a layer sits
+type Level string
+
+// Levels, lowest first
+const (
+	LevelDefault Level = "default"
+	LevelSite    Level = "site"
+	LevelGroup   Level = "group"
+	LevelDevice  Level = "device"
+)
+
+// Layer is one level's configuration
+type Layer map[string]interface{}
+
+// Templates are the layers devices' configuration is resolved from
+type Templates struct {
+	Default Layer            `json:"default,omitempty"`
+	Sites   map[string]Layer `json:"sites,omitempty"`
+	Groups  map[string]Layer `json:"groups,omitempty"`
+	// Devices are keyed by MAC
+	Devices map[string]Layer `json:"devices,omitempty"`
+	// SiteDevices and GroupDevices put devices, by MAC, in sites and
+	// groups
+	SiteDevices  map[string][]string `json:"site_devices,omitempty"`
+	GroupDevices map[string][]string `json:"group_devices,omitempty"`
+}
+
+// Parse reads templates from JSON, keeping numbers exactly as written
+func Parse(data []byte) (*Templates, error) {
+	var t Templates
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, err
+	}
+	if err := t.normalize(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// normalize keys Devices by normalized MAC and checks no device is put in
+// two sites or groups
+func (t *Templates) normalize() error {
+	for what, members := range map[string]map[string][]string{"site": t.SiteDevices, "group": t.GroupDevices} {
+		in := make(map[string]string)
+		for _, name := range sortedNames(members) {
+			for i, mac := range members[name] {
+				norm, err := device.NormalizeMAC(mac)
+				if err != nil {
+					return err
+				}
+				if other, ok := in[norm]; ok {
+					return fmt.Errorf("device %s is in %s %s and %s", norm, what, other, name)
+				}
+				in[norm] = name
+				members[name][i] = norm
+			}
+		}
+	}
+
+	devices := make(map[string]Layer, len(t.Devices))
+	for mac, l := range t.Devices {
+		norm, err := device.NormalizeMAC(mac)
+		if err != nil {
+			return err
+		}
+		if _, ok := devices[norm]; ok {
+			return fmt.Errorf("device %s is listed twice", norm)
+		}
+		devices[norm] = l
+	}
+	t.Devices = devices
+	return nil
+}
+
+// Set puts value at the dot separated path in the layer at level, creating
+// the layer and any objects on the way
+func (t *Templates) Set(level Level, name string, path string, value interface{}) error {
+	var l Layer
+	switch level {
+	case LevelDefault:
+		if t.Default == nil {
+			t.Default = make(Layer)
+		}
+		l = t.Default
+	case LevelSite:
+		l = layer(&t.Sites, name)
+	case LevelGroup:
+		l = layer(&t.Groups, name)
+	case LevelDevice:
+		mac, err := device.NormalizeMAC(name)
+		if err != nil {
+			return err
+		}
+		l = layer(&t.Devices, mac)
+	default:
+		return fmt.Errorf("unknown level %q", level)
+	}
+
+	keys := strings.Split(path, ".")
+	m := map[string]interface{}(l)
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = value
+	return nil
+}
+
+func sortedNames(m map[string][]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Place returns dev in the site and group the templates put it in, if they
+// name one
+func (t *Templates) Place(dev device.Device) device.Device {
+	mac, err := device.NormalizeMAC(dev.MAC)
+	if err != nil {
+		return dev
+	}
+	for site, macs := range t.SiteDevices {
+		for _, m := range macs {
+			if m == mac {
+				dev.Site = site
+			}
+		}
+	}
+	for group, macs := range t.GroupDevices {
+		for _, m := range macs {
+			if m == mac {
+				dev.Group = group
+			}
+		}
+	}
+	return dev
+}
+
+func layer(m *map[string]Layer, name string) Layer {
+	if *m == nil {
+		*m = make(map[string]Layer)
+	}
+	if (*m)[name] == nil {
+		(*m)[name] = make(Layer)
+	}
+	return (*m)[name]
+}
+
+// Source is the layer a value came from
+type Source struct {
+	Level Level  `json:"level"`
+	Name  string `json:"name,omitempty"`
+}
+
+func (s Source) String() string {
+	if s.Name == "" {
+		return string(s.Level)
+	}
+	return string(s.Level) + " " + s.Name
+}
+
+// Value is one effective value and where it came from
+type Value struct {
+	// Path is the dot separated path to the value
+	Path string `json:"path"`
+	// Value is nil for values a layer removed
+	Value  interface{} `json:"value"`
+	Source Source      `json:"source"`
+	// Overrides are the lower layers that set the path too
+	Overrides []Source `json:"overrides,omitempty"`
+}
+
+// Resolved is a device's effective configuration
+type Resolved struct {
+	config map[string]interface{}
+	values map[string]*Value
+}
+
+// Resolve merges the layers that apply to dev
+func (t *Templates) Resolve(dev device.Device) *Resolved {
+	r := &Resolved{config: make(map[string]interface{}), values: make(map[string]*Value)}
+	r.apply("", r.config, t.Default, Source{Level: LevelDefault})
+	if dev.Site != "" {
+		r.apply("", r.config, t.Sites[dev.Site], Source{Level: LevelSite, Name: dev.Site})
+	}
+	if dev.Group != "" {
+		r.apply("", r.config, t.Groups[dev.Group], Source{Level: LevelGroup, Name: dev.Group})
+	}
+	if mac, err := device.NormalizeMAC(dev.MAC); err == nil {
+		r.apply("", r.config, t.Devices[mac], Source{Level: LevelDevice, Name: mac})
+	}
+	return r
+}
+
+func join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// apply merges layer into dst, which is at prefix
+func (r *Resolved) apply(prefix string, dst map[string]interface{}, layer map[string]interface{}, src Source) {
+	for k, v := range layer {
+		path := join(prefix, k)
+		if v == nil {
+			delete(dst, k)
+			r.values[path] = &Value{Path: path, Source: src, Overrides: r.drop(path)}
+			continue
+		}
+
+		lv, lok := v.(map[string]interface{})
+		if dv, dok := dst[k].(map[string]interface{}); lok && dok {
+			r.apply(path, dv, lv, src)
+			continue
+		}
+
+		overrides := r.drop(path)
+		if lok {
+			obj := make(map[string]interface{}, len(lv))
+			dst[k] = obj
+			r.apply(path, obj, lv, src)
+			if len(lv) == 0 {
+				r.values[path] = &Value{Path: path, Value: obj, Source: src}
+			}
+			for _, val := range r.values {
+				if strings.HasPrefix(val.Path, path+".") || val.Path == path {
+					val.Overrides = overrides
+				}
+			}
+			continue
+		}
+		dst[k] = v
+		r.values[path] = &Value{Path: path, Value: v, Source: src, Overrides: overrides}
+	}
+}
+
+// drop forgets the values at and under path, returning the layers that
+// set them
+func (r *Resolved) drop(path string) []Source {
+	var paths []string
+	for p := range r.values {
+		if p == path || strings.HasPrefix(p, path+".") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var out []Source
+	seen := make(map[Source]bool)
+	for _, p := range paths {
+		v := r.values[p]
+		delete(r.values, p)
+		// a removal isn't a value to override
+		if v.Value == nil {
+			continue
+		}
+		for _, s := range append(v.Overrides, v.Source) {
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// Values returns every effective value, and every removed one, by path
+func (r *Resolved) Values() []Value {
+	out := make([]Value, 0, len(r.values))
+	for _, v := range r.values {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// Source returns the layer the value at path came from
+func (r *Resolved) Source(path string) (Source, bool) {
+	v, ok := r.values[path]
+	if !ok {
+		return Source{}, false
+	}
+	return v.Source, true
+}
+
+// Decode decodes the effective configuration into v, rejecting keys v
+// doesn't have
+func (r *Resolved) Decode(v interface{}) error {
+	data, err := json.Marshal(r.config)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
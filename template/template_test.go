@@ -0,0 +1,178 @@
+package template
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jda/nanofi/device"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTemplates = `{
+	"default": {
+		"mgmt": {"ntp": ["pool.ntp.org"], "timezone": "UTC", "leds": true},
+		"wlan": {"wlans": [{"ssid": "corp", "security": "wpa2", "passphrase": "hunter2222"}]}
+	},
+	"sites": {
+		"warehouse": {
+			"mgmt": {"timezone": "America/Chicago", "network": {"mode": "dhcp", "vlan": 10}}
+		}
+	},
+	"groups": {
+		"warehouse-aps": {
+			"mgmt": {"leds": false, "network": {"vlan": 20}},
+			"wlan": {"radios": [{"band": "5g", "channel": 36}]}
+		}
+	},
+	"devices": {
+		"FC-EC-DA-00-00-01": {
+			"mgmt": {"hostname": "ap-dock", "ntp": null, "network": {"mode": "static", "address": "10.0.20.5/24", "gateway": "10.0.20.1"}}
+		}
+	}
+}`
+
+func parse(t *testing.T) *Templates {
+	tpl, err := Parse([]byte(testTemplates))
+	assert.Nil(t, err)
+	return tpl
+}
+
+func values(r *Resolved) map[string]Value {
+	out := make(map[string]Value)
+	for _, v := range r.Values() {
+		out[v.Path] = v
+	}
+	return out
+}
+
+func TestResolve(t *testing.T) {
+	tpl := parse(t)
+	dev := device.Device{MAC: "fc:ec:da:00:00:01", Site: "warehouse", Group: "warehouse-aps"}
+	r := tpl.Resolve(dev)
+
+	var cfg struct {
+		Mgmt struct {
+			Hostname string   `json:"hostname"`
+			NTP      []string `json:"ntp"`
+			Timezone string   `json:"timezone"`
+			LEDs     bool     `json:"leds"`
+			Network  struct {
+				Mode    string `json:"mode"`
+				Address string `json:"address"`
+				Gateway string `json:"gateway"`
+				VLAN    int    `json:"vlan"`
+			} `json:"network"`
+		} `json:"mgmt"`
+		WLAN json.RawMessage `json:"wlan"`
+	}
+	assert.Nil(t, r.Decode(&cfg))
+	assert.Equal(t, "ap-dock", cfg.Mgmt.Hostname)
+	assert.Nil(t, cfg.Mgmt.NTP, "removed by the device")
+	assert.Equal(t, "America/Chicago", cfg.Mgmt.Timezone)
+	assert.False(t, cfg.Mgmt.LEDs)
+	assert.Equal(t, "static", cfg.Mgmt.Network.Mode)
+	assert.Equal(t, 20, cfg.Mgmt.Network.VLAN, "group overrides one key of the site's object")
+	assert.Contains(t, string(cfg.WLAN), `"corp"`)
+	assert.Contains(t, string(cfg.WLAN), `"channel":36`)
+
+	v := values(r)
+	assert.Equal(t, Source{LevelDevice, "fc:ec:da:00:00:01"}, v["mgmt.hostname"].Source)
+	assert.Empty(t, v["mgmt.hostname"].Overrides)
+	assert.Equal(t, Source{LevelSite, "warehouse"}, v["mgmt.timezone"].Source)
+	assert.Equal(t, []Source{{Level: LevelDefault}}, v["mgmt.timezone"].Overrides)
+	assert.Equal(t, Source{LevelGroup, "warehouse-aps"}, v["mgmt.network.vlan"].Source)
+	assert.Equal(t, []Source{{LevelSite, "warehouse"}}, v["mgmt.network.vlan"].Overrides)
+	assert.Equal(t, Source{LevelDevice, "fc:ec:da:00:00:01"}, v["mgmt.network.mode"].Source)
+	assert.Equal(t, Source{LevelSite, "warehouse"}, v["mgmt.network.vlan"].Overrides[0])
+	assert.Nil(t, v["mgmt.ntp"].Value)
+	assert.Equal(t, Source{LevelDevice, "fc:ec:da:00:00:01"}, v["mgmt.ntp"].Source)
+	assert.Equal(t, []Source{{Level: LevelDefault}}, v["mgmt.ntp"].Overrides)
+	assert.Equal(t, "device fc:ec:da:00:00:01", v["mgmt.ntp"].Source.String())
+
+	src, ok := r.Source("wlan.radios")
+	assert.True(t, ok)
+	assert.Equal(t, "group warehouse-aps", src.String())
+}
+
+func TestResolveLayersUntouched(t *testing.T) {
+	tpl := parse(t)
+	tpl.Resolve(device.Device{MAC: "fc:ec:da:00:00:01", Site: "warehouse", Group: "warehouse-aps"})
+
+	// merging must not have written the group's values into the site layer
+	other := tpl.Resolve(device.Device{MAC: "fc:ec:da:00:00:02", Site: "warehouse"})
+	v := values(other)
+	assert.Equal(t, json.Number("10"), v["mgmt.network.vlan"].Value)
+	assert.Equal(t, true, v["mgmt.leds"].Value)
+	assert.Equal(t, []interface{}{"pool.ntp.org"}, v["mgmt.ntp"].Value)
+	_, ok := v["mgmt.hostname"]
+	assert.False(t, ok)
+}
+
+func TestReplaceObject(t *testing.T) {
+	tpl, err := Parse([]byte(`{"default": {"a": 1}, "sites": {"s": {"a": {"b": 2, "c": 3}}}}`))
+	assert.Nil(t, err)
+	v := values(tpl.Resolve(device.Device{MAC: "fc:ec:da:00:00:01", Site: "s"}))
+	assert.Equal(t, []Source{{Level: LevelDefault}}, v["a.b"].Overrides)
+	assert.Equal(t, []Source{{Level: LevelDefault}}, v["a.c"].Overrides)
+	_, ok := v["a"]
+	assert.False(t, ok)
+}
+
+func TestSet(t *testing.T) {
+	tpl := &Templates{}
+	assert.Nil(t, tpl.Set(LevelDefault, "", "mgmt.timezone", "UTC"))
+	assert.Nil(t, tpl.Set(LevelDevice, "FC:EC:DA:00:00:01", "mgmt.hostname", "ap-1"))
+	assert.NotNil(t, tpl.Set(LevelDevice, "nope", "mgmt.hostname", "ap-1"))
+	assert.NotNil(t, tpl.Set("planet", "", "x", 1))
+
+	v := values(tpl.Resolve(device.Device{MAC: "fc:ec:da:00:00:01"}))
+	assert.Equal(t, "UTC", v["mgmt.timezone"].Value)
+	assert.Equal(t, "ap-1", v["mgmt.hostname"].Value)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"empty", `{}`, true},
+		{"bad mac", `{"devices": {"nope": {}}}`, false},
+		{"same mac twice", `{"devices": {"fc:ec:da:00:00:01": {}, "FC:EC:DA:00:00:01": {}}}`, false},
+		{"unknown level", `{"regions": {}}`, false},
+		{"layer not an object", `{"default": []}`, false},
+		{"members", `{"site_devices": {"a": ["fc:ec:da:00:00:01"]}, "group_devices": {"a": ["fc:ec:da:00:00:01"]}}`, true},
+		{"bad member", `{"site_devices": {"a": ["nope"]}}`, false},
+		{"two sites", `{"site_devices": {"a": ["fc:ec:da:00:00:01"], "b": ["FC:EC:DA:00:00:01"]}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			assert.Equal(t, tt.ok, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestDecodeUnknownField(t *testing.T) {
+	tpl, err := Parse([]byte(`{"default": {"mgmt": {"hostnme": "x"}}}`))
+	assert.Nil(t, err)
+	var cfg struct {
+		Mgmt struct {
+			Hostname string `json:"hostname"`
+		} `json:"mgmt"`
+	}
+	assert.NotNil(t, tpl.Resolve(device.Device{}).Decode(&cfg))
+}
+
+func TestPlace(t *testing.T) {
+	tpl, err := Parse([]byte(`{"site_devices": {"warehouse": ["FC:EC:DA:00:00:01"]}, "group_devices": {"warehouse-aps": ["fc:ec:da:00:00:01"]}}`))
+	assert.Nil(t, err)
+
+	dev := tpl.Place(device.Device{MAC: "fc:ec:da:00:00:01", Site: "office"})
+	assert.Equal(t, "warehouse", dev.Site)
+	assert.Equal(t, "warehouse-aps", dev.Group)
+
+	dev = tpl.Place(device.Device{MAC: "fc:ec:da:00:00:02", Site: "office"})
+	assert.Equal(t, "office", dev.Site, "unlisted devices keep their site")
+	assert.Equal(t, "", dev.Group)
+}
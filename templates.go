@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jda/nanofi/config"
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/template"
+)
+
+// loadTemplates reads the templates in path, or with no path builds them
+// from the WLAN, switch and management config files as defaults for every
+// device
+func loadTemplates(path string, wlanPath string, switchPath string, mgmtPath string) (*template.Templates, error) {
+	if path != "" {
+		if wlanPath != "" || switchPath != "" || mgmtPath != "" {
+			return nil, fmt.Errorf("-templates can't be used with -wlan-config, -switch-config or -mgmt-config")
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read templates: %w", err)
+		}
+		t, err := template.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse templates %s: %w", path, err)
+		}
+		return t, nil
+	}
+
+	t := &template.Templates{}
+	for key, path := range map[string]string{"wlan": wlanPath, "switch": switchPath} {
+		if path == "" {
+			continue
+		}
+		var v interface{}
+		if err := readJSON(path, &v); err != nil {
+			return nil, err
+		}
+		if err := t.Set(template.LevelDefault, "", key, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if mgmtPath != "" {
+		// the management config is itself default, site and device layers
+		var file struct {
+			Default interface{}            `json:"default"`
+			Sites   map[string]interface{} `json:"sites"`
+			Devices map[string]interface{} `json:"devices"`
+		}
+		if err := readJSON(mgmtPath, &file); err != nil {
+			return nil, err
+		}
+		if file.Default != nil {
+			if err := t.Set(template.LevelDefault, "", "mgmt", file.Default); err != nil {
+				return nil, fmt.Errorf("invalid management config %s: %w", mgmtPath, err)
+			}
+		}
+		for site, v := range file.Sites {
+			if err := t.Set(template.LevelSite, site, "mgmt", v); err != nil {
+				return nil, fmt.Errorf("invalid management config %s: %w", mgmtPath, err)
+			}
+		}
+		for mac, v := range file.Devices {
+			if err := t.Set(template.LevelDevice, mac, "mgmt", v); err != nil {
+				return nil, fmt.Errorf("invalid management config %s: %w", mgmtPath, err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// readJSON decodes the JSON in path into v, keeping numbers as written
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// place puts dev in the site and group the config templates name
+func (c *controller) place(dev device.Device) device.Device {
+	if c.provision == nil {
+		return dev
+	}
+	return c.provision.place(dev)
+}
+
+// checkTemplates checks each of t's layers, then the config t resolves for
+// every known device and every device t names, returning the first device
+// whose config is invalid. A bad layer is returned with no device.
+func checkTemplates(t *template.Templates, devices *device.Registry) (device.Device, error) {
+	if path, err := config.CheckLayers(t); err != nil {
+		return device.Device{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	known := make(map[string]device.Device)
+	for _, d := range devices.List() {
+		known[d.MAC] = t.Place(d)
+	}
+	for mac := range t.Devices {
+		if _, ok := known[mac]; !ok {
+			known[mac] = t.Place(device.Device{MAC: mac})
+		}
+	}
+
+	macs := make([]string, 0, len(known))
+	for mac := range known {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		if _, err := resolveConfig(t, known[mac]); err != nil {
+			return known[mac], err
+		}
+	}
+	return device.Device{}, nil
+}
+
+// placement names a device along with its site and group
+func placement(d device.Device) string {
+	s := d.MAC
+	if d.Site != "" {
+		s += ", site " + d.Site
+	}
+	if d.Group != "" {
+		s += ", group " + d.Group
+	}
+	return s
+}
+
+// explainConfig writes where each of the device's effective config values
+// came from
+func explainConfig(w io.Writer, devices *device.Registry, t *template.Templates, mac string) error {
+	dev, ok := devices.Get(mac)
+	if !ok {
+		norm, err := device.NormalizeMAC(mac)
+		if err != nil {
+			return err
+		}
+		dev = device.Device{MAC: norm}
+	}
+	dev = t.Place(dev)
+
+	fmt.Fprintf(w, "%s\n", placement(dev))
+	if !ok {
+		fmt.Fprintf(w, "(not seen yet)\n")
+	}
+	fmt.Fprintln(w)
+
+	r := t.Resolve(dev)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "PATH\tVALUE\tFROM\tOVERRIDES\n")
+	for _, v := range r.Values() {
+		value := "(removed)"
+		if v.Value != nil {
+			value = explainValue(v.Path, v.Value)
+		}
+		overrides := make([]string, len(v.Overrides))
+		for i, o := range v.Overrides {
+			overrides[i] = o.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Path, value, v.Source, strings.Join(overrides, ", "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var cfg config.Layer
+	err := r.Decode(&cfg)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(w, "\ninvalid: %s\n", err)
+	} else {
+		fmt.Fprintf(w, "\nvalid\n")
+	}
+	return nil
+}
+
+// explainValue renders v as JSON with secrets hidden
+func explainValue(path string, v interface{}) string {
+	if config.Secret(path[strings.LastIndexByte(path, '.')+1:]) {
+		return `"` + config.Redacted + `"`
+	}
+	data, err := json.Marshal(config.Redact(v))
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
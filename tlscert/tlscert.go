@@ -0,0 +1,192 @@
+// Package tlscert holds the certificate a TLS listener serves, so it can be
+// replaced without restarting, and creates a self-signed one for when none
+// has been configured.
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SelfSignedLifetime is how long self-signed certificates are valid for
+const SelfSignedLifetime = 10 * 365 * 24 * time.Hour
+
+// ErrNoClientCAs is returned for client CA files without any certificates
+var ErrNoClientCAs = errors.New("no certificates in client CA file")
+
+// Store is a certificate and key, and optionally CAs that client
+// certificates must be signed by, loaded from files
+type Store struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// New loads the certificate and key in certFile and keyFile, which may be
+// the same file. With a clientCAFile, clients must present a certificate
+// signed by one of the CAs in it.
+func New(certFile string, keyFile string, clientCAFile string) (*Store, error) {
+	s := &Store{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the files again. Connections already open keep the
+// certificate they were made with; if loading fails nothing changes.
+func (s *Store) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("could not parse certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if s.clientCAFile != "" {
+		data, err := ioutil.ReadFile(s.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read client CAs: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: %w", s.clientCAFile, ErrNoClientCAs)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert, s.clientCAs = &cert, pool
+	return nil
+}
+
+// Certificate returns the certificate being served
+func (s *Store) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// Config returns a TLS config for a listener serving whatever the store
+// holds at the time of each handshake
+func (s *Store) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.Certificate(), nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+			}
+			if s.clientCAs != nil {
+				c.ClientCAs = s.clientCAs
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+// Fingerprint is the SHA-256 fingerprint of cert, as browsers show it
+func Fingerprint(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// SelfSigned writes a self-signed certificate and key for hosts, which are
+// names or IP addresses, to path unless it exists already. It reports
+// whether it created one.
+func SelfSigned(path string, hosts []string) (bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, fmt.Errorf("could not generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, fmt.Errorf("could not generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "nanofi", Organization: []string{"nanofi self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SelfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return false, fmt.Errorf("could not create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, fmt.Errorf("could not encode key: %w", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	// the key is written whole or not at all, and only readable by us
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return false, fmt.Errorf("could not write certificate: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("could not write certificate: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("could not write certificate: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, fmt.Errorf("could not write certificate: %w", err)
+	}
+	return true, nil
+}
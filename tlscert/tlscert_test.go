@@ -0,0 +1,134 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tlscert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSelfSigned(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cert.pem")
+
+	created, err := SelfSigned(path, []string{"localhost", "192.168.1.1", ""})
+	assert.Nil(t, err)
+	assert.True(t, created)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "key is private")
+
+	s, err := New(path, path, "")
+	assert.Nil(t, err)
+	leaf := s.Certificate().Leaf
+	assert.Equal(t, []string{"localhost"}, leaf.DNSNames)
+	assert.True(t, leaf.IPAddresses[0].Equal(net.ParseIP("192.168.1.1")))
+	assert.Nil(t, leaf.VerifyHostname("192.168.1.1"))
+
+	before := Fingerprint(s.Certificate())
+	assert.Len(t, before, 95)
+	created, err = SelfSigned(path, []string{"localhost"})
+	assert.Nil(t, err)
+	assert.False(t, created, "kept from the first run")
+	assert.Nil(t, s.Reload())
+	assert.Equal(t, before, Fingerprint(s.Certificate()))
+}
+
+func TestReload(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cert.pem")
+
+	_, err := SelfSigned(path, []string{"localhost"})
+	assert.Nil(t, err)
+	s, err := New(path, path, "")
+	assert.Nil(t, err)
+	before := Fingerprint(s.Certificate())
+
+	assert.Nil(t, os.Remove(path))
+	assert.NotNil(t, s.Reload())
+	assert.Equal(t, before, Fingerprint(s.Certificate()), "kept after a failed reload")
+
+	_, err = SelfSigned(path, []string{"localhost"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Reload())
+	assert.NotEqual(t, before, Fingerprint(s.Certificate()))
+
+	c, err := s.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, s.Certificate().Certificate, c.Certificates[0].Certificate)
+	assert.Equal(t, tls.NoClientCert, c.ClientAuth)
+
+	_, err = New(filepath.Join(dir, "missing.pem"), path, "")
+	assert.NotNil(t, err)
+}
+
+func TestClientCA(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cert.pem")
+	ca := filepath.Join(dir, "ca.pem")
+
+	_, err := SelfSigned(path, []string{"localhost"})
+	assert.Nil(t, err)
+	_, err = SelfSigned(ca, []string{"ca"})
+	assert.Nil(t, err)
+	s, err := New(path, path, ca)
+	assert.Nil(t, err)
+
+	c, err := s.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, c.ClientAuth)
+	assert.Len(t, c.ClientCAs.Subjects(), 1)
+
+	empty := filepath.Join(dir, "empty.pem")
+	assert.Nil(t, ioutil.WriteFile(empty, []byte("nothing here\n"), 0644))
+	_, err = New(path, path, empty)
+	assert.True(t, errors.Is(err, ErrNoClientCAs))
+}
+
+func TestHandshake(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cert.pem")
+
+	_, err := SelfSigned(path, []string{"localhost"})
+	assert.Nil(t, err)
+	s, err := New(path, path, "")
+	assert.Nil(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", s.Config())
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate().Leaf)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	assert.Nil(t, err)
+	if conn != nil {
+		assert.Equal(t, Fingerprint(s.Certificate()), Fingerprint(&tls.Certificate{Certificate: [][]byte{conn.ConnectionState().PeerCertificates[0].Raw}}))
+		conn.Close()
+	}
+}
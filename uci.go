@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/jda/nanofi/config"
+)
+
+// convertUCI runs nanofi uci to-yaml|from-yaml <file>, writing the
+// converted config to w
+func convertUCI(w io.Writer, args []string) error {
+	if len(args) != 2 || (args[0] != "to-yaml" && args[0] != "from-yaml") {
+		return fmt.Errorf("usage: nanofi uci to-yaml|from-yaml <file>")
+	}
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return fmt.Errorf("could not read config: %w", err)
+	}
+
+	convert := config.UCIToYAML
+	if args[0] == "from-yaml" {
+		convert = config.YAMLToUCI
+	}
+	out, err := convert(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[1], err)
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,302 @@
+// Package uci reads and writes OpenWRT's UCI configuration syntax:
+//
+//	config nanofi 'main'
+//		option inform_url 'http://192.168.1.1:8080/inform'
+//		list ntp 'pool.ntp.org'
+//
+// Sections have a type and an optional name; anonymous sections are
+// told apart by their order. Options hold one value and lists several.
+// Values may be bare, 'single quoted' or "double quoted", and quoted parts
+// next to each other join, which is how single quotes are written:
+//
+//	option motd 'it'\''s'
+package uci
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ErrSyntax is returned for lines that aren't UCI
+var ErrSyntax = errors.New("invalid UCI")
+
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// File is a UCI configuration file
+type File struct {
+	// Package is the name given by a package line, if any
+	Package  string
+	Sections []*Section
+}
+
+// Section is a config section
+type Section struct {
+	Type string
+	// Name is empty for anonymous sections
+	Name    string
+	Options []*Option
+	// Line is where the section starts, or 0 if it wasn't parsed
+	Line int
+}
+
+// Option is an option or list in a section
+type Option struct {
+	Name   string
+	Values []string
+	// List is set for list options, which may hold any number of values
+	List bool
+	// Line is where the option was first set
+	Line int
+}
+
+// Value returns the option's value; lists return their first
+func (o *Option) Value() string {
+	if len(o.Values) == 0 {
+		return ""
+	}
+	return o.Values[0]
+}
+
+// ValidName reports whether s can name a section type, section or option
+func ValidName(s string) bool {
+	return nameRE.MatchString(s)
+}
+
+// Parse reads a UCI file
+func Parse(r io.Reader) (*File, error) {
+	f := &File{}
+	var cur *Section
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		words, err := split(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		case "package":
+			if len(words) != 2 {
+				return nil, fmt.Errorf("line %d: %w: package takes a name", n, ErrSyntax)
+			}
+			f.Package = words[1]
+		case "config":
+			if len(words) < 2 || len(words) > 3 {
+				return nil, fmt.Errorf("line %d: %w: config takes a type and an optional name", n, ErrSyntax)
+			}
+			cur = &Section{Type: words[1], Line: n}
+			if len(words) == 3 {
+				cur.Name = words[2]
+			}
+			if !ValidName(cur.Type) || (cur.Name != "" && !ValidName(cur.Name)) {
+				return nil, fmt.Errorf("line %d: %w: section types and names are letters, digits and _", n, ErrSyntax)
+			}
+			f.Sections = append(f.Sections, cur)
+		case "option", "list":
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: %w: %s outside a section", n, ErrSyntax, words[0])
+			}
+			if len(words) != 3 {
+				return nil, fmt.Errorf("line %d: %w: %s takes a name and a value", n, ErrSyntax, words[0])
+			}
+			if !ValidName(words[1]) {
+				return nil, fmt.Errorf("line %d: %w: option names are letters, digits and _", n, ErrSyntax)
+			}
+			if words[0] == "option" {
+				cur.set(words[1], words[2], n)
+			} else {
+				cur.add(words[1], words[2], n)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: %w: unknown statement %q", n, ErrSyntax, words[0])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read UCI: %w", err)
+	}
+	return f, nil
+}
+
+// ParseString reads a UCI file from s
+func ParseString(s string) (*File, error) {
+	return Parse(strings.NewReader(s))
+}
+
+// split breaks a line into words, unquoting them and dropping comments
+func split(line string) ([]string, error) {
+	var words []string
+	var b strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			if inWord {
+				words = append(words, b.String())
+				b.Reset()
+				inWord = false
+			}
+		case c == '#' && !inWord:
+			return words, nil
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrSyntax)
+			}
+			b.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				b.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrSyntax)
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			b.WriteByte(line[i])
+			inWord = true
+		default:
+			b.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, b.String())
+	}
+	return words, nil
+}
+
+// Add appends a new section
+func (f *File) Add(typ string, name string) *Section {
+	s := &Section{Type: typ, Name: name}
+	f.Sections = append(f.Sections, s)
+	return s
+}
+
+// Section returns the section called name
+func (f *File) Section(name string) *Section {
+	for _, s := range f.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// SectionsOf returns the sections of type typ in order
+func (f *File) SectionsOf(typ string) []*Section {
+	var out []*Section
+	for _, s := range f.Sections {
+		if s.Type == typ {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Option returns the option called name
+func (s *Section) Option(name string) *Option {
+	for _, o := range s.Options {
+		if o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// Get returns the value of option name
+func (s *Section) Get(name string) (string, bool) {
+	o := s.Option(name)
+	if o == nil || len(o.Values) == 0 {
+		return "", false
+	}
+	return o.Value(), true
+}
+
+// Set sets option name to value
+func (s *Section) Set(name string, value string) {
+	s.set(name, value, 0)
+}
+
+func (s *Section) set(name string, value string, line int) {
+	if o := s.Option(name); o != nil {
+		o.Values, o.List = []string{value}, false
+		return
+	}
+	s.Options = append(s.Options, &Option{Name: name, Values: []string{value}, Line: line})
+}
+
+// Add appends value to list name
+func (s *Section) Add(name string, value string) {
+	s.add(name, value, 0)
+}
+
+func (s *Section) add(name string, value string, line int) {
+	if o := s.Option(name); o != nil {
+		if !o.List {
+			o.Values = nil
+		}
+		o.Values, o.List = append(o.Values, value), true
+		return
+	}
+	s.Options = append(s.Options, &Option{Name: name, Values: []string{value}, List: true, Line: line})
+}
+
+// Delete removes option name
+func (s *Section) Delete(name string) {
+	for i, o := range s.Options {
+		if o.Name == name {
+			s.Options = append(s.Options[:i], s.Options[i+1:]...)
+			return
+		}
+	}
+}
+
+// quote single quotes v the way uci export does
+func quote(v string) string {
+	return "'" + strings.Replace(v, "'", `'\''`, -1) + "'"
+}
+
+// Render writes the file out the way uci export does
+func (f *File) Render() string {
+	var b strings.Builder
+	if f.Package != "" {
+		fmt.Fprintf(&b, "package %s\n\n", f.Package)
+	}
+	for i, s := range f.Sections {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString("config " + s.Type)
+		if s.Name != "" {
+			b.WriteString(" " + quote(s.Name))
+		}
+		b.WriteByte('\n')
+		for _, o := range s.Options {
+			kind := "option"
+			if o.List {
+				kind = "list"
+			}
+			for _, v := range o.Values {
+				fmt.Fprintf(&b, "\t%s %s %s\n", kind, o.Name, quote(v))
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package uci
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFile = `package nanofi
+
+# controller settings
+config nanofi 'main'
+	option inform_url 'http://192.168.1.1:8080/inform'
+	option storage /var/lib/nanofi   # trailing comment
+	list ntp 'pool.ntp.org'
+	list ntp "time.lab"
+
+config credential
+	option user admin
+	option password 'it'\''s "quoted"'
+
+config credential
+	option user "ubnt"
+	option password "say \"hi\" # not a comment"
+`
+
+func TestParse(t *testing.T) {
+	f, err := ParseString(testFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "nanofi", f.Package)
+	assert.Len(t, f.Sections, 3)
+
+	main := f.Section("main")
+	assert.Equal(t, "nanofi", main.Type)
+	assert.Equal(t, 4, main.Line)
+	v, ok := main.Get("storage")
+	assert.True(t, ok)
+	assert.Equal(t, "/var/lib/nanofi", v)
+	ntp := main.Option("ntp")
+	assert.True(t, ntp.List)
+	assert.Equal(t, []string{"pool.ntp.org", "time.lab"}, ntp.Values)
+	assert.Equal(t, 7, ntp.Line)
+
+	creds := f.SectionsOf("credential")
+	assert.Len(t, creds, 2)
+	assert.Equal(t, "", creds[0].Name)
+	v, _ = creds[0].Get("password")
+	assert.Equal(t, `it's "quoted"`, v)
+	v, _ = creds[1].Get("password")
+	assert.Equal(t, `say "hi" # not a comment`, v)
+
+	_, ok = main.Get("nope")
+	assert.False(t, ok)
+}
+
+func TestRoundTrip(t *testing.T) {
+	f, err := ParseString(testFile)
+	assert.Nil(t, err)
+	out := f.Render()
+	assert.Contains(t, out, "config nanofi 'main'\n\toption inform_url 'http://192.168.1.1:8080/inform'\n")
+	assert.Contains(t, out, "\tlist ntp 'pool.ntp.org'\n\tlist ntp 'time.lab'\n")
+	assert.Contains(t, out, `option password 'it'\''s "quoted"'`)
+
+	again, err := ParseString(out)
+	assert.Nil(t, err)
+	assert.Equal(t, out, again.Render())
+}
+
+func TestEdit(t *testing.T) {
+	f := &File{}
+	s := f.Add("site", "")
+	s.Set("name", "warehouse")
+	s.Set("name", "dock")
+	s.Add("device", "fc:ec:da:00:00:01")
+	s.Add("device", "fc:ec:da:00:00:02")
+	s.Set("timezone", "UTC")
+	s.Delete("timezone")
+
+	assert.Equal(t, "config site\n\toption name 'dock'\n\tlist device 'fc:ec:da:00:00:01'\n\tlist device 'fc:ec:da:00:00:02'\n", f.Render())
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"option outside section", "option a b\n"},
+		{"unterminated", "config a\n\toption b 'c\n"},
+		{"unknown statement", "config a\n\tvalue b c\n"},
+		{"bad section name", "config a 'b-c'\n"},
+		{"bad option name", "config a\n\toption b.c d\n"},
+		{"missing value", "config a\n\toption b\n"},
+		{"too many", "config a b c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseString(tt.data)
+			assert.True(t, errors.Is(err, ErrSyntax), "%v", err)
+		})
+	}
+}
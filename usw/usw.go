@@ -0,0 +1,335 @@
+// Package usw models the port configuration of UniFi switches: port
+// profiles assigned to ports, rendered into the switch's system_cfg, and
+// checked against the port_table switches report in their informs.
+package usw
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jda/nanofi/device"
+	"github.com/jda/nanofi/props"
+)
+
+// PoEMode is how a port powers what's plugged into it
+type PoEMode string
+
+// PoE modes
+const (
+	PoEAuto PoEMode = "auto"
+	PoEOff  PoEMode = "off"
+	// PoEPassive is 24V passive PoE
+	PoEPassive PoEMode = "pasv24"
+)
+
+// DefaultProfile is the profile of ports not assigned one
+const DefaultProfile = "default"
+
+// Profile is a port's configuration
+type Profile struct {
+	// NativeVLAN carries untagged traffic, 1 by default
+	NativeVLAN int `json:"native_vlan,omitempty"`
+	// TaggedVLANs are also carried, tagged
+	TaggedVLANs []int   `json:"tagged_vlans,omitempty"`
+	PoE         PoEMode `json:"poe,omitempty"`
+	// Isolation stops the port reaching other isolated ports
+	Isolation bool `json:"isolation,omitempty"`
+	// Speed forces a speed in Mbps; 0 autonegotiates
+	Speed int `json:"speed,omitempty"`
+	// HalfDuplex forces half duplex with Speed
+	HalfDuplex bool `json:"half_duplex,omitempty"`
+	// STPDisabled turns spanning tree off on the port
+	STPDisabled bool `json:"stp_disabled,omitempty"`
+	// STPEdge marks the port as an edge port that forwards immediately
+	STPEdge bool `json:"stp_edge,omitempty"`
+	// STPPriority is the port priority, 0-240 in steps of 16, 128 by default
+	STPPriority *int `json:"stp_priority,omitempty"`
+	// Disabled shuts the port down
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+func (p Profile) nativeVLAN() int {
+	if p.NativeVLAN == 0 {
+		return 1
+	}
+	return p.NativeVLAN
+}
+
+func (p Profile) poe() PoEMode {
+	if p.PoE == "" {
+		return PoEAuto
+	}
+	return p.PoE
+}
+
+// Mirror copies the traffic of Sources to Destination
+type Mirror struct {
+	Destination int   `json:"destination"`
+	Sources     []int `json:"sources"`
+}
+
+// Config is the port configuration of a switch
+type Config struct {
+	// Profiles by name; a profile named default applies to unassigned
+	// ports, which otherwise get the zero Profile
+	Profiles map[string]Profile `json:"profiles"`
+	// Ports assigns profiles to ports by number
+	Ports  map[int]string `json:"ports"`
+	Mirror *Mirror        `json:"mirror,omitempty"`
+}
+
+// Validate checks the profiles and port assignments
+func (c Config) Validate() error {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := c.Profiles[name].validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+
+	for port, name := range c.Ports {
+		if port < 1 {
+			return fmt.Errorf("port %d: ports number from 1", port)
+		}
+		if _, ok := c.Profiles[name]; !ok {
+			return fmt.Errorf("port %d: no profile %q", port, name)
+		}
+	}
+
+	if m := c.Mirror; m != nil {
+		if m.Destination < 1 || len(m.Sources) == 0 {
+			return fmt.Errorf("mirror needs a destination and sources")
+		}
+		for _, src := range m.Sources {
+			if src == m.Destination {
+				return fmt.Errorf("port %d can't mirror to itself", src)
+			}
+			if src < 1 {
+				return fmt.Errorf("mirror source %d: ports number from 1", src)
+			}
+		}
+	}
+	return nil
+}
+
+func (p Profile) validate() error {
+	if p.NativeVLAN < 0 || p.NativeVLAN > 4094 {
+		return fmt.Errorf("native VLAN %d out of range", p.NativeVLAN)
+	}
+	for _, v := range p.TaggedVLANs {
+		if v < 1 || v > 4094 {
+			return fmt.Errorf("tagged VLAN %d out of range", v)
+		}
+		if v == p.nativeVLAN() {
+			return fmt.Errorf("VLAN %d is both native and tagged", v)
+		}
+	}
+	switch p.PoE {
+	case "", PoEAuto, PoEOff, PoEPassive:
+	default:
+		return fmt.Errorf("unknown PoE mode %q", p.PoE)
+	}
+	switch p.Speed {
+	case 0:
+		if p.HalfDuplex {
+			return fmt.Errorf("half duplex needs a forced speed")
+		}
+	case 10, 100, 1000:
+		if p.HalfDuplex && p.Speed == 1000 {
+			return fmt.Errorf("gigabit is full duplex only")
+		}
+	default:
+		return fmt.Errorf("speed must be 10, 100 or 1000")
+	}
+	if pri := p.STPPriority; pri != nil && (*pri < 0 || *pri > 240 || *pri%16 != 0) {
+		return fmt.Errorf("STP priority must be 0-240 in steps of 16")
+	}
+	return nil
+}
+
+// checkPorts checks the ports c assigns and mirrors are among a switch's n
+func (c Config) checkPorts(n int) error {
+	ports := make([]int, 0, len(c.Ports))
+	for port := range c.Ports {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		if port > n {
+			return fmt.Errorf("port %d: the switch has %d ports", port, n)
+		}
+	}
+	if m := c.Mirror; m != nil {
+		if m.Destination > n {
+			return fmt.Errorf("mirror destination %d: the switch has %d ports", m.Destination, n)
+		}
+		for _, src := range m.Sources {
+			if src > n {
+				return fmt.Errorf("mirror source %d: the switch has %d ports", src, n)
+			}
+		}
+	}
+	return nil
+}
+
+// profile returns the profile for port
+func (c Config) profile(port int) Profile {
+	if name, ok := c.Ports[port]; ok {
+		return c.Profiles[name]
+	}
+	return c.Profiles[DefaultProfile]
+}
+
+// Render produces the system_cfg properties for a switch with n ports, to
+// be layered onto the base config for the switch. Ports the config assigns
+// or mirrors beyond n are refused. n of 0, for a switch that hasn't
+// reported its ports, covers just the ports the config names.
+func Render(c Config, n int) (*props.Node, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		if err := c.checkPorts(n); err != nil {
+			return nil, err
+		}
+	}
+	for port := range c.Ports {
+		if port > n {
+			n = port
+		}
+	}
+
+	out := props.New()
+	members := make(map[int]*vlanMembers)
+	for port := 1; port <= n; port++ {
+		p := c.profile(port)
+		renderPort(out, port, p)
+
+		native := p.nativeVLAN()
+		vlan(members, native).untagged = append(vlan(members, native).untagged, port)
+		for _, v := range p.TaggedVLANs {
+			vlan(members, v).tagged = append(vlan(members, v).tagged, port)
+		}
+	}
+
+	ids := make([]int, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		v := out.Append("switch.vlan")
+		v.Setf("id", "%d", id)
+		v.Set("untagged", joinPorts(members[id].untagged))
+		v.Set("tagged", joinPorts(members[id].tagged))
+	}
+	out.SetEnabled("switch.vlan.status", true)
+
+	if m := c.Mirror; m != nil {
+		out.SetEnabled("switch.mirror.status", true)
+		out.Setf("switch.mirror.dst_port", "%d", m.Destination)
+		out.Set("switch.mirror.src_ports", joinPorts(m.Sources))
+	} else {
+		out.SetEnabled("switch.mirror.status", false)
+	}
+	out.SetEnabled("switch.stp.status", true)
+
+	return out, nil
+}
+
+type vlanMembers struct {
+	untagged []int
+	tagged   []int
+}
+
+func vlan(m map[int]*vlanMembers, id int) *vlanMembers {
+	if m[id] == nil {
+		m[id] = &vlanMembers{}
+	}
+	return m[id]
+}
+
+func renderPort(out *props.Node, port int, p Profile) {
+	prefix := "switch.port." + strconv.Itoa(port) + "."
+	out.SetEnabled(prefix+"status", !p.Disabled)
+	out.Setf(prefix+"pvid", "%d", p.nativeVLAN())
+	out.Set(prefix+"poe", string(p.poe()))
+	out.SetEnabled(prefix+"isolation", p.Isolation)
+	if p.Speed == 0 {
+		out.SetEnabled(prefix+"autoneg", true)
+	} else {
+		out.SetEnabled(prefix+"autoneg", false)
+		out.Setf(prefix+"speed", "%d", p.Speed)
+		if p.HalfDuplex {
+			out.Set(prefix+"duplex", "half")
+		} else {
+			out.Set(prefix+"duplex", "full")
+		}
+	}
+	out.SetEnabled(prefix+"stp.status", !p.STPDisabled)
+	out.SetEnabled(prefix+"stp.edge", p.STPEdge)
+	priority := 128
+	if p.STPPriority != nil {
+		priority = *p.STPPriority
+	}
+	out.Setf(prefix+"stp.priority", "%d", priority)
+}
+
+func joinPorts(ports []int) string {
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, ",")
+}
+
+// Mismatch is a port whose reported state doesn't match its profile
+type Mismatch struct {
+	Port  int    `json:"port"`
+	Field string `json:"field"`
+	Want  string `json:"want"`
+	Got   string `json:"got"`
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("port %d %s: want %s, got %s", m.Port, m.Field, m.Want, m.Got)
+}
+
+// Check compares the port states a switch reported with c. Only what
+// port_table shows can be checked: whether the port is enabled, its PoE
+// mode, a forced speed and duplex on ports that are up, and spanning tree
+// being off.
+func Check(c Config, ports []device.Port) []Mismatch {
+	var out []Mismatch
+	add := func(port int, field string, want string, got string) {
+		out = append(out, Mismatch{Port: port, Field: field, Want: want, Got: got})
+	}
+
+	for _, rep := range ports {
+		p := c.profile(rep.Index)
+		if rep.Enabled == p.Disabled {
+			add(rep.Index, "enabled", strconv.FormatBool(!p.Disabled), strconv.FormatBool(rep.Enabled))
+		}
+		if rep.PoE && rep.PoEMode != string(p.poe()) {
+			add(rep.Index, "poe", string(p.poe()), rep.PoEMode)
+		}
+		if rep.Up && p.Speed != 0 {
+			if rep.Speed != p.Speed {
+				add(rep.Index, "speed", strconv.Itoa(p.Speed), strconv.Itoa(rep.Speed))
+			}
+			if rep.FullDuplex == p.HalfDuplex {
+				add(rep.Index, "full_duplex", strconv.FormatBool(!p.HalfDuplex), strconv.FormatBool(rep.FullDuplex))
+			}
+		}
+		if p.STPDisabled && rep.Up && rep.STPState != "disabled" && rep.STPState != "" {
+			add(rep.Index, "stp_state", "disabled", rep.STPState)
+		}
+	}
+	return out
+}
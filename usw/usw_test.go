@@ -0,0 +1,124 @@
+package usw
+
+import (
+	"testing"
+
+	"github.com/jda/nanofi/device"
+	"github.com/stretchr/testify/assert"
+)
+
+var priority = 32
+
+var testConfig = Config{
+	Profiles: map[string]Profile{
+		DefaultProfile: {},
+		"ap":           {NativeVLAN: 1, TaggedVLANs: []int{20, 30}, STPEdge: true},
+		"camera":       {NativeVLAN: 40, PoE: PoEPassive, Isolation: true, Speed: 100},
+		"uplink":       {TaggedVLANs: []int{20, 30, 40}, PoE: PoEOff, STPPriority: &priority},
+		"unused":       {Disabled: true, PoE: PoEOff, STPDisabled: true},
+	},
+	Ports:  map[int]string{1: "uplink", 2: "ap", 3: "ap", 5: "camera", 8: "unused"},
+	Mirror: &Mirror{Destination: 7, Sources: []int{5}},
+}
+
+func TestRender(t *testing.T) {
+	n, err := Render(testConfig, 8)
+	assert.Nil(t, err)
+	get := func(key string) string {
+		v, ok := n.Get(key)
+		assert.True(t, ok, key)
+		return v
+	}
+
+	assert.Equal(t, "off", get("switch.port.1.poe"))
+	assert.Equal(t, "32", get("switch.port.1.stp.priority"))
+	assert.Equal(t, "enabled", get("switch.port.2.stp.edge"))
+	assert.Equal(t, "auto", get("switch.port.4.poe"), "unassigned ports get the default")
+	assert.Equal(t, "40", get("switch.port.5.pvid"))
+	assert.Equal(t, "pasv24", get("switch.port.5.poe"))
+	assert.Equal(t, "disabled", get("switch.port.5.autoneg"))
+	assert.Equal(t, "100", get("switch.port.5.speed"))
+	assert.Equal(t, "full", get("switch.port.5.duplex"))
+	assert.Equal(t, "enabled", get("switch.port.5.isolation"))
+	assert.Equal(t, "disabled", get("switch.port.8.status"))
+	assert.Equal(t, "disabled", get("switch.port.8.stp.status"))
+
+	assert.Len(t, n.List("switch.vlan"), 4)
+	assert.Equal(t, "1", get("switch.vlan.1.id"))
+	assert.Equal(t, "1,2,3,4,6,7,8", get("switch.vlan.1.untagged"))
+	assert.Equal(t, "20", get("switch.vlan.2.id"))
+	assert.Equal(t, "1,2,3", get("switch.vlan.2.tagged"))
+	assert.Equal(t, "5", get("switch.vlan.4.untagged"))
+	assert.Equal(t, "1", get("switch.vlan.4.tagged"))
+
+	assert.Equal(t, "7", get("switch.mirror.dst_port"))
+	assert.Equal(t, "5", get("switch.mirror.src_ports"))
+
+	short, err := Render(Config{Profiles: map[string]Profile{"ap": {}}, Ports: map[int]string{3: "ap"}}, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, short.Child("switch.port.3"), "covers the ports named")
+	assert.Nil(t, short.Child("switch.port.4"))
+
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{"port", Config{Profiles: map[string]Profile{"ap": {}}, Ports: map[int]string{9: "ap"}}, "port 9: the switch has 8 ports"},
+		{"mirror destination", Config{Mirror: &Mirror{Destination: 10, Sources: []int{1}}}, "mirror destination 10: the switch has 8 ports"},
+		{"mirror source", Config{Mirror: &Mirror{Destination: 8, Sources: []int{1, 12}}}, "mirror source 12: the switch has 8 ports"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Render(tt.cfg, 8)
+			if assert.NotNil(t, err) {
+				assert.Equal(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	bad := 100
+	tests := []struct {
+		name string
+		p    Profile
+		err  string
+	}{
+		{"tagged native", Profile{NativeVLAN: 20, TaggedVLANs: []int{20}}, "both"},
+		{"tagged default native", Profile{TaggedVLANs: []int{1}}, "both"},
+		{"vlan range", Profile{TaggedVLANs: []int{4095}}, "range"},
+		{"poe", Profile{PoE: "on"}, "PoE"},
+		{"speed", Profile{Speed: 2500}, "speed"},
+		{"half auto", Profile{HalfDuplex: true}, "forced"},
+		{"half gig", Profile{Speed: 1000, HalfDuplex: true}, "gigabit"},
+		{"priority", Profile{STPPriority: &bad}, "priority"},
+	}
+	for _, tt := range tests {
+		err := Config{Profiles: map[string]Profile{"p": tt.p}}.Validate()
+		if assert.NotNil(t, err, tt.name) {
+			assert.Contains(t, err.Error(), tt.err, tt.name)
+		}
+	}
+
+	assert.NotNil(t, Config{Ports: map[int]string{1: "missing"}}.Validate())
+	assert.NotNil(t, Config{Profiles: map[string]Profile{"p": {}}, Ports: map[int]string{0: "p"}}.Validate())
+	assert.NotNil(t, Config{Mirror: &Mirror{Destination: 1, Sources: []int{1}}}.Validate())
+	assert.Nil(t, testConfig.Validate())
+}
+
+func TestCheck(t *testing.T) {
+	ports := []device.Port{
+		{Index: 1, Enabled: true, Up: true, Speed: 1000, FullDuplex: true, PoE: true, PoEMode: "off", STPState: "forwarding"},
+		{Index: 2, Enabled: true, Up: true, Speed: 1000, FullDuplex: true},
+		{Index: 4, Enabled: true, PoE: true, PoEMode: "auto"},
+		{Index: 5, Enabled: true, Up: true, Speed: 1000, FullDuplex: true, PoE: true, PoEMode: "auto"},
+		{Index: 8, Enabled: true, Up: true, Speed: 100, FullDuplex: true, PoE: true, PoEMode: "off", STPState: "forwarding"},
+	}
+	assert.Equal(t, []Mismatch{
+		{Port: 5, Field: "poe", Want: "pasv24", Got: "auto"},
+		{Port: 5, Field: "speed", Want: "100", Got: "1000"},
+		{Port: 8, Field: "enabled", Want: "false", Got: "true"},
+		{Port: 8, Field: "stp_state", Want: "disabled", Got: "forwarding"},
+	}, Check(testConfig, ports))
+	assert.Equal(t, "port 5 poe: want pasv24, got auto", Check(testConfig, ports)[0].String())
+}
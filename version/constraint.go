@@ -0,0 +1,160 @@
+package version
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint is a version range such as "< 4.3.28", "6.x" or
+// ">= 4.0, < 5 || 6.x". Comma separated terms must all match; groups
+// separated by || are alternatives.
+//
+// Terms only compare the components they spell out, so "< 4.3.28"
+// matches 4.3.27.11000 but not 4.3.28.11361.
+type Constraint struct {
+	raw    string
+	groups [][]term
+}
+
+type term struct {
+	op    string
+	v     Version
+	parts int
+}
+
+var operators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+// ParseConstraint parses a version constraint
+func ParseConstraint(s string) (*Constraint, error) {
+	c := &Constraint{raw: strings.TrimSpace(s)}
+	if c.raw == "" {
+		return nil, fmt.Errorf("%w: empty constraint", ErrInvalid)
+	}
+
+	for _, alt := range strings.Split(c.raw, "||") {
+		var group []term
+		for _, t := range strings.Split(alt, ",") {
+			parsed, err := parseTerm(strings.TrimSpace(t))
+			if err != nil {
+				return nil, fmt.Errorf("constraint %q: %w", c.raw, err)
+			}
+			group = append(group, parsed)
+		}
+		c.groups = append(c.groups, group)
+	}
+
+	return c, nil
+}
+
+// MustParseConstraint is like ParseConstraint but panics on invalid input
+func MustParseConstraint(s string) *Constraint {
+	c, err := ParseConstraint(s)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func parseTerm(s string) (t term, err error) {
+	t.op = "="
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			t.op = op
+			s = strings.TrimSpace(s[len(op):])
+			break
+		}
+	}
+	if t.op == "==" {
+		t.op = "="
+	}
+
+	// wildcards: 6.x, 4.3.*
+	fields := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	for i, f := range fields {
+		if f == "x" || f == "X" || f == "*" {
+			if i != len(fields)-1 || (t.op != "=" && t.op != "!=") {
+				return t, fmt.Errorf("%w: wildcard only allowed last with = or !=: %q", ErrInvalid, s)
+			}
+			fields = fields[:i]
+			break
+		}
+	}
+	if len(fields) == 0 {
+		return t, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+
+	t.v, err = Parse(strings.Join(fields, "."))
+	if err != nil {
+		return t, err
+	}
+	t.parts = t.v.Parts
+
+	return t, nil
+}
+
+// Match reports whether v satisfies the constraint
+func (c *Constraint) Match(v Version) bool {
+	for _, group := range c.groups {
+		ok := true
+		for _, t := range group {
+			if !t.match(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchString parses s and reports whether it satisfies the constraint.
+// Unparseable versions never match.
+func (c *Constraint) MatchString(s string) bool {
+	v, err := Parse(s)
+	if err != nil {
+		return false
+	}
+	return c.Match(v)
+}
+
+// String returns the constraint as it was written
+func (c *Constraint) String() string {
+	return c.raw
+}
+
+func (t term) match(v Version) bool {
+	cmp := compareN(v, t.v, t.parts)
+	switch t.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (c *Constraint) MarshalText() ([]byte, error) {
+	return []byte(c.raw), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so constraints can be
+// used directly in config files
+func (c *Constraint) UnmarshalText(b []byte) error {
+	parsed, err := ParseConstraint(string(b))
+	if err != nil {
+		return err
+	}
+	*c = *parsed
+	return nil
+}
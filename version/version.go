@@ -0,0 +1,137 @@
+// Package version parses and compares UniFi firmware versions as they
+// appear in inform payloads, firmware headers and the firmware feed:
+//
+//	4.3.20.11298
+//	v4.0.80.10875-ge9ea0aa
+//	v4.3.28+11361.210526.1345
+//	1.6.1.525 (with the trailing space some firmware sends)
+//
+// Versions order by major, minor, patch and build number. Git suffixes
+// and build dates are kept but never affect ordering.
+package version
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is returned when a string is not a firmware version
+var ErrInvalid = errors.New("invalid firmware version")
+
+// Version is a parsed firmware version
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+	Build int
+	// Parts is how many numeric components were given, 1 to 4
+	Parts int
+	// Suffix is any trailing git describe suffix, e.g. ge9ea0aa
+	Suffix string
+	// BuildDate is any trailing build stamp, e.g. 210526.1345
+	BuildDate string
+}
+
+// Parse parses a firmware version string
+func Parse(s string) (v Version, err error) {
+	raw := s
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.Suffix = s[i+1:]
+		s = s[:i]
+	}
+	s = strings.Replace(s, "+", ".", 1)
+
+	fields := strings.Split(s, ".")
+	if len(fields) > 4 {
+		v.BuildDate = strings.Join(fields[4:], ".")
+		fields = fields[:4]
+	}
+
+	nums := []*int{&v.Major, &v.Minor, &v.Patch, &v.Build}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalid, raw)
+		}
+		*nums[i] = n
+	}
+	v.Parts = len(fields)
+
+	return v, nil
+}
+
+// MustParse is like Parse but panics on invalid input; for constants
+func MustParse(s string) Version {
+	v, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// String returns the version in the dotted form devices report
+func (v Version) String() string {
+	nums := []int{v.Major, v.Minor, v.Patch, v.Build}
+	parts := v.Parts
+	if parts == 0 {
+		parts = 4
+	}
+
+	out := make([]string, parts)
+	for i := range out {
+		out[i] = strconv.Itoa(nums[i])
+	}
+	return strings.Join(out, ".")
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as, or newer
+// than o. Missing components count as zero.
+func (v Version) Compare(o Version) int {
+	return compareN(v, o, 4)
+}
+
+// Less reports whether v is older than o
+func (v Version) Less(o Version) bool {
+	return v.Compare(o) < 0
+}
+
+// Equal reports whether v and o are the same release
+func (v Version) Equal(o Version) bool {
+	return v.Compare(o) == 0
+}
+
+// compareN compares the first n numeric components of v and o
+func compareN(v Version, o Version, n int) int {
+	a := []int{v.Major, v.Minor, v.Patch, v.Build}
+	b := []int{o.Major, o.Minor, o.Patch, o.Build}
+	for i := 0; i < n && i < 4; i++ {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Compare parses and compares two version strings, see Version.Compare.
+// Unparseable versions sort before all valid ones.
+func Compare(a string, b string) int {
+	va, aerr := Parse(a)
+	vb, berr := Parse(b)
+	switch {
+	case aerr != nil && berr != nil:
+		return strings.Compare(a, b)
+	case aerr != nil:
+		return -1
+	case berr != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
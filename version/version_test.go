@@ -0,0 +1,114 @@
+package version
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	test := []struct {
+		In   string
+		Want Version
+	}{
+		// version and required_version fields from the captured inform payloads
+		{"1.6.1.525 ", Version{Major: 1, Minor: 6, Patch: 1, Build: 525, Parts: 4}},
+		{"3.9.54.9373", Version{Major: 3, Minor: 9, Patch: 54, Build: 9373, Parts: 4}},
+		{"4.0.42.10433", Version{Major: 4, Minor: 0, Patch: 42, Build: 10433, Parts: 4}},
+		{"3.7.16", Version{Major: 3, Minor: 7, Patch: 16, Parts: 3}},
+		{"1.2.1", Version{Major: 1, Minor: 2, Patch: 1, Parts: 3}},
+		{"0.0.1", Version{Major: 0, Minor: 0, Patch: 1, Parts: 3}},
+		// other forms devices and the firmware feed use
+		{"4.3.20.11298", Version{Major: 4, Minor: 3, Patch: 20, Build: 11298, Parts: 4}},
+		{"6.5.28.14491", Version{Major: 6, Minor: 5, Patch: 28, Build: 14491, Parts: 4}},
+		{"v4.0.80.10875-ge9ea0aa", Version{Major: 4, Minor: 0, Patch: 80, Build: 10875, Parts: 4, Suffix: "ge9ea0aa"}},
+		{"v4.3.28+11361.210526.1345", Version{Major: 4, Minor: 3, Patch: 28, Build: 11361, Parts: 4, BuildDate: "210526.1345"}},
+		{"6", Version{Major: 6, Parts: 1}},
+	}
+
+	for _, tc := range test {
+		have, err := Parse(tc.In)
+		assert.Nil(t, err, tc.In)
+		assert.Equal(t, tc.Want, have, tc.In)
+	}
+
+	for _, bad := range []string{"", "v", "4.3.x", "four", "4..3", "1.2.3.a"} {
+		_, err := Parse(bad)
+		assert.True(t, errors.Is(err, ErrInvalid), "%q should not parse", bad)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "4.0.80.10875", MustParse("v4.0.80.10875-ge9ea0aa").String())
+	assert.Equal(t, "3.7.16", MustParse("3.7.16").String())
+	assert.Equal(t, "1.6.1.525", MustParse("1.6.1.525 ").String())
+}
+
+func TestCompare(t *testing.T) {
+	test := []struct {
+		A, B string
+		Want int
+	}{
+		{"4.3.20.11298", "4.3.28.11361", -1},
+		{"6.5.28.14491", "4.3.28.11361", 1},
+		{"4.0.42.10433", "4.0.42.10433", 0},
+		{"v4.0.80.10875-ge9ea0aa", "4.0.80.10875", 0},
+		{"4.0.80.10875", "4.0.80.10876", -1},
+		{"4.3.28", "4.3.28.11361", -1},
+		{"10.0.0.1", "9.9.9.9", 1},
+		{"1.6.1.525 ", "1.6.1.525", 0},
+		{"garbage", "1.0.0", -1},
+	}
+
+	for _, tc := range test {
+		assert.Equal(t, tc.Want, Compare(tc.A, tc.B), "%s vs %s", tc.A, tc.B)
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	test := []struct {
+		Constraint string
+		Version    string
+		Want       bool
+	}{
+		{"< 4.3.28", "4.3.20.11298", true},
+		{"< 4.3.28", "4.3.28.11361", false},
+		{"< 4.3.28", "6.5.28.14491", false},
+		{"<= 4.3.28", "4.3.28.11361", true},
+		{"6.x", "6.5.28.14491", true},
+		{"6.x", "4.3.28.11361", false},
+		{"4.3.*", "4.3.20.11298", true},
+		{"!= 4.x", "6.5.28.14491", true},
+		{">= 4.0, < 5", "4.3.28.11361", true},
+		{">= 4.0, < 5", "5.0.1.1", false},
+		{"< 4 || 6.x", "3.9.54.9373", true},
+		{"< 4 || 6.x", "4.0.42.10433", false},
+		{"< 4 || 6.x", "6.0.0.1", true},
+		{"4.0.80.10875", "v4.0.80.10875-ge9ea0aa", true},
+		{"== 1.6.1.525", "1.6.1.525 ", true},
+		{">= 3.7.16", "3.9.54.9373", true},
+		{"> 1.2.1", "1.6.1.525", true},
+		{"< 4.3.28", "not a version", false},
+	}
+
+	for _, tc := range test {
+		c, err := ParseConstraint(tc.Constraint)
+		assert.Nil(t, err, tc.Constraint)
+		assert.Equal(t, tc.Want, c.MatchString(tc.Version), "%s %s", tc.Constraint, tc.Version)
+	}
+
+	for _, bad := range []string{"", "< 6.x", "4.x.1", "<", ">= 4.0, "} {
+		_, err := ParseConstraint(bad)
+		assert.NotNil(t, err, "%q should not parse", bad)
+	}
+}
+
+func TestConstraintText(t *testing.T) {
+	var c Constraint
+	assert.Nil(t, c.UnmarshalText([]byte(">= 4.0, < 5")))
+	assert.True(t, c.MatchString("4.3.28.11361"))
+	b, err := c.MarshalText()
+	assert.Nil(t, err)
+	assert.Equal(t, ">= 4.0, < 5", string(b))
+}
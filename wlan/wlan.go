@@ -0,0 +1,361 @@
+// Package wlan models the wireless networks and radio settings of an access
+// point and renders them into the system_cfg UniFi access points take.
+package wlan
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/jda/nanofi/props"
+)
+
+// Security is how clients authenticate to a WLAN
+type Security string
+
+// Security modes
+const (
+	Open Security = "open"
+	WPA2 Security = "wpa2"
+	WPA3 Security = "wpa3"
+	// WPA2WPA3 accepts clients using either
+	WPA2WPA3 Security = "wpa2-wpa3"
+)
+
+// Band is a radio band
+type Band string
+
+// Bands
+const (
+	Band2G   Band = "2g"
+	Band5G   Band = "5g"
+	BandBoth Band = "both"
+)
+
+// TxPower levels; a number of dBm is also accepted
+const (
+	TxPowerAuto   = "auto"
+	TxPowerLow    = "low"
+	TxPowerMedium = "medium"
+	TxPowerHigh   = "high"
+)
+
+// maxPerRadio is how many WLANs a radio can serve
+const maxPerRadio = 8
+
+// phys are the radio devices serving each band
+var phys = map[Band]string{Band2G: "wifi0", Band5G: "wifi1"}
+
+// WLAN is a wireless network
+type WLAN struct {
+	SSID       string   `json:"ssid"`
+	Security   Security `json:"security"`
+	Passphrase string   `json:"passphrase,omitempty"`
+	Hidden     bool     `json:"hidden,omitempty"`
+	// VLAN tags the WLAN's traffic; 0 leaves it untagged
+	VLAN int `json:"vlan,omitempty"`
+	// Band the WLAN is served on, both by default
+	Band Band `json:"band,omitempty"`
+	// Isolation stops clients of the WLAN reaching each other
+	Isolation bool `json:"client_isolation,omitempty"`
+	// RateLimitDown and RateLimitUp cap each client in kbps; 0 is unlimited
+	RateLimitDown int `json:"rate_limit_down,omitempty"`
+	RateLimitUp   int `json:"rate_limit_up,omitempty"`
+}
+
+// bands returns the bands the WLAN is served on
+func (w WLAN) bands() []Band {
+	switch w.Band {
+	case Band2G, Band5G:
+		return []Band{w.Band}
+	}
+	return []Band{Band2G, Band5G}
+}
+
+// Radio is the settings for one of an access point's radios
+type Radio struct {
+	Band Band `json:"band"`
+	// Channel to use; 0 picks automatically
+	Channel int `json:"channel,omitempty"`
+	// Width is the channel width in MHz, 20 on 2g and 80 on 5g by default
+	Width int `json:"width,omitempty"`
+	// TxPower is auto, low, medium, high or a number of dBm
+	TxPower string `json:"tx_power,omitempty"`
+	// MinRSSI disconnects clients weaker than this many dBm; 0 disables it
+	MinRSSI int `json:"min_rssi,omitempty"`
+}
+
+// Config is the wireless configuration of an access point
+type Config struct {
+	WLANs  []WLAN  `json:"wlans"`
+	Radios []Radio `json:"radios,omitempty"`
+}
+
+// Validate checks every WLAN and radio setting
+func (c Config) Validate() error {
+	perBand := make(map[Band]int)
+	ssids := make(map[Band]map[string]bool)
+	for i, w := range c.WLANs {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("wlan %d (%s): %w", i+1, w.SSID, err)
+		}
+		for _, b := range w.bands() {
+			if ssids[b] == nil {
+				ssids[b] = make(map[string]bool)
+			}
+			if ssids[b][w.SSID] {
+				return fmt.Errorf("wlan %d: SSID %q is already on %s", i+1, w.SSID, b)
+			}
+			ssids[b][w.SSID] = true
+			if perBand[b]++; perBand[b] > maxPerRadio {
+				return fmt.Errorf("more than %d WLANs on %s", maxPerRadio, b)
+			}
+		}
+	}
+
+	seen := make(map[Band]bool)
+	for _, r := range c.Radios {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("radio %s: %w", r.Band, err)
+		}
+		if seen[r.Band] {
+			return fmt.Errorf("radio %s is configured twice", r.Band)
+		}
+		seen[r.Band] = true
+	}
+	return nil
+}
+
+func (w WLAN) validate() error {
+	if len(w.SSID) == 0 || len(w.SSID) > 32 {
+		return fmt.Errorf("SSID must be 1-32 bytes")
+	}
+	switch w.Security {
+	case Open:
+		if w.Passphrase != "" {
+			return fmt.Errorf("open WLANs don't take a passphrase")
+		}
+	case WPA2, WPA3, WPA2WPA3:
+		if !validPassphrase(w.Passphrase) {
+			return fmt.Errorf("passphrase must be 8-63 characters or 64 hex digits")
+		}
+	default:
+		return fmt.Errorf("unknown security %q", w.Security)
+	}
+	switch w.Band {
+	case "", Band2G, Band5G, BandBoth:
+	default:
+		return fmt.Errorf("unknown band %q", w.Band)
+	}
+	if w.VLAN < 0 || w.VLAN > 4094 {
+		return fmt.Errorf("VLAN %d out of range", w.VLAN)
+	}
+	if w.RateLimitDown < 0 || w.RateLimitUp < 0 {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	return nil
+}
+
+func validPassphrase(p string) bool {
+	if len(p) == 64 {
+		_, err := hex.DecodeString(p)
+		return err == nil
+	}
+	if len(p) < 8 || len(p) > 63 {
+		return false
+	}
+	for _, c := range p {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Radio) validate() error {
+	switch r.Band {
+	case Band2G:
+		if r.Channel < 0 || r.Channel > 14 {
+			return fmt.Errorf("channel %d isn't a 2.4GHz channel", r.Channel)
+		}
+		if r.Width != 0 && r.Width != 20 && r.Width != 40 {
+			return fmt.Errorf("width must be 20 or 40 on 2.4GHz")
+		}
+	case Band5G:
+		if r.Channel != 0 && !valid5G(r.Channel) {
+			return fmt.Errorf("channel %d isn't a 5GHz channel", r.Channel)
+		}
+		switch r.Width {
+		case 0, 20, 40, 80, 160:
+		default:
+			return fmt.Errorf("width must be 20, 40, 80 or 160 on 5GHz")
+		}
+	default:
+		return fmt.Errorf("radios are 2g or 5g")
+	}
+
+	switch r.TxPower {
+	case "", TxPowerAuto, TxPowerLow, TxPowerMedium, TxPowerHigh:
+	default:
+		dbm, err := strconv.Atoi(r.TxPower)
+		if err != nil || dbm < 1 || dbm > 30 {
+			return fmt.Errorf("tx power must be auto, low, medium, high or 1-30 dBm")
+		}
+	}
+	if r.MinRSSI != 0 && (r.MinRSSI < -94 || r.MinRSSI > -40) {
+		return fmt.Errorf("min RSSI must be between -94 and -40 dBm")
+	}
+	return nil
+}
+
+func valid5G(ch int) bool {
+	switch {
+	case ch >= 36 && ch <= 64, ch >= 100 && ch <= 144:
+		return ch%4 == 0
+	case ch >= 149 && ch <= 165:
+		return (ch-149)%4 == 0
+	}
+	return false
+}
+
+// Render produces the system_cfg properties for c, to be layered onto the
+// base config for the device
+func Render(c Config) (*props.Node, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	n := props.New()
+
+	radios := map[Band]Radio{Band2G: {Band: Band2G}, Band5G: {Band: Band5G}}
+	for _, r := range c.Radios {
+		radios[r.Band] = r
+	}
+	for _, b := range []Band{Band2G, Band5G} {
+		renderRadio(n.Append("radio"), radios[b])
+	}
+	n.SetEnabled("radio.status", true)
+
+	vlans := make(map[int]bool)
+	ath := 0
+	for _, w := range c.WLANs {
+		for _, b := range w.bands() {
+			dev := "ath" + strconv.Itoa(ath)
+			ath++
+			renderAAA(n.Append("aaa"), w, dev)
+			renderWireless(n.Append("wireless"), w, b, dev)
+		}
+		if w.VLAN != 0 && !vlans[w.VLAN] {
+			vlans[w.VLAN] = true
+			renderVLAN(n, w.VLAN)
+		}
+	}
+	n.SetEnabled("aaa.status", true)
+	n.SetEnabled("wireless.status", true)
+	if len(vlans) > 0 {
+		n.SetEnabled("vlan.status", true)
+		n.SetEnabled("bridge.status", true)
+	}
+
+	return n, nil
+}
+
+func renderRadio(n *props.Node, r Radio) {
+	n.Set("phyname", phys[r.Band])
+	width := r.Width
+	if r.Band == Band2G {
+		n.Set("ieee_mode", "11ng")
+		if width == 0 {
+			width = 20
+		}
+	} else {
+		n.Set("ieee_mode", "11na")
+		if width == 0 {
+			width = 80
+		}
+	}
+	n.Setf("ht", "%d", width)
+	if r.Channel == 0 {
+		n.Set("channel", "auto")
+	} else {
+		n.Setf("channel", "%d", r.Channel)
+	}
+
+	switch r.TxPower {
+	case "", TxPowerAuto:
+		n.Set("txpower_mode", TxPowerAuto)
+	case TxPowerLow, TxPowerMedium, TxPowerHigh:
+		n.Set("txpower_mode", r.TxPower)
+	default:
+		n.Set("txpower_mode", "custom")
+		n.Set("txpower", r.TxPower)
+	}
+
+	n.SetEnabled("min_rssi.status", r.MinRSSI != 0)
+	if r.MinRSSI != 0 {
+		n.Setf("min_rssi", "%d", r.MinRSSI)
+	}
+}
+
+// renderAAA renders the hostapd side of a WLAN
+func renderAAA(n *props.Node, w WLAN, dev string) {
+	n.Set("devname", dev)
+	n.Set("driver", "madwifi")
+	n.Set("ssid", w.SSID)
+	n.SetEnabled("status", true)
+	if w.VLAN != 0 {
+		n.Setf("br.devname", "br0.%d", w.VLAN)
+	} else {
+		n.Set("br.devname", "br0")
+	}
+
+	if w.Security == Open {
+		n.Set("wpa", "0")
+		return
+	}
+	n.Set("wpa", "2")
+	n.Set("wpa.1.pairwise", "CCMP")
+	n.Set("wpa.psk", w.Passphrase)
+	switch w.Security {
+	case WPA2:
+		n.Set("wpa.key.1.mgmt", "WPA-PSK")
+		n.Set("ieee80211w", "0")
+	case WPA3:
+		n.Set("wpa.key.1.mgmt", "SAE")
+		n.Set("ieee80211w", "2")
+	case WPA2WPA3:
+		n.Set("wpa.key.1.mgmt", "WPA-PSK")
+		n.Set("wpa.key.2.mgmt", "SAE")
+		n.Set("ieee80211w", "1")
+	}
+}
+
+// renderWireless renders the interface side of a WLAN
+func renderWireless(n *props.Node, w WLAN, b Band, dev string) {
+	n.Set("devname", dev)
+	n.Set("parent", phys[b])
+	n.Set("mode", "master")
+	n.Set("ssid", w.SSID)
+	n.Set("hide_ssid", strconv.FormatBool(w.Hidden))
+	n.Set("l2_isolation", strconv.FormatBool(w.Isolation))
+	n.SetEnabled("status", true)
+	n.Setf("vlan", "%d", w.VLAN)
+	if w.RateLimitDown != 0 || w.RateLimitUp != 0 {
+		n.SetEnabled("ratelimit.status", true)
+		n.Setf("ratelimit.down", "%d", w.RateLimitDown)
+		n.Setf("ratelimit.up", "%d", w.RateLimitUp)
+	}
+}
+
+// renderVLAN adds the tagged uplink interface and bridge a VLAN's WLANs
+// join
+func renderVLAN(n *props.Node, id int) {
+	v := n.Append("vlan")
+	v.Set("devname", "eth0")
+	v.Setf("id", "%d", id)
+	v.SetEnabled("status", true)
+
+	br := n.Append("bridge")
+	br.Setf("devname", "br0.%d", id)
+	br.Setf("port.1.devname", "eth0.%d", id)
+	br.SetEnabled("stp.status", false)
+}
@@ -0,0 +1,116 @@
+package wlan
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jda/nanofi/props"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{
+	WLANs: []WLAN{
+		{SSID: "lab", Security: WPA2, Passphrase: "hunter2222"},
+		{SSID: "guest", Security: Open, VLAN: 20, Band: Band2G, Isolation: true, RateLimitDown: 2000, RateLimitUp: 500},
+		{SSID: "iot", Security: WPA2WPA3, Passphrase: "correct horse", Hidden: true, VLAN: 30, Band: Band5G},
+	},
+	Radios: []Radio{
+		{Band: Band2G, Channel: 6, TxPower: TxPowerLow},
+		{Band: Band5G, Channel: 36, Width: 40, TxPower: "17", MinRSSI: -75},
+	},
+}
+
+func TestRender(t *testing.T) {
+	n, err := Render(testConfig)
+	assert.Nil(t, err)
+
+	get := func(key string) string {
+		v, ok := n.Get(key)
+		assert.True(t, ok, key)
+		return v
+	}
+
+	assert.Len(t, n.List("aaa"), 4, "lab on both bands, guest and iot on one")
+	assert.Len(t, n.List("wireless"), 4)
+	assert.Equal(t, "ath0", get("wireless.1.devname"))
+	assert.Equal(t, "wifi0", get("wireless.1.parent"))
+	assert.Equal(t, "wifi1", get("wireless.2.parent"))
+	assert.Equal(t, "lab", get("aaa.2.ssid"))
+	assert.Equal(t, "WPA-PSK", get("aaa.1.wpa.key.1.mgmt"))
+	assert.Equal(t, "hunter2222", get("aaa.1.wpa.psk"))
+
+	assert.Equal(t, "0", get("aaa.3.wpa"), "guest is open")
+	assert.Equal(t, "br0.20", get("aaa.3.br.devname"))
+	assert.Equal(t, "true", get("wireless.3.l2_isolation"))
+	assert.Equal(t, "2000", get("wireless.3.ratelimit.down"))
+
+	assert.Equal(t, "wifi1", get("wireless.4.parent"))
+	assert.Equal(t, "true", get("wireless.4.hide_ssid"))
+	assert.Equal(t, "SAE", get("aaa.4.wpa.key.2.mgmt"))
+	assert.Equal(t, "1", get("aaa.4.ieee80211w"))
+
+	assert.Equal(t, "6", get("radio.1.channel"))
+	assert.Equal(t, "20", get("radio.1.ht"))
+	assert.Equal(t, "low", get("radio.1.txpower_mode"))
+	assert.Equal(t, "custom", get("radio.2.txpower_mode"))
+	assert.Equal(t, "17", get("radio.2.txpower"))
+	assert.Equal(t, "-75", get("radio.2.min_rssi"))
+
+	assert.Len(t, n.List("vlan"), 2)
+	assert.Equal(t, "eth0.30", get("bridge.2.port.1.devname"))
+
+	again, _ := Render(testConfig)
+	assert.Equal(t, n.Render(), again.Render())
+	parsed, err := props.ParseString(n.Render())
+	assert.Nil(t, err)
+	assert.Empty(t, props.Diff(n, parsed))
+}
+
+func TestDefaults(t *testing.T) {
+	n, err := Render(Config{WLANs: []WLAN{{SSID: "lab", Security: WPA3, Passphrase: "hunter2222"}}})
+	assert.Nil(t, err)
+	out := n.Render()
+	assert.Contains(t, out, "radio.1.channel=auto\n")
+	assert.Contains(t, out, "radio.2.ht=80\n")
+	assert.Contains(t, out, "radio.2.min_rssi.status=disabled\n")
+	assert.NotContains(t, out, "vlan.")
+}
+
+func TestValidate(t *testing.T) {
+	psk := "hunter2222"
+	tests := []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{"empty ssid", Config{WLANs: []WLAN{{Security: Open}}}, "SSID"},
+		{"open with passphrase", Config{WLANs: []WLAN{{SSID: "a", Security: Open, Passphrase: psk}}}, "passphrase"},
+		{"short passphrase", Config{WLANs: []WLAN{{SSID: "a", Security: WPA2, Passphrase: "short"}}}, "passphrase"},
+		{"hex psk", Config{WLANs: []WLAN{{SSID: "a", Security: WPA2, Passphrase: strings.Repeat("ab", 32)}}}, ""},
+		{"bad security", Config{WLANs: []WLAN{{SSID: "a", Security: "wep"}}}, "security"},
+		{"bad vlan", Config{WLANs: []WLAN{{SSID: "a", Security: Open, VLAN: 5000}}}, "VLAN"},
+		{"duplicate ssid", Config{WLANs: []WLAN{{SSID: "a", Security: Open}, {SSID: "a", Security: Open, Band: Band5G}}}, "already"},
+		{"same ssid other band", Config{WLANs: []WLAN{{SSID: "a", Security: Open, Band: Band2G}, {SSID: "a", Security: Open, Band: Band5G}}}, ""},
+		{"2g channel", Config{Radios: []Radio{{Band: Band2G, Channel: 36}}}, "channel"},
+		{"5g channel", Config{Radios: []Radio{{Band: Band5G, Channel: 38}}}, "channel"},
+		{"5g upper", Config{Radios: []Radio{{Band: Band5G, Channel: 157, Width: 80}}}, ""},
+		{"2g width", Config{Radios: []Radio{{Band: Band2G, Width: 80}}}, "width"},
+		{"tx power", Config{Radios: []Radio{{Band: Band2G, TxPower: "max"}}}, "tx power"},
+		{"min rssi", Config{Radios: []Radio{{Band: Band5G, MinRSSI: -20}}}, "RSSI"},
+		{"twice", Config{Radios: []Radio{{Band: Band5G}, {Band: Band5G}}}, "twice"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.err == "" {
+			assert.Nil(t, err, tt.name)
+		} else if assert.NotNil(t, err, tt.name) {
+			assert.Contains(t, err.Error(), tt.err, tt.name)
+		}
+	}
+
+	var many []WLAN
+	for i := 0; i < 9; i++ {
+		many = append(many, WLAN{SSID: strings.Repeat("x", i+1), Security: Open})
+	}
+	assert.NotNil(t, Config{WLANs: many}.Validate())
+}